@@ -0,0 +1,62 @@
+// Command rewrap wraps the data keys of encrypted archives with the primary key of
+// the keyring. Run it after adding a new primary key, then remove the old one once
+// it rewrapped every archive.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"audio_compression/config"
+	"audio_compression/internal/compression"
+	"audio_compression/internal/storage/s3repo"
+)
+
+func main() {
+	bucket := flag.String("bucket", "", "bucket of the compressed archives, e.g. recordings-compressed")
+	prefix := flag.String("prefix", "", "only rewrap archives below this prefix")
+	flag.Parse()
+
+	if *bucket == "" {
+		log.Fatal("-bucket is required")
+	}
+
+	// Configuration
+	cfg, err := config.NewConfig()
+	if err != nil {
+		log.Fatalf("Config error: %s", err)
+	}
+	if cfg.Encryption.KeyringFile == "" {
+		log.Fatal("encryption.keyring_file is not configured")
+	}
+
+	s3Repo, err := s3repo.NewS3Repository(cfg.S3)
+	if err != nil {
+		log.Fatal(err)
+	}
+	archives, err := compression.NewArchiveStore(cfg.Encryption, cfg.S3.Archives, s3Repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := archives.Rewrap(context.Background(), *bucket, *prefix)
+	if report == nil {
+		log.Fatal(err)
+	}
+	for _, key := range report.Cold {
+		log.Printf("%s: not rewrapped, restore it from cold storage first", key)
+	}
+	for key, err := range report.Failed {
+		log.Printf("%s: %v", key, err)
+	}
+	log.Printf("rewrapped %d archives, %d in cold storage, %d failed", report.Rewrapped, len(report.Cold), len(report.Failed))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the old master keys are still needed
+	if len(report.Cold) > 0 || len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+// Command scheduler queues compressions of the objects matching the lifecycle
+// rules. Several may run, only the one holding the database lock evaluates rules.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"audio_compression/config"
+	"audio_compression/internal/compression"
+	"audio_compression/internal/controller/rmq"
+	"audio_compression/internal/db/gorm/mysql"
+	"audio_compression/internal/storage/s3repo"
+	"audio_compression/pkg/logger"
+)
+
+func main() {
+	// Configuration
+	cfg, err := config.NewConfig()
+	if err != nil {
+		log.Fatalf("Config error: %s", err)
+	}
+
+	l := logger.New("Info")
+	db := mysql.NewDB(cfg.MYSQL)
+
+	s3Repo, err := s3repo.NewS3Repository(cfg.S3)
+	if err != nil {
+		l.Fatal(err)
+	}
+	compressionRepo := compression.NewCompressionRepository(db, l)
+	quotaUsecase := compression.NewQuotaUsecase(cfg.Quota, s3Repo, compressionRepo, l)
+
+	publisher, err := rmq.NewAMQPPublisher(cfg, l)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	scheduler := compression.NewScheduleUsecase(cfg, db, s3Repo, compressionRepo, quotaUsecase, publisher, l)
+
+	// Run until a signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	l.Info("compression scheduler started")
+	scheduler.Run(ctx)
+
+	sql, err := db.DB()
+	if err != nil {
+		log.Fatalf("unable to get db driver")
+	}
+	if err = sql.Close(); err != nil {
+		log.Fatalf("unable close db connection")
+	}
+
+	l.Info("compression scheduler exited properly")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"audio_compression/config"
+	"audio_compression/entity"
+	"audio_compression/internal/compression"
+	"audio_compression/internal/storage/s3repo"
+	"audio_compression/pkg/archive"
+	"audio_compression/pkg/logger"
+)
+
+func compressCommand(ctx context.Context, cfg *config.Config, l *logger.Logger, args []string) error {
+	fs := newFlagSet("compress")
+	tier := fs.String("tier", "", "conversion policy tier, e.g. cold")
+	level := fs.Int("level", 0, "gzip level from 1 to 9, the default when 0")
+	args = parseArgs(fs, args, 1, 2)
+
+	if *level < 0 || *level > 9 {
+		return errors.New("level must be 1 to 9")
+	}
+	src, err := parseLocation(args[0])
+	if err != nil {
+		return err
+	}
+	var dst location
+	switch {
+	case len(args) == 2:
+		if dst, err = parseLocation(args[1]); err != nil {
+			return err
+		}
+	case !src.isObject():
+		dst = location{path: src.path + ".gz"}
+	}
+	if src.isObject() && dst.isObject() {
+		return errors.New("an object is compressed to where workers store it, leave out dst")
+	}
+
+	cu := compression.NewLocalUsecase(cfg, l)
+
+	// as a worker would
+	if src.isObject() && len(args) == 1 {
+		if err := cu.CompressObject(ctx, src.bucket, src.key, *tier, *level, entity.StorageOptions{}); err != nil {
+			return err
+		}
+		fmt.Printf("compressed %s\n", src)
+		return nil
+	}
+
+	// as the server stores posted archives
+	if dst.isObject() {
+		f, err := os.Open(src.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		manifest, err := cu.StoreFile(ctx, dst.bucket, dst.key, *tier, *level, entity.StorageOptions{}, f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("compressed %s to %s, %d members\n", src, dst, len(manifest.Entries))
+		return nil
+	}
+
+	r, err := openSource(ctx, cu.StorageRepo, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var manifest *entity.Manifest
+	err = writeFile(dst.path, func(w io.Writer) error {
+		manifest, err = cu.CompressFile(ctx, filepath.Base(src.String()), *tier, *level, r, w)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("compressed %s to %s, %d members\n", src, dst, len(manifest.Entries))
+	return nil
+}
+
+func decompressCommand(ctx context.Context, cfg *config.Config, l *logger.Logger, args []string) error {
+	args = parseArgs(newFlagSet("decompress"), args, 2, 2)
+
+	src, err := parseLocation(args[0])
+	if err != nil {
+		return err
+	}
+	dst, err := parseLocation(args[1])
+	if err != nil {
+		return err
+	}
+	if dst.isObject() {
+		return errors.New("restored tars are written to local files only")
+	}
+
+	cu := compression.NewLocalUsecase(cfg, l)
+
+	err = writeFile(dst.path, func(w io.Writer) error {
+		if src.isObject() {
+			return cu.DecompressObject(ctx, src.bucket, src.key, w)
+		}
+		f, err := os.Open(src.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return cu.DecompressFile(ctx, f, w)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("decompressed %s to %s\n", src, dst)
+	return nil
+}
+
+func listCommand(ctx context.Context, cfg *config.Config, l *logger.Logger, args []string) error {
+	args = parseArgs(newFlagSet("list"), args, 1, 1)
+
+	src, err := parseLocation(args[0])
+	if err != nil {
+		return err
+	}
+
+	var manifest *entity.Manifest
+	if src.isObject() {
+		s3Repo, err := s3repo.NewS3Repository(cfg.S3)
+		if err != nil {
+			return err
+		}
+		archives, err := compression.NewArchiveStore(cfg.Encryption, cfg.S3.Archives, s3Repo)
+		if err != nil {
+			return err
+		}
+		if manifest, err = compression.NewArchiveUsecase(archives, l).ListEntries(ctx, src.bucket, src.key); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Open(src.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if manifest, err = archive.NewTarGzArchiever(archive.Limits{}).List(ctx, f); err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTORED AS\tFORMAT\tCODEC\tORIGINAL\tCOMPRESSED\tDURATION\tEXACT")
+	for _, e := range manifest.Entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%.1f\t%t\n", e.Name, e.StoredName, e.Format, e.Codec, e.OriginalSize, e.CompressedSize, e.Duration, e.Exact)
+	}
+	return w.Flush()
+}
+
+func verifyCommand(ctx context.Context, cfg *config.Config, l *logger.Logger, args []string) error {
+	args = parseArgs(newFlagSet("verify"), args, 1, 1)
+
+	src, err := parseLocation(args[0])
+	if err != nil {
+		return err
+	}
+
+	cu := compression.NewLocalUsecase(cfg, l)
+
+	var problems []string
+	if src.isObject() {
+		problems, err = cu.VerifyObject(ctx, src.bucket, src.key)
+	} else {
+		var f *os.File
+		if f, err = os.Open(src.path); err != nil {
+			return err
+		}
+		defer f.Close()
+		problems, err = cu.VerifyFile(ctx, f)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s does not match its manifest", src)
+	}
+	fmt.Printf("%s matches its manifest\n", src)
+	return nil
+}
+
+// openSource opens a local file or streams an object.
+func openSource(ctx context.Context, storage entity.StorageRepository, src location) (io.ReadCloser, error) {
+	if !src.isObject() {
+		return os.Open(src.path)
+	}
+	r, _, err := storage.OpenObject(ctx, src.bucket, src.key)
+	return r, err
+}
+
+// writeFile writes path with write, leaving no partial file behind on errors.
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tarc-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	// as os.Create would
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
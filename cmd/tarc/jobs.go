@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"audio_compression/config"
+	"audio_compression/entity"
+	"audio_compression/internal/compression"
+	"audio_compression/internal/controller/rmq"
+	"audio_compression/internal/db/gorm/mysql"
+	"audio_compression/internal/storage/s3repo"
+	"audio_compression/pkg/logger"
+)
+
+func enqueueCommand(ctx context.Context, cfg *config.Config, l *logger.Logger, args []string) error {
+	fs := newFlagSet("enqueue")
+	tenant := fs.String("tenant", "", "tenant charged for the job")
+	tier := fs.String("tier", "", "conversion policy tier, e.g. cold")
+	level := fs.Int("level", 0, "gzip level from 1 to 9, the default when 0")
+	priority := fs.Uint("priority", uint(entity.PriorityBatch), "queue priority of the job")
+	args = parseArgs(fs, args, 1, 1)
+
+	if *level < 0 || *level > 9 {
+		return fmt.Errorf("level must be 1 to 9")
+	}
+	if *priority > uint(cfg.RMQ.MaxPriority) {
+		return fmt.Errorf("priority must be 0 to %d", cfg.RMQ.MaxPriority)
+	}
+	src, err := parseLocation(args[0])
+	if err != nil {
+		return err
+	}
+	if !src.isObject() {
+		return fmt.Errorf("%s is not an s3:// object", src)
+	}
+
+	s3Repo, err := s3repo.NewS3Repository(cfg.S3)
+	if err != nil {
+		return err
+	}
+	compressionRepo := compression.NewCompressionRepository(mysql.NewDB(cfg.MYSQL), l)
+	quota := compression.NewQuotaUsecase(cfg.Quota, s3Repo, compressionRepo, l)
+	publisher, err := rmq.NewAMQPPublisher(cfg, l)
+	if err != nil {
+		return err
+	}
+
+	jobID, err := quota.AdmitCompression(ctx, *tenant, src.bucket, src.key)
+	if err != nil {
+		return err
+	}
+	if err := publisher.PlanCompression(ctx, jobID, src.bucket, src.key, *tier, entity.CodecGzip, *level, uint8(*priority), entity.StorageOptions{}); err != nil {
+		quota.CancelJob(ctx, jobID)
+		return err
+	}
+	fmt.Println(jobID)
+	return nil
+}
+
+func statusCommand(ctx context.Context, cfg *config.Config, l *logger.Logger, args []string) error {
+	fs := newFlagSet("status")
+	limit := fs.Int("limit", 10, "jobs of an object to show")
+	args = parseArgs(fs, args, 1, 1)
+
+	src, err := parseLocation(args[0])
+	if err != nil {
+		return err
+	}
+	compressionRepo := compression.NewCompressionRepository(mysql.NewDB(cfg.MYSQL), l)
+
+	var result interface{}
+	if src.isObject() {
+		result, err = compressionRepo.RecentJobs(ctx, src.bucket, src.key, *limit)
+	} else {
+		result, err = compressionRepo.GetJob(ctx, args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+func replayCommand(ctx context.Context, cfg *config.Config, l *logger.Logger, args []string) error {
+	fs := newFlagSet("replay")
+	limit := fs.Int("limit", 0, "messages to replay, all when 0")
+	args = parseArgs(fs, args, 0, 1)
+
+	queue := rmq.DeadLetterQueue
+	if len(args) == 1 {
+		queue = args[0]
+	}
+	publisher, err := rmq.NewAMQPPublisher(cfg, l)
+	if err != nil {
+		return err
+	}
+
+	n, err := publisher.ReplayDeadLetters(queue, *limit)
+	fmt.Printf("replayed %d messages\n", n)
+	return err
+}
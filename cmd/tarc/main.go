@@ -0,0 +1,138 @@
+// Command tarc runs the compression pipeline without the services and operates a
+// running deployment: it queues jobs, looks them up and replays dead letters.
+//
+// Locations are local files or s3://bucket/key of a source .tar, whose compressed
+// archive is kept at the location the workers store it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"audio_compression/config"
+	"audio_compression/pkg/logger"
+)
+
+const usage = `usage: tarc <command> [flags] [arguments]
+
+commands:
+  compress   [-tier t] [-level n] <src> [dst]   compress a tar, s3:// sources are stored
+                                                as a worker would without dst
+  decompress <src> <dst>                        restore the tar of a compressed archive
+  list       <src>                              list the members of a compressed archive
+  verify     <src>                              check a compressed archive against its manifest
+  enqueue    [-tenant t] [-tier t] [-level n] [-priority n] <s3://bucket/key.tar>
+                                                queue a compression for the workers
+  status     [-limit n] <job-id | s3://bucket/key.tar>
+                                                show a job, or the latest jobs of an object
+  replay     [-limit n] [queue]                 republish dead-lettered requests, of
+                                                compress_dead_letter by default, or
+                                                notifications of notification_dead_letter
+
+src and dst are local files or s3://bucket/key. Compressed archives are local
+.tar.gz files, or the archive stored for s3://bucket/key.tar.
+`
+
+type command func(ctx context.Context, cfg *config.Config, l *logger.Logger, args []string) error
+
+var commands = map[string]command{
+	"compress":   compressCommand,
+	"decompress": decompressCommand,
+	"list":       listCommand,
+	"verify":     verifyCommand,
+	"enqueue":    enqueueCommand,
+	"status":     statusCommand,
+	"replay":     replayCommand,
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// Configuration
+	cfg, err := config.NewConfig()
+	if err != nil {
+		log.Fatalf("Config error: %s", err)
+	}
+	// the logger writes to stdout, keep it to what goes wrong
+	l := logger.New("warn")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, cfg, l, os.Args[2:]); err != nil {
+		log.Fatalf("tarc %s: %v", os.Args[1], err)
+	}
+}
+
+// newFlagSet returns the flags of a command, which exit with the usage on errors.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// location is a local file, or an object when bucket is set.
+type location struct {
+	bucket string
+	key    string
+	path   string
+}
+
+func parseLocation(s string) (location, error) {
+	rest, ok := cutPrefix(s, "s3://")
+	if !ok {
+		return location{path: s}, nil
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return location{}, fmt.Errorf("%q is not s3://bucket/key", s)
+	}
+	return location{bucket: bucket, key: key}, nil
+}
+
+func (loc location) isObject() bool {
+	return loc.bucket != ""
+}
+
+func (loc location) String() string {
+	if loc.isObject() {
+		return "s3://" + loc.bucket + "/" + loc.key
+	}
+	return loc.path
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// parseArgs parses the flags of a command and returns between min and max
+// arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) []string {
+	fs.Parse(args)
+	if fs.NArg() < min || fs.NArg() > max {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
@@ -9,12 +10,22 @@ import (
 type (
 	// Config -.
 	Config struct {
-		App    `yaml:"app"`
-		Server `yaml:"server"`
-		Log    `yaml:"logger"`
-		MYSQL  `yaml:"mysql"`
-		RMQ    `yaml:"rabbitmq"`
-		OTEL   `yaml:"otel"`
+		App           `yaml:"app"`
+		Server        `yaml:"server"`
+		Worker        `yaml:"worker"`
+		Log           `yaml:"logger"`
+		MYSQL         `yaml:"mysql"`
+		RMQ           `yaml:"rabbitmq"`
+		OTEL          `yaml:"otel"`
+		Audio         `yaml:"audio"`
+		Archive       `yaml:"archive"`
+		Encryption    `yaml:"encryption"`
+		S3            `yaml:"s3"`
+		Cache         `yaml:"cache"`
+		Auth          `yaml:"auth"`
+		Quota         `yaml:"quota"`
+		Scheduler     `yaml:"scheduler"`
+		Notifications `yaml:"notifications"`
 	}
 
 	// App -.
@@ -26,6 +37,24 @@ type (
 	// Server -.
 	Server struct {
 		Port string `env-required:"true" yaml:"port" env:"HTTP_PORT"`
+		// ReadTimeout bounds reading a whole request, including archive uploads
+		ReadTimeout time.Duration `env-default:"10m" yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+		// WriteTimeout bounds a whole response, including archive downloads
+		WriteTimeout time.Duration `env-default:"10m" yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+		// SyncBudget is how long a decompress request waits before answering 202 Accepted
+		SyncBudget time.Duration `env-default:"30s" yaml:"sync_budget" env:"HTTP_SYNC_BUDGET"`
+		// MaxUploadBytes bounds a tar posted for compression
+		MaxUploadBytes int64 `env-default:"4294967296" yaml:"max_upload_bytes" env:"HTTP_MAX_UPLOAD_BYTES"`
+		// CORSOrigins lists the origins allowed to call the API from a browser,
+		// cross origin requests are refused when empty
+		CORSOrigins []string `yaml:"cors_origins" env:"HTTP_CORS_ORIGINS"`
+	}
+
+	// Worker -.
+	Worker struct {
+		// ShutdownTimeout is how long in-flight jobs may finish after SIGTERM before
+		// they are returned to the queue. Keep it below the pod's termination grace period.
+		ShutdownTimeout time.Duration `env-default:"25s" yaml:"shutdown_timeout" env:"WORKER_SHUTDOWN_TIMEOUT"`
 	}
 
 	// Log -.
@@ -48,12 +77,270 @@ type (
 		ServerExchange string `env-required:"true" yaml:"rpc_server_exchange" env:"RMQ_RPC_SERVER"`
 		ClientExchange string `env-required:"true" yaml:"rpc_client_exchange" env:"RMQ_RPC_CLIENT"`
 		URL            string `env-required:"false" yaml:"url" env:"RMQ_URL"`
+		// DecompressTimeout bounds a decompression from request to worker response
+		DecompressTimeout time.Duration `env-default:"10m" yaml:"decompress_timeout" env:"RMQ_DECOMPRESS_TIMEOUT"`
+		// MaxPriority is the x-max-priority the compression queue is first declared
+		// with. A declared queue keeps it, changes apply to a new queue only.
+		MaxPriority int `env-default:"10" yaml:"max_priority" env:"RMQ_MAX_PRIORITY"`
+		// MaxRetries is how often a compression that may succeed on another try is
+		// queued again before it is dead-lettered
+		MaxRetries int `env-default:"5" yaml:"max_retries" env:"RMQ_MAX_RETRIES"`
 	}
 
 	OTEL struct {
 		JaegerEndpoint string `env-required:"true" yaml:"jaeger_endpoint" env:"JAEGER_ENDPOINT"`
 		PrometheusPort string `env-required:"true" yaml:"prometheus_port" env:"PROMETHEUS_PORT"`
 	}
+
+	// Audio -.
+	Audio struct {
+		// Converter is either "ffmpeg" or "native"
+		Converter string `env-default:"ffmpeg" yaml:"converter" env:"AUDIO_CONVERTER"`
+		// Concurrency bounds the members of one archive transcoded at a time
+		Concurrency int `env-default:"4" yaml:"concurrency" env:"AUDIO_CONCURRENCY"`
+		// Policies replace the default of storing integer PCM WAV, AIFF and raw PCM as FLAC
+		Policies []AudioPolicy `yaml:"policies"`
+		Raw      AudioRaw      `yaml:"raw"`
+		Limits   AudioLimits   `yaml:"limits"`
+	}
+
+	// AudioLimits bound the conversions, zero values are unlimited.
+	AudioLimits struct {
+		// MemberTimeout bounds converting and verifying one member
+		MemberTimeout time.Duration `env-default:"10m" yaml:"member_timeout" env:"AUDIO_MEMBER_TIMEOUT"`
+		// JobTimeout bounds converting every member of an archive
+		JobTimeout time.Duration `env-default:"2h" yaml:"job_timeout" env:"AUDIO_JOB_TIMEOUT"`
+		// MaxOutputBytes stops a conversion writing more than that
+		MaxOutputBytes int64 `env-default:"4294967296" yaml:"max_output_bytes" env:"AUDIO_MAX_OUTPUT_BYTES"`
+		// CPUSeconds and MaxMemoryBytes are set on ffmpeg with prlimit(1)
+		CPUSeconds     int   `env-default:"0" yaml:"cpu_seconds" env:"AUDIO_CPU_SECONDS"`
+		MaxMemoryBytes int64 `env-default:"0" yaml:"max_memory_bytes" env:"AUDIO_MAX_MEMORY_BYTES"`
+		// Cgroup is a cgroup v2 directory ffmpeg is moved into, the worker needs write
+		// access to its cgroup.procs
+		Cgroup string `env-default:"" yaml:"cgroup" env:"AUDIO_CGROUP"`
+	}
+
+	// Archive limits what is read from a source tar, which may come from third
+	// parties. Zero values are unlimited.
+	Archive struct {
+		MaxTotalBytes  int64 `env-default:"8589934592" yaml:"max_total_bytes" env:"ARCHIVE_MAX_TOTAL_BYTES"`
+		MaxMembers     int   `env-default:"10000" yaml:"max_members" env:"ARCHIVE_MAX_MEMBERS"`
+		MaxMemberBytes int64 `env-default:"2147483648" yaml:"max_member_bytes" env:"ARCHIVE_MAX_MEMBER_BYTES"`
+		// MaxRatio bounds the bytes extracted per byte of the tar, e.g. for sparse members
+		MaxRatio float64 `env-default:"10" yaml:"max_ratio" env:"ARCHIVE_MAX_RATIO"`
+	}
+
+	// S3 -.
+	S3 struct {
+		Endpoint  string `env-default:"http://localhost:9000" yaml:"endpoint" env:"S3_ENDPOINT"`
+		Region    string `env-default:"us-east-1" yaml:"region" env:"S3_REGION"`
+		AccessKey string `env-default:"minioadmin" yaml:"access_key" env:"S3_ACCESS_KEY"`
+		SecretKey string `env-default:"minioadmin" yaml:"secret_key" env:"S3_SECRET_KEY"`
+		// SSECustomerKeyFile holds the base64 encoded 32 byte SSE-C key. It is needed
+		// to read archives written with SSE-C as well.
+		SSECustomerKeyFile string `env-default:"" yaml:"sse_customer_key_file" env:"S3_SSE_CUSTOMER_KEY_FILE"`
+		// Archives is how compressed archives are stored unless a request says otherwise
+		Archives  S3Storage   `yaml:"archives"`
+		Multipart S3Multipart `yaml:"multipart"`
+		Download  S3Download  `yaml:"download"`
+	}
+
+	// S3Download tunes reading objects with parallel GETs.
+	S3Download struct {
+		// PartSize is the range read per GET. Objects uploaded in parts are read by
+		// part instead, so the checksum of every part is validated.
+		PartSize int64 `env-default:"8388608" yaml:"part_size" env:"S3_DOWNLOAD_PART_SIZE"`
+		// Concurrency is the GETs of one object in flight, each held in memory
+		Concurrency int `env-default:"4" yaml:"concurrency" env:"S3_DOWNLOAD_CONCURRENCY"`
+		// Retries is how often a failed GET is retried
+		Retries int `env-default:"3" yaml:"retries" env:"S3_DOWNLOAD_RETRIES"`
+	}
+
+	// S3Multipart tunes the multipart uploads of large objects. Uploads are recorded
+	// in MySQL, so a retry after a failure or crash resumes them.
+	S3Multipart struct {
+		// PartSize is at least 5 MiB, objects up to it are uploaded in one request.
+		// S3 allows 10000 parts, so it bounds the object size as well.
+		PartSize int64 `env-default:"16777216" yaml:"part_size" env:"S3_MULTIPART_PART_SIZE"`
+		// Concurrency is the parts of one upload in flight, each held in memory
+		Concurrency int `env-default:"4" yaml:"concurrency" env:"S3_MULTIPART_CONCURRENCY"`
+		// AbandonAfter is how long an upload may go without a part before the sweeper
+		// aborts it
+		AbandonAfter  time.Duration `env-default:"24h" yaml:"abandon_after" env:"S3_MULTIPART_ABANDON_AFTER"`
+		SweepInterval time.Duration `env-default:"1h" yaml:"sweep_interval" env:"S3_MULTIPART_SWEEP_INTERVAL"`
+		// SweepBuckets are also searched for uploads that were never recorded, e.g.
+		// of a worker that crashed right after starting one
+		SweepBuckets []string `yaml:"sweep_buckets" env:"S3_MULTIPART_SWEEP_BUCKETS"`
+	}
+
+	// S3Storage -.
+	S3Storage struct {
+		// SSE is AES256, aws:kms or SSE-C, the bucket default applies when empty
+		SSE          string            `env-default:"" yaml:"sse" env:"S3_ARCHIVES_SSE"`
+		KMSKeyID     string            `env-default:"" yaml:"kms_key_id" env:"S3_ARCHIVES_KMS_KEY_ID"`
+		StorageClass string            `env-default:"" yaml:"storage_class" env:"S3_ARCHIVES_STORAGE_CLASS"`
+		Tags         map[string]string `yaml:"tags"`
+	}
+
+	// Encryption encrypts compressed archives at rest.
+	Encryption struct {
+		// KeyringFile holds the master keys as JSON, encryption is disabled when
+		// empty. Archives written before stay readable either way.
+		KeyringFile string `env-default:"" yaml:"keyring_file" env:"ENCRYPTION_KEYRING_FILE"`
+	}
+
+	// Cache keeps decompressed archives on disk.
+	Cache struct {
+		// Dir defaults to a directory below os.TempDir. The server and the worker
+		// keep their results in subdirectories of it.
+		Dir      string        `env-default:"" yaml:"dir" env:"CACHE_DIR"`
+		MaxBytes int64         `env-default:"1073741824" yaml:"max_bytes" env:"CACHE_MAX_BYTES"`
+		TTL      time.Duration `env-default:"1m" yaml:"ttl" env:"CACHE_TTL"`
+		Shared   SharedCache   `yaml:"shared"`
+	}
+
+	// SharedCache lets workers reuse each others decompression results.
+	SharedCache struct {
+		// Kind is "s3" or "fs", the shared tier is disabled when empty
+		Kind   string `env-default:"" yaml:"kind" env:"SHARED_CACHE_KIND"`
+		Bucket string `yaml:"bucket" env:"SHARED_CACHE_BUCKET"`
+		Prefix string `env-default:"decompressed" yaml:"prefix" env:"SHARED_CACHE_PREFIX"`
+		Dir    string `yaml:"dir" env:"SHARED_CACHE_DIR"`
+		// LeaseTTL is how long other workers wait for a decompression whose owner stopped
+		// renewing its lease before taking it over
+		LeaseTTL time.Duration `env-default:"5m" yaml:"lease_ttl" env:"SHARED_CACHE_LEASE_TTL"`
+	}
+
+	// Auth authenticates API requests and maps tenants to the objects they may use.
+	Auth struct {
+		// Disabled serves every request as an anonymous tenant allowed everything
+		Disabled bool     `env-default:"false" yaml:"disabled" env:"AUTH_DISABLED"`
+		APIKeys  []APIKey `yaml:"api_keys"`
+		JWT      JWT      `yaml:"jwt"`
+		Tenants  []Tenant `yaml:"tenants"`
+		// AuditFile receives one JSON line per request, stdout when empty
+		AuditFile string `env-default:"" yaml:"audit_file" env:"AUTH_AUDIT_FILE"`
+	}
+
+	// APIKey is sent in the X-API-Key header. Only its hex SHA-256 is configured.
+	APIKey struct {
+		Name   string `yaml:"name"`
+		Tenant string `yaml:"tenant"`
+		SHA256 string `yaml:"sha256"`
+	}
+
+	// JWT accepts bearer tokens signed with HS256 or with an RS256 key of the JWKS file.
+	JWT struct {
+		HS256Secret string `env-default:"" yaml:"hs256_secret" env:"JWT_HS256_SECRET"`
+		JWKSFile    string `env-default:"" yaml:"jwks_file" env:"JWT_JWKS_FILE"`
+		Issuer      string `env-default:"" yaml:"issuer" env:"JWT_ISSUER"`
+		Audience    string `env-default:"" yaml:"audience" env:"JWT_AUDIENCE"`
+		// TenantClaim names the claim holding the tenant
+		TenantClaim string        `env-default:"tenant" yaml:"tenant_claim" env:"JWT_TENANT_CLAIM"`
+		Leeway      time.Duration `env-default:"30s" yaml:"leeway" env:"JWT_LEEWAY"`
+	}
+
+	// Tenant -.
+	Tenant struct {
+		Name  string       `yaml:"name"`
+		Rules []TenantRule `yaml:"rules"`
+	}
+
+	// TenantRule grants actions on keys of a bucket.
+	TenantRule struct {
+		// Bucket is a bucket name or "*" for every bucket
+		Bucket string `yaml:"bucket"`
+		// Prefixes limit the rule to keys starting with one of them
+		Prefixes []string `yaml:"prefixes"`
+		// Actions are compress and read
+		Actions []string `yaml:"actions"`
+	}
+
+	// Quota limits what each tenant may use.
+	Quota struct {
+		Default QuotaLimits   `yaml:"default"`
+		Tenants []TenantQuota `yaml:"tenants"`
+		// JobTimeout stops counting active jobs that were not updated for that long,
+		// so jobs of crashed workers do not hold the quota forever
+		JobTimeout time.Duration `env-default:"6h" yaml:"job_timeout" env:"QUOTA_JOB_TIMEOUT"`
+	}
+
+	// Scheduler evaluates the lifecycle rules. Every scheduler process competes for
+	// a database lock and only its holder runs the rules.
+	Scheduler struct {
+		Interval time.Duration `env-default:"1h" yaml:"interval" env:"SCHEDULER_INTERVAL"`
+		LockName string        `env-default:"audio_compression_scheduler" yaml:"lock_name" env:"SCHEDULER_LOCK_NAME"`
+		// MaxEnqueuePerRun bounds the jobs a rule queues per run, the rest are queued
+		// by the next runs
+		MaxEnqueuePerRun int `env-default:"1000" yaml:"max_enqueue_per_run" env:"SCHEDULER_MAX_ENQUEUE_PER_RUN"`
+	}
+
+	// Notifications consumes the ObjectCreated events a bucket publishes, in the
+	// AWS S3 or MinIO format, and queues compressions of the .tar objects the
+	// filters match.
+	Notifications struct {
+		// Queue is not consumed when empty
+		Queue string `yaml:"queue" env:"NOTIFICATIONS_QUEUE"`
+		// Exchange and RoutingKey bind the queue to the exchange the storage
+		// publishes to, which the storage declares. The queue is not bound without.
+		Exchange   string `yaml:"exchange" env:"NOTIFICATIONS_EXCHANGE"`
+		RoutingKey string `yaml:"routing_key" env:"NOTIFICATIONS_ROUTING_KEY"`
+		// Tenant is charged for the jobs, Tier chooses their conversion policies
+		Tenant  string               `yaml:"tenant" env:"NOTIFICATIONS_TENANT"`
+		Tier    string               `yaml:"tier" env:"NOTIFICATIONS_TIER"`
+		Filters []NotificationFilter `yaml:"filters"`
+	}
+
+	// NotificationFilter matches the objects of a bucket, or of every bucket for
+	// "*", below Prefix and ending in Suffix. Objects matched by no filter are
+	// ignored.
+	NotificationFilter struct {
+		Bucket string `yaml:"bucket"`
+		Prefix string `yaml:"prefix"`
+		Suffix string `yaml:"suffix"`
+		// MinBytes skips smaller objects, e.g. empty placeholders
+		MinBytes int64 `yaml:"min_bytes"`
+	}
+
+	// QuotaLimits are unlimited when zero.
+	QuotaLimits struct {
+		// RequestsPerSecond refills the token bucket of each API key or token subject
+		RequestsPerSecond float64 `env-default:"10" yaml:"requests_per_second" env:"QUOTA_REQUESTS_PER_SECOND"`
+		Burst             int     `env-default:"20" yaml:"burst" env:"QUOTA_BURST"`
+		// MaxActiveJobs bounds the queued and running compressions of a tenant
+		MaxActiveJobs int `env-default:"0" yaml:"max_active_jobs" env:"QUOTA_MAX_ACTIVE_JOBS"`
+		// MaxBytesPerDay bounds the source bytes a tenant compresses per UTC day
+		MaxBytesPerDay int64 `env-default:"0" yaml:"max_bytes_per_day" env:"QUOTA_MAX_BYTES_PER_DAY"`
+	}
+
+	// TenantQuota overrides the non-zero limits of the default for a tenant. A
+	// negative limit makes it unlimited.
+	TenantQuota struct {
+		Name              string  `yaml:"name"`
+		RequestsPerSecond float64 `yaml:"requests_per_second"`
+		Burst             int     `yaml:"burst"`
+		MaxActiveJobs     int     `yaml:"max_active_jobs"`
+		MaxBytesPerDay    int64   `yaml:"max_bytes_per_day"`
+	}
+
+	// AudioPolicy -.
+	AudioPolicy struct {
+		// Source is wav, wav_float, wav_telephony, aiff, raw, mp3 or other
+		Source string `yaml:"source"`
+		// Tier limits the policy to compression requests of that tier
+		Tier string `yaml:"tier"`
+		// Target is flac, opus or copy
+		Target  string `yaml:"target"`
+		Bitrate string `yaml:"bitrate"`
+	}
+
+	// AudioRaw describes headerless PCM members.
+	AudioRaw struct {
+		Extensions []string `env-default:".raw,.pcm" yaml:"extensions" env:"AUDIO_RAW_EXTENSIONS"`
+		Codec      string   `env-default:"pcm_s16le" yaml:"codec" env:"AUDIO_RAW_CODEC"`
+		SampleRate int      `env-default:"8000" yaml:"sample_rate" env:"AUDIO_RAW_SAMPLE_RATE"`
+		Channels   int      `env-default:"1" yaml:"channels" env:"AUDIO_RAW_CHANNELS"`
+	}
 )
 
 // NewConfig returns app config.
@@ -1,5 +1,32 @@
 package entity
 
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrArchiveNotFound = errors.New("archive not found")
+
+// ErrArchiveChanged is returned for decompressions of a compressed archive that was
+// replaced since they were requested.
+var ErrArchiveChanged = errors.New("archive changed since the request")
+
+// ErrUnsafeArchive is matched by archives refused on extraction, e.g. for a member
+// path outside the archive or sizes over the configured limits.
+var ErrUnsafeArchive = errors.New("unsafe archive")
+
+// UploadUsecase compresses archives posted to the server instead of read from S3.
+type UploadUsecase interface {
+	CompressUpload(ctx context.Context, jobID, bucket, key, tier string, level int, storage StorageOptions, r io.Reader) (*Manifest, error)
+}
+
+type ArchiveUsecase interface {
+	ListEntries(ctx context.Context, bucket, key string) (*Manifest, error)
+	// StatArchive describes the compressed archive stored for an object
+	StatArchive(ctx context.Context, bucket, key string) (*ObjectInfo, error)
+}
+
 type FileObject struct {
 	Name string
 	Body []byte
@@ -2,10 +2,133 @@ package entity
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"time"
 )
 
+// ErrArchiveInColdStorage is returned for archives in an archive storage class that
+// have to be restored before they can be read.
+var ErrArchiveInColdStorage = errors.New("archive is in cold storage and has to be restored first")
+
 type StorageRepository interface {
 	DownloadObject(ctx context.Context, bucket string, key string, w io.Writer) error
-	UploadObject(ctx context.Context, bucket string, key string, r io.Reader) error
+	// OpenObject streams an object, the caller closes it
+	OpenObject(ctx context.Context, bucket, key string) (io.ReadCloser, *ObjectInfo, error)
+	UploadObject(ctx context.Context, bucket string, key string, r io.Reader, opts UploadOptions) error
+	StatObject(ctx context.Context, bucket string, key string) (*ObjectInfo, error)
+	// ListObjects calls fn with every object below prefix. Listed objects have their
+	// key, ETag, size, last modification and storage class set.
+	ListObjects(ctx context.Context, bucket, prefix string, fn func(object *ObjectInfo) error) error
+	DeleteObject(ctx context.Context, bucket, key string) error
+	// ReplaceMetadata replaces the user metadata of an object unless it changed
+	// from the etag. Its storage class and encryption are kept. Objects that need
+	// a restore fail with ErrArchiveInColdStorage.
+	ReplaceMetadata(ctx context.Context, bucket, key, etag string, metadata map[string]string) error
+}
+
+// Server-side encryption modes of StorageOptions.SSE
+const (
+	SSES3 = "AES256"
+	// SSEKMS encrypts with StorageOptions.KMSKeyID, or the default KMS key without one
+	SSEKMS = "aws:kms"
+	// SSEC encrypts with the customer key configured for the storage. It cannot be
+	// requested per request since the key would travel with the request.
+	SSEC = "SSE-C"
+)
+
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER_IR":          true,
+	"GLACIER":             true,
+	"DEEP_ARCHIVE":        true,
+}
+
+// StorageOptions choose how a compressed archive is stored. Empty fields keep the
+// configured defaults.
+type StorageOptions struct {
+	SSE          string            `json:"sse,omitempty"`
+	KMSKeyID     string            `json:"kms_key_id,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// Validate checks options given with a request.
+func (o StorageOptions) Validate() error {
+	switch o.SSE {
+	case "", SSES3, SSEKMS:
+	default:
+		return fmt.Errorf("sse must be %s or %s", SSES3, SSEKMS)
+	}
+	if o.KMSKeyID != "" && o.SSE != SSEKMS {
+		return fmt.Errorf("kms_key_id requires sse %s", SSEKMS)
+	}
+	if o.StorageClass != "" && !storageClasses[o.StorageClass] {
+		return fmt.Errorf("unknown storage class %q", o.StorageClass)
+	}
+	// the limits of S3 object tagging
+	if len(o.Tags) > 10 {
+		return errors.New("at most 10 tags are allowed")
+	}
+	for k, v := range o.Tags {
+		if k == "" || len(k) > 128 || len(v) > 256 {
+			return fmt.Errorf("tag %q must have a key of 1 to 128 and a value of up to 256 characters", k)
+		}
+	}
+	return nil
+}
+
+// Or fills the empty fields of o from defaults. Tags are merged, those of o win.
+func (o StorageOptions) Or(defaults StorageOptions) StorageOptions {
+	merged := o
+	if merged.SSE == "" {
+		merged.SSE, merged.KMSKeyID = defaults.SSE, defaults.KMSKeyID
+	}
+	if merged.StorageClass == "" {
+		merged.StorageClass = defaults.StorageClass
+	}
+	if len(defaults.Tags) > 0 {
+		merged.Tags = make(map[string]string, len(defaults.Tags)+len(o.Tags))
+		for k, v := range defaults.Tags {
+			merged.Tags[k] = v
+		}
+		for k, v := range o.Tags {
+			merged.Tags[k] = v
+		}
+	}
+	return merged
+}
+
+// UploadOptions -.
+type UploadOptions struct {
+	// Metadata is stored as user metadata of the object
+	Metadata    map[string]string
+	ContentType string
+	Storage     StorageOptions
+}
+
+type ObjectInfo struct {
+	Key          string
+	ETag         string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+	ContentType  string
+	StorageClass string
+	// SSE is the server-side encryption of the object, KMSKeyID is set for SSE-KMS
+	SSE      string
+	KMSKeyID string
+	// Restored is set for archive storage class objects with a restored copy
+	Restored bool
+}
+
+// NeedsRestore reports whether the object is in an archive storage class without
+// a restored copy to read.
+func (i *ObjectInfo) NeedsRestore() bool {
+	return (i.StorageClass == "GLACIER" || i.StorageClass == "DEEP_ARCHIVE") && !i.Restored
 }
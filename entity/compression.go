@@ -2,34 +2,101 @@ package entity
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"time"
 )
 
 type CompressionUsecase interface {
-	PlanCompression(ctx context.Context, bucket, key string) error
-	GetDecompression(ctx context.Context, bucket, key string) ([]byte, error)
+	// PlanCompression queues the compression of the job admitted by QuotaUsecase
+	PlanCompression(ctx context.Context, jobID, bucket, key, tier, codec string, level int, priority uint8, storage StorageOptions) error
+	// GetDecompression returns the tar archive restored from the compressed archive
+	// with the ETag etag, the caller closes it
+	GetDecompression(ctx context.Context, bucket, key, etag string) (io.ReadSeekCloser, error)
+	// StartDecompression starts restoring an archive without waiting for it
+	StartDecompression(ctx context.Context, bucket, key, etag string) (*DecompressionJob, error)
+	GetDecompressionJob(ctx context.Context, id string) (*DecompressionJob, error)
 }
 
+// DecompressionJob tracks an asynchronous decompression. It lives as long as its
+// result stays cached.
+type DecompressionJob struct {
+	ID     string `json:"id"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Priorities of queued requests, higher priorities are consumed first. Requests
+// someone waits for are interactive, backfills are batch.
+const (
+	PriorityBatch       uint8 = 1
+	PriorityInteractive uint8 = 8
+)
+
 type CompressionRequest struct {
+	// JobID is the queued job recorded when the request was admitted
+	JobID  string `json:"job_id,omitempty"`
 	Bucket string `json:"bucket"`
 	Key    string `json:"key"`
 	Type   string
+	// Tier selects the conversion policies, e.g. "cold"
+	Tier string `json:"tier,omitempty"`
+	// Priority is also set on the AMQP message
+	Priority uint8 `json:"priority,omitempty"`
+	// Deadline is when the requester of a decompression stops waiting, the worker
+	// drops the request after that
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Storage overrides how the compressed archive is stored
+	Storage StorageOptions `json:"storage"`
+	// ETag is the compressed archive a decompression restores, a worker finding
+	// another version fails the request
+	ETag string `json:"etag,omitempty"`
+	// Codec compresses the archive, gzip when empty
+	Codec string `json:"codec,omitempty"`
+	// Level is the level of Codec, its default when zero
+	Level int `json:"level,omitempty"`
+}
+
+// Codecs of compressed archives, which are stored as key.tar.gz and key.tar.zst.
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+const (
+	MaxGzipLevel = 9
+	// MaxZstdLevel leaves out the ultra levels, which need far more memory to
+	// decompress
+	MaxZstdLevel = 19
+)
+
+// ValidateCodec checks a codec, gzip when empty, and a level of it, zero being its
+// default.
+func ValidateCodec(codec string, level int) error {
+	max := MaxGzipLevel
+	switch codec {
+	case "", CodecGzip:
+		codec = CodecGzip
+	case CodecZstd:
+		max = MaxZstdLevel
+	default:
+		return fmt.Errorf("unknown codec %q", codec)
+	}
+	if level < 0 || level > max {
+		return fmt.Errorf("%s level must be 1 to %d", codec, max)
+	}
+	return nil
 }
 
 type CompressionResponse struct {
-	Bucket        string `json:"bucket"`
-	Key           string `json:"key"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// ETag is the compressed archive a decompression was requested for
+	ETag          string `json:"etag,omitempty"`
 	Type          string
 	ResultType    string
 	ResultAddress string
 	Err           error
 }
-
-type DecompressionObject struct {
-	Bucket     string `json:"bucket"`
-	Key        string `json:"key"`
-	FilePath   string
-	Err        error
-	LastAccess time.Time
-	TTL        time.Duration
-}
@@ -0,0 +1,68 @@
+package entity
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrDuplicateJob is returned for an object whose content is queued, running or
+// compressed already.
+var ErrDuplicateJob = errors.New("object is compressed or being compressed already")
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+type RecordingUsecase interface {
+	SearchRecordings(ctx context.Context, query RecordingQuery) ([]AudioMember, error)
+}
+
+type CompressionJob struct {
+	ID     string `gorm:"primaryKey;size:36" json:"id"`
+	Tenant string `gorm:"size:255;index:idx_compression_job_tenant,priority:1" json:"tenant,omitempty"`
+	Bucket string `gorm:"size:255;index" json:"bucket"`
+	Key    string `gorm:"size:1024" json:"key"`
+	// Bytes is the size of the source tar, counted against the daily quota
+	Bytes int64 `json:"bytes"`
+	// SourceETag is the ETag of the source object when the job was admitted
+	SourceETag string     `gorm:"size:64" json:"source_etag,omitempty"`
+	Status     string     `gorm:"size:16;index" json:"status"`
+	Error      string     `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt  time.Time  `gorm:"index:idx_compression_job_tenant,priority:2" json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// AudioMember is the probed metadata of one audio member of a compressed archive.
+type AudioMember struct {
+	ID         uint              `gorm:"primaryKey" json:"-"`
+	JobID      string            `gorm:"size:36;index" json:"job_id"`
+	Bucket     string            `gorm:"size:255;index:idx_audio_member_bucket_duration,priority:1" json:"bucket"`
+	Key        string            `gorm:"size:1024" json:"key"`
+	Name       string            `gorm:"size:1024" json:"name"`
+	Codec      string            `gorm:"size:32" json:"codec"`
+	SampleRate int               `json:"sample_rate"`
+	Channels   int               `json:"channels"`
+	BitDepth   int               `json:"bit_depth"`
+	Duration   float64           `gorm:"index:idx_audio_member_bucket_duration,priority:2" json:"duration"`
+	Tags       map[string]string `gorm:"serializer:json;type:text" json:"tags,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+type RecordingQuery struct {
+	Bucket      string
+	Prefix      string
+	Codec       string
+	MinDuration float64
+	MaxDuration float64
+	SampleRate  int
+	Channels    int
+	Limit       int
+	Offset      int
+}
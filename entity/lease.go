@@ -0,0 +1,27 @@
+package entity
+
+import "time"
+
+const (
+	LeaseStatusRunning = "running"
+	LeaseStatusDone    = "done"
+	LeaseStatusFailed  = "failed"
+	// LeaseStatusReleased is a lease given up without a shared result, the next
+	// waiter takes it over
+	LeaseStatusReleased = "released"
+)
+
+// DecompressionLease coordinates the workers sharing a decompression cache, so
+// only the lease owner decompresses an object and everyone else waits for it.
+type DecompressionLease struct {
+	// ID is the shared cache name of the object
+	ID        string    `gorm:"primaryKey;size:64" json:"id"`
+	Bucket    string    `gorm:"size:255" json:"bucket"`
+	Key       string    `gorm:"size:1024" json:"key"`
+	ETag      string    `gorm:"size:128" json:"etag"`
+	Owner     string    `gorm:"size:128" json:"owner"`
+	Status    string    `gorm:"size:16" json:"status"`
+	Error     string    `gorm:"type:text" json:"error,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
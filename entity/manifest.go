@@ -0,0 +1,39 @@
+package entity
+
+const (
+	ManifestSourceEmbedded = "manifest"
+	ManifestSourceHeaders  = "headers"
+)
+
+type Manifest struct {
+	Version int             `json:"version"`
+	Bucket  string          `json:"bucket"`
+	Key     string          `json:"key"`
+	Source  string          `json:"source,omitempty"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+type ManifestEntry struct {
+	Name           string            `json:"name"`
+	StoredName     string            `json:"stored_name"`
+	OriginalSize   int64             `json:"original_size"`
+	CompressedSize int64             `json:"compressed_size"`
+	Format         string            `json:"format"`
+	Codec          string            `json:"codec,omitempty"`
+	SampleRate     int               `json:"sample_rate,omitempty"`
+	Channels       int               `json:"channels,omitempty"`
+	BitDepth       int               `json:"bit_depth,omitempty"`
+	Duration       float64           `json:"duration"`
+	Checksum       string            `json:"checksum,omitempty"`
+	Policy         *ConversionPolicy `json:"policy,omitempty"`
+	// Exact is set when the member restores to its original samples
+	Exact bool `json:"exact"`
+}
+
+// ConversionPolicy selects how audio of a source class is stored.
+type ConversionPolicy struct {
+	Source  string `json:"source"`
+	Tier    string `json:"tier,omitempty"`
+	Target  string `json:"target"`
+	Bitrate string `json:"bitrate,omitempty"`
+}
@@ -0,0 +1,40 @@
+package entity
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaUsecase admits compression jobs within the quota of their tenant.
+type QuotaUsecase interface {
+	// AdmitCompression records a queued job for an object in S3 and returns its ID
+	AdmitCompression(ctx context.Context, tenant, bucket, key string) (string, error)
+	// AdmitObject is AdmitCompression for an object that may have been admitted
+	// before, it returns ErrDuplicateJob for a job of the same content
+	AdmitObject(ctx context.Context, tenant, bucket, key string) (string, error)
+	// AdmitUpload records a queued job for a tar of size bytes posted to the server
+	AdmitUpload(ctx context.Context, tenant, bucket, key string, size int64) (string, error)
+	// CancelJob forgets a job that was admitted but never started
+	CancelJob(ctx context.Context, jobID string)
+	GetUsage(ctx context.Context, tenant string) (*QuotaUsage, error)
+	// RequestRate returns the token bucket rate and burst of each caller of tenant
+	RequestRate(tenant string) (float64, int)
+}
+
+// QuotaUsage is what a tenant used of its quota. Zero limits are unlimited.
+type QuotaUsage struct {
+	Tenant         string    `json:"tenant"`
+	ActiveJobs     int64     `json:"active_jobs"`
+	MaxActiveJobs  int       `json:"max_active_jobs"`
+	BytesToday     int64     `json:"bytes_today"`
+	MaxBytesPerDay int64     `json:"max_bytes_per_day"`
+	ResetsAt       time.Time `json:"resets_at"`
+}
+
+// QuotaLock serializes the admission of jobs of a tenant across servers.
+type QuotaLock struct {
+	Tenant string `gorm:"primaryKey;size:255"`
+}
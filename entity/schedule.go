@@ -0,0 +1,75 @@
+package entity
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	RunStatusRunning   = "running"
+	RunStatusSucceeded = "succeeded"
+	RunStatusFailed    = "failed"
+)
+
+// LifecycleRule compresses the .tar objects below a prefix once they reach an age.
+// Rules are kept in the lifecycle_rules table and evaluated by the scheduler.
+type LifecycleRule struct {
+	ID      uint   `gorm:"primaryKey" json:"id"`
+	Name    string `gorm:"size:255;uniqueIndex" json:"name"`
+	Enabled bool   `json:"enabled"`
+	Bucket  string `gorm:"size:255" json:"bucket"`
+	Prefix  string `gorm:"size:1024" json:"prefix"`
+	// MinAgeSeconds is how long an object stays as it is after its last modification
+	MinAgeSeconds int64 `json:"min_age_seconds"`
+	// Codec is gzip, the default, or zstd. Level is 1 to 9 for gzip and 1 to 19 for
+	// zstd, the default of the codec when zero
+	Codec string `gorm:"size:16" json:"codec"`
+	Level int    `json:"level"`
+	// Tier chooses the conversion policies of the members
+	Tier    string         `gorm:"size:64" json:"tier"`
+	Storage StorageOptions `gorm:"serializer:json;type:text" json:"storage"`
+	// DeleteOriginals deletes an object once its compressed archive is stored with
+	// the ETag of the object, on the run after the one that queued it
+	DeleteOriginals bool `json:"delete_originals"`
+	// Tenant is charged for the jobs of the rule
+	Tenant    string    `gorm:"size:255" json:"tenant"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// MinAge -.
+func (r *LifecycleRule) MinAge() time.Duration {
+	return time.Duration(r.MinAgeSeconds) * time.Second
+}
+
+// Validate checks a rule before it is evaluated.
+func (r *LifecycleRule) Validate() error {
+	if r.Bucket == "" {
+		return errors.New("rule has no bucket")
+	}
+	if r.MinAgeSeconds < 0 {
+		return errors.New("min age must not be negative")
+	}
+	if err := ValidateCodec(r.Codec, r.Level); err != nil {
+		return err
+	}
+	return r.Storage.Validate()
+}
+
+// ScheduleRun is the history of one evaluation of a rule.
+type ScheduleRun struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	RuleID uint   `gorm:"index" json:"rule_id"`
+	Leader string `gorm:"size:128" json:"leader"`
+	Status string `gorm:"size:16" json:"status"`
+	// Scanned objects are old enough .tar objects, of which Enqueued were queued
+	// for compression, Deleted had their original deleted and Skipped were either
+	// compressed already or in progress
+	Scanned    int        `json:"scanned"`
+	Enqueued   int        `json:"enqueued"`
+	Deleted    int        `json:"deleted"`
+	Skipped    int        `json:"skipped"`
+	Error      string     `gorm:"type:text" json:"error,omitempty"`
+	StartedAt  time.Time  `gorm:"index" json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
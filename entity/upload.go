@@ -0,0 +1,46 @@
+package entity
+
+import (
+	"context"
+	"time"
+)
+
+// MultipartUpload is an unfinished multipart upload, kept so a retry of the same
+// object resumes it instead of starting over.
+type MultipartUpload struct {
+	// ID is the upload ID S3 assigned
+	ID     string `gorm:"primaryKey;size:512" json:"id"`
+	Bucket string `gorm:"size:255;index" json:"bucket"`
+	Key    string `gorm:"size:1024" json:"key"`
+	// Fingerprint covers the metadata and storage options the upload was started
+	// with, an upload of the object with others starts over
+	Fingerprint string    `gorm:"size:64" json:"fingerprint"`
+	PartSize    int64     `json:"part_size"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `gorm:"index" json:"updated_at"`
+}
+
+// UploadedPart is a part of a MultipartUpload that S3 accepted.
+type UploadedPart struct {
+	UploadID   string `gorm:"primaryKey;size:512" json:"upload_id"`
+	PartNumber int32  `gorm:"primaryKey;autoIncrement:false" json:"part_number"`
+	ETag       string `gorm:"size:128" json:"etag"`
+	Size       int64  `json:"size"`
+	// SHA256 tells whether a resumed upload reads the same part again
+	SHA256 string `gorm:"size:64" json:"sha256"`
+}
+
+// UploadStore records multipart uploads while they are in progress.
+type UploadStore interface {
+	// FindUpload returns the latest unfinished upload of the object with its parts,
+	// or nil when there is none
+	FindUpload(ctx context.Context, bucket, key string) (*MultipartUpload, []UploadedPart, error)
+	CreateUpload(ctx context.Context, upload *MultipartUpload) error
+	// SavePart records a part, replacing one of the same number, and marks the
+	// upload as continued
+	SavePart(ctx context.Context, part *UploadedPart) error
+	// DeleteUpload forgets a completed or aborted upload
+	DeleteUpload(ctx context.Context, uploadID string) error
+	// StaleUploads returns the uploads not continued since before
+	StaleUploads(ctx context.Context, before time.Time) ([]MultipartUpload, error)
+}
@@ -0,0 +1,80 @@
+package compression
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/archive"
+	"audio_compression/pkg/logger"
+)
+
+type ArchiveUsecase struct {
+	StorageRepo         entity.StorageRepository
+	archives            *ArchiveStore
+	compressedArchiever archive.Archiver
+	l                   logger.Interface
+}
+
+func NewArchiveUsecase(archives *ArchiveStore, l logger.Interface) *ArchiveUsecase {
+	return &ArchiveUsecase{archives.StorageRepo, archives, archive.NewTarGzArchiever(archive.Limits{}), l}
+}
+
+// ListEntries returns the manifest of a compressed archive. Archives without an
+// embedded manifest are listed from their tar headers only.
+func (a *ArchiveUsecase) ListEntries(ctx context.Context, bucket, key string) (*entity.Manifest, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "ListEntries")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	if !isKeyExtensionValid(key, ".tar") {
+		return nil, errors.New("Invalid file extension")
+	}
+
+	compressedBucket, compressedKey, _, err := findCompressed(ctx, a.StorageRepo, bucket, key)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, entity.ErrArchiveNotFound
+		}
+		return nil, err
+	}
+
+	r, _, err := a.archives.Open(ctx, compressedBucket, compressedKey)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	manifest, err := a.compressedArchiever.List(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Bucket = bucket
+	manifest.Key = key
+
+	return manifest, nil
+}
+
+func (a *ArchiveUsecase) StatArchive(ctx context.Context, bucket, key string) (*entity.ObjectInfo, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "StatArchive")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	if !isKeyExtensionValid(key, ".tar") {
+		return nil, errors.New("Invalid file extension")
+	}
+
+	_, _, info, err := findCompressed(ctx, a.StorageRepo, bucket, key)
+	if isNotFound(err) {
+		return nil, entity.ErrArchiveNotFound
+	}
+	return info, err
+}
@@ -0,0 +1,278 @@
+package compression
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/logger"
+)
+
+// cacheFilePrefix marks the files the cache owns in its directory.
+const cacheFilePrefix = "decompressed_audio_"
+
+type cacheEntry struct {
+	id         string
+	bucket     string
+	key        string
+	etag       string
+	filePath   string
+	size       int64
+	err        error
+	done       bool
+	lastAccess time.Time
+}
+
+// ResultCache keeps decompressed archives on disk. Entries expire once they have
+// not been read for the TTL, and the least recently read entries are evicted when
+// the files exceed the byte limit. The index lives in memory, so files left by an
+// earlier process are removed when the cache is created.
+type ResultCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	entries  map[string]*list.Element
+	ids      map[string]*list.Element
+	lru      *list.List
+	l        logger.Interface
+}
+
+// CacheDir returns the directory of a named cache below the configured directory,
+// so the server and a worker on the same host never remove each others files.
+func CacheDir(dir, name string) string {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "audio_compression")
+	}
+	return filepath.Join(dir, name)
+}
+
+func NewResultCache(dir string, maxBytes int64, ttl time.Duration, l logger.Interface) (*ResultCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	rc := &ResultCache{dir: dir, maxBytes: maxBytes, ttl: ttl, entries: make(map[string]*list.Element), ids: make(map[string]*list.Element), lru: list.New(), l: l}
+	rc.removeOrphans()
+	go rc.expireWorker()
+	return rc, nil
+}
+
+// cacheKey names the result of an object restored from the compressed archive with
+// the ETag etag, so a recompressed archive never serves an older result.
+func cacheKey(bucket, key, etag string) string {
+	return bucket + "/" + key + "\x00" + etag
+}
+
+// JobID names the entry of an object for asynchronous requests.
+func JobID(bucket, key, etag string) string {
+	sum := sha256.Sum256([]byte(cacheKey(bucket, key, etag)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Reserve returns true when the caller should produce the result for the object.
+// Every other caller finds the entry and waits for Result. A failed entry is
+// dropped and reserved again, so a retry is not answered with an earlier error.
+func (rc *ResultCache) Reserve(ctx context.Context, bucket, key, etag string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if elem, ok := rc.entries[cacheKey(bucket, key, etag)]; ok && elem.Value.(*cacheEntry).err != nil {
+		rc.removeLocked(ctx, elem, "failed")
+	} else if ok {
+		elem.Value.(*cacheEntry).lastAccess = time.Now()
+		rc.lru.MoveToFront(elem)
+		cacheLookupCounter.Add(ctx, 1, cacheResultKey.String("hit"))
+		return false
+	}
+
+	elem := rc.lru.PushFront(&cacheEntry{id: JobID(bucket, key, etag), bucket: bucket, key: key, etag: etag, lastAccess: time.Now()})
+	rc.entries[cacheKey(bucket, key, etag)] = elem
+	rc.ids[JobID(bucket, key, etag)] = elem
+	cacheLookupCounter.Add(ctx, 1, cacheResultKey.String("miss"))
+	return true
+}
+
+// Put writes the result of a reserved object to the cache directory.
+func (rc *ResultCache) Put(ctx context.Context, bucket, key, etag string, r io.Reader) error {
+	f, err := os.CreateTemp(rc.dir, cacheFilePrefix+"*.tar")
+	if err != nil {
+		rc.Fail(bucket, key, etag, err)
+		return err
+	}
+	size, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		rc.Fail(bucket, key, etag, err)
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[cacheKey(bucket, key, etag)]
+	if !ok {
+		// the reservation was dropped meanwhile
+		os.Remove(f.Name())
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	entry.filePath, entry.size, entry.done, entry.lastAccess = f.Name(), size, true, time.Now()
+	rc.lru.MoveToFront(elem)
+	rc.size += size
+	cacheBytes.Add(ctx, size)
+
+	rc.evictLocked(ctx, elem)
+	return nil
+}
+
+// Fail records the error of a reserved object. The error is returned to readers
+// until the entry expires or the object is reserved again.
+func (rc *ResultCache) Fail(bucket, key, etag string, err error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if elem, ok := rc.entries[cacheKey(bucket, key, etag)]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.err, entry.done = err, true
+	}
+}
+
+// Result opens the cached file of an object. Both return values are nil while the
+// result is still being produced. The file stays readable after an eviction since
+// it is opened under the lock.
+func (rc *ResultCache) Result(ctx context.Context, bucket, key, etag string) (*os.File, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[cacheKey(bucket, key, etag)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.done {
+		return nil, nil
+	}
+	if entry.err != nil {
+		return nil, entry.err
+	}
+
+	entry.lastAccess = time.Now()
+	rc.lru.MoveToFront(elem)
+	return os.Open(entry.filePath)
+}
+
+// Job describes the entry with the given JobID, or returns nil when there is none.
+func (rc *ResultCache) Job(id string) *entity.DecompressionJob {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.ids[id]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+
+	job := &entity.DecompressionJob{ID: entry.id, Bucket: entry.bucket, Key: entry.key, Status: entity.JobStatusRunning}
+	switch {
+	case entry.err != nil:
+		job.Status, job.Error = entity.JobStatusFailed, entry.err.Error()
+	case entry.done:
+		job.Status = entity.JobStatusSucceeded
+	}
+	return job
+}
+
+// Wait polls Result until the object is produced or ctx is done.
+func (rc *ResultCache) Wait(ctx context.Context, bucket, key, etag string) (*os.File, error) {
+	for {
+		f, err := rc.Result(ctx, bucket, key, etag)
+		if f != nil || err != nil {
+			return f, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// evictLocked drops the least recently read finished entries until the cache fits
+// maxBytes again. keep is never evicted, so a result larger than the limit is still
+// served until the next insert.
+func (rc *ResultCache) evictLocked(ctx context.Context, keep *list.Element) {
+	for elem := rc.lru.Back(); elem != nil && rc.maxBytes > 0 && rc.size > rc.maxBytes; {
+		prev := elem.Prev()
+		if entry := elem.Value.(*cacheEntry); elem != keep && entry.done {
+			rc.removeLocked(ctx, elem, "lru")
+		}
+		elem = prev
+	}
+}
+
+func (rc *ResultCache) removeLocked(ctx context.Context, elem *list.Element, reason string) {
+	entry := elem.Value.(*cacheEntry)
+	rc.l.Info("Removing decompression result from cache (%s) : %s - %s", reason, entry.bucket, entry.key)
+
+	if entry.filePath != "" {
+		if err := os.Remove(entry.filePath); err != nil && !os.IsNotExist(err) {
+			rc.l.Error("Failed to remove cached file %s : %v", entry.filePath, err)
+		}
+	}
+	rc.size -= entry.size
+	cacheBytes.Add(ctx, -entry.size)
+	cacheEvictionCounter.Add(ctx, 1, cacheReasonKey.String(reason))
+
+	rc.lru.Remove(elem)
+	delete(rc.entries, cacheKey(entry.bucket, entry.key, entry.etag))
+	delete(rc.ids, entry.id)
+}
+
+func (rc *ResultCache) expireWorker() {
+	for {
+		time.Sleep(1 * time.Second)
+
+		ctx := context.Background()
+		rc.mu.Lock()
+		for elem := rc.lru.Back(); elem != nil; {
+			prev := elem.Prev()
+			if entry := elem.Value.(*cacheEntry); entry.done && time.Since(entry.lastAccess) > rc.ttl {
+				rc.removeLocked(ctx, elem, "ttl")
+			}
+			elem = prev
+		}
+		rc.mu.Unlock()
+	}
+}
+
+func (rc *ResultCache) removeOrphans() {
+	files, err := os.ReadDir(rc.dir)
+	if err != nil {
+		rc.l.Error("Failed to list cache directory %s : %v", rc.dir, err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), cacheFilePrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(rc.dir, file.Name())); err != nil {
+			rc.l.Error("Failed to remove orphan cache file %s : %v", file.Name(), err)
+			continue
+		}
+		rc.l.Info("Removed orphan cache file %s", file.Name())
+	}
+}
@@ -0,0 +1,184 @@
+package compression
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"audio_compression/pkg/logger"
+)
+
+func newTestCache(t *testing.T, maxBytes int64, ttl time.Duration) *ResultCache {
+	t.Helper()
+	rc, err := NewResultCache(t.TempDir(), maxBytes, ttl, logger.New("error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+func putResult(t *testing.T, rc *ResultCache, key, body string) {
+	t.Helper()
+	if !rc.Reserve(context.Background(), "bucket", key, "etag") {
+		t.Fatalf("%s was reserved already", key)
+	}
+	if err := rc.Put(context.Background(), "bucket", key, "etag", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readResult(t *testing.T, rc *ResultCache, key string) (string, error) {
+	t.Helper()
+	f, err := rc.Result(context.Background(), "bucket", key, "etag")
+	if err != nil || f == nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	return string(b), err
+}
+
+func TestResultCacheRetriesFailures(t *testing.T) {
+	ctx := context.Background()
+	rc := newTestCache(t, 0, time.Hour)
+
+	if !rc.Reserve(ctx, "bucket", "a.tar", "etag") {
+		t.Fatal("first reserve was a hit")
+	}
+	if f, err := rc.Result(ctx, "bucket", "a.tar", "etag"); f != nil || err != nil {
+		t.Fatalf("result of a running entry: %v, %v", f, err)
+	}
+
+	failure := context.DeadlineExceeded
+	rc.Fail("bucket", "a.tar", "etag", failure)
+	if _, err := rc.Result(ctx, "bucket", "a.tar", "etag"); !errors.Is(err, failure) {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+	if job := rc.Job(JobID("bucket", "a.tar", "etag")); job == nil || job.Error == "" {
+		t.Fatalf("job of a failed entry: %+v", job)
+	}
+
+	// the retry produces the result again instead of finding the failure
+	if !rc.Reserve(ctx, "bucket", "a.tar", "etag") {
+		t.Fatal("reserve after a failure was a hit")
+	}
+	if f, err := rc.Result(ctx, "bucket", "a.tar", "etag"); f != nil || err != nil {
+		t.Fatalf("result of the retried entry: %v, %v", f, err)
+	}
+	if rc.Reserve(ctx, "bucket", "a.tar", "etag") {
+		t.Fatal("second reserve of the retry was a miss")
+	}
+	if err := rc.Put(ctx, "bucket", "a.tar", "etag", strings.NewReader("restored")); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := readResult(t, rc, "a.tar"); err != nil || body != "restored" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+}
+
+func TestResultCacheKeysByETag(t *testing.T) {
+	ctx := context.Background()
+	rc := newTestCache(t, 0, time.Hour)
+	putResult(t, rc, "a.tar", "old")
+
+	if !rc.Reserve(ctx, "bucket", "a.tar", "other") {
+		t.Fatal("another etag was a hit")
+	}
+	if JobID("bucket", "a.tar", "etag") == JobID("bucket", "a.tar", "other") {
+		t.Fatal("etags share a job id")
+	}
+}
+
+func TestResultCacheEvictsLeastRecentlyRead(t *testing.T) {
+	rc := newTestCache(t, 10, time.Hour)
+	putResult(t, rc, "a.tar", "aaaa")
+	putResult(t, rc, "b.tar", "bbbb")
+
+	// reading a makes b the least recently read entry
+	if body, err := readResult(t, rc, "a.tar"); err != nil || body != "aaaa" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	putResult(t, rc, "c.tar", "cccc")
+
+	if _, err := rc.Result(context.Background(), "bucket", "b.tar", "etag"); !os.IsNotExist(err) {
+		t.Errorf("b was not evicted: %v", err)
+	}
+	for _, key := range []string{"a.tar", "c.tar"} {
+		if _, err := readResult(t, rc, key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+	rc.mu.Lock()
+	if rc.size != 8 {
+		t.Errorf("cache holds %d bytes, want 8", rc.size)
+	}
+	rc.mu.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(rc.dir, cacheFilePrefix+"*"))
+	if len(files) != 2 {
+		t.Errorf("%d files left in the cache directory, want 2", len(files))
+	}
+}
+
+func TestResultCacheKeepsOversizedResult(t *testing.T) {
+	rc := newTestCache(t, 4, time.Hour)
+	putResult(t, rc, "a.tar", "aa")
+	putResult(t, rc, "b.tar", "larger than the limit")
+
+	if _, err := rc.Result(context.Background(), "bucket", "a.tar", "etag"); !os.IsNotExist(err) {
+		t.Errorf("a was not evicted: %v", err)
+	}
+	if body, err := readResult(t, rc, "b.tar"); err != nil || body != "larger than the limit" {
+		t.Errorf("got %q, %v", body, err)
+	}
+}
+
+func TestResultCacheExpires(t *testing.T) {
+	rc := newTestCache(t, 0, 10*time.Millisecond)
+	putResult(t, rc, "a.tar", "aaaa")
+
+	// the expiry worker runs every second
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := rc.Result(context.Background(), "bucket", "a.tar", "etag")
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry did not expire: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.size != 0 || len(rc.ids) != 0 {
+		t.Errorf("expired entry left %d bytes and %d ids", rc.size, len(rc.ids))
+	}
+}
+
+func TestResultCacheRemovesOrphans(t *testing.T) {
+	dir := t.TempDir()
+	orphan := filepath.Join(dir, cacheFilePrefix+"1.tar")
+	other := filepath.Join(dir, "other.tar")
+	for _, name := range []string{orphan, other} {
+		if err := os.WriteFile(name, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewResultCache(dir, 0, time.Hour, logger.New("error")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan was kept: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("foreign file was removed: %v", err)
+	}
+}
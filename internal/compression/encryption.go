@@ -0,0 +1,250 @@
+package compression
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"audio_compression/config"
+	"audio_compression/entity"
+	"audio_compression/pkg/envelope"
+)
+
+// ArchiveStore reads and writes compressed archives. With a keyring every archive
+// is encrypted under a data key of its own, stored wrapped in the object metadata.
+// Archives written without encryption are read as they are.
+type ArchiveStore struct {
+	StorageRepo entity.StorageRepository
+	keyring     *envelope.Keyring
+	defaults    entity.StorageOptions
+}
+
+// NewArchiveStore loads the keyring of cfg, encryption is disabled without one.
+// Archives are stored as defaults says unless a request overrides it.
+func NewArchiveStore(cfg config.Encryption, defaults config.S3Storage, storageRepo entity.StorageRepository) (*ArchiveStore, error) {
+	s := &ArchiveStore{
+		StorageRepo: storageRepo,
+		defaults: entity.StorageOptions{
+			SSE:          defaults.SSE,
+			KMSKeyID:     defaults.KMSKeyID,
+			StorageClass: defaults.StorageClass,
+			Tags:         defaults.Tags,
+		},
+	}
+	// SSE-C is only accepted here, requests cannot ask for it
+	if s.defaults.SSE != entity.SSEC {
+		if err := s.defaults.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.KeyringFile != "" {
+		keyring, err := envelope.LoadKeyring(cfg.KeyringFile)
+		if err != nil {
+			return nil, err
+		}
+		s.keyring = keyring
+	}
+	return s, nil
+}
+
+// Put uploads the archive read from r, encrypting it when a keyring is configured.
+// An archive r can seek in is encrypted under a data key derived from its content,
+// so uploading the same archive again writes the same bytes and resumes the parts
+// a failed upload left. Others get a random data key.
+func (s *ArchiveStore) Put(ctx context.Context, bucket, key string, r io.Reader, opts entity.UploadOptions) error {
+	opts.Storage = opts.Storage.Or(s.defaults)
+	if s.keyring == nil {
+		return s.StorageRepo.UploadObject(ctx, bucket, key, r, opts)
+	}
+
+	ctx, span := otel.Tracer(traceName).Start(ctx, "EncryptArchive")
+	defer span.End()
+
+	var (
+		dataKey   []byte
+		metadata  map[string]string
+		err       error
+		newWriter = envelope.NewWriter
+	)
+	if rs, ok := r.(io.ReadSeeker); ok {
+		newWriter = envelope.NewContentWriter
+		dataKey, metadata, err = s.contentDataKey(bucket, key, rs)
+	} else {
+		dataKey, metadata, err = s.keyring.NewDataKey()
+	}
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("key_id", metadata[envelope.MetaKeyID]))
+	for name, value := range opts.Metadata {
+		if _, ok := metadata[name]; !ok {
+			metadata[name] = value
+		}
+	}
+	opts.Metadata = metadata
+	// the stored bytes are the envelope, not the archive
+	opts.ContentType = "application/octet-stream"
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ew, err := newWriter(pw, dataKey)
+		if err == nil {
+			_, err = io.Copy(ew, r)
+		}
+		if err == nil {
+			err = ew.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = s.StorageRepo.UploadObject(ctx, bucket, key, pr, opts)
+	pr.CloseWithError(errors.New("upload ended"))
+	<-done
+	return err
+}
+
+// contentDataKey derives the data key of the archive read from r from its digest
+// and returns to the start of the archive.
+func (s *ArchiveStore) contentDataKey(bucket, key string, r io.ReadSeeker) ([]byte, map[string]string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	return s.keyring.ContentDataKey(bucket+"/"+key, h.Sum(nil))
+}
+
+// Get downloads the archive to w, decrypting it when it is encrypted, and returns
+// what its metadata says about it.
+func (s *ArchiveStore) Get(ctx context.Context, bucket, key string, w io.Writer) (*entity.ObjectInfo, error) {
+	r, info, err := s.Open(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Open streams the archive, decrypting it when it is encrypted, and returns what
+// its metadata says about it. The caller closes the archive.
+func (s *ArchiveStore) Open(ctx context.Context, bucket, key string) (io.ReadCloser, *entity.ObjectInfo, error) {
+	r, info, err := s.StorageRepo.OpenObject(ctx, bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.NeedsRestore() {
+		r.Close()
+		return nil, nil, entity.ErrArchiveInColdStorage
+	}
+	if !envelope.Encrypted(info.Metadata) {
+		return r, info, nil
+	}
+	if s.keyring == nil {
+		r.Close()
+		return nil, nil, envelope.ErrNoKeyring
+	}
+
+	_, span := otel.Tracer(traceName).Start(ctx, "DecryptArchive")
+	defer span.End()
+
+	dataKey, err := s.keyring.DataKey(info.Metadata)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	dr, err := envelope.NewReader(r, dataKey)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return readCloser{dr, r}, info, nil
+}
+
+// readCloser reads from Reader and closes Closer underneath it.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// RewrapReport is what a rewrap did. The archives it did not rewrap keep data keys
+// wrapped by older master keys, which stay needed until they are rewrapped too.
+type RewrapReport struct {
+	Rewrapped int
+	// Cold are archives in an archive storage class, which have to be restored first
+	Cold []string
+	// Failed are the errors of the archives that failed, by key
+	Failed map[string]error
+}
+
+// Rewrap wraps the data keys of the encrypted archives below prefix with the
+// primary master key, so older master keys can be removed from the keyring
+// afterwards. An archive that fails does not stop the others, the error returned
+// is one of the listing.
+func (s *ArchiveStore) Rewrap(ctx context.Context, bucket, prefix string) (*RewrapReport, error) {
+	if s.keyring == nil {
+		return nil, envelope.ErrNoKeyring
+	}
+
+	ctx, span := otel.Tracer(traceName).Start(ctx, "RewrapArchives")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("primary_key_id", s.keyring.Primary()))
+
+	report := &RewrapReport{Failed: make(map[string]error)}
+	err := s.StorageRepo.ListObjects(ctx, bucket, prefix, func(object *entity.ObjectInfo) error {
+		rewrapped, err := s.rewrap(ctx, bucket, object.Key)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, entity.ErrArchiveInColdStorage):
+			report.Cold = append(report.Cold, object.Key)
+		case err != nil:
+			report.Failed[object.Key] = err
+		case rewrapped:
+			report.Rewrapped++
+		}
+		return nil
+	})
+
+	span.SetAttributes(attribute.Int("rewrapped", report.Rewrapped))
+	span.SetAttributes(attribute.Int("cold", len(report.Cold)))
+	span.SetAttributes(attribute.Int("failed", len(report.Failed)))
+	return report, err
+}
+
+// rewrap rewraps the data key of one archive, if it is encrypted under an older
+// master key.
+func (s *ArchiveStore) rewrap(ctx context.Context, bucket, key string) (bool, error) {
+	info, err := s.StorageRepo.StatObject(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if !envelope.Encrypted(info.Metadata) {
+		return false, nil
+	}
+
+	metadata, changed, err := s.keyring.Rewrap(info.Metadata)
+	if err != nil || !changed {
+		return false, err
+	}
+	if info.NeedsRestore() {
+		return false, entity.ErrArchiveInColdStorage
+	}
+	if err := s.StorageRepo.ReplaceMetadata(ctx, bucket, key, info.ETag, metadata); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,58 @@
+package compression
+
+import (
+	"context"
+	"sync"
+)
+
+// cpuGate lets decompressions, which somebody waits for, run ahead of the
+// compressions sharing the CPUs of a worker. Compressions finish the members they
+// are transcoding but start no new one while a decompression runs.
+type cpuGate struct {
+	mu          sync.Mutex
+	interactive int
+	// idle is closed while no decompression runs
+	idle chan struct{}
+}
+
+func newCPUGate() *cpuGate {
+	idle := make(chan struct{})
+	close(idle)
+	return &cpuGate{idle: idle}
+}
+
+// enter counts a decompression until the returned func is called.
+func (g *cpuGate) enter() func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.interactive == 0 {
+		g.idle = make(chan struct{})
+	}
+	g.interactive++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.interactive--
+			if g.interactive == 0 {
+				close(g.idle)
+			}
+		})
+	}
+}
+
+// wait blocks a compression while decompressions run.
+func (g *cpuGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
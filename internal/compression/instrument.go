@@ -17,3 +17,36 @@ var orderCounter, _ = meter.Int64Counter("order",
 	instrument.WithUnit(unit.Dimensionless))
 
 var orderStatusKey = attribute.Key("status")
+
+var roundTripCounter, _ = meter.Int64Counter("audio_round_trip",
+	instrument.WithDescription("number of verified audio round trips with their result"),
+	instrument.WithUnit(unit.Dimensionless))
+
+var roundTripResultKey = attribute.Key("result")
+
+var cacheLookupCounter, _ = meter.Int64Counter("decompression_cache_lookup",
+	instrument.WithDescription("number of decompression cache lookups with their result"),
+	instrument.WithUnit(unit.Dimensionless))
+
+var cacheEvictionCounter, _ = meter.Int64Counter("decompression_cache_eviction",
+	instrument.WithDescription("number of decompression cache evictions with their reason"),
+	instrument.WithUnit(unit.Dimensionless))
+
+var cacheBytes, _ = meter.Int64UpDownCounter("decompression_cache_bytes",
+	instrument.WithDescription("bytes of decompressed archives on disk"),
+	instrument.WithUnit(unit.Bytes))
+
+var cacheResultKey = attribute.Key("result")
+var cacheReasonKey = attribute.Key("reason")
+
+var quotaRejectionCounter, _ = meter.Int64Counter("quota_rejection",
+	instrument.WithDescription("number of compression jobs rejected over the quota of their tenant"),
+	instrument.WithUnit(unit.Dimensionless))
+
+var tenantKey = attribute.Key("tenant")
+
+var conversionFailureCounter, _ = meter.Int64Counter("audio_conversion_failure",
+	instrument.WithDescription("number of failed audio conversions with their kind"),
+	instrument.WithUnit(unit.Dimensionless))
+
+var failureKindKey = attribute.Key("kind")
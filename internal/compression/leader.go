@@ -0,0 +1,73 @@
+package compression
+
+import (
+	"context"
+	"database/sql"
+
+	"gorm.io/gorm"
+)
+
+// LeaderLock elects one leader among processes sharing the database with a MySQL
+// named lock. The lock is held by a connection of its own and is lost with it, so
+// a leader that dies or loses the database hands over to the next one to try.
+type LeaderLock struct {
+	db   *gorm.DB
+	name string
+	conn *sql.Conn
+}
+
+func NewLeaderLock(db *gorm.DB, name string) *LeaderLock {
+	return &LeaderLock{db: db, name: name}
+}
+
+// TryAcquire takes the lock unless another process holds it, and reports whether
+// this process is the leader. A leader checks that it still holds the lock.
+func (ll *LeaderLock) TryAcquire(ctx context.Context) (bool, error) {
+	if ll.conn != nil {
+		var held sql.NullBool
+		err := ll.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?) = CONNECTION_ID()", ll.name).Scan(&held)
+		if err == nil && held.Bool {
+			return true, nil
+		}
+		ll.close()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	sqlDB, err := ll.db.DB()
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	// GET_LOCK returns 1 once taken, 0 when held by another connection
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", ll.name).Scan(&acquired); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if acquired.Int64 != 1 {
+		conn.Close()
+		return false, nil
+	}
+	ll.conn = conn
+	return true, nil
+}
+
+// Release gives up the lock if this process holds it.
+func (ll *LeaderLock) Release(ctx context.Context) error {
+	if ll.conn == nil {
+		return nil
+	}
+	_, err := ll.conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", ll.name)
+	ll.close()
+	return err
+}
+
+func (ll *LeaderLock) close() {
+	ll.conn.Close()
+	ll.conn = nil
+}
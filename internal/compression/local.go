@@ -0,0 +1,188 @@
+package compression
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/audio_converter"
+)
+
+// CompressFile compresses the tar r to w as a worker would, without storing it.
+// name is the source recorded in the manifest.
+func (c *CompressionUsecase) CompressFile(ctx context.Context, name, tier string, level int, r io.Reader, w io.Writer) (*entity.Manifest, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "CompressFile")
+	defer span.End()
+
+	manifest, _, _, err, _ := c.buildArchive(ctx, "", name, tier, entity.CodecGzip, level, r, w)
+	return manifest, err
+}
+
+// CompressObject stores the compressed archive of an object in S3 as a worker
+// would, without recording a job.
+func (c *CompressionUsecase) CompressObject(ctx context.Context, bucket, key, tier string, level int, storage entity.StorageOptions) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "CompressObject")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	if !isKeyExtensionValid(key, ".tar") {
+		return errors.New("Invalid file extension")
+	}
+	_, err, _ := c.compress(ctx, bucket, key, tier, entity.CodecGzip, level, storage)
+	return err
+}
+
+// StoreFile stores the compressed archive of the tar r as that of bucket/key, as
+// the server stores archives posted to it, without recording a job.
+func (c *CompressionUsecase) StoreFile(ctx context.Context, bucket, key, tier string, level int, storage entity.StorageOptions, r io.Reader) (*entity.Manifest, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "StoreFile")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	if !isKeyExtensionValid(key, ".tar") {
+		return nil, errors.New("Invalid file extension")
+	}
+	output := newSpool(new(bytes.Buffer))
+	defer output.Close()
+
+	manifest, _, err, _ := c.compressArchive(ctx, bucket, key, tier, entity.CodecGzip, level, "", storage, r, output)
+	return manifest, err
+}
+
+// DecompressFile restores the tar a compressed archive read from r was built from.
+func (c *CompressionUsecase) DecompressFile(ctx context.Context, r io.Reader, w io.Writer) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "DecompressFile")
+	defer span.End()
+
+	return c.restoreArchive(ctx, r, nil, w)
+}
+
+// DecompressObject restores the tar the compressed archive of an object was built
+// from, bypassing the decompression caches.
+func (c *CompressionUsecase) DecompressObject(ctx context.Context, bucket, key string, w io.Writer) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "DecompressObject")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	if !isKeyExtensionValid(key, ".tar") {
+		return errors.New("Invalid file extension")
+	}
+	return c.decompress(ctx, bucket, key, "", w)
+}
+
+// VerifyFile checks a compressed archive read from r against its manifest and
+// returns the problems found, none for a sound archive.
+func (c *CompressionUsecase) VerifyFile(ctx context.Context, r io.Reader) ([]string, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "VerifyFile")
+	defer span.End()
+
+	return c.verifyArchive(ctx, r, nil)
+}
+
+// VerifyObject checks the compressed archive of an object against its manifest,
+// and the manifest against the archive metadata.
+func (c *CompressionUsecase) VerifyObject(ctx context.Context, bucket, key string) ([]string, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "VerifyObject")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	if !isKeyExtensionValid(key, ".tar") {
+		return nil, errors.New("Invalid file extension")
+	}
+	compressedBucket, compressedKey, _, err := findCompressed(ctx, c.StorageRepo, bucket, key)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, entity.ErrArchiveNotFound
+		}
+		return nil, err
+	}
+	r, info, err := c.archives.Open(ctx, compressedBucket, compressedKey)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return c.verifyArchive(ctx, r, info.Metadata)
+}
+
+// verifyArchive compares every member of a compressed archive with its manifest
+// entry. Members stored as they were must match the checksum of the source, the
+// others must restore to audio of the recorded format. Their samples are compared
+// with the source when they are stored, which is gone by now.
+func (c *CompressionUsecase) verifyArchive(ctx context.Context, r io.Reader, metadata map[string]string) ([]string, error) {
+	manifest, files, err := c.extractArchive(ctx, r, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, errors.New("archive has no manifest")
+	}
+	if len(manifest.Entries) != len(files) {
+		return []string{fmt.Sprintf("manifest lists %d members, the archive holds %d", len(manifest.Entries), len(files))}, nil
+	}
+
+	var problems []string
+	for i, file := range files {
+		if problem := c.verifyMember(ctx, file, &manifest.Entries[i]); problem != "" {
+			problems = append(problems, manifest.Entries[i].Name+": "+problem)
+		}
+	}
+	return problems, nil
+}
+
+// verifyMember returns what is wrong with a stored member, or an empty string.
+func (c *CompressionUsecase) verifyMember(ctx context.Context, file entity.FileObject, entry *entity.ManifestEntry) string {
+	if memberName(entry.StoredName) != file.Name {
+		return fmt.Sprintf("stored as %s, the manifest records %s", file.Name, entry.StoredName)
+	}
+	if int64(len(file.Body)) != entry.CompressedSize {
+		return fmt.Sprintf("stored %d bytes, the manifest records %d", len(file.Body), entry.CompressedSize)
+	}
+
+	restored, err := c.restore(ctx, file, entry)
+	if err != nil {
+		return fmt.Sprintf("failed to restore: %v", err)
+	}
+	if memberName(entry.Name) == file.Name {
+		sum := sha256.Sum256(restored.Body)
+		if int64(len(restored.Body)) != entry.OriginalSize || (entry.Checksum != "" && hex.EncodeToString(sum[:]) != entry.Checksum) {
+			return "does not match the checksum of the source"
+		}
+		return ""
+	}
+	// version 1 manifests record no audio format
+	if entry.Codec == "" {
+		return ""
+	}
+
+	var info *audio_converter.AudioInfo
+	if entry.Format == "raw" {
+		info, err = audio_converter.ProbeRaw(restored.Body, entry.Codec, entry.SampleRate, entry.Channels)
+	} else {
+		info, err = audio_converter.Probe(restored.Body)
+	}
+	if err != nil {
+		return fmt.Sprintf("failed to probe the restored member: %v", err)
+	}
+	if info.Codec != entry.Codec || info.SampleRate != entry.SampleRate || info.Channels != entry.Channels {
+		return fmt.Sprintf("restored %s %d Hz %d ch, the manifest records %s %d Hz %d ch",
+			info.Codec, info.SampleRate, info.Channels, entry.Codec, entry.SampleRate, entry.Channels)
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+package compression
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/archive"
+	"audio_compression/pkg/audio_converter"
+)
+
+// manifestVersion 2 records the conversion policy of every audio member.
+const manifestVersion = 2
+
+// User metadata of compressed archives
+const (
+	metaCodecs         = "codecs"
+	metaOriginalSize   = "original-size"
+	metaSourceETag     = "source-etag"
+	metaManifestSHA256 = "manifest-sha256"
+	metaCompression    = "compression"
+)
+
+// archiveCodecs are the codecs compressed archives may be stored with.
+var archiveCodecs = []string{entity.CodecGzip, entity.CodecZstd}
+
+// compressedLocation maps a source object to where its archive compressed with
+// codec is stored, key.tar.gz for gzip and key.tar.zst for zstd.
+func compressedLocation(bucket, key, codec string) (string, string) {
+	if codec == entity.CodecZstd {
+		return bucket + "-compressed", key + ".zst"
+	}
+	return bucket + "-compressed", key + ".gz"
+}
+
+func codecContentType(codec string) string {
+	if codec == entity.CodecZstd {
+		return "application/zstd"
+	}
+	return "application/gzip"
+}
+
+// findCompressed returns the location of the compressed archive of a source object
+// and what it says about it. When the object was compressed with more than one
+// codec, the latest archive is returned. It fails as StatObject does when there
+// is none.
+func findCompressed(ctx context.Context, storageRepo entity.StorageRepository, bucket, key string) (string, string, *entity.ObjectInfo, error) {
+	var (
+		foundBucket, foundKey string
+		found                 *entity.ObjectInfo
+		firstErr              error
+	)
+	for _, codec := range archiveCodecs {
+		compressedBucket, compressedKey := compressedLocation(bucket, key, codec)
+		info, err := storageRepo.StatObject(ctx, compressedBucket, compressedKey)
+		if err != nil {
+			if !isNotFound(err) {
+				return "", "", nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if found == nil || info.LastModified.After(found.LastModified) {
+			foundBucket, foundKey, found = compressedBucket, compressedKey, info
+		}
+	}
+	if found == nil {
+		return "", "", nil, firstErr
+	}
+	return foundBucket, foundKey, found, nil
+}
+
+// newManifestEntry describes a source member and the stored member it became. Info
+// and policy are nil for members that are not audio.
+func newManifestEntry(source, stored entity.FileObject, info *audio_converter.AudioInfo, policy *entity.ConversionPolicy) entity.ManifestEntry {
+	sum := sha256.Sum256(source.Body)
+	entry := entity.ManifestEntry{
+		Name:           source.Name,
+		StoredName:     stored.Name,
+		OriginalSize:   int64(len(source.Body)),
+		CompressedSize: int64(len(stored.Body)),
+		Format:         archive.FormatFromName(source.Name),
+		Checksum:       hex.EncodeToString(sum[:]),
+		Exact:          true,
+	}
+	if info != nil {
+		entry.Format = info.Format
+		entry.Codec = info.Codec
+		entry.SampleRate = info.SampleRate
+		entry.Channels = info.Channels
+		entry.BitDepth = info.BitDepth
+		entry.Duration = info.Duration
+	}
+	if policy != nil {
+		entry.Policy = policy
+		entry.Exact = audio_converter.IsExact(*policy)
+	}
+	return entry
+}
+
+func newManifest(bucket, key string, entries []entity.ManifestEntry) *entity.Manifest {
+	return &entity.Manifest{Version: manifestVersion, Bucket: bucket, Key: key, Source: entity.ManifestSourceEmbedded, Entries: entries}
+}
+
+func buildManifestFile(manifest *entity.Manifest) (entity.FileObject, error) {
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return entity.FileObject{}, err
+	}
+
+	return entity.FileObject{Name: archive.ManifestName, Body: body}, nil
+}
+
+// archiveMetadata describes a compressed archive in its object metadata, so it can
+// be told apart without downloading it.
+func archiveMetadata(manifest *entity.Manifest, manifestFile entity.FileObject, sourceETag, codec string) map[string]string {
+	var originalSize int64
+	var codecs []string
+	seen := make(map[string]bool)
+	for _, entry := range manifest.Entries {
+		originalSize += entry.OriginalSize
+		if entry.Codec != "" && !seen[entry.Codec] {
+			seen[entry.Codec] = true
+			codecs = append(codecs, entry.Codec)
+		}
+	}
+	sort.Strings(codecs)
+
+	sum := sha256.Sum256(manifestFile.Body)
+	metadata := map[string]string{
+		metaOriginalSize:   strconv.FormatInt(originalSize, 10),
+		metaManifestSHA256: hex.EncodeToString(sum[:]),
+		metaCompression:    codec,
+	}
+	if len(codecs) > 0 {
+		metadata[metaCodecs] = strings.Join(codecs, ",")
+	}
+	if sourceETag != "" {
+		metadata[metaSourceETag] = sourceETag
+	}
+	return metadata
+}
+
+// checkManifest compares the embedded manifest with the hash recorded in the object
+// metadata. Archives stored before the hash was recorded pass.
+func checkManifest(files []entity.FileObject, metadata map[string]string) error {
+	want, ok := metadata[metaManifestSHA256]
+	if !ok {
+		return nil
+	}
+	if len(files) == 0 || files[0].Name != archive.ManifestName {
+		return errors.New("archive has no manifest but its metadata records one")
+	}
+	sum := sha256.Sum256(files[0].Body)
+	if hex.EncodeToString(sum[:]) != want {
+		return errors.New("manifest does not match the archive metadata")
+	}
+	return nil
+}
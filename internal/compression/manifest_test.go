@@ -0,0 +1,58 @@
+package compression
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"audio_compression/entity"
+)
+
+// statStorage answers StatObject from objects, the other methods are not used.
+type statStorage struct {
+	entity.StorageRepository
+	objects map[string]*entity.ObjectInfo
+}
+
+func (s *statStorage) StatObject(ctx context.Context, bucket, key string) (*entity.ObjectInfo, error) {
+	if info, ok := s.objects[bucket+"/"+key]; ok {
+		return info, nil
+	}
+	return nil, &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}}}
+}
+
+func TestFindCompressed(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	storage := &statStorage{objects: map[string]*entity.ObjectInfo{
+		"b-compressed/gz.tar.gz":    {ETag: "gz", LastModified: now},
+		"b-compressed/zst.tar.zst":  {ETag: "zst", LastModified: now},
+		"b-compressed/both.tar.gz":  {ETag: "old", LastModified: now.Add(-time.Hour)},
+		"b-compressed/both.tar.zst": {ETag: "new", LastModified: now},
+	}}
+
+	tests := []struct {
+		key, wantKey, wantETag string
+	}{
+		{"gz.tar", "gz.tar.gz", "gz"},
+		{"zst.tar", "zst.tar.zst", "zst"},
+		{"both.tar", "both.tar.zst", "new"},
+	}
+	for _, tt := range tests {
+		bucket, key, info, err := findCompressed(ctx, storage, "b", tt.key)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.key, err)
+		}
+		if bucket != "b-compressed" || key != tt.wantKey || info.ETag != tt.wantETag {
+			t.Errorf("%s: found %s/%s with ETag %s, want %s with %s", tt.key, bucket, key, info.ETag, tt.wantKey, tt.wantETag)
+		}
+	}
+
+	if _, _, _, err := findCompressed(ctx, storage, "b", "missing.tar"); !isNotFound(err) {
+		t.Errorf("missing archive: got %v, want not found", err)
+	}
+}
@@ -0,0 +1,144 @@
+package compression
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/audio_converter"
+)
+
+type memberResult struct {
+	stored entity.FileObject
+	entry  entity.ManifestEntry
+	// member is nil for members that are not audio
+	member *entity.AudioMember
+	err    error
+}
+
+// transcodeMembers processes up to c.concurrency members at a time. The results keep
+// the extraction order so the archive is written in the original member order. No
+// new member is started once one has failed.
+func (c *CompressionUsecase) transcodeMembers(ctx context.Context, bucket, key, tier string, files []entity.FileObject) ([]memberResult, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "transcodeMembers")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("members", len(files)))
+	span.SetAttributes(attribute.Int("concurrency", c.concurrency))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if c.jobTimeout > 0 {
+		var cancelJob context.CancelFunc
+		ctx, cancelJob = context.WithTimeout(ctx, c.jobTimeout)
+		defer cancelJob()
+	}
+
+	results := make([]memberResult, len(files))
+	sem := make(chan struct{}, c.concurrency)
+	var wg sync.WaitGroup
+
+	for i, file := range files {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		// decompressions go first, the job timeout still runs meanwhile
+		if c.gate.wait(ctx) != nil {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, file entity.FileObject) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i] = c.processMember(ctx, bucket, key, tier, i, file)
+			if results[i].err != nil {
+				cancel()
+			}
+		}(i, file)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.err != nil {
+			return nil, result.err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &audio_converter.ConvertError{Kind: audio_converter.ErrorTimeout, Err: fmt.Errorf("members not converted within %s", c.jobTimeout)}
+		}
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// processMember probes, converts and verifies one member in its own span, so the
+// trace shows how long every member took.
+func (c *CompressionUsecase) processMember(ctx context.Context, bucket, key, tier string, index int, file entity.FileObject) memberResult {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "member")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("member", file.Name))
+	span.SetAttributes(attribute.Int("index", index))
+	span.SetAttributes(attribute.Int("size", len(file.Body)))
+
+	if c.memberTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.memberTimeout)
+		defer cancel()
+	}
+
+	info, err := c.probe(file)
+	if err != nil {
+		return memberResult{stored: file, entry: newManifestEntry(file, file, nil, nil)}
+	}
+	span.SetAttributes(attribute.String("codec", info.Codec))
+
+	converted, policy, err := c.transcode(ctx, file, info, c.policies.Select(info.Class(), tier))
+	if err == nil {
+		err = c.verify(ctx, file, converted, info, policy)
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && audio_converter.ErrorKindOf(err) == "" {
+			err = &audio_converter.ConvertError{Kind: audio_converter.ErrorTimeout, Err: err}
+		}
+		if kind := audio_converter.ErrorKindOf(err); kind != "" {
+			conversionFailureCounter.Add(ctx, 1, failureKindKey.String(string(kind)))
+			span.SetAttributes(attribute.String("failure", string(kind)))
+		}
+		err = fmt.Errorf("member %s: %w", file.Name, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return memberResult{err: err}
+	}
+
+	return memberResult{
+		stored: converted,
+		entry:  newManifestEntry(file, converted, info, &policy),
+		member: &entity.AudioMember{
+			Bucket:     bucket,
+			Key:        key,
+			Name:       file.Name,
+			Codec:      info.Codec,
+			SampleRate: info.SampleRate,
+			Channels:   info.Channels,
+			BitDepth:   info.BitDepth,
+			Duration:   info.Duration,
+			Tags:       info.Tags,
+		},
+	}
+}
@@ -0,0 +1,195 @@
+package compression
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"audio_compression/config"
+	"audio_compression/entity"
+	"audio_compression/pkg/logger"
+)
+
+type QuotaUsecase struct {
+	StorageRepo     entity.StorageRepository
+	CompressionRepo *CompressionRepository
+	defaults        config.QuotaLimits
+	tenants         map[string]config.TenantQuota
+	jobTimeout      time.Duration
+	l               logger.Interface
+}
+
+func NewQuotaUsecase(cfg config.Quota, storageRepo entity.StorageRepository, compressionRepo *CompressionRepository, l logger.Interface) *QuotaUsecase {
+	tenants := make(map[string]config.TenantQuota)
+	for _, t := range cfg.Tenants {
+		tenants[t.Name] = t
+	}
+	return &QuotaUsecase{
+		StorageRepo:     storageRepo,
+		CompressionRepo: compressionRepo,
+		defaults:        cfg.Default,
+		tenants:         tenants,
+		jobTimeout:      cfg.JobTimeout,
+		l:               l,
+	}
+}
+
+// AdmitCompression records a queued job for the source tar in S3, counting its
+// size against the daily quota.
+func (q *QuotaUsecase) AdmitCompression(ctx context.Context, tenant, bucket, key string) (string, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "AdmitCompression")
+	defer span.End()
+
+	return q.admitObject(ctx, tenant, bucket, key, false)
+}
+
+// AdmitObject records a queued job for the source tar in S3 unless a job of its
+// current ETag is queued, running or succeeded, so events delivered more than once
+// compress an object once.
+func (q *QuotaUsecase) AdmitObject(ctx context.Context, tenant, bucket, key string) (string, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "AdmitObject")
+	defer span.End()
+
+	return q.admitObject(ctx, tenant, bucket, key, true)
+}
+
+// Retryable reports whether admitting an object may succeed when retried. A quota
+// stays exceeded until jobs finish, and requests S3 refused stay refused.
+func Retryable(err error) bool {
+	if errors.Is(err, entity.ErrQuotaExceeded) {
+		return false
+	}
+	var responseError *awshttp.ResponseError
+	if errors.As(err, &responseError) {
+		status := responseError.HTTPStatusCode()
+		return status >= 500 || status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func (q *QuotaUsecase) admitObject(ctx context.Context, tenant, bucket, key string, dedupe bool) (string, error) {
+	span := trace.SpanFromContext(ctx)
+
+	span.SetAttributes(attribute.String("tenant", tenant))
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	if !isKeyExtensionValid(key, ".tar") {
+		return "", errors.New("Invalid file extension")
+	}
+
+	info, err := q.StorageRepo.StatObject(ctx, bucket, key)
+	if err != nil {
+		if isNotFound(err) {
+			return "", entity.ErrArchiveNotFound
+		}
+		return "", err
+	}
+
+	job := &entity.CompressionJob{Tenant: tenant, Bucket: bucket, Key: key, Bytes: info.Size, SourceETag: info.ETag}
+	return q.admit(ctx, job, dedupe)
+}
+
+func (q *QuotaUsecase) AdmitUpload(ctx context.Context, tenant, bucket, key string, size int64) (string, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "AdmitUpload")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("tenant", tenant))
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	job := &entity.CompressionJob{Tenant: tenant, Bucket: bucket, Key: key, Bytes: size}
+	return q.admit(ctx, job, false)
+}
+
+func (q *QuotaUsecase) admit(ctx context.Context, job *entity.CompressionJob, dedupe bool) (string, error) {
+	limits := q.limits(job.Tenant)
+	day := startOfDay(time.Now())
+
+	job.ID = uuid.New().String()
+	if err := q.CompressionRepo.AdmitJob(ctx, job, dedupe, limits.MaxActiveJobs, limits.MaxBytesPerDay, day, time.Now().Add(-q.jobTimeout)); err != nil {
+		if errors.Is(err, entity.ErrQuotaExceeded) {
+			quotaRejectionCounter.Add(ctx, 1, tenantKey.String(job.Tenant))
+		}
+		return "", err
+	}
+	return job.ID, nil
+}
+
+func (q *QuotaUsecase) CancelJob(ctx context.Context, jobID string) {
+	q.CompressionRepo.CancelJob(ctx, jobID)
+}
+
+func (q *QuotaUsecase) GetUsage(ctx context.Context, tenant string) (*entity.QuotaUsage, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "GetUsage")
+	defer span.End()
+
+	limits := q.limits(tenant)
+	day := startOfDay(time.Now())
+
+	activeJobs, bytesToday, err := q.CompressionRepo.TenantUsage(ctx, tenant, day, time.Now().Add(-q.jobTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	return &entity.QuotaUsage{
+		Tenant:         tenant,
+		ActiveJobs:     activeJobs,
+		MaxActiveJobs:  limits.MaxActiveJobs,
+		BytesToday:     bytesToday,
+		MaxBytesPerDay: limits.MaxBytesPerDay,
+		ResetsAt:       day.AddDate(0, 0, 1),
+	}, nil
+}
+
+// RequestRate returns the token bucket rate and burst of the callers of tenant.
+func (q *QuotaUsecase) RequestRate(tenant string) (float64, int) {
+	limits := q.limits(tenant)
+	return limits.RequestsPerSecond, limits.Burst
+}
+
+// limits applies the overrides of tenant to the defaults. Negative overrides are
+// returned as zero, which is unlimited.
+func (q *QuotaUsecase) limits(tenant string) config.QuotaLimits {
+	limits := q.defaults
+	t, ok := q.tenants[tenant]
+	if !ok {
+		return limits
+	}
+
+	if t.RequestsPerSecond != 0 {
+		limits.RequestsPerSecond = t.RequestsPerSecond
+	}
+	if t.Burst != 0 {
+		limits.Burst = t.Burst
+	}
+	if t.MaxActiveJobs != 0 {
+		limits.MaxActiveJobs = t.MaxActiveJobs
+	}
+	if t.MaxBytesPerDay != 0 {
+		limits.MaxBytesPerDay = t.MaxBytesPerDay
+	}
+
+	if limits.RequestsPerSecond < 0 {
+		limits.RequestsPerSecond = 0
+	}
+	if limits.MaxActiveJobs < 0 {
+		limits.MaxActiveJobs = 0
+	}
+	if limits.MaxBytesPerDay < 0 {
+		limits.MaxBytesPerDay = 0
+	}
+	return limits
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,41 @@
+package compression
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/logger"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+type RecordingUsecase struct {
+	CompressionRepo *CompressionRepository
+	l               logger.Interface
+}
+
+func NewRecordingUsecase(compRepo *CompressionRepository, l logger.Interface) *RecordingUsecase {
+	return &RecordingUsecase{compRepo, l}
+}
+
+func (r *RecordingUsecase) SearchRecordings(ctx context.Context, query entity.RecordingQuery) ([]entity.AudioMember, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "SearchRecordings")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", query.Bucket))
+
+	if query.Limit <= 0 {
+		query.Limit = defaultSearchLimit
+	}
+	if query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+
+	return r.CompressionRepo.SearchAudioMembers(ctx, query)
+}
@@ -4,26 +4,27 @@ import (
 	"audio_compression/entity"
 	"audio_compression/pkg/logger"
 	"context"
-	"os"
-	"sync"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type CompressionRepository struct {
-	mu *sync.Mutex
 	db *gorm.DB
 	l  logger.Interface
-
-	dos []entity.DecompressionObject
 }
 
 func NewCompressionRepository(db *gorm.DB, l logger.Interface) *CompressionRepository {
-	var mut sync.Mutex
-	var dos []entity.DecompressionObject
-	repo := &CompressionRepository{&mut, db, l, dos}
-	go repo.decompressionListWorker()
+	repo := &CompressionRepository{db, l}
+	if err := db.AutoMigrate(&entity.CompressionJob{}, &entity.AudioMember{}, &entity.DecompressionLease{}, &entity.QuotaLock{}, &entity.MultipartUpload{}, &entity.UploadedPart{}, &entity.LifecycleRule{}, &entity.ScheduleRun{}); err != nil {
+		l.Error(err)
+		l.Fatal("Failed to migrate compression tables")
+	}
 	return repo
 }
 
@@ -31,79 +32,366 @@ func (cr *CompressionRepository) IsCompressed(ctx context.Context, bucket, key s
 	return false
 }
 
-func (cr *CompressionRepository) CreateCompression(ctx context.Context, bucket, key string) {
-	// cr.db.Create()
+// StartCompression marks the queued job jobID as running, or records a running job
+// when the request carries none, and returns its ID. Failing to record the job is
+// logged but does not stop the compression itself.
+func (cr *CompressionRepository) StartCompression(ctx context.Context, jobID, bucket, key string) string {
+	if jobID != "" {
+		res := cr.db.WithContext(ctx).Model(&entity.CompressionJob{}).Where("id = ?", jobID).Updates(map[string]interface{}{"status": entity.JobStatusRunning, "error": ""})
+		if res.Error != nil {
+			cr.l.Error("Failed to start compression job %s : %v", jobID, res.Error)
+		}
+		if res.Error != nil || res.RowsAffected == 1 {
+			return jobID
+		}
+	} else {
+		jobID = uuid.New().String()
+	}
+
+	job := entity.CompressionJob{ID: jobID, Bucket: bucket, Key: key, Status: entity.JobStatusRunning}
+	if err := cr.db.WithContext(ctx).Create(&job).Error; err != nil {
+		cr.l.Error("Failed to create compression job %s - %s : %v", bucket, key, err)
+	}
+	return job.ID
 }
 
-func (cr *CompressionRepository) CreateDecompression(ctx context.Context, bucket, key string) {
-	obj := entity.DecompressionObject{Bucket: bucket, Key: key, LastAccess: time.Now(), TTL: time.Minute}
-	cr.mu.Lock()
-	defer cr.mu.Unlock()
-	cr.dos = append(cr.dos, obj)
+// RequeueCompression returns a job cut off by a shutdown to the queue it is
+// redelivered from.
+func (cr *CompressionRepository) RequeueCompression(ctx context.Context, jobID string) {
+	err := cr.db.WithContext(ctx).Model(&entity.CompressionJob{}).Where("id = ?", jobID).Update("status", entity.JobStatusQueued).Error
+	if err != nil {
+		cr.l.Error("Failed to requeue compression job %s : %v", jobID, err)
+	}
 }
-func (cr *CompressionRepository) UpdateDecompressionFilePath(ctx context.Context, bucket, key, filepath string) {
-	cr.mu.Lock()
-	defer cr.mu.Unlock()
 
-	for i, obj := range cr.dos {
-		if obj.Bucket == bucket && obj.Key == key {
-			cr.dos[i].FilePath = filepath
+// AdmitJob records job as queued unless it would take the tenant over limits. Jobs
+// of a tenant are admitted one at a time, under a lock on its quota row, so
+// concurrent servers cannot admit past the limits together. With dedupe, a job of
+// the object with the same source ETag that succeeded or is still active refuses
+// the admission with entity.ErrDuplicateJob.
+func (cr *CompressionRepository) AdmitJob(ctx context.Context, job *entity.CompressionJob, dedupe bool, maxActiveJobs int, maxBytesPerDay int64, day, activeSince time.Time) error {
+	return cr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entity.QuotaLock{Tenant: job.Tenant}).Error; err != nil {
+			return err
+		}
+		var lock entity.QuotaLock
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lock, "tenant = ?", job.Tenant).Error; err != nil {
+			return err
 		}
+
+		if dedupe {
+			var jobs int64
+			err := tx.Model(&entity.CompressionJob{}).
+				Where("bucket = ? AND `key` = ? AND source_etag = ?", job.Bucket, job.Key, job.SourceETag).
+				Where("status = ? OR (status IN ? AND updated_at >= ?)", entity.JobStatusSucceeded, []string{entity.JobStatusQueued, entity.JobStatusRunning}, activeSince).
+				Count(&jobs).Error
+			if err != nil {
+				return err
+			}
+			if jobs > 0 {
+				return entity.ErrDuplicateJob
+			}
+		}
+
+		activeJobs, bytesToday, err := tenantUsage(tx, job.Tenant, day, activeSince)
+		if err != nil {
+			return err
+		}
+		if maxActiveJobs > 0 && activeJobs >= int64(maxActiveJobs) {
+			return fmt.Errorf("%w: %d of %d jobs active", entity.ErrQuotaExceeded, activeJobs, maxActiveJobs)
+		}
+		if maxBytesPerDay > 0 && bytesToday+job.Bytes > maxBytesPerDay {
+			return fmt.Errorf("%w: %d of %d bytes used today", entity.ErrQuotaExceeded, bytesToday, maxBytesPerDay)
+		}
+
+		job.Status = entity.JobStatusQueued
+		return tx.Create(job).Error
+	})
+}
+
+// CancelJob deletes a job that is still queued, so it no longer counts against the
+// quota of its tenant.
+func (cr *CompressionRepository) CancelJob(ctx context.Context, jobID string) {
+	err := cr.db.WithContext(ctx).Where("id = ? AND status = ?", jobID, entity.JobStatusQueued).Delete(&entity.CompressionJob{}).Error
+	if err != nil {
+		cr.l.Error("Failed to cancel compression job %s : %v", jobID, err)
 	}
 }
 
-func (cr *CompressionRepository) UpdateDecompressionError(ctx context.Context, bucket, key string, err error) {
-	cr.mu.Lock()
-	defer cr.mu.Unlock()
+// RecordBytes sets the bytes a job counts against the daily quota to what it read.
+func (cr *CompressionRepository) RecordBytes(ctx context.Context, jobID string, bytes int64) {
+	err := cr.db.WithContext(ctx).Model(&entity.CompressionJob{}).Where("id = ?", jobID).Update("bytes", bytes).Error
+	if err != nil {
+		cr.l.Error("Failed to record the bytes of compression job %s : %v", jobID, err)
+	}
+}
 
-	for i, obj := range cr.dos {
-		if obj.Bucket == bucket && obj.Key == key {
-			cr.dos[i].Err = err
-		}
+// TenantUsage returns the active jobs of tenant and the bytes it compressed since day.
+func (cr *CompressionRepository) TenantUsage(ctx context.Context, tenant string, day, activeSince time.Time) (int64, int64, error) {
+	return tenantUsage(cr.db.WithContext(ctx), tenant, day, activeSince)
+}
+
+// tenantUsage counts queued and running jobs updated since activeSince, and sums
+// the bytes of every job admitted since day.
+func tenantUsage(tx *gorm.DB, tenant string, day, activeSince time.Time) (int64, int64, error) {
+	var activeJobs int64
+	err := tx.Model(&entity.CompressionJob{}).
+		Where("tenant = ? AND status IN ? AND updated_at >= ?", tenant, []string{entity.JobStatusQueued, entity.JobStatusRunning}, activeSince).
+		Count(&activeJobs).Error
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var bytesToday int64
+	err = tx.Model(&entity.CompressionJob{}).
+		Select("COALESCE(SUM(bytes), 0)").
+		Where("tenant = ? AND created_at >= ?", tenant, day).
+		Scan(&bytesToday).Error
+	if err != nil {
+		return 0, 0, err
 	}
+
+	return activeJobs, bytesToday, nil
 }
 
-func (cr *CompressionRepository) decompressionListWorker() {
-	for {
-		// fmt.Printf("%v \n", cr.dos)
-		for i, obj := range cr.dos {
-			if time.Now().Sub(obj.LastAccess) > obj.TTL {
-				// Removing object from list if already expired
-				cr.l.Info("Removing decompression object from list : %s - %s", obj.Bucket, obj.Key)
-				cr.mu.Lock()
-				os.Remove(obj.FilePath)
-				cr.dos = append(cr.dos[:i], cr.dos[i+1:]...)
-				cr.mu.Unlock()
-				break
-			}
+// FinishCompression stores the job outcome together with the probed audio members.
+func (cr *CompressionRepository) FinishCompression(ctx context.Context, jobID string, members []entity.AudioMember, jobErr error) {
+	now := time.Now()
+	updates := map[string]interface{}{"status": entity.JobStatusSucceeded, "finished_at": &now}
+	if jobErr != nil {
+		updates["status"] = entity.JobStatusFailed
+		updates["error"] = jobErr.Error()
+	}
+
+	err := cr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&entity.CompressionJob{}).Where("id = ?", jobID).Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		// members would point to a job StartCompression failed to record
+		if res.RowsAffected == 0 {
+			return errors.New("job is not recorded, its members are not stored")
 		}
-		// debug.FreeOSMemory()
-		time.Sleep(1 * time.Second)
+		if jobErr != nil || len(members) == 0 {
+			return nil
+		}
+		for i := range members {
+			members[i].JobID = jobID
+			members[i].Key = memberKey(members[i].Key)
+		}
+		return tx.Create(&members).Error
+	})
+	if err != nil {
+		cr.l.Error("Failed to finish compression job %s : %v", jobID, err)
 	}
 }
 
-func (cr *CompressionRepository) IsDecompressHasRequested(ctx context.Context, bucket, key string) bool {
-	cr.mu.Lock()
-	defer cr.mu.Unlock()
+func (cr *CompressionRepository) SearchAudioMembers(ctx context.Context, query entity.RecordingQuery) ([]entity.AudioMember, error) {
+	tx := cr.db.WithContext(ctx).Model(&entity.AudioMember{})
+	if query.Bucket != "" {
+		tx = tx.Where("bucket = ?", query.Bucket)
+	}
+	if prefix := memberKey(query.Prefix); prefix != "" {
+		tx = tx.Where("`key` LIKE ?", escapeLike(prefix)+"%")
+	}
+	if query.Codec != "" {
+		tx = tx.Where("codec = ?", query.Codec)
+	}
+	if query.MinDuration > 0 {
+		tx = tx.Where("duration >= ?", query.MinDuration)
+	}
+	if query.MaxDuration > 0 {
+		tx = tx.Where("duration <= ?", query.MaxDuration)
+	}
+	if query.SampleRate > 0 {
+		tx = tx.Where("sample_rate = ?", query.SampleRate)
+	}
+	if query.Channels > 0 {
+		tx = tx.Where("channels = ?", query.Channels)
+	}
+
+	var members []entity.AudioMember
+	err := tx.Order("id").Limit(query.Limit).Offset(query.Offset).Find(&members).Error
+	return members, err
+}
+
+// memberKey drops the leading slash HTTP requests give keys, so members are found
+// by the same prefix whichever way their archive was compressed.
+func memberKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
+
+// AcquireLease makes owner the decompressor of the object named id unless another
+// owner holds a running lease that has not expired. The current lease is returned
+// either way.
+func (cr *CompressionRepository) AcquireLease(ctx context.Context, id, bucket, key, etag, owner string, ttl time.Duration) (bool, *entity.DecompressionLease, error) {
+	var lease entity.DecompressionLease
+	var acquired bool
+
+	err := cr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		fresh := entity.DecompressionLease{ID: id, Bucket: bucket, Key: key, ETag: etag, Owner: owner, Status: entity.LeaseStatusRunning, ExpiresAt: now.Add(ttl)}
+
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&fresh)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 1 {
+			lease, acquired = fresh, true
+			return nil
+		}
 
-	for _, obj := range cr.dos {
-		if obj.Bucket == bucket && obj.Key == key {
-			return true
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lease, "id = ?", id).Error; err != nil {
+			return err
 		}
+		if lease.Status == entity.LeaseStatusRunning && lease.ExpiresAt.After(now) {
+			return nil
+		}
+
+		// callers only acquire after missing the shared cache, so a finished lease
+		// lost its result as well. Take over finished, failed and abandoned leases.
+		if err := tx.Model(&lease).Updates(map[string]interface{}{
+			"owner": owner, "status": entity.LeaseStatusRunning, "error": "", "expires_at": fresh.ExpiresAt,
+		}).Error; err != nil {
+			return err
+		}
+		acquired = true
+		return nil
+	})
+	if err != nil {
+		return false, nil, err
 	}
+	return acquired, &lease, nil
+}
 
-	return false
+// GetLease returns the lease of the object named id.
+func (cr *CompressionRepository) GetLease(ctx context.Context, id string) (*entity.DecompressionLease, error) {
+	var lease entity.DecompressionLease
+	if err := cr.db.WithContext(ctx).First(&lease, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// ExtendLease moves the expiry of the running lease of owner to ttl from now.
+func (cr *CompressionRepository) ExtendLease(ctx context.Context, id, owner string, ttl time.Duration) error {
+	return cr.db.WithContext(ctx).Model(&entity.DecompressionLease{}).
+		Where("id = ? AND owner = ? AND status = ?", id, owner, entity.LeaseStatusRunning).
+		Update("expires_at", time.Now().Add(ttl)).Error
+}
+
+// ReleaseLease records the outcome of the decompression owner did.
+func (cr *CompressionRepository) ReleaseLease(ctx context.Context, id, owner string, leaseErr error) {
+	updates := map[string]interface{}{"status": entity.LeaseStatusDone, "error": ""}
+	if leaseErr != nil {
+		updates["status"] = entity.LeaseStatusFailed
+		updates["error"] = leaseErr.Error()
+	}
+	cr.updateLease(ctx, id, owner, updates)
+}
+
+// AbandonLease gives up the lease of owner without a shared result, so a waiter
+// decompresses the object instead of failing.
+func (cr *CompressionRepository) AbandonLease(ctx context.Context, id, owner string) {
+	cr.updateLease(ctx, id, owner, map[string]interface{}{"status": entity.LeaseStatusReleased, "error": ""})
+}
+
+func (cr *CompressionRepository) updateLease(ctx context.Context, id, owner string, updates map[string]interface{}) {
+	err := cr.db.WithContext(ctx).Model(&entity.DecompressionLease{}).Where("id = ? AND owner = ?", id, owner).Updates(updates).Error
+	if err != nil {
+		cr.l.Error("Failed to release decompression lease %s : %v", id, err)
+	}
+}
+
+// FindUpload returns the latest unfinished multipart upload of the object.
+func (cr *CompressionRepository) FindUpload(ctx context.Context, bucket, key string) (*entity.MultipartUpload, []entity.UploadedPart, error) {
+	var uploads []entity.MultipartUpload
+	err := cr.db.WithContext(ctx).Where("bucket = ? AND `key` = ?", bucket, key).Order("updated_at DESC").Limit(1).Find(&uploads).Error
+	if err != nil || len(uploads) == 0 {
+		return nil, nil, err
+	}
+
+	var parts []entity.UploadedPart
+	if err := cr.db.WithContext(ctx).Where("upload_id = ?", uploads[0].ID).Order("part_number").Find(&parts).Error; err != nil {
+		return nil, nil, err
+	}
+	return &uploads[0], parts, nil
+}
+
+func (cr *CompressionRepository) CreateUpload(ctx context.Context, upload *entity.MultipartUpload) error {
+	return cr.db.WithContext(ctx).Create(upload).Error
 }
 
-func (cr *CompressionRepository) GetDecompressedObjectResult(ctx context.Context, bucket, key string) (string, error) {
-	cr.mu.Lock()
-	defer cr.mu.Unlock()
+// SavePart records part and touches its upload, so the sweeper leaves it alone.
+func (cr *CompressionRepository) SavePart(ctx context.Context, part *entity.UploadedPart) error {
+	return cr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(part).Error; err != nil {
+			return err
+		}
+		return tx.Model(&entity.MultipartUpload{}).Where("id = ?", part.UploadID).Update("updated_at", time.Now()).Error
+	})
+}
 
-	for _, obj := range cr.dos {
-		if obj.Bucket == bucket && obj.Key == key {
-			return obj.FilePath, obj.Err
+func (cr *CompressionRepository) DeleteUpload(ctx context.Context, uploadID string) error {
+	return cr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ?", uploadID).Delete(&entity.UploadedPart{}).Error; err != nil {
+			return err
 		}
+		return tx.Where("id = ?", uploadID).Delete(&entity.MultipartUpload{}).Error
+	})
+}
+
+func (cr *CompressionRepository) StaleUploads(ctx context.Context, before time.Time) ([]entity.MultipartUpload, error) {
+	var uploads []entity.MultipartUpload
+	err := cr.db.WithContext(ctx).Where("updated_at < ?", before).Order("updated_at").Find(&uploads).Error
+	return uploads, err
+}
+
+// HasActiveJob reports whether a compression of the object is queued or running,
+// counting jobs updated since activeSince only.
+func (cr *CompressionRepository) HasActiveJob(ctx context.Context, bucket, key string, activeSince time.Time) (bool, error) {
+	var jobs int64
+	err := cr.db.WithContext(ctx).Model(&entity.CompressionJob{}).
+		Where("bucket = ? AND `key` = ? AND status IN ? AND updated_at >= ?", bucket, key, []string{entity.JobStatusQueued, entity.JobStatusRunning}, activeSince).
+		Count(&jobs).Error
+	return jobs > 0, err
+}
+
+func (cr *CompressionRepository) EnabledRules(ctx context.Context) ([]entity.LifecycleRule, error) {
+	var rules []entity.LifecycleRule
+	err := cr.db.WithContext(ctx).Where("enabled = ?", true).Order("id").Find(&rules).Error
+	return rules, err
+}
+
+func (cr *CompressionRepository) StartRun(ctx context.Context, run *entity.ScheduleRun) error {
+	return cr.db.WithContext(ctx).Create(run).Error
+}
+
+// FinishRun stores the counts and outcome of run.
+func (cr *CompressionRepository) FinishRun(ctx context.Context, run *entity.ScheduleRun) {
+	if err := cr.db.WithContext(ctx).Save(run).Error; err != nil {
+		cr.l.Error("Failed to record schedule run of rule %d : %v", run.RuleID, err)
 	}
+}
+
+func (cr *CompressionRepository) GetJob(ctx context.Context, jobID string) (*entity.CompressionJob, error) {
+	var jobs []entity.CompressionJob
+	if err := cr.db.WithContext(ctx).Where("id = ?", jobID).Limit(1).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, entity.ErrJobNotFound
+	}
+	return &jobs[0], nil
+}
 
-	return "", nil
+// RecentJobs returns the latest jobs of an object, newest first.
+func (cr *CompressionRepository) RecentJobs(ctx context.Context, bucket, key string, limit int) ([]entity.CompressionJob, error) {
+	var jobs []entity.CompressionJob
+	err := cr.db.WithContext(ctx).Where("bucket = ? AND `key` = ?", bucket, key).Order("created_at DESC").Limit(limit).Find(&jobs).Error
+	return jobs, err
 }
@@ -0,0 +1,210 @@
+package compression
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+
+	"audio_compression/config"
+	"audio_compression/entity"
+	"audio_compression/pkg/archive"
+	"audio_compression/pkg/logger"
+)
+
+// errEnqueueLimit ends a run that queued as many jobs as a run may.
+var errEnqueueLimit = errors.New("enqueue limit of the run reached")
+
+// ScheduleUsecase queues compressions of the objects matching the lifecycle rules.
+type ScheduleUsecase struct {
+	StorageRepo     entity.StorageRepository
+	CompressionRepo *CompressionRepository
+	quota           *QuotaUsecase
+	// cu publishes the compression requests to the workers
+	cu         entity.CompressionUsecase
+	lock       *LeaderLock
+	interval   time.Duration
+	maxEnqueue int
+	jobTimeout time.Duration
+	owner      string
+	l          logger.Interface
+}
+
+func NewScheduleUsecase(cfg *config.Config, db *gorm.DB, storageRepo entity.StorageRepository, compressionRepo *CompressionRepository, quota *QuotaUsecase, cu entity.CompressionUsecase, l logger.Interface) *ScheduleUsecase {
+	hostname, _ := os.Hostname()
+
+	return &ScheduleUsecase{
+		StorageRepo:     storageRepo,
+		CompressionRepo: compressionRepo,
+		quota:           quota,
+		cu:              cu,
+		lock:            NewLeaderLock(db, cfg.Scheduler.LockName),
+		interval:        cfg.Scheduler.Interval,
+		maxEnqueue:      cfg.Scheduler.MaxEnqueuePerRun,
+		jobTimeout:      cfg.Quota.JobTimeout,
+		owner:           hostname + "-" + uuid.New().String()[:8],
+		l:               l,
+	}
+}
+
+// Run evaluates the rules every interval while this process is the leader, until
+// ctx is done.
+func (s *ScheduleUsecase) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	defer func() {
+		if err := s.lock.Release(context.Background()); err != nil {
+			s.l.Error("Failed to release scheduler lock : %v", err)
+		}
+	}()
+
+	for {
+		leader, err := s.lock.TryAcquire(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.l.Error("Failed to acquire scheduler lock : %v", err)
+		}
+		if leader {
+			s.RunRules(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunRules evaluates every enabled rule once.
+func (s *ScheduleUsecase) RunRules(ctx context.Context) {
+	rules, err := s.CompressionRepo.EnabledRules(ctx)
+	if err != nil {
+		s.l.Error("Failed to load lifecycle rules : %v", err)
+		return
+	}
+	for i := range rules {
+		if ctx.Err() != nil {
+			return
+		}
+		s.runRule(ctx, &rules[i])
+	}
+}
+
+func (s *ScheduleUsecase) runRule(ctx context.Context, rule *entity.LifecycleRule) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "RunRule")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("rule", rule.Name))
+	span.SetAttributes(attribute.String("bucket", rule.Bucket))
+
+	run := &entity.ScheduleRun{RuleID: rule.ID, Leader: s.owner, Status: entity.RunStatusRunning, StartedAt: time.Now()}
+	if err := s.CompressionRepo.StartRun(ctx, run); err != nil {
+		s.l.Error("Failed to record schedule run of rule %s : %v", rule.Name, err)
+	}
+
+	err := s.evaluate(ctx, rule, run)
+
+	now := time.Now()
+	run.FinishedAt = &now
+	run.Status = entity.RunStatusSucceeded
+	switch {
+	case err == nil:
+	case errors.Is(err, errEnqueueLimit), errors.Is(err, entity.ErrQuotaExceeded):
+		// the next runs queue the rest
+		run.Error = err.Error()
+	default:
+		run.Status = entity.RunStatusFailed
+		run.Error = err.Error()
+		s.l.Error("Failed to run lifecycle rule %s : %v", rule.Name, err)
+	}
+	// the run is recorded even when ctx was cancelled during it
+	s.CompressionRepo.FinishRun(context.Background(), run)
+
+	span.SetAttributes(attribute.Int("scanned", run.Scanned))
+	span.SetAttributes(attribute.Int("enqueued", run.Enqueued))
+	span.SetAttributes(attribute.Int("deleted", run.Deleted))
+}
+
+// evaluate queues a compression of every .tar object of the rule that is old enough
+// and neither compressed nor being compressed. Originals whose compressed archive
+// was stored from them are deleted if the rule says so.
+func (s *ScheduleUsecase) evaluate(ctx context.Context, rule *entity.LifecycleRule, run *entity.ScheduleRun) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	// the workers are expected to be set up as the scheduler is, rather than have
+	// every queued job fail
+	if err := archive.CheckCodec(rule.Codec); err != nil {
+		return err
+	}
+	modifiedBefore := time.Now().Add(-rule.MinAge())
+
+	return s.StorageRepo.ListObjects(ctx, rule.Bucket, rule.Prefix, func(object *entity.ObjectInfo) error {
+		if !isKeyExtensionValid(object.Key, ".tar") || object.LastModified.After(modifiedBefore) {
+			return nil
+		}
+		run.Scanned++
+
+		compressed, err := s.isCompressed(ctx, rule.Bucket, object)
+		if err != nil {
+			return err
+		}
+		if compressed {
+			if !rule.DeleteOriginals {
+				run.Skipped++
+				return nil
+			}
+			if err := s.StorageRepo.DeleteObject(ctx, rule.Bucket, object.Key); err != nil {
+				return err
+			}
+			run.Deleted++
+			return nil
+		}
+
+		// listed objects in an archive storage class cannot be read as they are
+		if object.NeedsRestore() {
+			run.Skipped++
+			return nil
+		}
+		active, err := s.CompressionRepo.HasActiveJob(ctx, rule.Bucket, object.Key, time.Now().Add(-s.jobTimeout))
+		if err != nil {
+			return err
+		}
+		if active {
+			run.Skipped++
+			return nil
+		}
+
+		if s.maxEnqueue > 0 && run.Enqueued >= s.maxEnqueue {
+			return errEnqueueLimit
+		}
+		jobID, err := s.quota.AdmitCompression(ctx, rule.Tenant, rule.Bucket, object.Key)
+		if err != nil {
+			return err
+		}
+		if err := s.cu.PlanCompression(ctx, jobID, rule.Bucket, object.Key, rule.Tier, rule.Codec, rule.Level, entity.PriorityBatch, rule.Storage); err != nil {
+			s.quota.CancelJob(ctx, jobID)
+			return err
+		}
+		run.Enqueued++
+		return nil
+	})
+}
+
+// isCompressed reports whether the compressed archive of object was stored from
+// its current content.
+func (s *ScheduleUsecase) isCompressed(ctx context.Context, bucket string, object *entity.ObjectInfo) (bool, error) {
+	_, _, info, err := findCompressed(ctx, s.StorageRepo, bucket, object.Key)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return info.Metadata[metaSourceETag] == object.ETag, nil
+}
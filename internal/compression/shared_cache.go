@@ -0,0 +1,255 @@
+package compression
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"audio_compression/config"
+	"audio_compression/entity"
+)
+
+const (
+	SharedCacheS3 = "s3"
+	SharedCacheFS = "fs"
+)
+
+// leaseReleaseTimeout bounds recording the outcome of a leased decompression.
+const leaseReleaseTimeout = 10 * time.Second
+
+// SharedCache stores decompression results where every worker can read them.
+type SharedCache interface {
+	// Get writes the named result to w and reports whether it was found
+	Get(ctx context.Context, name string, w io.Writer) (bool, error)
+	Put(ctx context.Context, name string, r io.Reader) error
+}
+
+// NewSharedCache returns the shared tier selected by cfg, or nil when it is disabled.
+func NewSharedCache(cfg config.SharedCache, storageRepo entity.StorageRepository) (SharedCache, error) {
+	switch cfg.Kind {
+	case "":
+		return nil, nil
+	case SharedCacheS3:
+		if cfg.Bucket == "" {
+			return nil, fmt.Errorf("shared cache bucket is required")
+		}
+		return &s3SharedCache{storageRepo, cfg.Bucket, cfg.Prefix}, nil
+	case SharedCacheFS:
+		if cfg.Dir == "" {
+			return nil, fmt.Errorf("shared cache dir is required")
+		}
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return nil, err
+		}
+		return &fsSharedCache{cfg.Dir}, nil
+	}
+	return nil, fmt.Errorf("unknown shared cache %q", cfg.Kind)
+}
+
+// sharedCacheName keys a result by the compressed object version, so a recompressed
+// archive never serves an older result.
+func sharedCacheName(bucket, key, etag string) string {
+	sum := sha256.Sum256([]byte(bucket + "\x00" + key + "\x00" + etag))
+	return hex.EncodeToString(sum[:])
+}
+
+// s3SharedCache keeps results below a staging prefix. Expiry is left to a bucket
+// lifecycle rule on the prefix.
+type s3SharedCache struct {
+	StorageRepo entity.StorageRepository
+	bucket      string
+	prefix      string
+}
+
+func (s *s3SharedCache) Get(ctx context.Context, name string, w io.Writer) (bool, error) {
+	// buffered so a failed download leaves w untouched
+	var buf bytes.Buffer
+	if err := s.StorageRepo.DownloadObject(ctx, s.bucket, path.Join(s.prefix, name+".tar"), &buf); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, err := buf.WriteTo(w)
+	return err == nil, err
+}
+
+func (s *s3SharedCache) Put(ctx context.Context, name string, r io.Reader) error {
+	return s.StorageRepo.UploadObject(ctx, s.bucket, path.Join(s.prefix, name+".tar"), r, entity.UploadOptions{})
+}
+
+// fsSharedCache keeps results on a volume mounted by every worker.
+type fsSharedCache struct {
+	dir string
+}
+
+func (s *fsSharedCache) Get(ctx context.Context, name string, w io.Writer) (bool, error) {
+	f, err := os.Open(filepath.Join(s.dir, name+".tar"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err == nil, err
+}
+
+// Put writes to a temporary file first so readers never see a partial result.
+func (s *fsSharedCache) Put(ctx context.Context, name string, r io.Reader) error {
+	f, err := os.CreateTemp(s.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, name+".tar"))
+}
+
+// decompressShared collapses concurrent decompressions of one object version across
+// workers into one. The lease owner decompresses and publishes the result, the
+// others wait for it and read it from the shared tier. The current version is
+// restored when etag is empty.
+func (c *CompressionUsecase) decompressShared(ctx context.Context, bucket, key, etag string, w *bytes.Buffer) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "decompressShared")
+	defer span.End()
+
+	if etag == "" {
+		_, _, info, err := findCompressed(ctx, c.StorageRepo, bucket, key)
+		if err != nil {
+			return err
+		}
+		etag = info.ETag
+	}
+	name := sharedCacheName(bucket, key, etag)
+	span.SetAttributes(attribute.String("etag", etag))
+
+	for {
+		found, err := c.shared.Get(ctx, name, w)
+		if err != nil {
+			return err
+		}
+		if found {
+			span.AddEvent("Found result in shared cache")
+			cacheLookupCounter.Add(ctx, 1, cacheResultKey.String("shared_hit"))
+			return nil
+		}
+
+		acquired, lease, err := c.CompressionRepo.AcquireLease(ctx, name, bucket, key, etag, c.owner, c.leaseTTL)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			cacheLookupCounter.Add(ctx, 1, cacheResultKey.String("shared_miss"))
+			return c.decompressLeased(ctx, name, bucket, key, etag, w)
+		}
+
+		span.AddEvent("Waiting for lease owner " + lease.Owner)
+		if err := c.waitLease(ctx, name); err != nil {
+			return err
+		}
+	}
+}
+
+// decompressLeased decompresses the object under the acquired lease name and
+// publishes the result. The lease is renewed meanwhile, so waiters never take over
+// a decompression that outlasts the lease TTL.
+func (c *CompressionUsecase) decompressLeased(ctx context.Context, name, bucket, key, etag string, w *bytes.Buffer) error {
+	stopRenew := c.renewLease(ctx, name)
+
+	err := c.decompress(ctx, bucket, key, etag, w)
+	published := err == nil
+	if published {
+		if putErr := c.shared.Put(ctx, name, bytes.NewReader(w.Bytes())); putErr != nil {
+			c.l.Error("Failed to publish decompression %s - %s : %v", bucket, key, putErr)
+			published = false
+		}
+	}
+	stopRenew()
+
+	// detached, ctx may be the one that timed out the decompression
+	releaseCtx, cancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)), leaseReleaseTimeout)
+	defer cancel()
+	switch {
+	case err != nil:
+		c.CompressionRepo.ReleaseLease(releaseCtx, name, c.owner, err)
+	case !published:
+		// the result is fine and served here, the waiters decompress it
+		// themselves rather than fail with the upload
+		c.CompressionRepo.AbandonLease(releaseCtx, name, c.owner)
+	default:
+		c.CompressionRepo.ReleaseLease(releaseCtx, name, c.owner, nil)
+	}
+	return err
+}
+
+// renewLease extends the lease name every third of its TTL until the returned
+// function is called.
+func (c *CompressionUsecase) renewLease(ctx context.Context, name string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if c.leaseTTL <= 0 {
+			return
+		}
+		ticker := time.NewTicker(c.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := c.CompressionRepo.ExtendLease(ctx, name, c.owner, c.leaseTTL); err != nil && ctx.Err() == nil {
+				c.l.Error("Failed to extend decompression lease %s : %v", name, err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitLease polls until the lease is released or has expired.
+func (c *CompressionUsecase) waitLease(ctx context.Context, name string) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		lease, err := c.CompressionRepo.GetLease(ctx, name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case lease.Status == entity.LeaseStatusFailed:
+			return fmt.Errorf("decompression by %s failed: %s", lease.Owner, lease.Error)
+		case lease.Status == entity.LeaseStatusDone, lease.Status == entity.LeaseStatusReleased, time.Now().After(lease.ExpiresAt):
+			return nil
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spoolMemoryBytes is how much of a compressed archive is kept in memory, the rest
+// of a larger one goes to a temporary file.
+const spoolMemoryBytes = 64 << 20
+
+// spool holds the compressed archive until it is uploaded. buf may be reused
+// between archives, the temporary file is removed by Close.
+type spool struct {
+	buf *bytes.Buffer
+	f   *os.File
+}
+
+func newSpool(buf *bytes.Buffer) *spool {
+	buf.Reset()
+	return &spool{buf: buf}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.f == nil && s.buf.Len()+len(p) > spoolMemoryBytes {
+		f, err := os.CreateTemp("", "compressed_archive_*.tmp")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	if s.f != nil {
+		return s.f.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// reader returns the archive from its start. Put reads it twice when encrypting.
+func (s *spool) reader() (io.ReadSeeker, error) {
+	if s.f == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.f, nil
+}
+
+func (s *spool) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
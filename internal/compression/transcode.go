@@ -0,0 +1,120 @@
+package compression
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/archive"
+	"audio_compression/pkg/audio_converter"
+)
+
+// probe reads the stream parameters of a member. Members with a raw extension are
+// described by the configured raw PCM parameters.
+func (c *CompressionUsecase) probe(file entity.FileObject) (*audio_converter.AudioInfo, error) {
+	ext := strings.ToLower(path.Ext(file.Name))
+	for _, rawExt := range c.raw.Extensions {
+		if ext == rawExt {
+			return audio_converter.ProbeRaw(file.Body, c.raw.Codec, c.raw.SampleRate, c.raw.Channels)
+		}
+	}
+	return audio_converter.Probe(file.Body)
+}
+
+// transcode converts an audio member as the policy says and returns the policy that
+// was applied. Members the converter cannot handle are stored untouched.
+func (c *CompressionUsecase) transcode(ctx context.Context, file entity.FileObject, info *audio_converter.AudioInfo, policy entity.ConversionPolicy) (entity.FileObject, entity.ConversionPolicy, error) {
+	if policy.Target == audio_converter.TargetCopy {
+		return file, policy, nil
+	}
+	target, ext := audio_converter.TargetFormat(policy)
+
+	ctx, span := otel.Tracer(traceName).Start(ctx, "transcode")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("member", file.Name))
+	span.SetAttributes(attribute.String("source", policy.Source))
+	span.SetAttributes(attribute.String("target", policy.Target))
+
+	var buf bytes.Buffer
+	if err := c.converter.Convert(ctx, bytes.NewReader(file.Body), &buf, info.SourceFormat(), target); err != nil {
+		if errors.Is(err, audio_converter.ErrUnsupportedFormat) {
+			c.l.Warn("Storing %s untouched : %v", file.Name, err)
+			return file, entity.ConversionPolicy{Source: policy.Source, Target: audio_converter.TargetCopy}, nil
+		}
+		return entity.FileObject{}, entity.ConversionPolicy{}, err
+	}
+
+	return entity.FileObject{Name: strings.TrimSuffix(file.Name, path.Ext(file.Name)) + ext, Body: buf.Bytes()}, policy, nil
+}
+
+// restore converts a stored member described by entry back to its source format.
+// Members stored by a lossy policy come back with the source parameters but not the
+// original samples.
+func (c *CompressionUsecase) restore(ctx context.Context, file entity.FileObject, entry *entity.ManifestEntry) (entity.FileObject, error) {
+	if entry == nil || memberName(entry.StoredName) != file.Name || memberName(entry.Name) == file.Name {
+		return file, nil
+	}
+
+	policy := entry.Policy
+	// version 1 manifests carry no policy, they only stored integer PCM WAV as FLAC
+	if policy == nil && entry.Format == "wav" && archive.FormatFromName(file.Name) == "flac" {
+		policy = &entity.ConversionPolicy{Source: audio_converter.SourceWav, Target: audio_converter.TargetFlac}
+	}
+	if policy == nil || policy.Target == audio_converter.TargetCopy {
+		return file, nil
+	}
+
+	ctx, span := otel.Tracer(traceName).Start(ctx, "restore")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("member", entry.Name))
+	span.SetAttributes(attribute.String("target", policy.Target))
+	span.SetAttributes(attribute.Bool("exact", entry.Exact))
+
+	from, _ := audio_converter.TargetFormat(*policy)
+	source := audio_converter.AudioInfo{Format: entry.Format, Codec: entry.Codec, SampleRate: entry.SampleRate, Channels: entry.Channels}
+
+	var buf bytes.Buffer
+	var err error
+	if entry.Codec == "" && entry.Format == "wav" && from.Container == "flac" {
+		err = c.converter.ConvertFlacToWav(ctx, bytes.NewReader(file.Body), &buf)
+	} else {
+		err = c.converter.Convert(ctx, bytes.NewReader(file.Body), &buf, from, source.SourceFormat())
+	}
+	if err != nil {
+		return entity.FileObject{}, err
+	}
+
+	return entity.FileObject{Name: memberName(entry.Name), Body: buf.Bytes()}, nil
+}
+
+// memberName is the name Extract gives a member recorded in a manifest. Manifests
+// written before names were normalised may hold e.g. "./a.wav".
+func memberName(name string) string {
+	if cleaned, ok := archive.CleanName(name); ok {
+		return cleaned
+	}
+	return name
+}
+
+// splitManifest separates the embedded manifest from the stored members. Archives
+// written before the manifest existed return a nil manifest.
+func splitManifest(files []entity.FileObject) (*entity.Manifest, []entity.FileObject, error) {
+	if len(files) == 0 || files[0].Name != archive.ManifestName {
+		return nil, files, nil
+	}
+
+	var manifest entity.Manifest
+	if err := json.Unmarshal(files[0].Body, &manifest); err != nil {
+		return nil, nil, err
+	}
+	return &manifest, files[1:], nil
+}
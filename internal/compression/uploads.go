@@ -0,0 +1,32 @@
+package compression
+
+import (
+	"context"
+	"time"
+)
+
+// SweepUploads aborts abandoned multipart uploads every sweep interval until ctx is
+// done.
+func (c *CompressionUsecase) SweepUploads(ctx context.Context) {
+	if c.multipart.SweepInterval <= 0 || c.multipart.AbandonAfter <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.multipart.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		aborted, err := c.s3Repo.SweepUploads(ctx, time.Now().Add(-c.multipart.AbandonAfter), c.multipart.SweepBuckets)
+		if err != nil && ctx.Err() == nil {
+			c.l.Error("Failed to sweep multipart uploads : %v", err)
+		}
+		if aborted > 0 {
+			c.l.Info("Aborted %d abandoned multipart uploads", aborted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -5,33 +5,50 @@ import (
 	"audio_compression/entity"
 	"audio_compression/internal/storage/s3repo"
 	"audio_compression/pkg/archive"
+	"audio_compression/pkg/audio_converter"
 	"audio_compression/pkg/logger"
 	"bytes"
 	"context"
 	"errors"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"time"
 
 	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/google/uuid"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"gorm.io/gorm"
 )
 
 type CompressionUsecase struct {
 	StorageRepo           entity.StorageRepository
+	s3Repo                *s3repo.S3Repository
+	multipart             config.S3Multipart
+	archives              *ArchiveStore
 	uncompressedArchiever archive.Archiver
 	compressedArchiever   archive.Archiver
 	CompressionRepo       *CompressionRepository
-	l                     logger.Interface
-	compBuffer            CompressionBuffer
-	decompBuffer          CompressionBuffer
+	cache                 *ResultCache
+	shared                SharedCache
+	leaseTTL              time.Duration
+	owner                 string
+	decompressTimeout     time.Duration
+	converter             audio_converter.AudioConverter
+	policies              *audio_converter.PolicyEngine
+	raw                   config.AudioRaw
+	concurrency           int
+	// gate holds compressions back while decompressions run
+	gate          *cpuGate
+	memberTimeout time.Duration
+	jobTimeout    time.Duration
+	l             logger.Interface
+	compBuffer    CompressionBuffer
+	decompBuffer  CompressionBuffer
 }
 
 type CompressionBuffer struct {
@@ -40,233 +57,465 @@ type CompressionBuffer struct {
 }
 
 func NewCompressionUsecase(cfg *config.Config, db *gorm.DB, l logger.Interface) *CompressionUsecase {
-	s3Repo, err := s3repo.NewS3Repository()
+	cu := newCompressionUsecase(cfg, db, l)
+
+	cache, err := NewResultCache(CacheDir(cfg.Cache.Dir, "worker"), cfg.Cache.MaxBytes, cfg.Cache.TTL, l)
+	if err != nil {
+		l.Error(err)
+		l.Fatal("Failed to init decompression cache")
+	}
+
+	shared, err := NewSharedCache(cfg.Cache.Shared, cu.StorageRepo)
+	if err != nil {
+		l.Error(err)
+		l.Fatal("Failed to init shared decompression cache")
+	}
+	hostname, _ := os.Hostname()
+
+	// zstd lifecycle rules are refused by a scheduler without the binary, this
+	// worker fails their jobs
+	if err := archive.CheckCodec(entity.CodecZstd); err != nil {
+		l.Warn("Compressions and decompressions with zstd will fail : %v", err)
+	}
+
+	cu.cache = cache
+	cu.shared = shared
+	cu.leaseTTL = cfg.Cache.Shared.LeaseTTL
+	cu.owner = hostname + "-" + uuid.New().String()[:8]
+	cu.decompressTimeout = cfg.RMQ.DecompressTimeout
+
+	return cu
+}
+
+// NewUploadUsecase returns the compression pipeline for archives posted to the
+// server. It has no decompression cache since it never decompresses.
+func NewUploadUsecase(cfg *config.Config, db *gorm.DB, l logger.Interface) *CompressionUsecase {
+	return newCompressionUsecase(cfg, db, l)
+}
+
+func newCompressionUsecase(cfg *config.Config, db *gorm.DB, l logger.Interface) *CompressionUsecase {
+	cu := NewLocalUsecase(cfg, l)
+
+	cu.CompressionRepo = NewCompressionRepository(db, l)
+	cu.s3Repo.UseUploadStore(cu.CompressionRepo)
+
+	return cu
+}
+
+// NewLocalUsecase returns the compression pipeline without the job store and the
+// decompression cache, for tools that compress and decompress without the services.
+func NewLocalUsecase(cfg *config.Config, l logger.Interface) *CompressionUsecase {
+	s3Repo, err := s3repo.NewS3Repository(cfg.S3)
 	if err != nil {
 		l.Error(err)
 		l.Fatal("Failed to init S3 Repository")
 	}
-	uncompArchiever := archive.NewTarArchiever()
-	compArchiever := archive.NewTarGzArchiever()
+	archives, err := NewArchiveStore(cfg.Encryption, cfg.S3.Archives, s3Repo)
+	if err != nil {
+		l.Error(err)
+		l.Fatal("Failed to init archive encryption")
+	}
+	uncompArchiever := archive.NewTarArchiever(archive.Limits{
+		MaxTotalBytes:  cfg.Archive.MaxTotalBytes,
+		MaxMembers:     cfg.Archive.MaxMembers,
+		MaxMemberBytes: cfg.Archive.MaxMemberBytes,
+		MaxRatio:       cfg.Archive.MaxRatio,
+	})
+	// compressed archives are written by the pipeline from sources within the
+	// limits, which may have changed since, so only member paths are checked
+	compArchiever := archive.NewTarGzArchiever(archive.Limits{})
+
+	limits := cfg.Audio.Limits
+	converter, err := audio_converter.NewAudioConverter(cfg.Audio.Converter, audio_converter.Limits{
+		MaxOutputBytes: limits.MaxOutputBytes,
+		CPUSeconds:     limits.CPUSeconds,
+		MaxMemoryBytes: limits.MaxMemoryBytes,
+		Cgroup:         limits.Cgroup,
+	})
+	if err != nil {
+		l.Error(err)
+		l.Fatal("Failed to init audio converter")
+	}
+
+	var policies []entity.ConversionPolicy
+	for _, p := range cfg.Audio.Policies {
+		policies = append(policies, entity.ConversionPolicy{Source: p.Source, Tier: p.Tier, Target: p.Target, Bitrate: p.Bitrate})
+	}
+	policyEngine, err := audio_converter.NewPolicyEngine(policies)
+	if err != nil {
+		l.Error(err)
+		l.Fatal("Failed to init audio conversion policies")
+	}
 
-	compRepo := NewCompressionRepository(db, l)
+	concurrency := cfg.Audio.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
 
 	compBuffer := CompressionBuffer{new(bytes.Buffer), new(bytes.Buffer)}
 	decompBuffer := CompressionBuffer{new(bytes.Buffer), new(bytes.Buffer)}
 
-	cu := &CompressionUsecase{s3Repo, uncompArchiever, compArchiever, compRepo, l, compBuffer, decompBuffer}
-
-	return cu
+	return &CompressionUsecase{
+		StorageRepo:           s3Repo,
+		s3Repo:                s3Repo,
+		multipart:             cfg.S3.Multipart,
+		archives:              archives,
+		uncompressedArchiever: uncompArchiever,
+		compressedArchiever:   compArchiever,
+		converter:             converter,
+		policies:              policyEngine,
+		raw:                   cfg.Audio.Raw,
+		concurrency:           concurrency,
+		gate:                  newCPUGate(),
+		memberTimeout:         limits.MemberTimeout,
+		jobTimeout:            limits.JobTimeout,
+		l:                     l,
+		compBuffer:            compBuffer,
+		decompBuffer:          decompBuffer,
+	}
 }
 
-func (c *CompressionUsecase) PlanCompression(ctx context.Context, bucket, key string) error {
+func (c *CompressionUsecase) PlanCompression(ctx context.Context, jobID, bucket, key, tier, codec string, level int, priority uint8, storage entity.StorageOptions) error {
 	return nil
 }
 
-func (c *CompressionUsecase) GetDecompression(ctx context.Context, bucket, key string) ([]byte, error) {
+// GetDecompression returns the restored archive from the result cache, decompressing
+// it first when no other request has. etag is the compressed archive to restore,
+// any version when empty.
+func (c *CompressionUsecase) GetDecompression(ctx context.Context, bucket, key, etag string) (io.ReadSeekCloser, error) {
 	ctx, span := otel.Tracer(traceName).Start(ctx, "GetDecompression")
 	defer span.End()
 
 	span.SetAttributes(attribute.String("bucket", bucket))
 	span.SetAttributes(attribute.String("key", key))
 
-	if !c.CompressionRepo.IsDecompressHasRequested(ctx, bucket, key) {
+	if c.cache.Reserve(ctx, bucket, key, etag) {
 		span.AddEvent("Starting DoDecompression")
 
-		c.CompressionRepo.CreateDecompression(ctx, bucket, key)
-
+		// detached from the request, the result is shared with every waiting request
+		doCtx, doCancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), span), c.decompressTimeout)
 		go func() {
-			filepath, err := c.DoDecompression(ctx, bucket, key)
-			if err != nil {
-				c.CompressionRepo.UpdateDecompressionError(ctx, bucket, key, err)
-			}
-			if filepath != "" {
-				c.CompressionRepo.UpdateDecompressionFilePath(ctx, bucket, key, filepath)
+			defer doCancel()
+			if err := c.DoDecompression(doCtx, bucket, key, etag); err != nil {
+				c.cache.Fail(bucket, key, etag, err)
 			}
 		}()
 	}
 
-	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*80)
+	ctxTimeout, cancel := context.WithTimeout(ctx, c.decompressTimeout)
 	defer cancel()
 
-	fileContentChan := make(chan []byte)
-	errorChan := make(chan error)
-
-	go func() {
-		for {
-			filepath, err := c.CompressionRepo.GetDecompressedObjectResult(ctx, bucket, key)
-			if filepath != "" {
-				span.AddEvent("Found decompressed object file path")
-				content, err := ioutil.ReadFile(filepath)
-				if err != nil {
-					c.l.Error(err)
-				}
-				fileContentChan <- content
-				return
-			}
-			if err != nil {
-				span.AddEvent("Found decompressed object error")
-				errorChan <- err
-				return
-			}
-			time.Sleep(100 * time.Millisecond)
-		}
-	}()
-
-	select {
-	case <-ctxTimeout.Done():
-		return nil, ctxTimeout.Err()
-	case fileContent := <-fileContentChan:
-		return fileContent, nil
-	case err := <-errorChan:
+	f, err := c.cache.Wait(ctxTimeout, bucket, key, etag)
+	if err != nil {
 		return nil, err
 	}
+	span.AddEvent("Found decompressed object file")
+	return f, nil
 }
 
-func (c *CompressionUsecase) DoCompression(ctx context.Context, bucket, key string) (error, bool) {
+func (c *CompressionUsecase) DoCompression(ctx context.Context, jobID, bucket, key, tier, codec string, level int, storage entity.StorageOptions) (error, bool) {
 	ctx, span := otel.Tracer(traceName).Start(ctx, "DoCompression")
 	defer span.End()
 
 	span.SetAttributes(attribute.String("bucket", bucket))
 	span.SetAttributes(attribute.String("key", key))
+	span.SetAttributes(attribute.String("tier", tier))
+	span.SetAttributes(attribute.String("codec", codec))
 
-	if !c.isKeyExtensionValid(key, ".tar") {
+	if !isKeyExtensionValid(key, ".tar") {
 		return errors.New("Invalid file extension"), false
 	}
 
-	sourceBuffer := c.compBuffer.sourceBuffer
-	outputBuffer := c.compBuffer.outputBuffer
+	jobID = c.CompressionRepo.StartCompression(ctx, jobID, bucket, key)
+	span.SetAttributes(attribute.String("job_id", jobID))
 
-	sourceBuffer.Reset()
-	outputBuffer.Reset()
+	// retrying on this worker cannot help, the request is dead-lettered for a replay
+	if err := archive.CheckCodec(codec); err != nil {
+		c.CompressionRepo.FinishCompression(ctx, jobID, nil, err)
+		return err, false
+	}
 
-	// Download from s3
-	if err := c.StorageRepo.DownloadObject(ctx, bucket, key, sourceBuffer); err != nil {
-		var responseError *awshttp.ResponseError
-		if errors.As(err, &responseError) && responseError.ResponseError.HTTPStatusCode() == http.StatusNotFound {
-			return err, false
-		}
+	members, err, shouldRetry := c.compress(ctx, bucket, key, tier, codec, level, storage)
+	if ctx.Err() != nil {
+		// cancelled by a worker shutdown, the request is redelivered
+		c.CompressionRepo.RequeueCompression(trace.ContextWithSpan(context.Background(), span), jobID)
 		return err, true
 	}
+	c.CompressionRepo.FinishCompression(ctx, jobID, members, err)
 
-	// Extract
-	files, err := c.uncompressedArchiever.Extract(ctx, sourceBuffer)
-	if err != nil {
-		return err, false
-	}
+	return err, shouldRetry
+}
 
-	var newFiles []entity.FileObject
+// compress runs the download, extract, transcode, compress and upload pipeline and
+// returns the probed metadata of every audio member.
+func (c *CompressionUsecase) compress(ctx context.Context, bucket, key, tier, codec string, level int, storage entity.StorageOptions) ([]entity.AudioMember, error, bool) {
+	output := newSpool(c.compBuffer.outputBuffer)
+	defer output.Close()
 
-	// Convert wav to flac
-	for _, file := range files {
-		newFiles = append(newFiles, file)
+	// Download from s3, streamed into the extraction
+	r, source, err := c.StorageRepo.OpenObject(ctx, bucket, key)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, err, false
+		}
+		return nil, err, true
 	}
+	defer r.Close()
+	sourceReader := &downloadReader{r: r}
 
-	// Compress to tar gz
-	if err := c.compressedArchiever.Compress(ctx, newFiles, outputBuffer); err != nil {
-		return err, true
+	_, members, err, shouldRetry := c.compressArchive(ctx, bucket, key, tier, codec, level, source.ETag, storage, sourceReader, output)
+	if sourceReader.err != nil {
+		// the archive is fine, reading it failed
+		return nil, sourceReader.err, true
 	}
+	return members, err, shouldRetry
+}
 
-	compressedBucket := bucket + "-compressed"
-	compressedKey := key + ".gz"
+// downloadReader keeps the error a download failed with, to tell it from errors
+// of what was downloaded.
+type downloadReader struct {
+	r   io.Reader
+	err error
+}
 
-	// Upload to S3
-	if err := c.StorageRepo.UploadObject(ctx, compressedBucket, compressedKey, outputBuffer); err != nil {
-		return err, true
+func (d *downloadReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF {
+		d.err = err
 	}
+	return n, err
+}
 
-	return nil, false
+// uploadReader counts the bytes of an upload read so far.
+type uploadReader struct {
+	r io.Reader
+	n int64
 }
 
-func (c *CompressionUsecase) DoDecompression(ctx context.Context, bucket, key string) (string, error) {
-	ctx, span := otel.Tracer(traceName).Start(ctx, "DoDecompression")
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.n += int64(n)
+	return n, err
+}
+
+// CompressUpload runs the pipeline on a tar posted to the server and returns the
+// manifest of the stored archive.
+func (c *CompressionUsecase) CompressUpload(ctx context.Context, jobID, bucket, key, tier string, level int, storage entity.StorageOptions, r io.Reader) (*entity.Manifest, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "CompressUpload")
 	defer span.End()
 
 	span.SetAttributes(attribute.String("bucket", bucket))
 	span.SetAttributes(attribute.String("key", key))
+	span.SetAttributes(attribute.String("tier", tier))
 
-	if !c.isKeyExtensionValid(key, ".tar") {
-		return "", errors.New("Invalid file extension")
+	if !isKeyExtensionValid(key, ".tar") {
+		return nil, errors.New("Invalid file extension")
 	}
 
-	compressedBucket := bucket + "-compressed"
-	compressedKey := key + ".gz"
+	jobID = c.CompressionRepo.StartCompression(ctx, jobID, bucket, key)
+	span.SetAttributes(attribute.String("job_id", jobID))
 
-	fmt.Print(compressedKey)
+	output := newSpool(new(bytes.Buffer))
+	defer output.Close()
 
-	// sourceBuffer := c.decompBuffer.sourceBuffer
-	// outputBuffer := c.decompBuffer.outputBuffer
+	upload := &uploadReader{r: r}
+	manifest, members, err, _ := c.compressArchive(ctx, bucket, key, tier, entity.CodecGzip, 0, "", storage, upload, output)
+	// uploads of unknown length are admitted at the largest size they may have
+	c.CompressionRepo.RecordBytes(ctx, jobID, upload.n)
+	c.CompressionRepo.FinishCompression(ctx, jobID, members, err)
 
-	// sourceBuffer.Reset()
-	// outputBuffer.Reset()
+	return manifest, err
+}
 
-	sourceBuffer := new(bytes.Buffer)
-	outputBuffer := new(bytes.Buffer)
+// compressArchive runs the extract, transcode, compress and upload pipeline on a tar
+// stream and returns the manifest with the probed metadata of every audio member.
+// The archive is compressed with codec at level, the default of codec when zero.
+// sourceETag is empty for archives that were not read from S3.
+func (c *CompressionUsecase) compressArchive(ctx context.Context, bucket, key, tier, codec string, level int, sourceETag string, storage entity.StorageOptions, r io.Reader, output *spool) (*entity.Manifest, []entity.AudioMember, error, bool) {
+	if codec == "" {
+		codec = entity.CodecGzip
+	}
+	manifest, manifestFile, members, err, shouldRetry := c.buildArchive(ctx, bucket, key, tier, codec, level, r, output)
+	if err != nil {
+		return nil, nil, err, shouldRetry
+	}
 
-	// Download from s3
-	c.l.Debug("Downloading object from S3")
-	if err := c.StorageRepo.DownloadObject(ctx, compressedBucket, compressedKey, sourceBuffer); err != nil {
-		return "", err
+	compressedBucket, compressedKey := compressedLocation(bucket, key, codec)
+
+	// Upload to S3
+	opts := entity.UploadOptions{Metadata: archiveMetadata(manifest, manifestFile, sourceETag, codec), ContentType: codecContentType(codec), Storage: storage}
+	compressed, err := output.reader()
+	if err != nil {
+		return nil, nil, err, true
 	}
+	// read twice when encrypted, the key is derived from the archive
+	if err := c.archives.Put(ctx, compressedBucket, compressedKey, compressed, opts); err != nil {
+		return nil, nil, err, true
+	}
+	c.removeOtherCodecs(ctx, bucket, key, codec)
+
+	return manifest, members, nil, false
+}
 
+// removeOtherCodecs deletes the archives of a source object compressed with other
+// codecs than codec before, so they are not read in place of the new one.
+func (c *CompressionUsecase) removeOtherCodecs(ctx context.Context, bucket, key, codec string) {
+	for _, other := range archiveCodecs {
+		if other == codec {
+			continue
+		}
+		compressedBucket, compressedKey := compressedLocation(bucket, key, other)
+		if err := c.StorageRepo.DeleteObject(ctx, compressedBucket, compressedKey); err != nil && !isNotFound(err) {
+			c.l.Error("Failed to delete %s archive %s - %s : %v", other, compressedBucket, compressedKey, err)
+		}
+	}
+}
+
+// buildArchive extracts and transcodes the tar r and writes the compressed archive
+// to w. It returns the manifest, the manifest member and the probed metadata of
+// every audio member.
+func (c *CompressionUsecase) buildArchive(ctx context.Context, bucket, key, tier, codec string, level int, r io.Reader, w io.Writer) (*entity.Manifest, entity.FileObject, []entity.AudioMember, error, bool) {
 	// Extract
-	c.l.Debug("Extracting object")
-	files, err := c.compressedArchiever.Extract(ctx, sourceBuffer)
+	files, err := c.uncompressedArchiever.Extract(ctx, r)
 	if err != nil {
-		return "", err
+		return nil, entity.FileObject{}, nil, err, false
 	}
 
-	var newFiles []entity.FileObject
-	// ctx := context.TODO()
-
-	// Convert wav to flac
-	c.l.Debug("Walk the files...")
-	for _, file := range files {
-		newFiles = append(newFiles, file)
+	results, err := c.transcodeMembers(ctx, bucket, key, tier, files)
+	if err != nil {
+		return nil, entity.FileObject{}, nil, err, false
 	}
 
-	// Compress to tar gz
-	if err := c.uncompressedArchiever.Compress(ctx, newFiles, outputBuffer); err != nil {
-		return "", err
+	var newFiles []entity.FileObject
+	var members []entity.AudioMember
+	var entries []entity.ManifestEntry
+	for _, result := range results {
+		newFiles = append(newFiles, result.stored)
+		entries = append(entries, result.entry)
+		if result.member != nil {
+			members = append(members, *result.member)
+		}
 	}
 
-	// Put decompression result to tempfile
-	filePath, err := c.PutToTempFile(ctx, outputBuffer)
+	// Embed manifest as the first member
+	manifest := newManifest(bucket, key, entries)
+	manifestFile, err := buildManifestFile(manifest)
 	if err != nil {
-		return "", err
+		return nil, entity.FileObject{}, nil, err, false
+	}
+	newFiles = append([]entity.FileObject{manifestFile}, newFiles...)
+
+	// Compress to tar gz, or tar zst with zstd
+	if err := archive.WithCodec(c.compressedArchiever, codec, level).Compress(ctx, newFiles, w); err != nil {
+		return nil, entity.FileObject{}, nil, err, true
 	}
 
-	return filePath, nil
+	return manifest, manifestFile, members, nil, false
 }
 
-func (c *CompressionUsecase) isKeyExtensionValid(key, ext string) bool {
-	fileExtension := filepath.Ext(key)
-	if fileExtension != ext {
-		return false
+// DoDecompression restores the original archive and stores it in the result cache.
+// With a shared cache the result is taken from, or published to, the shared tier.
+func (c *CompressionUsecase) DoDecompression(ctx context.Context, bucket, key, etag string) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "DoDecompression")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("bucket", bucket))
+	span.SetAttributes(attribute.String("key", key))
+
+	if !isKeyExtensionValid(key, ".tar") {
+		return errors.New("Invalid file extension")
 	}
-	return true
+	defer c.gate.enter()()
+
+	outputBuffer := new(bytes.Buffer)
+	if c.shared == nil {
+		if err := c.decompress(ctx, bucket, key, etag, outputBuffer); err != nil {
+			return err
+		}
+	} else if err := c.decompressShared(ctx, bucket, key, etag, outputBuffer); err != nil {
+		return err
+	}
+
+	// Put decompression result to the cache
+	return c.cache.Put(ctx, bucket, key, etag, outputBuffer)
 }
 
-func (cr *CompressionUsecase) PutToTempFile(ctx context.Context, r io.Reader) (string, error) {
-	ctx, span := otel.Tracer(traceName).Start(ctx, "PutToTempFile")
-	defer span.End()
+// decompress downloads the compressed archive and writes the restored tar to w.
+// Unless etag is empty, the archive has to have that ETag.
+func (c *CompressionUsecase) decompress(ctx context.Context, bucket, key, etag string, w io.Writer) error {
+	compressedBucket, compressedKey, _, err := findCompressed(ctx, c.StorageRepo, bucket, key)
+	if err != nil {
+		return err
+	}
 
-	// Put to tempfile
-	f, err := os.CreateTemp(".", "decompressed_audio_*.tar")
+	// Download from s3, streamed into the extraction
+	c.l.Debug("Downloading object from S3")
+	r, info, err := c.archives.Open(ctx, compressedBucket, compressedKey)
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer r.Close()
+	if etag != "" && info.ETag != etag {
+		return entity.ErrArchiveChanged
 	}
-	defer f.Close()
 
-	body, err := ioutil.ReadAll(r)
+	return c.restoreArchive(ctx, r, info.Metadata, w)
+}
+
+// restoreArchive writes the tar a compressed archive was built from to w. The
+// manifest is checked against metadata, if that records one.
+func (c *CompressionUsecase) restoreArchive(ctx context.Context, r io.Reader, metadata map[string]string, w io.Writer) error {
+	manifest, files, err := c.extractArchive(ctx, r, metadata)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	filePath := f.Name()
+	var newFiles []entity.FileObject
+
+	// Convert members back to their source format
+	c.l.Debug("Walk the files...")
+	for i, file := range files {
+		var entry *entity.ManifestEntry
+		if manifest != nil && len(manifest.Entries) == len(files) {
+			entry = &manifest.Entries[i]
+		}
 
-	if _, err := f.Write(body); err != nil {
-		return "", err
+		restored, err := c.restore(ctx, file, entry)
+		if err != nil {
+			return err
+		}
+		newFiles = append(newFiles, restored)
 	}
 
-	return filePath, nil
+	// Compress to tar
+	return c.uncompressedArchiever.Compress(ctx, newFiles, w)
+}
+
+// extractArchive returns the manifest and the other members of a compressed archive.
+func (c *CompressionUsecase) extractArchive(ctx context.Context, r io.Reader, metadata map[string]string) (*entity.Manifest, []entity.FileObject, error) {
+	// Extract
+	c.l.Debug("Extracting object")
+	files, err := c.compressedArchiever.Extract(ctx, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkManifest(files, metadata); err != nil {
+		return nil, nil, err
+	}
+	return splitManifest(files)
+}
+
+// isNotFound reports whether a storage error is a 404 from S3.
+func isNotFound(err error) bool {
+	var responseError *awshttp.ResponseError
+	return errors.As(err, &responseError) && responseError.ResponseError.HTTPStatusCode() == http.StatusNotFound
+}
+
+func isKeyExtensionValid(key, ext string) bool {
+	fileExtension := filepath.Ext(key)
+	if fileExtension != ext {
+		return false
+	}
+	return true
 }
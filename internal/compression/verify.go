@@ -0,0 +1,104 @@
+package compression
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/audio_converter"
+)
+
+// ErrRoundTripMismatch is matched by every RoundTripError.
+var ErrRoundTripMismatch = errors.New("audio round trip mismatch")
+
+// RoundTripError fails a job whose converted member does not decode back to the
+// samples it was made from.
+type RoundTripError struct {
+	Member string
+	Reason string
+}
+
+func (e *RoundTripError) Error() string {
+	return fmt.Sprintf("%v: %s: %s", ErrRoundTripMismatch, e.Member, e.Reason)
+}
+
+func (e *RoundTripError) Unwrap() error {
+	return ErrRoundTripMismatch
+}
+
+// verify decodes a member stored by an exact policy and compares its samples with
+// the source before the archive is uploaded. Lossy and copied members are skipped.
+func (c *CompressionUsecase) verify(ctx context.Context, source, stored entity.FileObject, info *audio_converter.AudioInfo, policy entity.ConversionPolicy) error {
+	if policy.Target == audio_converter.TargetCopy || !audio_converter.IsExact(policy) {
+		return nil
+	}
+
+	ctx, span := otel.Tracer(traceName).Start(ctx, "verify")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("member", source.Name))
+
+	reason := c.compareRoundTrip(ctx, source, stored, info, policy)
+	if err := ctx.Err(); err != nil {
+		// a cancelled decode says nothing about the stored member
+		return err
+	}
+	if reason != "" {
+		err := &RoundTripError{Member: source.Name, Reason: reason}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, reason)
+		roundTripCounter.Add(ctx, 1, roundTripResultKey.String("mismatch"))
+		return err
+	}
+
+	roundTripCounter.Add(ctx, 1, roundTripResultKey.String("ok"))
+	return nil
+}
+
+// compareRoundTrip returns why the stored member differs from the source, or an
+// empty string when the samples match.
+func (c *CompressionUsecase) compareRoundTrip(ctx context.Context, source, stored entity.FileObject, info *audio_converter.AudioInfo, policy entity.ConversionPolicy) string {
+	sourcePCM, err := audio_converter.PCMData(source.Body, info)
+	if err != nil {
+		return fmt.Sprintf("read source samples: %v", err)
+	}
+
+	from, _ := audio_converter.TargetFormat(policy)
+	var buf bytes.Buffer
+	if err := c.converter.Convert(ctx, bytes.NewReader(stored.Body), &buf, from, info.SourceFormat()); err != nil {
+		return fmt.Sprintf("decode %s: %v", policy.Target, err)
+	}
+
+	var restored *audio_converter.AudioInfo
+	if info.Format == "raw" {
+		restored, err = audio_converter.ProbeRaw(buf.Bytes(), info.Codec, info.SampleRate, info.Channels)
+	} else {
+		restored, err = audio_converter.Probe(buf.Bytes())
+	}
+	if err != nil {
+		return fmt.Sprintf("probe decoded %s: %v", policy.Target, err)
+	}
+	if restored.Codec != info.Codec || restored.SampleRate != info.SampleRate || restored.Channels != info.Channels {
+		return fmt.Sprintf("decoded %s %d Hz %d ch, source %s %d Hz %d ch",
+			restored.Codec, restored.SampleRate, restored.Channels, info.Codec, info.SampleRate, info.Channels)
+	}
+
+	restoredPCM, err := audio_converter.PCMData(buf.Bytes(), restored)
+	if err != nil {
+		return fmt.Sprintf("read decoded samples: %v", err)
+	}
+	if len(restoredPCM) != len(sourcePCM) {
+		return fmt.Sprintf("decoded %d sample bytes, source %d", len(restoredPCM), len(sourcePCM))
+	}
+	if sha256.Sum256(restoredPCM) != sha256.Sum256(sourcePCM) {
+		return "decoded samples differ from the source"
+	}
+	return ""
+}
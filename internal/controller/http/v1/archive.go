@@ -0,0 +1,219 @@
+package v1
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/auth"
+	"audio_compression/pkg/logger"
+)
+
+const entriesSuffix = "/entries"
+
+var errUploadTooLarge = errors.New("upload too large")
+
+type archiveRoutes struct {
+	au             entity.ArchiveUsecase
+	uu             entity.UploadUsecase
+	qu             entity.QuotaUsecase
+	a              *auth.Auth
+	l              logger.Interface
+	maxUploadBytes int64
+}
+
+func newArchiveRoutes(handler *gin.RouterGroup, au entity.ArchiveUsecase, uu entity.UploadUsecase, qu entity.QuotaUsecase, a *auth.Auth, l logger.Interface, maxUploadBytes int64) {
+	r := &archiveRoutes{au, uu, qu, a, l, maxUploadBytes}
+
+	h := handler.Group("/archives")
+	{
+		h.GET("/:bucket/*key", r.get)
+		h.POST("/:bucket/*key", r.upload)
+	}
+}
+
+// get dispatches on the key suffix since a catch-all parameter must end the route.
+func (r *archiveRoutes) get(cu *gin.Context) {
+	key := cu.Param("key")
+	if strings.HasSuffix(key, entriesSuffix) {
+		r.entries(cu, strings.TrimSuffix(key, entriesSuffix))
+		return
+	}
+
+	errorResponse(cu, http.StatusNotFound, "not found")
+}
+
+// @Summary     List archive entries
+// @Description List members of a compressed archive without decompressing it
+// @ID          archive-entries
+// @Tags  	    archive
+// @Produce     json
+// @Success     200 {object} entity.Manifest
+// @Failure     401 {object} response
+// @Failure     403 {object} response
+// @Failure     404 {object} response
+// @Failure     409 {object} response
+// @Failure     500 {object} response
+// @Router      /archives/{bucket}/{key}/entries [get]
+func (r *archiveRoutes) entries(cu *gin.Context, key string) {
+	ctx, span := otel.Tracer(traceName).Start(cu, "entries-api")
+	defer span.End()
+
+	bucket := cu.Param("bucket")
+	if !authorize(cu, r.a, auth.ActionRead, bucket, key) {
+		return
+	}
+
+	manifest, err := r.au.ListEntries(ctx, bucket, key)
+	if err != nil {
+		r.l.Error(err, "http - v1 - entries")
+		if errors.Is(err, entity.ErrArchiveNotFound) {
+			errorResponse(cu, http.StatusNotFound, "archive not found")
+			return
+		}
+		if errors.Is(err, entity.ErrArchiveInColdStorage) {
+			errorResponse(cu, http.StatusConflict, err.Error())
+			return
+		}
+		errorResponse(cu, http.StatusInternalServerError, "failed to list archive entries")
+		return
+	}
+
+	cu.JSON(http.StatusOK, manifest)
+}
+
+// @Summary     Upload archive
+// @Description Compress a tar sent as the request body, or as the file of a multipart form,
+// @Description and store only the compressed archive
+// @ID          archive-upload
+// @Tags  	    archive
+// @Accept      application/x-tar
+// @Accept      multipart/form-data
+// @Produce     json
+// @Param       tier query string false "conversion policy tier, e.g. cold"
+// @Param       level query int false "gzip level from 1 to 9"
+// @Param       sse query string false "AES256 or aws:kms, the configured default when empty"
+// @Param       kms_key_id query string false "KMS key of aws:kms"
+// @Param       storage_class query string false "storage class, e.g. GLACIER_IR or DEEP_ARCHIVE"
+// @Param       tag query []string false "object tag as key:value" collectionFormat(multi)
+// @Success     201 {object} entity.Manifest
+// @Failure     400 {object} response
+// @Failure     401 {object} response
+// @Failure     403 {object} response
+// @Failure     413 {object} response
+// @Failure     422 {object} response
+// @Failure     429 {object} response
+// @Failure     500 {object} response
+// @Router      /archives/{bucket}/{key} [post]
+func (r *archiveRoutes) upload(cu *gin.Context) {
+	ctx, span := otel.Tracer(traceName).Start(cu, "upload-api")
+	defer span.End()
+
+	bucket := cu.Param("bucket")
+	key := cu.Param("key")
+	if !authorize(cu, r.a, auth.ActionCompress, bucket, key) {
+		return
+	}
+	if path.Ext(key) != ".tar" {
+		errorResponse(cu, http.StatusBadRequest, "key must end in .tar")
+		return
+	}
+	storage, err := parseStorageOptions(cu)
+	if err != nil {
+		errorResponse(cu, http.StatusBadRequest, err.Error())
+		return
+	}
+	level, ok := parseLevel(cu.Query("level"))
+	if !ok {
+		errorResponse(cu, http.StatusBadRequest, "level must be 1 to 9")
+		return
+	}
+
+	// a body of unknown length is counted at the largest size it may have
+	size := cu.Request.ContentLength
+	if size < 0 || size > r.maxUploadBytes {
+		size = r.maxUploadBytes
+	}
+	jobID, err := r.qu.AdmitUpload(ctx, principal(cu).Tenant, bucket, key, size)
+	if err != nil {
+		if errors.Is(err, entity.ErrQuotaExceeded) {
+			errorResponse(cu, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		r.l.Error(err, "http - v1 - upload")
+		errorResponse(cu, http.StatusInternalServerError, "failed to compress upload")
+		return
+	}
+
+	var body io.Reader = &limitedReader{cu.Request.Body, r.maxUploadBytes}
+	if mediaType, params, _ := mime.ParseMediaType(cu.GetHeader("Content-Type")); mediaType == "multipart/form-data" {
+		part, err := filePart(multipart.NewReader(body, params["boundary"]))
+		if err != nil {
+			r.qu.CancelJob(ctx, jobID)
+			errorResponse(cu, http.StatusBadRequest, "multipart form has no file")
+			return
+		}
+		body = part
+	}
+
+	manifest, err := r.uu.CompressUpload(ctx, jobID, bucket, key, cu.Query("tier"), level, storage, body)
+	if err != nil {
+		r.l.Error(err, "http - v1 - upload")
+		if errors.Is(err, errUploadTooLarge) {
+			errorResponse(cu, http.StatusRequestEntityTooLarge, "upload too large")
+			return
+		}
+		if errors.Is(err, entity.ErrUnsafeArchive) {
+			errorResponse(cu, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		errorResponse(cu, http.StatusInternalServerError, "failed to compress upload")
+		return
+	}
+
+	cu.JSON(http.StatusCreated, manifest)
+}
+
+// filePart returns the first file of a multipart form.
+func filePart(mr *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// limitedReader fails with errUploadTooLarge instead of truncating the upload.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.remaining <= 0 {
+		// an upload of exactly the limit still ends cleanly
+		var probe [1]byte
+		if n, err := lr.r.Read(probe[:]); n == 0 && err != nil {
+			return 0, err
+		}
+		return 0, errUploadTooLarge
+	}
+	if int64(len(p)) > lr.remaining {
+		p = p[:lr.remaining]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	return n, err
+}
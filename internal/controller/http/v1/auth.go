@@ -0,0 +1,76 @@
+package v1
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"audio_compression/pkg/auth"
+	"audio_compression/pkg/logger"
+)
+
+const (
+	principalKey = "principal"
+	auditKey     = "audit"
+)
+
+// authenticate rejects requests without valid credentials and writes every request
+// to the audit log once it is answered.
+func authenticate(a *auth.Auth, audit *auth.AuditLog, l logger.Interface) gin.HandlerFunc {
+	return func(cu *gin.Context) {
+		start := time.Now()
+		record := &auth.AuditRecord{
+			Time:       start.UTC(),
+			RemoteAddr: cu.ClientIP(),
+			Method:     cu.Request.Method,
+			Path:       cu.Request.URL.Path,
+		}
+		cu.Set(auditKey, record)
+
+		p, err := a.Authenticate(cu.Request)
+		if err != nil {
+			record.Error = err.Error()
+			cu.Header("WWW-Authenticate", `Bearer realm="audio_compression"`)
+			errorResponse(cu, http.StatusUnauthorized, "unauthenticated")
+		} else {
+			record.Tenant, record.Subject, record.AuthMethod = p.Tenant, p.Subject, p.Method
+			cu.Set(principalKey, p)
+			cu.Next()
+		}
+
+		record.Status = cu.Writer.Status()
+		record.Duration = time.Since(start).Seconds()
+		if err := audit.Record(*record); err != nil {
+			l.Error(err, "http - v1 - audit")
+		}
+	}
+}
+
+// principal returns the caller authenticated for the request.
+func principal(cu *gin.Context) *auth.Principal {
+	if v, ok := cu.Get(principalKey); ok {
+		return v.(*auth.Principal)
+	}
+	return &auth.Principal{Method: auth.MethodAnonymous}
+}
+
+// authorize answers 403 unless the principal of the request may perform action on
+// the key of bucket.
+func authorize(cu *gin.Context, a *auth.Auth, action auth.Action, bucket, key string) bool {
+	if !allowed(cu, a, action, bucket, key) {
+		errorResponse(cu, http.StatusForbidden, "forbidden")
+		return false
+	}
+	return true
+}
+
+// allowed records the action in the audit log and reports whether the principal
+// may take it, leaving the response to the caller.
+func allowed(cu *gin.Context, a *auth.Auth, action auth.Action, bucket, key string) bool {
+	if v, ok := cu.Get(auditKey); ok {
+		record := v.(*auth.AuditRecord)
+		record.Action, record.Bucket, record.Key = action, bucket, key
+	}
+	return a.Allowed(principal(cu), action, bucket, key)
+}
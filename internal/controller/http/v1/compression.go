@@ -1,14 +1,22 @@
 package v1
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel"
 
 	"audio_compression/entity"
+	"audio_compression/pkg/auth"
 	"audio_compression/pkg/logger"
 	// "github.com/evrone/go-clean-template/internal/entity"
 	// "github.com/evrone/go-clean-template/internal/usecase"
@@ -16,17 +24,22 @@ import (
 )
 
 type compressionRoutes struct {
-	cu entity.CompressionUsecase
-	l  logger.Interface
+	cu         entity.CompressionUsecase
+	au         entity.ArchiveUsecase
+	qu         entity.QuotaUsecase
+	a          *auth.Auth
+	l          logger.Interface
+	syncBudget time.Duration
+	basePath   string
 }
 
-func newCompressionRoutes(handler *gin.RouterGroup, cu entity.CompressionUsecase, l logger.Interface) {
-	r := &compressionRoutes{cu, l}
-
+func newCompressionRoutes(handler *gin.RouterGroup, cu entity.CompressionUsecase, au entity.ArchiveUsecase, qu entity.QuotaUsecase, a *auth.Auth, l logger.Interface, syncBudget time.Duration) {
 	h := handler.Group("/compression")
+	r := &compressionRoutes{cu, au, qu, a, l, syncBudget, h.BasePath()}
 	{
 		h.GET("/compress/:bucket/*key", r.compress)
 		h.GET("/decompress/:bucket/*key", r.decompress)
+		h.GET("/jobs/:id", r.job)
 	}
 }
 
@@ -36,7 +49,19 @@ func newCompressionRoutes(handler *gin.RouterGroup, cu entity.CompressionUsecase
 // @Tags  	    compress
 // @Produce     json
 // @Success     200
+// @Failure     400
+// @Failure     401
+// @Failure     403
+// @Failure     404
+// @Failure     429
 // @Failure     500
+// @Param       tier query string false "conversion policy tier, e.g. cold"
+// @Param       priority query string false "batch (default) or interactive"
+// @Param       level query int false "gzip level from 1 to 9"
+// @Param       sse query string false "AES256 or aws:kms, the configured default when empty"
+// @Param       kms_key_id query string false "KMS key of aws:kms"
+// @Param       storage_class query string false "storage class, e.g. GLACIER_IR or DEEP_ARCHIVE"
+// @Param       tag query []string false "object tag as key:value" collectionFormat(multi)
 // @Router      /compress/:bucket/*key [get]
 func (r *compressionRoutes) compress(cu *gin.Context) {
 	ctx, span := otel.Tracer(traceName).Start(cu, "compress-api")
@@ -44,8 +69,48 @@ func (r *compressionRoutes) compress(cu *gin.Context) {
 
 	bucket := cu.Param("bucket")
 	key := cu.Param("key")
-	err := r.cu.PlanCompression(ctx, bucket, key)
+	tier := cu.Query("tier")
+	if !authorize(cu, r.a, auth.ActionCompress, bucket, key) {
+		return
+	}
+	if path.Ext(key) != ".tar" {
+		errorResponse(cu, http.StatusBadRequest, "key must end in .tar")
+		return
+	}
+	priority, ok := parsePriority(cu.Query("priority"))
+	if !ok {
+		errorResponse(cu, http.StatusBadRequest, "priority must be batch or interactive")
+		return
+	}
+	storage, err := parseStorageOptions(cu)
+	if err != nil {
+		errorResponse(cu, http.StatusBadRequest, err.Error())
+		return
+	}
+	level, ok := parseLevel(cu.Query("level"))
+	if !ok {
+		errorResponse(cu, http.StatusBadRequest, "level must be 1 to 9")
+		return
+	}
+
+	jobID, err := r.qu.AdmitCompression(ctx, principal(cu).Tenant, bucket, key)
+	if err != nil {
+		if errors.Is(err, entity.ErrQuotaExceeded) {
+			errorResponse(cu, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		if errors.Is(err, entity.ErrArchiveNotFound) {
+			errorResponse(cu, http.StatusNotFound, "object not found")
+			return
+		}
+		r.l.Error(err, "http - v1 - compress")
+		errorResponse(cu, http.StatusInternalServerError, "failed to plan compression")
+		return
+	}
+
+	err = r.cu.PlanCompression(ctx, jobID, bucket, key, tier, entity.CodecGzip, level, priority, storage)
 	if err != nil {
+		r.qu.CancelJob(ctx, jobID)
 		r.l.Error(err, "http - v1 - compress")
 		errorResponse(cu, http.StatusInternalServerError, "failed to plan compression")
 		return
@@ -54,29 +119,200 @@ func (r *compressionRoutes) compress(cu *gin.Context) {
 	cu.JSON(http.StatusOK, "{'status':'OK'}")
 }
 
-// @Summary     Show history
-// @Description Show all translation history
-// @ID          history
-// @Tags  	    translation
-// @Produce     file
+// @Summary     download decompression
+// @Description download the restored archive, with range and conditional request support.
+// @Description With async=true, or when the archive is not ready within the sync budget,
+// @Description 202 Accepted is returned with the job to poll in the Location header.
+// @ID          decompression
+// @Tags  	    compress
+// @Produce     application/x-tar
+// @Param       async query bool false "return 202 Accepted right away"
 // @Success     200
+// @Success     202 {object} entity.DecompressionJob
+// @Success     206
+// @Success     304
+// @Failure     401
+// @Failure     403
+// @Failure     404
 // @Failure     500
-// @Router      /compress/:bucket/*key [get]
+// @Router      /decompress/:bucket/*key [get]
 func (r *compressionRoutes) decompress(cu *gin.Context) {
 	ctx, span := otel.Tracer(traceName).Start(cu, "decompress-api")
 	defer span.End()
 
 	bucket := cu.Param("bucket")
 	key := cu.Param("key")
+	if !authorize(cu, r.a, auth.ActionRead, bucket, key) {
+		return
+	}
 
-	content, err := r.cu.GetDecompression(ctx, bucket, key)
+	info, err := r.au.StatArchive(ctx, bucket, key)
 	if err != nil {
+		if errors.Is(err, entity.ErrArchiveNotFound) {
+			errorResponse(cu, http.StatusNotFound, "archive not found")
+			return
+		}
 		r.l.Error(err, "http - v1 - decompress")
 		errorResponse(cu, http.StatusInternalServerError, "failed to get decompression")
 		return
 	}
 
-	contentReader := bytes.NewReader(content)
+	// The restored archive is fully determined by the compressed one
+	etag := `"` + info.ETag + `-tar"`
+	name := path.Base(key)
+	cu.Header("ETag", etag)
+	cu.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	if notModified(cu.Request, etag, info.LastModified) {
+		cu.Header("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+		cu.Status(http.StatusNotModified)
+		return
+	}
+	if info.NeedsRestore() {
+		errorResponse(cu, http.StatusConflict, entity.ErrArchiveInColdStorage.Error())
+		return
+	}
 
-	http.ServeContent(cu.Writer, cu.Request, key, time.Now(), contentReader)
+	if cu.Query("async") == "true" || strings.Contains(cu.GetHeader("Prefer"), "respond-async") {
+		r.startDecompression(ctx, cu, bucket, key, info.ETag)
+		return
+	}
+
+	budgetCtx, cancel := context.WithTimeout(ctx, r.syncBudget)
+	defer cancel()
+
+	content, err := r.cu.GetDecompression(budgetCtx, bucket, key, info.ETag)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		r.startDecompression(ctx, cu, bucket, key, info.ETag)
+		return
+	}
+	if err != nil {
+		r.l.Error(err, "http - v1 - decompress")
+		errorResponse(cu, http.StatusInternalServerError, "failed to get decompression")
+		return
+	}
+	defer content.Close()
+
+	http.ServeContent(cu.Writer, cu.Request, name, info.LastModified, content)
+}
+
+// startDecompression answers 202 Accepted with the job to poll.
+func (r *compressionRoutes) startDecompression(ctx context.Context, cu *gin.Context, bucket, key, etag string) {
+	job, err := r.cu.StartDecompression(ctx, bucket, key, etag)
+	if err != nil {
+		r.l.Error(err, "http - v1 - decompress")
+		errorResponse(cu, http.StatusInternalServerError, "failed to start decompression")
+		return
+	}
+
+	cu.Header("Location", r.basePath+"/jobs/"+job.ID)
+	cu.Header("Retry-After", "5")
+	cu.JSON(http.StatusAccepted, job)
+}
+
+// @Summary     decompression job
+// @Description poll an asynchronous decompression, redirects to the download once it succeeded
+// @ID          decompression-job
+// @Tags  	    compress
+// @Produce     json
+// @Param       id path string true "job ID"
+// @Success     200 {object} entity.DecompressionJob
+// @Success     303
+// @Failure     401
+// @Failure     404
+// @Router      /jobs/{id} [get]
+func (r *compressionRoutes) job(cu *gin.Context) {
+	ctx, span := otel.Tracer(traceName).Start(cu, "decompression-job-api")
+	defer span.End()
+
+	job, err := r.cu.GetDecompressionJob(ctx, cu.Param("id"))
+	if err != nil && !errors.Is(err, entity.ErrJobNotFound) {
+		r.l.Error(err, "http - v1 - job")
+		errorResponse(cu, http.StatusInternalServerError, "failed to get job")
+		return
+	}
+	// jobs of objects the caller may not read are not found either, so that
+	// job IDs do not reveal whether they exist
+	if err != nil || !allowed(cu, r.a, auth.ActionRead, job.Bucket, job.Key) {
+		errorResponse(cu, http.StatusNotFound, "job not found")
+		return
+	}
+
+	switch job.Status {
+	case entity.JobStatusSucceeded:
+		download := url.URL{Path: r.basePath + "/decompress/" + job.Bucket + "/" + strings.TrimPrefix(job.Key, "/")}
+		cu.Redirect(http.StatusSeeOther, download.String())
+	case entity.JobStatusRunning:
+		cu.Header("Retry-After", "5")
+		cu.JSON(http.StatusOK, job)
+	default:
+		cu.JSON(http.StatusOK, job)
+	}
+}
+
+// parsePriority maps the priority parameter of compressions, which default to batch.
+func parsePriority(s string) (uint8, bool) {
+	switch s {
+	case "", "batch":
+		return entity.PriorityBatch, true
+	case "interactive":
+		return entity.PriorityInteractive, true
+	}
+	return 0, false
+}
+
+// parseLevel maps the gzip level parameter, zero keeps the default.
+func parseLevel(s string) (int, bool) {
+	if s == "" {
+		return 0, true
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 1 || level > 9 {
+		return 0, false
+	}
+	return level, true
+}
+
+// parseStorageOptions reads how the compressed archive is stored from the query.
+func parseStorageOptions(cu *gin.Context) (entity.StorageOptions, error) {
+	opts := entity.StorageOptions{
+		SSE:          cu.Query("sse"),
+		KMSKeyID:     cu.Query("kms_key_id"),
+		StorageClass: cu.Query("storage_class"),
+	}
+	for _, tag := range cu.QueryArray("tag") {
+		k, v, ok := strings.Cut(tag, ":")
+		if !ok {
+			return opts, fmt.Errorf("tag %q must be key:value", tag)
+		}
+		if opts.Tags == nil {
+			opts.Tags = make(map[string]string)
+		}
+		opts.Tags[k] = v
+	}
+	return opts, opts.Validate()
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since without it, so cached
+// copies are confirmed before the archive is decompressed.
+func notModified(req *http.Request, etag string, lastModified time.Time) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ims)
 }
@@ -0,0 +1,49 @@
+package v1
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/logger"
+)
+
+type quotaRoutes struct {
+	qu entity.QuotaUsecase
+	l  logger.Interface
+}
+
+func newQuotaRoutes(handler *gin.RouterGroup, qu entity.QuotaUsecase, l logger.Interface) {
+	r := &quotaRoutes{qu, l}
+
+	h := handler.Group("/quota")
+	{
+		h.GET("", r.usage)
+	}
+}
+
+// @Summary     Quota usage
+// @Description Active jobs and bytes compressed today by the tenant of the caller, with its limits.
+// @Description Zero limits are unlimited.
+// @ID          quota
+// @Tags  	    quota
+// @Produce     json
+// @Success     200 {object} entity.QuotaUsage
+// @Failure     401 {object} response
+// @Failure     500 {object} response
+// @Router      /quota [get]
+func (r *quotaRoutes) usage(cu *gin.Context) {
+	ctx, span := otel.Tracer(traceName).Start(cu, "quota-api")
+	defer span.End()
+
+	usage, err := r.qu.GetUsage(ctx, principal(cu).Tenant)
+	if err != nil {
+		r.l.Error(err, "http - v1 - quota")
+		errorResponse(cu, http.StatusInternalServerError, "failed to get quota usage")
+		return
+	}
+
+	cu.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,33 @@
+package v1
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/auth"
+	"audio_compression/pkg/ratelimit"
+)
+
+// rateLimit answers 429 once the caller used up its token bucket. Callers are told
+// apart by API key or token subject, anonymous callers by address.
+func rateLimit(limiter *ratelimit.Limiter, qu entity.QuotaUsecase) gin.HandlerFunc {
+	return func(cu *gin.Context) {
+		p := principal(cu)
+		caller := p.Method + ":" + p.Tenant + ":" + p.Subject
+		if p.Method == auth.MethodAnonymous {
+			caller = p.Method + ":" + cu.ClientIP()
+		}
+
+		rate, burst := qu.RequestRate(p.Tenant)
+		if ok, retryAfter := limiter.Allow(caller, rate, burst); !ok {
+			cu.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			errorResponse(cu, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		cu.Next()
+	}
+}
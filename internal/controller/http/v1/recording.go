@@ -0,0 +1,129 @@
+package v1
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+
+	"audio_compression/entity"
+	"audio_compression/pkg/auth"
+	"audio_compression/pkg/logger"
+)
+
+type recordingRoutes struct {
+	ru entity.RecordingUsecase
+	a  *auth.Auth
+	l  logger.Interface
+}
+
+func newRecordingRoutes(handler *gin.RouterGroup, ru entity.RecordingUsecase, a *auth.Auth, l logger.Interface) {
+	r := &recordingRoutes{ru, a, l}
+
+	h := handler.Group("/recordings")
+	{
+		h.GET("", r.search)
+	}
+}
+
+type recordingsResponse struct {
+	Recordings []entity.AudioMember `json:"recordings"`
+}
+
+// @Summary     Search recordings
+// @Description Search audio members of compressed archives by their probed metadata.
+// @Description Durations accept seconds ("600") or Go durations ("10m").
+// @ID          recordings
+// @Tags  	    recording
+// @Produce     json
+// @Param       bucket       query string false "bucket"
+// @Param       prefix       query string false "archive key prefix"
+// @Param       codec        query string false "codec, e.g. pcm_s16le"
+// @Param       min_duration query string false "minimum duration"
+// @Param       max_duration query string false "maximum duration"
+// @Param       sample_rate  query int    false "sample rate"
+// @Param       channels     query int    false "channels"
+// @Param       limit        query int    false "page size"
+// @Param       offset       query int    false "page offset"
+// @Success     200 {object} recordingsResponse
+// @Failure     400 {object} response
+// @Failure     401 {object} response
+// @Failure     403 {object} response
+// @Failure     500 {object} response
+// @Router      /recordings [get]
+func (r *recordingRoutes) search(cu *gin.Context) {
+	ctx, span := otel.Tracer(traceName).Start(cu, "recordings-api")
+	defer span.End()
+
+	query, err := parseRecordingQuery(cu)
+	if err != nil {
+		errorResponse(cu, http.StatusBadRequest, err.Error())
+		return
+	}
+	// tenants limited to some buckets or prefixes have to search within them
+	if !authorize(cu, r.a, auth.ActionRead, query.Bucket, query.Prefix) {
+		return
+	}
+
+	recordings, err := r.ru.SearchRecordings(ctx, query)
+	if err != nil {
+		r.l.Error(err, "http - v1 - recordings")
+		errorResponse(cu, http.StatusInternalServerError, "failed to search recordings")
+		return
+	}
+
+	cu.JSON(http.StatusOK, recordingsResponse{recordings})
+}
+
+func parseRecordingQuery(cu *gin.Context) (entity.RecordingQuery, error) {
+	query := entity.RecordingQuery{
+		Bucket: cu.Query("bucket"),
+		Prefix: cu.Query("prefix"),
+		Codec:  cu.Query("codec"),
+	}
+
+	var err error
+	if query.MinDuration, err = parseSeconds(cu.Query("min_duration")); err != nil {
+		return query, err
+	}
+	if query.MaxDuration, err = parseSeconds(cu.Query("max_duration")); err != nil {
+		return query, err
+	}
+	if query.SampleRate, err = parseInt(cu.Query("sample_rate")); err != nil {
+		return query, err
+	}
+	if query.Channels, err = parseInt(cu.Query("channels")); err != nil {
+		return query, err
+	}
+	if query.Limit, err = parseInt(cu.Query("limit")); err != nil {
+		return query, err
+	}
+	if query.Offset, err = parseInt(cu.Query("offset")); err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+func parseSeconds(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return seconds, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return d.Seconds(), nil
+}
+
+func parseInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
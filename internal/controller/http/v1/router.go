@@ -3,8 +3,11 @@ package v1
 
 import (
 	"audio_compression/entity"
+	"audio_compression/pkg/auth"
 	"audio_compression/pkg/logger"
+	"audio_compression/pkg/ratelimit"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -21,7 +24,7 @@ import (
 // @version     1.0
 // @host        localhost:8080
 // @BasePath    /v1
-func NewRouter(handler *gin.Engine, l logger.Interface, cu entity.CompressionUsecase) {
+func NewRouter(handler *gin.Engine, l logger.Interface, a *auth.Auth, audit *auth.AuditLog, cu entity.CompressionUsecase, au entity.ArchiveUsecase, uu entity.UploadUsecase, ru entity.RecordingUsecase, qu entity.QuotaUsecase, syncBudget time.Duration, maxUploadBytes int64) {
 	// Options
 	handler.Use(gin.Logger())
 	handler.Use(gin.Recovery())
@@ -37,8 +40,11 @@ func NewRouter(handler *gin.Engine, l logger.Interface, cu entity.CompressionUse
 	handler.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	// Routers
-	h := handler.Group("/v1")
+	h := handler.Group("/v1", authenticate(a, audit, l), rateLimit(ratelimit.New(), qu))
 	{
-		newCompressionRoutes(h, cu, l)
+		newCompressionRoutes(h, cu, au, qu, a, l, syncBudget)
+		newArchiveRoutes(h, au, uu, qu, a, l, maxUploadBytes)
+		newRecordingRoutes(h, ru, a, l)
+		newQuotaRoutes(h, qu, l)
 	}
 }
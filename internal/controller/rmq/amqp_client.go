@@ -3,16 +3,19 @@ package rmq
 import (
 	"audio_compression/config"
 	"audio_compression/entity"
+	"audio_compression/internal/compression"
 	"audio_compression/pkg/logger"
 	"audio_compression/pkg/rabbitmq"
 	"context"
 	"encoding/json"
-	"fmt"
+	"io"
+	"os"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AMQPClient struct {
@@ -20,6 +23,7 @@ type AMQPClient struct {
 	cfg        *config.Config
 	l          *logger.Logger
 	compClient *DecompressionClient
+	cache      *compression.ResultCache
 }
 
 var replyTos = "decompression_response"
@@ -36,9 +40,14 @@ func NewAMQPClient(cfg *config.Config, l *logger.Logger) (*AMQPClient, error) {
 	}
 	compClient := NewDecompressionClient(cfg, l)
 
-	c := &AMQPClient{cfg: cfg, l: l, amqpChan: amqpChan, compClient: compClient}
+	cache, err := compression.NewResultCache(compression.CacheDir(cfg.Cache.Dir, "http"), cfg.Cache.MaxBytes, cfg.Cache.TTL, l)
+	if err != nil {
+		return nil, errors.Wrap(err, "compression.NewResultCache")
+	}
+
+	c := &AMQPClient{cfg: cfg, l: l, amqpChan: amqpChan, compClient: compClient, cache: cache}
 
-	if c.SetupExchangeAndQueue("audio_compression", "decompress_response", "decompression_response", ""); err != nil {
+	if err := c.SetupExchangeAndQueue("audio_compression", "decompress_response", "decompression_response", "", nil); err != nil {
 		l.Error(err)
 		l.Fatal("Failed to setup exchange and queue")
 	}
@@ -46,8 +55,22 @@ func NewAMQPClient(cfg *config.Config, l *logger.Logger) (*AMQPClient, error) {
 	return c, nil
 }
 
+// NewAMQPPublisher returns a client that only publishes compression requests, for
+// processes that neither wait for decompressions nor keep a result cache.
+func NewAMQPPublisher(cfg *config.Config, l *logger.Logger) (*AMQPClient, error) {
+	mqConn, err := rabbitmq.NewRabbitMQConn(cfg)
+	if err != nil {
+		return nil, err
+	}
+	amqpChan, err := mqConn.Channel()
+	if err != nil {
+		return nil, errors.Wrap(err, "amqpw.amqpConn.Channel")
+	}
+	return &AMQPClient{cfg: cfg, l: l, amqpChan: amqpChan}, nil
+}
+
 // SetupExchangeAndQueue create exchange and queue
-func (amqpw *AMQPClient) SetupExchangeAndQueue(exchange, queueName, bindingKey, consumerTag string) error {
+func (amqpw *AMQPClient) SetupExchangeAndQueue(exchange, queueName, bindingKey, consumerTag string, args amqp.Table) error {
 	amqpw.l.Info("Declaring exchange: %s", exchange)
 	err := amqpw.amqpChan.ExchangeDeclare(
 		exchange,
@@ -68,14 +91,14 @@ func (amqpw *AMQPClient) SetupExchangeAndQueue(exchange, queueName, bindingKey,
 		queueAutoDelete,
 		queueExclusive,
 		queueNoWait,
-		nil,
+		args,
 	)
 	if err != nil {
 		return errors.Wrap(err, "Error ch.QueueDeclare")
 	}
 
 	amqpw.l.Info("Declared queue, binding it to exchange: Queue: %v, messageCount: %v, "+
-		"consumerCount: %v, exchange: %v, exchange: %v, bindingKey: %v",
+		"consumerCount: %v, exchange: %v, bindingKey: %v",
 		queue.Name,
 		queue.Messages,
 		queue.Consumers,
@@ -108,7 +131,7 @@ func (amqpw *AMQPClient) CloseChan() error {
 }
 
 // Publish message
-func (amqpw *AMQPClient) Publish(exchange, key, contentType, corrId, replyTo string, body []byte) error {
+func (amqpw *AMQPClient) Publish(exchange, key, contentType, corrId, replyTo string, priority uint8, body []byte) error {
 
 	amqpw.l.Info("Publishing message Exchange: %s, RoutingKey: %s", amqpw.cfg.RMQ.ServerExchange, "")
 
@@ -124,6 +147,7 @@ func (amqpw *AMQPClient) Publish(exchange, key, contentType, corrId, replyTo str
 			Timestamp:     time.Now(),
 			CorrelationId: corrId,
 			ReplyTo:       replyTo,
+			Priority:      priority,
 			Body:          body,
 		},
 	); err != nil {
@@ -180,8 +204,15 @@ func (c *AMQPClient) DecompressionConsumer() error {
 // 	return nil
 // }
 
-func (p *AMQPClient) CallCompressionApi(ctx context.Context, bucket, key, compType, corrId, replyTo string) error {
-	payload := entity.CompressionRequest{Bucket: bucket, Key: key, Type: compType}
+func (p *AMQPClient) CallCompressionApi(ctx context.Context, jobID, bucket, key, etag, tier, codec string, level int, compType, corrId, replyTo string, priority uint8, storage entity.StorageOptions) error {
+	if max := p.cfg.RMQ.MaxPriority; int(priority) > max {
+		priority = uint8(max)
+	}
+	payload := entity.CompressionRequest{JobID: jobID, Bucket: bucket, Key: key, Type: compType, Tier: tier, Priority: priority, Storage: storage, Codec: codec, Level: level, ETag: etag}
+	// an admitted compression outlives the request that queued it
+	if deadline, ok := ctx.Deadline(); ok && compType == "decompress" {
+		payload.Deadline = &deadline
+	}
 	s, err := json.Marshal(payload)
 	if err != nil {
 		return err
@@ -189,11 +220,11 @@ func (p *AMQPClient) CallCompressionApi(ctx context.Context, bucket, key, compTy
 
 	switch compType {
 	case "compress":
-		if err := p.Publish("audio_compression", "compress", "application/json", corrId, replyTo, s); err != nil {
+		if err := p.Publish("audio_compression", "compress", "application/json", corrId, replyTo, priority, s); err != nil {
 			return err
 		}
 	case "decompress":
-		if err := p.Publish("audio_compression", "decompress", "application/json", corrId, replyTo, s); err != nil {
+		if err := p.Publish("audio_compression", "decompress", "application/json", corrId, replyTo, priority, s); err != nil {
 			return err
 		}
 	}
@@ -201,37 +232,83 @@ func (p *AMQPClient) CallCompressionApi(ctx context.Context, bucket, key, compTy
 	return nil
 }
 
-func (cs *AMQPClient) PlanCompression(ctx context.Context, bucket, key string) error {
-	corrId, isAlreadyExist := cs.compClient.GetOrCreateRequest(bucket, key, "compress")
+// PlanCompression publishes the admitted job. No response is awaited, so the job ID
+// serves as correlation ID.
+func (cs *AMQPClient) PlanCompression(ctx context.Context, jobID, bucket, key, tier, codec string, level int, priority uint8, storage entity.StorageOptions) error {
+	return cs.CallCompressionApi(ctx, jobID, bucket, key, "", tier, codec, level, "compress", jobID, "compression_response", priority, storage)
+}
 
-	if !isAlreadyExist {
-		if err := cs.CallCompressionApi(ctx, bucket, key, "compress", corrId, "compression_response"); err != nil {
-			return err
-		}
+// GetDecompression serves results from the local cache, so range and repeated
+// requests do not go back to the workers while the result of the compressed
+// archive version etag is cached.
+func (cs *AMQPClient) GetDecompression(ctx context.Context, bucket, key, etag string) (io.ReadSeekCloser, error) {
+	cs.startDecompression(ctx, bucket, key, etag)
+
+	ctx, cancel := context.WithTimeout(ctx, cs.cfg.RMQ.DecompressTimeout)
+	defer cancel()
+
+	return cs.cache.Wait(ctx, bucket, key, etag)
+}
+
+func (cs *AMQPClient) StartDecompression(ctx context.Context, bucket, key, etag string) (*entity.DecompressionJob, error) {
+	cs.startDecompression(ctx, bucket, key, etag)
+
+	id := compression.JobID(bucket, key, etag)
+	if job := cs.cache.Job(id); job != nil {
+		return job, nil
 	}
-	return nil
+	// evicted right away, report it as still running so the client polls again
+	return &entity.DecompressionJob{ID: id, Bucket: bucket, Key: key, Status: entity.JobStatusRunning}, nil
 }
 
-func (cs *AMQPClient) GetDecompression(ctx context.Context, bucket, key string) ([]byte, error) {
-	corrId, isAlreadyExist := cs.compClient.GetOrCreateRequest(bucket, key, "decompress")
+func (cs *AMQPClient) GetDecompressionJob(ctx context.Context, id string) (*entity.DecompressionJob, error) {
+	job := cs.cache.Job(id)
+	if job == nil {
+		return nil, entity.ErrJobNotFound
+	}
+	return job, nil
+}
+
+// startDecompression fetches the result in the background unless it is cached or
+// already being fetched.
+func (cs *AMQPClient) startDecompression(ctx context.Context, bucket, key, etag string) {
+	if cs.cache.Reserve(ctx, bucket, key, etag) {
+		// detached from the request, the result is shared with every waiting request
+		fetchCtx := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+		go func() {
+			if err := cs.fetchDecompression(fetchCtx, bucket, key, etag); err != nil {
+				cs.l.Error("Failed to fetch decompression %s - %s : %v", bucket, key, err)
+				cs.cache.Fail(bucket, key, etag, err)
+			}
+		}()
+	}
+}
+
+// fetchDecompression asks a worker for the result and moves the file it wrote into
+// the cache.
+func (cs *AMQPClient) fetchDecompression(ctx context.Context, bucket, key, etag string) error {
+	ctx, cancel := context.WithTimeout(ctx, cs.cfg.RMQ.DecompressTimeout)
+	defer cancel()
+
+	corrId, isAlreadyExist := cs.compClient.GetOrCreateRequest(bucket, key, etag, "decompress")
+	defer cs.compClient.DeleteRequest(corrId)
 
 	if !isAlreadyExist {
-		if err := cs.CallCompressionApi(ctx, bucket, key, "decompress", corrId, "decompression_response"); err != nil {
-			return nil, err
+		if err := cs.CallCompressionApi(ctx, "", bucket, key, etag, "", "", 0, "decompress", corrId, "decompression_response", entity.PriorityInteractive, entity.StorageOptions{}); err != nil {
+			return err
 		}
 	}
-	res, err := cs.compClient.GetDecompressionResponse(ctx, corrId, 100)
+	res, err := cs.compClient.GetDecompressionResponse(ctx, corrId)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	fmt.Println(res.ResultType)
-	fmt.Println(res.ResultAddress)
-
-	resultByte, err := cs.compClient.GetByteFromFileSystem(res.ResultAddress)
+	f, err := os.Open(res.ResultAddress)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer os.Remove(res.ResultAddress)
+	defer f.Close()
 
-	return resultByte, nil
+	return cs.cache.Put(ctx, bucket, key, etag, f)
 }
@@ -3,7 +3,9 @@ package rmq
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,11 +22,24 @@ import (
 )
 
 type AMQPWorker struct {
+	mqConn          *amqp.Connection
 	amqpChan        *amqp.Channel
 	cfg             *config.Config
 	l               *logger.Logger
 	blobStorageRepo entity.StorageRepository
 	cu              *compression.CompressionUsecase
+	// qu admits the compressions of bucket notifications
+	qu           *compression.QuotaUsecase
+	consumerTags []string
+	notify       chan *amqp.Error
+
+	// jobCtx is cancelled when shutdown gives up waiting for the jobs in flight
+	jobCtx    context.Context
+	abortJobs context.CancelFunc
+	stopping  chan struct{}
+	mu        sync.Mutex
+	draining  bool
+	inflight  sync.WaitGroup
 }
 
 // NewCompressionConsumer Emails rabbitmq Consumer constructor
@@ -37,17 +52,36 @@ func NewAMQPWorker(cfg *config.Config, l *logger.Logger, cu *compression.Compres
 	if err != nil {
 		return nil, errors.Wrap(err, "amqpw.amqpConn.Channel")
 	}
-	s3Repo, err := s3repo.NewS3Repository()
+	s3Repo, err := s3repo.NewS3Repository(cfg.S3)
 	if err != nil {
 		l.Error(err)
 		l.Fatal("Failed to init S3 Repository")
 	}
 
-	return &AMQPWorker{cfg: cfg, l: l, amqpChan: amqpChan, cu: cu, blobStorageRepo: s3Repo}, nil
+	consumerID := uuid.New().String()[:8]
+	consumerTags := []string{"compress-" + consumerID, "decompress-" + consumerID}
+	if cfg.Notifications.Queue != "" {
+		consumerTags = append(consumerTags, "notify-"+consumerID)
+	}
+	jobCtx, abortJobs := context.WithCancel(context.Background())
+
+	return &AMQPWorker{
+		mqConn:          mqConn,
+		amqpChan:        amqpChan,
+		cfg:             cfg,
+		l:               l,
+		cu:              cu,
+		qu:              compression.NewQuotaUsecase(cfg.Quota, s3Repo, cu.CompressionRepo, l),
+		blobStorageRepo: s3Repo,
+		consumerTags:    consumerTags,
+		jobCtx:          jobCtx,
+		abortJobs:       abortJobs,
+		stopping:        make(chan struct{}),
+	}, nil
 }
 
 // SetupExchangeAndQueue create exchange and queue
-func (amqpw *AMQPWorker) SetupExchangeAndQueue(exchange, queueName, bindingKey, consumerTag string) error {
+func (amqpw *AMQPWorker) SetupExchangeAndQueue(exchange, queueName, bindingKey, consumerTag string, args amqp.Table) error {
 	amqpw.l.Info("Declaring exchange: %s", exchange)
 	err := amqpw.amqpChan.ExchangeDeclare(
 		exchange,
@@ -62,20 +96,30 @@ func (amqpw *AMQPWorker) SetupExchangeAndQueue(exchange, queueName, bindingKey,
 		return errors.Wrap(err, "Error ch.ExchangeDeclare")
 	}
 
-	queue, err := amqpw.amqpChan.QueueDeclare(
-		queueName,
-		queueDurable,
-		queueAutoDelete,
-		queueExclusive,
-		queueNoWait,
-		nil,
-	)
+	// a queue keeps the arguments it was first declared with, declaring it with
+	// others closes the channel
+	queue, exists, err := amqpw.declaredQueue(queueName)
 	if err != nil {
-		return errors.Wrap(err, "Error ch.QueueDeclare")
+		return err
+	}
+	if exists {
+		amqpw.l.Info("Queue %s exists, keeping the arguments it was declared with", queueName)
+	} else {
+		queue, err = amqpw.amqpChan.QueueDeclare(
+			queueName,
+			queueDurable,
+			queueAutoDelete,
+			queueExclusive,
+			queueNoWait,
+			args,
+		)
+		if err != nil {
+			return errors.Wrap(err, "Error ch.QueueDeclare")
+		}
 	}
 
 	amqpw.l.Info("Declared queue, binding it to exchange: Queue: %v, messageCount: %v, "+
-		"consumerCount: %v, exchange: %v, exchange: %v, bindingKey: %v",
+		"consumerCount: %v, exchange: %v, bindingKey: %v",
 		queue.Name,
 		queue.Messages,
 		queue.Consumers,
@@ -98,6 +142,55 @@ func (amqpw *AMQPWorker) SetupExchangeAndQueue(exchange, queueName, bindingKey,
 	return nil
 }
 
+// declaredQueue returns a queue unless it is not declared. It asks on a channel of
+// its own, which the broker closes when the queue is missing.
+func (amqpw *AMQPWorker) declaredQueue(name string) (amqp.Queue, bool, error) {
+	ch, err := amqpw.mqConn.Channel()
+	if err != nil {
+		return amqp.Queue{}, false, errors.Wrap(err, "amqpw.mqConn.Channel")
+	}
+	defer ch.Close()
+
+	queue, err := ch.QueueDeclarePassive(name, queueDurable, queueAutoDelete, queueExclusive, queueNoWait, nil)
+	if err != nil {
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			return amqp.Queue{}, false, nil
+		}
+		return amqp.Queue{}, false, errors.Wrap(err, "ch.QueueDeclarePassive")
+	}
+	return queue, true, nil
+}
+
+// drainLegacyQueue unbinds compress_request, which new requests skip from now on,
+// and consumes what is left in it, if it was declared.
+func (c *AMQPWorker) drainLegacyQueue() (<-chan amqp.Delivery, error) {
+	queue, exists, err := c.declaredQueue(legacyCompressionQueue)
+	if err != nil || !exists {
+		return nil, err
+	}
+	c.l.Info("Draining queue %s, messageCount: %v", queue.Name, queue.Messages)
+
+	if err := c.amqpChan.QueueUnbind(queue.Name, "compress", "audio_compression", nil); err != nil {
+		return nil, errors.Wrap(err, "Error ch.QueueUnbind")
+	}
+	tag := c.consumerTags[0] + "-legacy"
+	deliveries, err := c.amqpChan.Consume(
+		queue.Name,
+		tag,
+		consumeAutoAck,
+		consumeExclusive,
+		consumeNoLocal,
+		consumeNoWait,
+		nil,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Consume")
+	}
+	c.consumerTags = append(c.consumerTags, tag)
+	return deliveries, nil
+}
+
 // CloseChan Close messages chan
 func (amqpw *AMQPWorker) CloseChan() error {
 	if err := amqpw.amqpChan.Close(); err != nil {
@@ -108,7 +201,7 @@ func (amqpw *AMQPWorker) CloseChan() error {
 }
 
 // Publish message
-func (amqpw *AMQPWorker) Publish(exchange, key, contentType, corrId, replyTo string, body []byte) error {
+func (amqpw *AMQPWorker) Publish(exchange, key, contentType, corrId, replyTo string, priority uint8, body []byte) error {
 
 	amqpw.l.Info("Publishing message Exchange: %s, RoutingKey: %s", exchange, key)
 
@@ -124,6 +217,7 @@ func (amqpw *AMQPWorker) Publish(exchange, key, contentType, corrId, replyTo str
 			Timestamp:     time.Now(),
 			CorrelationId: corrId,
 			ReplyTo:       replyTo,
+			Priority:      priority,
 			Body:          body,
 		},
 	); err != nil {
@@ -133,26 +227,40 @@ func (amqpw *AMQPWorker) Publish(exchange, key, contentType, corrId, replyTo str
 	return nil
 }
 
-// StartConsumer Start new rabbitmq consumer
+// StartConsumer declares the request queues and starts consuming them. It returns
+// once the consumers run, Notify reports when the channel closes.
 func (c *AMQPWorker) StartConsumer() error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	ch := c.amqpChan
-	compressionQueue := "compress_request"
-	decompressionQueue := "decompress_request"
 
-	if err := c.SetupExchangeAndQueue("audio_compression", compressionQueue, "compress", ""); err != nil {
+	if err := c.SetupExchangeAndQueue(deadLetterExchange, DeadLetterQueue, "compress", "", nil); err != nil {
 		return errors.Wrap(err, "SetupExchangeAndQueue")
 	}
 
-	if err := c.SetupExchangeAndQueue("audio_compression", decompressionQueue, "decompress", ""); err != nil {
+	// interactive compressions overtake queued backfills. Every decompression is
+	// interactive, they go ahead of compressions on the CPUs instead
+	compressionArgs := amqp.Table{
+		"x-max-priority":         int32(c.cfg.RMQ.MaxPriority),
+		"x-dead-letter-exchange": deadLetterExchange,
+	}
+
+	if err := c.SetupExchangeAndQueue("audio_compression", compressionQueue, "compress", "", compressionArgs); err != nil {
 		return errors.Wrap(err, "SetupExchangeAndQueue")
 	}
 
+	if err := c.SetupExchangeAndQueue("audio_compression", decompressionQueue, "decompress", "", nil); err != nil {
+		return errors.Wrap(err, "SetupExchangeAndQueue")
+	}
+
+	// Priorities only order messages still in the broker, so take one at a time
+	if err := ch.Qos(prefetchCount, prefetchSize, prefetchGlobal); err != nil {
+		return errors.Wrap(err, "ch.Qos")
+	}
+
+	c.notify = ch.NotifyClose(make(chan *amqp.Error, 1))
+
 	compressionDeliveries, err := ch.Consume(
 		compressionQueue,
-		"",
+		c.consumerTags[0],
 		consumeAutoAck,
 		consumeExclusive,
 		consumeNoLocal,
@@ -165,7 +273,7 @@ func (c *AMQPWorker) StartConsumer() error {
 
 	decompressionDeliveries, err := ch.Consume(
 		decompressionQueue,
-		"",
+		c.consumerTags[1],
 		consumeAutoAck,
 		consumeExclusive,
 		consumeNoLocal,
@@ -176,86 +284,306 @@ func (c *AMQPWorker) StartConsumer() error {
 		return errors.Wrap(err, "Consume")
 	}
 
-	go c.ConsumeCompression(ctx, compressionDeliveries)
-	go c.ConsumeDecompression(ctx, decompressionDeliveries)
+	legacyDeliveries, err := c.drainLegacyQueue()
+	if err != nil {
+		return errors.Wrap(err, "drainLegacyQueue")
+	}
 
-	chanErr := <-ch.NotifyClose(make(chan *amqp.Error))
-	c.l.Error("ch.NotifyClose: %v", chanErr)
-	return chanErr
-}
+	go c.ConsumeCompression(mergeDeliveries(compressionDeliveries, legacyDeliveries))
+	go c.ConsumeDecompression(decompressionDeliveries)
 
-func (c *AMQPWorker) ConsumeCompression(_ context.Context, messages <-chan amqp.Delivery) {
-	for delivery := range messages {
-		ctx := context.Background()
-		ctx, span := otel.Tracer(traceName).Start(ctx, "consumer")
-		defer span.End()
+	if c.cfg.Notifications.Queue == "" {
+		return nil
+	}
+	if err := c.setupNotificationQueue(); err != nil {
+		return errors.Wrap(err, "setupNotificationQueue")
+	}
+	notificationDeliveries, err := ch.Consume(
+		c.cfg.Notifications.Queue,
+		c.consumerTags[2],
+		consumeAutoAck,
+		consumeExclusive,
+		consumeNoLocal,
+		consumeNoWait,
+		nil,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Consume")
+	}
+	go c.ConsumeNotifications(notificationDeliveries)
 
-		var compressionRequest entity.CompressionRequest
+	return nil
+}
 
-		if err := json.Unmarshal(delivery.Body, &compressionRequest); err != nil {
-			c.l.Error(err)
-			time.Sleep(time.Duration(time.Second * 5))
-			continue
+// Notify reports the error the channel closed with.
+func (c *AMQPWorker) Notify() <-chan *amqp.Error {
+	return c.notify
+}
+
+// Shutdown stops consuming and waits for the jobs in flight. Jobs still running
+// when ctx is done are cancelled and returned to the queue, and closing the
+// channel returns whatever was not acknowledged by then.
+func (c *AMQPWorker) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+	close(c.stopping)
+
+	for _, tag := range c.consumerTags {
+		if err := c.amqpChan.Cancel(tag, false); err != nil {
+			c.l.Error("AMQPWorker Shutdown cancel %s: %v", tag, err)
 		}
+	}
 
-		err, shouldRetry := c.cu.DoCompression(ctx, compressionRequest.Bucket, compressionRequest.Key)
-		if err != nil {
-			c.l.Error(err)
-			if shouldRetry {
-				delivery.Reject(true)
-			} else {
-				delivery.Ack(false)
-			}
-			time.Sleep(time.Duration(time.Second * 5))
-			continue
+	done := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		c.l.Info("AMQPWorker Shutdown: in-flight jobs finished")
+	case <-ctx.Done():
+		c.l.Warn("AMQPWorker Shutdown: deadline exceeded, cancelling in-flight jobs")
+		c.abortJobs()
+		select {
+		case <-done:
+		case <-time.After(abortGrace):
+			c.l.Warn("AMQPWorker Shutdown: in-flight jobs did not stop, leaving them to the broker")
 		}
-		delivery.Ack(false)
+	}
 
+	if err := c.CloseChan(); err != nil {
+		return err
 	}
+	return c.mqConn.Close()
 }
-func (c *AMQPWorker) ConsumeDecompression(_ context.Context, messages <-chan amqp.Delivery) {
-	for delivery := range messages {
-		ctx := context.Background()
-		ctx, span := otel.Tracer(traceName).Start(ctx, "consumer")
-		defer span.End()
 
-		var compressionRequest entity.CompressionRequest
+// begin counts a job in flight unless the worker is draining.
+func (c *AMQPWorker) begin() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return false
+	}
+	c.inflight.Add(1)
+	return true
+}
 
-		if err := json.Unmarshal(delivery.Body, &compressionRequest); err != nil {
-			c.l.Error(err)
-			delivery.Ack(true)
+// pause waits after a failed job, unless the worker is shutting down.
+func (c *AMQPWorker) pause(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-c.stopping:
+	}
+}
+
+func (c *AMQPWorker) ConsumeCompression(messages <-chan amqp.Delivery) {
+	for delivery := range messages {
+		if !c.begin() {
+			delivery.Nack(false, true)
 			continue
 		}
+		failed := c.handleCompression(delivery)
+		c.inflight.Done()
 
-		result, err := c.cu.GetDecompression(ctx, compressionRequest.Bucket, compressionRequest.Key)
-		if err != nil {
-			c.l.Error(err)
-			delivery.Reject(false)
-			continue
+		if failed {
+			c.pause(5 * time.Second)
 		}
+	}
+}
 
-		fileName, err := WriteByteToFileSystem(result)
-		if err != nil {
-			c.l.Error(err)
-			delivery.Reject(false)
-			continue
+// handleCompression runs one compression request and reports whether it failed.
+func (c *AMQPWorker) handleCompression(delivery amqp.Delivery) bool {
+	ctx, span := otel.Tracer(traceName).Start(c.jobCtx, "consumer")
+	defer span.End()
+
+	var compressionRequest entity.CompressionRequest
+
+	if err := json.Unmarshal(delivery.Body, &compressionRequest); err != nil {
+		c.l.Error(err)
+		c.deadLetterCompression(delivery)
+		return true
+	}
+
+	err, shouldRetry := c.cu.DoCompression(ctx, compressionRequest.JobID, compressionRequest.Bucket, compressionRequest.Key, compressionRequest.Tier, compressionRequest.Codec, compressionRequest.Level, compressionRequest.Storage)
+	if c.jobCtx.Err() != nil {
+		// cut off by shutdown, another worker starts it over
+		delivery.Nack(false, true)
+		return false
+	}
+	if err != nil {
+		c.l.Error(err)
+		if shouldRetry {
+			c.retryCompression(delivery)
+		} else {
+			c.deadLetterCompression(delivery)
 		}
+		return true
+	}
+	delivery.Ack(false)
+	return false
+}
 
-		compressionResponse := &entity.CompressionResponse{ResultAddress: fileName, ResultType: "FS"}
+// retryCompression queues a failed request again, behind those queued meanwhile,
+// and dead-letters it once it failed more than MaxRetries times.
+func (c *AMQPWorker) retryCompression(delivery amqp.Delivery) {
+	retries, _ := delivery.Headers[retryHeader].(int32)
+	if int(retries) >= c.cfg.RMQ.MaxRetries {
+		c.l.Warn("Dead-lettering compression request %s after %d retries", delivery.MessageId, retries)
+		c.deadLetterCompression(delivery)
+		return
+	}
+	c.requeueCompression(delivery, retries+1)
+}
 
-		s, err := json.Marshal(compressionResponse)
-		if err != nil {
-			c.l.Error(err)
-			delivery.Ack(true)
+// deadLetterCompression rejects a request to the dead letter queue. compress_request
+// has no dead letter exchange, its requests are moved to the compression queue
+// with no retries left instead, to be dead-lettered from there.
+func (c *AMQPWorker) deadLetterCompression(delivery amqp.Delivery) {
+	if delivery.ConsumerTag == c.consumerTags[0]+"-legacy" {
+		c.requeueCompression(delivery, int32(c.cfg.RMQ.MaxRetries))
+		return
+	}
+	delivery.Reject(false)
+}
+
+// requeueCompression publishes a request again with its retries, to where it was
+// published.
+func (c *AMQPWorker) requeueCompression(delivery amqp.Delivery, retries int32) {
+	c.requeue(delivery, delivery.Exchange, delivery.RoutingKey, retries)
+}
+
+// requeue publishes a delivery again with its retries and acknowledges it.
+func (c *AMQPWorker) requeue(delivery amqp.Delivery, exchange, key string, retries int32) {
+	headers := amqp.Table{}
+	for name, value := range delivery.Headers {
+		headers[name] = value
+	}
+	headers[retryHeader] = retries
+	err := c.amqpChan.Publish(exchange, key, publishMandatory, publishImmediate, amqp.Publishing{
+		Headers:       headers,
+		ContentType:   delivery.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     delivery.MessageId,
+		Timestamp:     delivery.Timestamp,
+		CorrelationId: delivery.CorrelationId,
+		ReplyTo:       delivery.ReplyTo,
+		Priority:      delivery.Priority,
+		Body:          delivery.Body,
+	})
+	if err != nil {
+		c.l.Error("Failed to queue message %s again : %v", delivery.MessageId, err)
+		delivery.Reject(true)
+		return
+	}
+	delivery.Ack(false)
+}
+
+func (c *AMQPWorker) ConsumeDecompression(messages <-chan amqp.Delivery) {
+	for delivery := range messages {
+		if !c.begin() {
+			delivery.Nack(false, true)
 			continue
 		}
+		c.handleDecompression(delivery)
+		c.inflight.Done()
+	}
+}
+
+func (c *AMQPWorker) handleDecompression(delivery amqp.Delivery) {
+	ctx, span := otel.Tracer(traceName).Start(c.jobCtx, "consumer")
+	defer span.End()
 
-		c.Publish("audio_compression", "decompression_response", "application/json", delivery.CorrelationId, "", s)
+	var compressionRequest entity.CompressionRequest
+
+	if err := json.Unmarshal(delivery.Body, &compressionRequest); err != nil {
+		c.l.Error(err)
 		delivery.Ack(false)
+		return
 	}
+
+	ctx, cancel, expired := withDeadline(ctx, compressionRequest.Deadline)
+	defer cancel()
+	if expired {
+		// nobody waits for the response anymore
+		c.l.Info("Dropping decompression request %s - %s past its deadline", compressionRequest.Bucket, compressionRequest.Key)
+		delivery.Ack(false)
+		return
+	}
+
+	result, err := c.cu.GetDecompression(ctx, compressionRequest.Bucket, compressionRequest.Key, compressionRequest.ETag)
+	if err != nil {
+		c.l.Error(err)
+		c.settleFailed(delivery)
+		return
+	}
+
+	fileName, err := WriteToFileSystem(result)
+	result.Close()
+	if err != nil {
+		c.l.Error(err)
+		c.settleFailed(delivery)
+		return
+	}
+
+	compressionResponse := &entity.CompressionResponse{ResultAddress: fileName, ResultType: "FS"}
+
+	s, err := json.Marshal(compressionResponse)
+	if err != nil {
+		c.l.Error(err)
+		delivery.Ack(false)
+		return
+	}
+
+	c.Publish("audio_compression", "decompression_response", "application/json", delivery.CorrelationId, "", 0, s)
+	delivery.Ack(false)
+}
+
+// settleFailed drops a failed request, or returns it to the queue when shutdown
+// cut it off.
+func (c *AMQPWorker) settleFailed(delivery amqp.Delivery) {
+	if c.jobCtx.Err() != nil {
+		delivery.Nack(false, true)
+		return
+	}
+	delivery.Reject(false)
 }
 
-func WriteByteToFileSystem(b []byte) (string, error) {
+// mergeDeliveries delivers the messages of both consumers until both channels
+// close, one at a time like a single consumer. b may be nil.
+func mergeDeliveries(a, b <-chan amqp.Delivery) <-chan amqp.Delivery {
+	if b == nil {
+		return a
+	}
+	merged := make(chan amqp.Delivery)
+	go func() {
+		defer close(merged)
+		for a != nil || b != nil {
+			var delivery amqp.Delivery
+			var ok bool
+			select {
+			case delivery, ok = <-a:
+				if !ok {
+					a = nil
+					continue
+				}
+			case delivery, ok = <-b:
+				if !ok {
+					b = nil
+					continue
+				}
+			}
+			merged <- delivery
+		}
+	}()
+	return merged
+}
+
+// WriteToFileSystem hands a result over to the client, which removes the file once
+// it has copied it.
+func WriteToFileSystem(r io.Reader) (string, error) {
 	f, err := os.CreateTemp(os.TempDir(), "decompress-")
 	if err != nil {
 		return "", err
@@ -264,9 +592,21 @@ func WriteByteToFileSystem(b []byte) (string, error) {
 
 	fileName := f.Name()
 
-	if _, err := f.Write(b); err != nil {
+	if _, err := io.Copy(f, r); err != nil {
+		os.Remove(fileName)
 		return "", err
 	}
 
 	return fileName, nil
 }
+
+// withDeadline bounds ctx by the deadline of a request and reports whether it has
+// already passed.
+func withDeadline(ctx context.Context, deadline *time.Time) (context.Context, context.CancelFunc, bool) {
+	if deadline == nil {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, false
+	}
+	ctx, cancel := context.WithDeadline(ctx, *deadline)
+	return ctx, cancel, !time.Now().Before(*deadline)
+}
@@ -1,7 +1,35 @@
 package rmq
 
+import "time"
+
 const traceName = "rpc"
 
+// abortGrace is how long shutdown waits for cancelled jobs to return.
+const abortGrace = 5 * time.Second
+
+// Request queues. Queue arguments cannot change once declared, and the compression
+// queue needs x-max-priority, which compress_request was declared without before
+// requests had priorities. It goes under a new name, compress_request is drained.
+const (
+	compressionQueue       = "compress_request_priority"
+	legacyCompressionQueue = "compress_request"
+	decompressionQueue     = "decompress_request"
+
+	// compressions that failed for good, or too often, are dead-lettered to be
+	// replayed with tarc replay once the cause is fixed
+	deadLetterExchange = "audio_compression_dead_letter"
+	// DeadLetterQueue holds the dead-lettered compression requests
+	DeadLetterQueue = "compress_dead_letter"
+	// NotificationDeadLetterQueue holds the bucket notifications that could not be
+	// queued, routed there by notificationDeadLetterKey
+	NotificationDeadLetterQueue = "notification_dead_letter"
+	notificationDeadLetterKey   = "notification"
+)
+
+// retryHeader counts how often a failed compression request or notification was
+// queued again.
+const retryHeader = "x-retries"
+
 const (
 	exchangeKind       = "direct"
 	exchangeDurable    = true
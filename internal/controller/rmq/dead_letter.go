@@ -0,0 +1,92 @@
+package rmq
+
+import (
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// ReplayDeadLetters moves up to limit messages, every message for zero, of a dead
+// letter queue back to the exchange and routing key they were dead-lettered from,
+// as their x-death header records, with their retries reset. Failed compressions
+// are dead-lettered to DeadLetterQueue. It returns the number of messages replayed.
+func (amqpw *AMQPClient) ReplayDeadLetters(queue string, limit int) (int, error) {
+	if err := amqpw.amqpChan.Confirm(false); err != nil {
+		return 0, errors.Wrap(err, "ch.Confirm")
+	}
+	confirms := amqpw.amqpChan.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	replayed := 0
+	for limit <= 0 || replayed < limit {
+		delivery, ok, err := amqpw.amqpChan.Get(queue, false)
+		if err != nil {
+			return replayed, errors.Wrap(err, "ch.Get")
+		}
+		if !ok {
+			return replayed, nil
+		}
+
+		exchange, key, ok := deadLetterOrigin(delivery.Headers)
+		if !ok {
+			delivery.Nack(false, true)
+			return replayed, errors.Errorf("message %s has no x-death header to replay it by", delivery.MessageId)
+		}
+
+		amqpw.l.Info("Replaying message %s to Exchange: %s, RoutingKey: %s", delivery.MessageId, exchange, key)
+		err = amqpw.amqpChan.Publish(exchange, key, publishMandatory, publishImmediate, amqp.Publishing{
+			Headers:       replayHeaders(delivery.Headers),
+			ContentType:   delivery.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			MessageId:     delivery.MessageId,
+			Timestamp:     delivery.Timestamp,
+			CorrelationId: delivery.CorrelationId,
+			ReplyTo:       delivery.ReplyTo,
+			Priority:      delivery.Priority,
+			Body:          delivery.Body,
+		})
+		if err != nil {
+			delivery.Nack(false, true)
+			return replayed, errors.Wrap(err, "ch.Publish")
+		}
+		// the message leaves the dead letter queue once the broker has the copy
+		if confirm := <-confirms; !confirm.Ack {
+			delivery.Nack(false, true)
+			return replayed, errors.Errorf("broker did not confirm the replay of message %s", delivery.MessageId)
+		}
+		if err := delivery.Ack(false); err != nil {
+			return replayed, errors.Wrap(err, "delivery.Ack")
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// deadLetterOrigin returns where a dead-lettered message was first published to.
+func deadLetterOrigin(headers amqp.Table) (string, string, bool) {
+	deaths, _ := headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return "", "", false
+	}
+	// the latest death comes first, the earliest is where it was published to
+	death, _ := deaths[len(deaths)-1].(amqp.Table)
+	exchange, _ := death["exchange"].(string)
+	keys, _ := death["routing-keys"].([]interface{})
+	if len(keys) == 0 {
+		return "", "", false
+	}
+	key, ok := keys[0].(string)
+	return exchange, key, ok
+}
+
+// replayHeaders drops the headers the broker added when dead-lettering, and the
+// retries counted before.
+func replayHeaders(headers amqp.Table) amqp.Table {
+	replay := amqp.Table{}
+	for name, value := range headers {
+		switch name {
+		case "x-death", "x-first-death-exchange", "x-first-death-queue", "x-first-death-reason", retryHeader:
+			continue
+		}
+		replay[name] = value
+	}
+	return replay
+}
@@ -20,11 +20,12 @@ type DecompressionClient struct {
 	cu              *compression.CompressionUsecase
 	reqMap          map[string]entity.CompressionResponse
 	mu              sync.Mutex
+	timeout         time.Duration
 }
 
 func NewDecompressionClient(cfg *config.Config, l logger.Interface) *DecompressionClient {
 	rand.Seed(time.Now().UnixNano())
-	return &DecompressionClient{l: l, reqMap: make(map[string]entity.CompressionResponse)}
+	return &DecompressionClient{l: l, reqMap: make(map[string]entity.CompressionResponse), timeout: cfg.RMQ.DecompressTimeout}
 }
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -37,22 +38,29 @@ func randSeq(n int) string {
 	return string(b)
 }
 
-func (dc *DecompressionClient) GetOrCreateRequest(bucket, key, compType string) (string, bool) {
+func (dc *DecompressionClient) GetOrCreateRequest(bucket, key, etag, compType string) (string, bool) {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
-	for key, val := range dc.reqMap {
-		if val.Bucket == bucket && val.Key == key && val.Type == compType {
-			return key, true
+	for corrId, val := range dc.reqMap {
+		if val.Bucket == bucket && val.Key == key && val.ETag == etag && val.Type == compType {
+			return corrId, true
 		}
 	}
 
 	corrId := randSeq(10)
 
-	dc.reqMap[corrId] = entity.CompressionResponse{Bucket: bucket, Key: key, Type: compType}
+	dc.reqMap[corrId] = entity.CompressionResponse{Bucket: bucket, Key: key, ETag: etag, Type: compType}
 
 	return corrId, false
 }
 
+// DeleteRequest forgets a request once its response has been handled.
+func (dc *DecompressionClient) DeleteRequest(corrId string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	delete(dc.reqMap, corrId)
+}
+
 func (dc *DecompressionClient) SetDecompressionResponse(corrId string, res entity.CompressionResponse) {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
@@ -63,21 +71,22 @@ func (dc *DecompressionClient) SetDecompressionResponse(corrId string, res entit
 	}
 }
 
-func (dc *DecompressionClient) GetDecompressionResponse(ctx context.Context, corrId string, timeOut int) (entity.CompressionResponse, error) {
-	resultChan := make(chan entity.CompressionResponse)
+func (dc *DecompressionClient) GetDecompressionResponse(ctx context.Context, corrId string) (entity.CompressionResponse, error) {
+	resultChan := make(chan entity.CompressionResponse, 1)
 
 	// ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, time.Second*100)
+	ctx, cancel := context.WithTimeout(ctx, dc.timeout)
 	defer cancel()
 
 	go func() {
-		for {
+		for ctx.Err() == nil {
 			dc.mu.Lock()
 			val, ok := dc.reqMap[corrId]
 			dc.mu.Unlock()
 			if ok {
 				if val.ResultAddress != "" {
 					resultChan <- val
+					return
 				}
 			}
 			time.Sleep(100 * time.Millisecond)
@@ -0,0 +1,218 @@
+package rmq
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"audio_compression/config"
+	"audio_compression/entity"
+	"audio_compression/internal/compression"
+)
+
+// s3Notification is an AWS S3 event, or a MinIO one, which adds the event name
+// and the bucket/key of the object to the records.
+type s3Notification struct {
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	// EventName is ObjectCreated:Put for AWS and s3:ObjectCreated:Put for MinIO
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			// Key is URL encoded
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// createdObject is an object an event reported as created.
+type createdObject struct {
+	Bucket string
+	Key    string
+	Size   int64
+}
+
+// parseNotification returns the objects created according to an event. Other
+// events, like the test event S3 sends when notifications are configured, have
+// none.
+func parseNotification(body []byte) ([]createdObject, error) {
+	var notification s3Notification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, err
+	}
+
+	var objects []createdObject
+	for _, record := range notification.Records {
+		if !strings.HasPrefix(strings.TrimPrefix(record.EventName, "s3:"), "ObjectCreated:") {
+			continue
+		}
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "object key %q", record.S3.Object.Key)
+		}
+		objects = append(objects, createdObject{Bucket: record.S3.Bucket.Name, Key: key, Size: record.S3.Object.Size})
+	}
+	return objects, nil
+}
+
+// matchesFilters reports whether a .tar object is matched by one of the filters.
+func matchesFilters(filters []config.NotificationFilter, object createdObject) bool {
+	if !strings.HasSuffix(object.Key, ".tar") {
+		return false
+	}
+	for _, f := range filters {
+		if (f.Bucket == "*" || f.Bucket == object.Bucket) &&
+			strings.HasPrefix(object.Key, f.Prefix) &&
+			strings.HasSuffix(object.Key, f.Suffix) &&
+			object.Size >= f.MinBytes {
+			return true
+		}
+	}
+	return false
+}
+
+// setupNotificationQueue declares the notification queue and binds it to the
+// exchange of the storage, if any. Notifications that cannot be queued are
+// dead-lettered to NotificationDeadLetterQueue.
+func (c *AMQPWorker) setupNotificationQueue() error {
+	cfg := c.cfg.Notifications
+	if err := c.SetupExchangeAndQueue(deadLetterExchange, NotificationDeadLetterQueue, notificationDeadLetterKey, "", nil); err != nil {
+		return errors.Wrap(err, "SetupExchangeAndQueue")
+	}
+
+	queue, err := c.amqpChan.QueueDeclare(
+		cfg.Queue,
+		queueDurable,
+		queueAutoDelete,
+		queueExclusive,
+		queueNoWait,
+		amqp.Table{
+			"x-dead-letter-exchange":    deadLetterExchange,
+			"x-dead-letter-routing-key": notificationDeadLetterKey,
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "Error ch.QueueDeclare")
+	}
+	if cfg.Exchange == "" {
+		return nil
+	}
+
+	c.l.Info("Binding notification queue %s to exchange %s with key %s", queue.Name, cfg.Exchange, cfg.RoutingKey)
+	if err := c.amqpChan.QueueBind(queue.Name, cfg.RoutingKey, cfg.Exchange, queueNoWait, nil); err != nil {
+		return errors.Wrap(err, "Error ch.QueueBind")
+	}
+	return nil
+}
+
+func (c *AMQPWorker) ConsumeNotifications(messages <-chan amqp.Delivery) {
+	for delivery := range messages {
+		if !c.begin() {
+			delivery.Nack(false, true)
+			continue
+		}
+		failed := c.handleNotification(delivery)
+		c.inflight.Done()
+
+		if failed {
+			c.pause(5 * time.Second)
+		}
+	}
+}
+
+// handleNotification queues a compression of every matching object of an event
+// and reports whether that failed. A failed event is queued again up to MaxRetries
+// times and dead-lettered after, or right away when retrying cannot help. The
+// objects queued before the failure are not queued again on redelivery.
+func (c *AMQPWorker) handleNotification(delivery amqp.Delivery) bool {
+	ctx, span := otel.Tracer(traceName).Start(c.jobCtx, "notification")
+	defer span.End()
+
+	objects, err := parseNotification(delivery.Body)
+	if err != nil {
+		c.l.Error("Failed to parse bucket notification : %v", err)
+		delivery.Ack(false)
+		return false
+	}
+	span.SetAttributes(attribute.Int("objects", len(objects)))
+
+	for _, object := range objects {
+		if !matchesFilters(c.cfg.Notifications.Filters, object) {
+			continue
+		}
+		if err := c.enqueueObject(ctx, object); err != nil {
+			if c.jobCtx.Err() != nil {
+				delivery.Nack(false, true)
+				return false
+			}
+			c.l.Error("Failed to queue compression of %s - %s : %v", object.Bucket, object.Key, err)
+			if !compression.Retryable(err) {
+				c.l.Warn("Dead-lettering notification %s : %v", delivery.MessageId, err)
+				delivery.Reject(false)
+				return false
+			}
+			c.retryNotification(delivery)
+			return true
+		}
+	}
+	delivery.Ack(false)
+	return false
+}
+
+// retryNotification queues a failed event again, behind those queued meanwhile,
+// and dead-letters it once it failed more than MaxRetries times. It goes straight
+// to the notification queue, other queues bound to the storage exchange saw it.
+func (c *AMQPWorker) retryNotification(delivery amqp.Delivery) {
+	retries, _ := delivery.Headers[retryHeader].(int32)
+	if int(retries) >= c.cfg.RMQ.MaxRetries {
+		c.l.Warn("Dead-lettering notification %s after %d retries", delivery.MessageId, retries)
+		delivery.Reject(false)
+		return
+	}
+	c.requeue(delivery, "", c.cfg.Notifications.Queue, retries+1)
+}
+
+// enqueueObject admits and publishes a batch compression of object, unless it is
+// gone or was admitted before.
+func (c *AMQPWorker) enqueueObject(ctx context.Context, object createdObject) error {
+	jobID, err := c.qu.AdmitObject(ctx, c.cfg.Notifications.Tenant, object.Bucket, object.Key)
+	if errors.Is(err, entity.ErrDuplicateJob) || errors.Is(err, entity.ErrArchiveNotFound) {
+		c.l.Info("Skipping notification of %s - %s : %v", object.Bucket, object.Key, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	payload := entity.CompressionRequest{
+		JobID:    jobID,
+		Bucket:   object.Bucket,
+		Key:      object.Key,
+		Type:     "compress",
+		Tier:     c.cfg.Notifications.Tier,
+		Priority: entity.PriorityBatch,
+	}
+	s, err := json.Marshal(payload)
+	if err != nil {
+		c.qu.CancelJob(ctx, jobID)
+		return err
+	}
+	if err := c.Publish("audio_compression", "compress", "application/json", jobID, "compression_response", payload.Priority, s); err != nil {
+		c.qu.CancelJob(ctx, jobID)
+		return err
+	}
+	return nil
+}
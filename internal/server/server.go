@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,8 +14,12 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"audio_compression/config"
+	"audio_compression/internal/compression"
 	v1 "audio_compression/internal/controller/http/v1"
 	"audio_compression/internal/controller/rmq"
+	"audio_compression/internal/db/gorm/mysql"
+	"audio_compression/internal/storage/s3repo"
+	"audio_compression/pkg/auth"
 	"audio_compression/pkg/httpserver"
 	"audio_compression/pkg/logger"
 
@@ -49,11 +54,45 @@ func (s *Server) Run(ctx context.Context, cfg *config.Config) error {
 	}
 	go AMQPClient.DecompressionConsumer()
 
+	s3Repo, err := s3repo.NewS3Repository(cfg.S3)
+	if err != nil {
+		l.Fatal(err)
+	}
+	archiveStore, err := compression.NewArchiveStore(cfg.Encryption, cfg.S3.Archives, s3Repo)
+	if err != nil {
+		l.Fatal(err)
+	}
+	archiveUsecase := compression.NewArchiveUsecase(archiveStore, l)
+
+	db := mysql.NewDB(cfg.MYSQL)
+	compressionRepo := compression.NewCompressionRepository(db, l)
+	recordingUsecase := compression.NewRecordingUsecase(compressionRepo, l)
+	quotaUsecase := compression.NewQuotaUsecase(cfg.Quota, s3Repo, compressionRepo, l)
+
+	a, err := auth.New(cfg.Auth)
+	if err != nil {
+		l.Fatal(err)
+	}
+	if a.Disabled() {
+		l.Warn("authentication is disabled, every request may use every bucket")
+	}
+	audit, err := auth.NewAuditLog(cfg.Auth.AuditFile)
+	if err != nil {
+		l.Fatal(err)
+	}
+	defer audit.Close()
+
 	handler := gin.New()
-	v1.NewRouter(handler, l, AMQPClient)
-	httpServer := httpserver.New(handler, httpserver.Port(cfg.Server.Port))
+	uploadUsecase := compression.NewUploadUsecase(cfg, db, l)
+	v1.NewRouter(handler, l, a, audit, AMQPClient, archiveUsecase, uploadUsecase, recordingUsecase, quotaUsecase, cfg.Server.SyncBudget, cfg.Server.MaxUploadBytes)
 
-	l.Info("server serving on port %d ", cfg.Server.Port)
+	var h http.Handler = handler
+	if len(cfg.Server.CORSOrigins) > 0 {
+		h = s.cors(cfg.Server.CORSOrigins).Handler(handler)
+	}
+	httpServer := httpserver.New(h, httpserver.Port(cfg.Server.Port), httpserver.ReadTimeout(cfg.Server.ReadTimeout), httpserver.WriteTimeout(cfg.Server.WriteTimeout))
+
+	l.Info("server serving on port %s ", cfg.Server.Port)
 
 	// Waiting signal
 	interrupt := make(chan os.Signal, 1)
@@ -80,6 +119,15 @@ func (s *Server) Run(ctx context.Context, cfg *config.Config) error {
 
 	log.Printf("server exited properly")
 
+	sql, err := db.DB()
+	if err != nil {
+		log.Fatal().Msgf("unable to get db driver")
+	}
+
+	if err = sql.Close(); err != nil {
+		log.Fatal().Msgf("unable close db connection")
+	}
+
 	// for _, closeFn := range s.metricProviderCloseFn {
 	// 	go func() {
 	// 		err = closeFn(ctxShutDown)
@@ -89,24 +137,31 @@ func (s *Server) Run(ctx context.Context, cfg *config.Config) error {
 	// 	}()
 	// }
 	for _, closeFn := range s.traceProviderCloseFn {
-		go func() {
-			err = closeFn(ctxShutDown)
-			if err != nil {
-				log.Error().Err(err).Msgf("Unable to close trace provider")
-			}
-		}()
+		if err = closeFn(ctxShutDown); err != nil {
+			log.Error().Err(err).Msgf("Unable to close trace provider")
+		}
 	}
 
 	return err
 }
 
-func (s *Server) cors() *cors.Cors {
+// cors allows the configured origins. Credentials are only allowed for origins
+// listed explicitly, never for "*".
+func (s *Server) cors(origins []string) *cors.Cors {
+	allowCredentials := true
+	for _, origin := range origins {
+		if origin == "*" {
+			allowCredentials = false
+		}
+	}
+
 	return cors.New(cors.Options{
-		AllowedOrigins:     []string{"*"},
+		AllowedOrigins:     origins,
 		AllowedMethods:     []string{"POST", "GET", "PUT", "DELETE", "HEAD", "OPTIONS"},
-		AllowedHeaders:     []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization"},
+		AllowedHeaders:     []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", auth.APIKeyHeader},
+		ExposedHeaders:     []string{"ETag", "Location", "Retry-After", "Content-Disposition"},
 		MaxAge:             60, // 1 minutes
-		AllowCredentials:   true,
+		AllowCredentials:   allowCredentials,
 		OptionsPassthrough: false,
 		Debug:              false,
 	})
@@ -0,0 +1,147 @@
+package s3repo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxCopySize is the largest object CopyObject copies, larger ones are copied
+	// in parts
+	maxCopySize = 5 << 30
+	// copyPartSize is copied per UploadPartCopy, S3 copies the bytes itself
+	copyPartSize = 512 << 20
+)
+
+// copyMultipart copies the object onto itself part by part, with the metadata,
+// storage class and encryption of input. The tags of the object are copied along,
+// as CopyObject would.
+func (s3Repo *S3Repository) copyMultipart(ctx context.Context, input *s3.CopyObjectInput, size int64) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "CopyMultipart")
+	defer span.End()
+
+	tagging, err := s3Repo.sess.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: input.Bucket, Key: input.Key})
+	if err != nil {
+		return err
+	}
+	tags := make(map[string]string, len(tagging.TagSet))
+	for _, tag := range tagging.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		Metadata:             input.Metadata,
+		ContentType:          input.ContentType,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		StorageClass:         input.StorageClass,
+	}
+	if len(tags) > 0 {
+		create.Tagging = aws.String(encodeTags(tags))
+	}
+	out, err := s3Repo.sess.CreateMultipartUpload(ctx, create)
+	if err != nil {
+		return err
+	}
+	uploadID := aws.ToString(out.UploadId)
+	span.SetAttributes(attribute.String("upload_id", uploadID))
+
+	partSize := int64(copyPartSize)
+	if min := (size + maxParts - 1) / maxParts; partSize < min {
+		partSize = min
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		copyErr   error
+		completed []types.CompletedPart
+	)
+	slots := make(chan struct{}, s3Repo.concurrency)
+	for number, start := int32(1), int64(0); start < size; number, start = number+1, start+partSize {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		mu.Lock()
+		failed := copyErr != nil
+		mu.Unlock()
+		if failed || ctx.Err() != nil {
+			break
+		}
+
+		end := start + partSize
+		if end > size {
+			end = size
+		}
+		wg.Add(1)
+		go func(number int32, start, end int64) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			part := &s3.UploadPartCopyInput{
+				Bucket:               input.Bucket,
+				Key:                  input.Key,
+				UploadId:             aws.String(uploadID),
+				PartNumber:           number,
+				CopySource:           input.CopySource,
+				CopySourceIfMatch:    input.CopySourceIfMatch,
+				CopySourceRange:      aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+				SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+				SSECustomerKey:       input.SSECustomerKey,
+				SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+
+				CopySourceSSECustomerAlgorithm: input.CopySourceSSECustomerAlgorithm,
+				CopySourceSSECustomerKey:       input.CopySourceSSECustomerKey,
+				CopySourceSSECustomerKeyMD5:    input.CopySourceSSECustomerKeyMD5,
+			}
+			out, err := s3Repo.sess.UploadPartCopy(ctx, part)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if copyErr == nil {
+					copyErr = err
+				}
+				return
+			}
+			completed = append(completed, types.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: number})
+		}(number, start, end)
+	}
+	wg.Wait()
+
+	if copyErr == nil && ctx.Err() != nil {
+		copyErr = ctx.Err()
+	}
+	if copyErr != nil {
+		abortCtx, cancelAbort := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancelAbort()
+		s3Repo.abortUpload(abortCtx, aws.ToString(input.Bucket), aws.ToString(input.Key), uploadID)
+		return copyErr
+	}
+
+	sort.Slice(completed, func(i, j int) bool { return completed[i].PartNumber < completed[j].PartNumber })
+	_, err = s3Repo.sess.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		UploadId:             aws.String(uploadID),
+		MultipartUpload:      &types.CompletedMultipartUpload{Parts: completed},
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	})
+	return err
+}
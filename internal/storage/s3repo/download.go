@@ -0,0 +1,316 @@
+package s3repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"audio_compression/entity"
+)
+
+// retryBackoff is the wait before the first retry of a GET, doubled for every other
+var retryBackoff = 200 * time.Millisecond
+
+var errChecksumMismatch = errors.New("object does not match its checksum")
+
+var (
+	// etagPattern matches the ETag of an object uploaded at once, an MD5 of it, or
+	// in parts, an MD5 of the part MD5s followed by the part count
+	etagPattern         = regexp.MustCompile(`^([0-9a-f]{32})(?:-([0-9]+))?$`)
+	contentRangePattern = regexp.MustCompile(`^bytes ([0-9]+)-([0-9]+)/([0-9]+|\*)$`)
+)
+
+// OpenObject streams the object through parallel GETs that are read in order,
+// download concurrency of them in flight. Objects uploaded in parts are read by
+// part, so S3 validates the checksum of every part it keeps. Others are read in
+// ranges of the download part size. A failed GET is retried on its own, and the
+// whole object is checked against its ETag when that is an MD5. Nothing is read
+// before the first Read.
+func (s3Repo *S3Repository) OpenObject(ctx context.Context, bucket, key string) (io.ReadCloser, *entity.ObjectInfo, error) {
+	info, err := s3Repo.StatObject(ctx, bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), info, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	ctx, span := otel.Tracer(traceName).Start(ctx, "OpenObject")
+	span.SetAttributes(attribute.Int64("size", info.Size))
+
+	r := &objectReader{
+		repo:   s3Repo,
+		ctx:    ctx,
+		cancel: cancel,
+		span:   span,
+		info:   info,
+		input: s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			// a GET of an object replaced since fails instead of mixing both
+			IfMatch: aws.String(`"` + info.ETag + `"`),
+		},
+		chunks: make(chan *chunk, s3Repo.download.Concurrency-1),
+	}
+	if info.SSE == entity.SSEC {
+		r.input.SSECustomerAlgorithm, r.input.SSECustomerKey, r.input.SSECustomerKeyMD5 = s3Repo.sseC()
+	}
+
+	sum, parts := parseETag(info.ETag)
+	if parts > 0 {
+		for number := 1; number <= parts; number++ {
+			r.plan = append(r.plan, &chunk{part: int32(number)})
+		}
+	} else {
+		for start := int64(0); start < info.Size; start += s3Repo.download.PartSize {
+			end := start + s3Repo.download.PartSize
+			if end > info.Size {
+				end = info.Size
+			}
+			r.plan = append(r.plan, &chunk{start: start, end: end - 1})
+		}
+	}
+	// the ETag of an encrypted object is no MD5 of its content
+	if sum != "" && info.SSE == "" {
+		r.md5 = sum
+		if parts == 0 {
+			r.whole = md5.New()
+		}
+	}
+	span.SetAttributes(attribute.Int("gets", len(r.plan)))
+
+	return r, info, nil
+}
+
+// parseETag returns the MD5 an ETag holds, if any, and the part count of objects
+// uploaded in parts.
+func parseETag(etag string) (string, int) {
+	m := etagPattern.FindStringSubmatch(etag)
+	if m == nil {
+		return "", 0
+	}
+	parts, _ := strconv.Atoi(m[2])
+	if parts > maxParts {
+		return "", 0
+	}
+	return m[1], parts
+}
+
+// chunk is a GET of an object part, or of the range from start to end without one.
+type chunk struct {
+	part       int32
+	start, end int64
+
+	ready chan struct{}
+	body  []byte
+	// offset is where body starts in the object, -1 when S3 did not say
+	offset int64
+	err    error
+}
+
+type objectReader struct {
+	repo   *S3Repository
+	ctx    context.Context
+	cancel context.CancelFunc
+	span   trace.Span
+	info   *entity.ObjectInfo
+	input  s3.GetObjectInput
+	plan   []*chunk
+	chunks chan *chunk
+	start  sync.Once
+
+	cur  []byte
+	read int64
+	err  error
+
+	// md5 is the MD5 of the ETag. Objects uploaded at once are hashed into whole,
+	// those uploaded in parts collect the MD5 of every part.
+	md5      string
+	whole    hash.Hash
+	partSums []byte
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	r.start.Do(func() { go r.schedule() })
+
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		c, ok := <-r.chunks
+		if !ok {
+			r.err = r.finish()
+			continue
+		}
+		<-c.ready
+		if c.err == nil {
+			c.err = r.consume(c)
+		}
+		if c.err != nil {
+			r.err = c.err
+			r.cancel()
+			continue
+		}
+		r.cur = c.body
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+func (r *objectReader) Close() error {
+	r.cancel()
+	r.span.End()
+	return nil
+}
+
+// schedule starts a GET for every chunk, holding back while the reader has
+// download concurrency of them waiting.
+func (r *objectReader) schedule() {
+	defer close(r.chunks)
+
+	for _, c := range r.plan {
+		c.ready = make(chan struct{})
+		select {
+		case r.chunks <- c:
+		case <-r.ctx.Done():
+			return
+		}
+		go func(c *chunk) {
+			defer close(c.ready)
+			c.body, c.offset, c.err = r.fetch(c)
+		}(c)
+	}
+}
+
+// consume checks that c continues what was read so far.
+func (r *objectReader) consume(c *chunk) error {
+	if c.offset >= 0 && c.offset != r.read {
+		return fmt.Errorf("GET returned bytes from %d, expected %d", c.offset, r.read)
+	}
+	r.read += int64(len(c.body))
+
+	if r.whole != nil {
+		r.whole.Write(c.body)
+	} else if r.md5 != "" {
+		sum := md5.Sum(c.body)
+		r.partSums = append(r.partSums, sum[:]...)
+	}
+	return nil
+}
+
+// finish checks the object that was read against its size and ETag.
+func (r *objectReader) finish() error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if r.read != r.info.Size {
+		return fmt.Errorf("read %d bytes of an object of %d", r.read, r.info.Size)
+	}
+	if r.md5 != "" {
+		var sum []byte
+		if r.whole != nil {
+			sum = r.whole.Sum(nil)
+		} else {
+			s := md5.Sum(r.partSums)
+			sum = s[:]
+		}
+		if hex.EncodeToString(sum) != r.md5 {
+			return errChecksumMismatch
+		}
+	}
+	return io.EOF
+}
+
+// fetch GETs c, retrying failures that another attempt may not run into.
+func (r *objectReader) fetch(c *chunk) ([]byte, int64, error) {
+	input := r.input
+	switch {
+	case c.part > 0:
+		input.PartNumber = c.part
+		input.ChecksumMode = types.ChecksumModeEnabled
+	case c.end-c.start+1 == r.info.Size:
+		// the whole object, for which S3 has a checksum as well
+		input.ChecksumMode = types.ChecksumModeEnabled
+	default:
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", c.start, c.end))
+	}
+
+	for attempt := 0; ; attempt++ {
+		body, offset, err := r.repo.getChunk(r.ctx, &input, c)
+		if err == nil || attempt >= r.repo.download.Retries || !retryable(r.ctx, err) {
+			return body, offset, err
+		}
+		select {
+		case <-time.After(retryBackoff << attempt):
+		case <-r.ctx.Done():
+			return nil, 0, r.ctx.Err()
+		}
+	}
+}
+
+func (s3Repo *S3Repository) getChunk(ctx context.Context, input *s3.GetObjectInput, c *chunk) ([]byte, int64, error) {
+	out, err := s3Repo.sess.GetObject(ctx, input)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer out.Body.Close()
+
+	// checksums are validated while the body is read
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	// chunked responses have no length
+	if out.ContentLength > 0 && int64(len(body)) != out.ContentLength {
+		return nil, 0, fmt.Errorf("GET returned %d of %d bytes", len(body), out.ContentLength)
+	}
+
+	offset := int64(-1)
+	if m := contentRangePattern.FindStringSubmatch(aws.ToString(out.ContentRange)); m != nil {
+		offset, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+	if c.part == 0 {
+		if offset < 0 {
+			offset = c.start
+		}
+		if offset != c.start || int64(len(body)) != c.end-c.start+1 {
+			return nil, 0, fmt.Errorf("GET of bytes %d-%d returned %d bytes from %d", c.start, c.end, len(body), offset)
+		}
+	}
+	return body, offset, nil
+}
+
+// retryable reports whether a failed GET may succeed when retried. Requests S3
+// refused, e.g. for an object that changed since, are not retried.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var responseError *awshttp.ResponseError
+	if errors.As(err, &responseError) {
+		status := responseError.HTTPStatusCode()
+		return status >= 500 || status == 429
+	}
+	// transport errors, short reads and checksum mismatches
+	return true
+}
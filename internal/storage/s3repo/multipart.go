@@ -0,0 +1,362 @@
+package s3repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"audio_compression/entity"
+)
+
+const (
+	// minPartSize is the smallest part S3 accepts, except for the last one
+	minPartSize = 5 << 20
+	maxParts    = 10000
+	// abortTimeout bounds aborting the upload of a cancelled request
+	abortTimeout = 30 * time.Second
+)
+
+// UseUploadStore records multipart uploads in store, so the next upload of an
+// object resumes one that failed. Parts it reads again unchanged are not sent
+// again, which needs the same bytes in the same parts and the same metadata.
+func (s3Repo *S3Repository) UseUploadStore(store entity.UploadStore) {
+	s3Repo.uploads = store
+}
+
+// uploadMultipart uploads first and the rest of r in parts, concurrency of them at
+// a time.
+func (s3Repo *S3Repository) uploadMultipart(ctx context.Context, input *s3.PutObjectInput, first []byte, r io.Reader) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "UploadMultipart")
+	defer span.End()
+
+	upload, parts := s3Repo.resumeUpload(ctx, input)
+	if upload == nil {
+		var err error
+		if upload, err = s3Repo.createUpload(ctx, input); err != nil {
+			return err
+		}
+	}
+	span.SetAttributes(attribute.String("upload_id", upload.ID))
+
+	uploaded := make(map[int32]entity.UploadedPart, len(parts))
+	for _, part := range parts {
+		uploaded[part.PartNumber] = part
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		uploadErr error
+		completed []types.CompletedPart
+		reused    int
+	)
+	// parts in flight are finished after a failure, so a retry does not send them again
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if uploadErr == nil {
+			uploadErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr != nil
+	}
+	complete := func(number int32, etag, hash string) {
+		mu.Lock()
+		defer mu.Unlock()
+		completed = append(completed, types.CompletedPart{ETag: aws.String(etag), PartNumber: number, ChecksumSHA256: checksumSHA256(hash)})
+	}
+
+	slots := make(chan struct{}, s3Repo.concurrency)
+	body, last := first, false
+	for number := int32(1); ctx.Err() == nil && !failed(); number++ {
+		if number > maxParts {
+			fail(fmt.Errorf("object exceeds %d parts of %d bytes", maxParts, s3Repo.partSize))
+			break
+		}
+
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+		if part, ok := uploaded[number]; ok && part.Size == int64(len(body)) && part.SHA256 == hash {
+			complete(number, part.ETag, part.SHA256)
+			reused++
+		} else {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			wg.Add(1)
+			go func(number int32, body []byte, hash string) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				etag, err := s3Repo.uploadPart(ctx, input, upload.ID, number, body, hash)
+				if err != nil {
+					fail(err)
+					return
+				}
+				if s3Repo.uploads != nil {
+					// a part that is not recorded only costs sending it again on resume
+					s3Repo.uploads.SavePart(ctx, &entity.UploadedPart{UploadID: upload.ID, PartNumber: number, ETag: etag, Size: int64(len(body)), SHA256: hash})
+				}
+				complete(number, etag, hash)
+			}(number, body, hash)
+		}
+
+		if last {
+			break
+		}
+		body = make([]byte, s3Repo.partSize)
+		n, err := io.ReadFull(r, body)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			body, last = body[:n], true
+		} else if err != nil {
+			fail(err)
+			break
+		}
+	}
+	wg.Wait()
+
+	span.SetAttributes(attribute.Int("parts_reused", reused))
+	if uploadErr == nil && ctx.Err() != nil {
+		uploadErr = ctx.Err()
+	}
+	if uploadErr != nil {
+		if s3Repo.uploads == nil || isNoSuchUpload(uploadErr) {
+			// nothing resumes it
+			abortCtx, cancelAbort := context.WithTimeout(context.Background(), abortTimeout)
+			defer cancelAbort()
+			s3Repo.abortUpload(abortCtx, aws.ToString(input.Bucket), aws.ToString(input.Key), upload.ID)
+		}
+		return uploadErr
+	}
+
+	sort.Slice(completed, func(i, j int) bool { return completed[i].PartNumber < completed[j].PartNumber })
+	completeInput := &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(upload.ID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	}
+	completeInput.SSECustomerAlgorithm, completeInput.SSECustomerKey, completeInput.SSECustomerKeyMD5 = input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5
+	if _, err := s3Repo.sess.CompleteMultipartUpload(ctx, completeInput); err != nil {
+		if isNoSuchUpload(err) {
+			s3Repo.forgetUpload(ctx, upload.ID)
+		}
+		return err
+	}
+	s3Repo.forgetUpload(ctx, upload.ID)
+	return nil
+}
+
+// resumeUpload returns the recorded upload of the object started with the same
+// options, or nil when there is none. Uploads started with other options are
+// aborted, since their parts would be stored with the wrong metadata.
+func (s3Repo *S3Repository) resumeUpload(ctx context.Context, input *s3.PutObjectInput) (*entity.MultipartUpload, []entity.UploadedPart) {
+	if s3Repo.uploads == nil {
+		return nil, nil
+	}
+	bucket, key := aws.ToString(input.Bucket), aws.ToString(input.Key)
+	// a failed lookup starts over
+	upload, parts, err := s3Repo.uploads.FindUpload(ctx, bucket, key)
+	if err != nil || upload == nil {
+		return nil, nil
+	}
+	if upload.Fingerprint != s3Repo.fingerprint(input) || upload.PartSize != s3Repo.partSize {
+		s3Repo.abortUpload(ctx, bucket, key, upload.ID)
+		return nil, nil
+	}
+	return upload, parts
+}
+
+// createUpload starts a multipart upload and records it.
+func (s3Repo *S3Repository) createUpload(ctx context.Context, input *s3.PutObjectInput) (*entity.MultipartUpload, error) {
+	out, err := s3Repo.sess.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		Metadata:             input.Metadata,
+		ContentType:          input.ContentType,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		StorageClass:         input.StorageClass,
+		Tagging:              input.Tagging,
+		ChecksumAlgorithm:    input.ChecksumAlgorithm,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &entity.MultipartUpload{
+		ID:          aws.ToString(out.UploadId),
+		Bucket:      aws.ToString(input.Bucket),
+		Key:         aws.ToString(input.Key),
+		Fingerprint: s3Repo.fingerprint(input),
+		PartSize:    s3Repo.partSize,
+	}
+	if s3Repo.uploads != nil {
+		// an upload that is not recorded is not resumed, the sweeper finds it
+		// in the buckets it lists
+		s3Repo.uploads.CreateUpload(ctx, upload)
+	}
+	return upload, nil
+}
+
+func (s3Repo *S3Repository) uploadPart(ctx context.Context, input *s3.PutObjectInput, uploadID string, number int32, body []byte, hash string) (string, error) {
+	out, err := s3Repo.sess.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		UploadId:             aws.String(uploadID),
+		PartNumber:           number,
+		Body:                 bytes.NewReader(body),
+		ChecksumSHA256:       checksumSHA256(hash),
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+// abortUpload aborts an upload and forgets it. Uploads S3 no longer knows are
+// forgotten as well.
+func (s3Repo *S3Repository) abortUpload(ctx context.Context, bucket, key, uploadID string) error {
+	_, err := s3Repo.sess.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil && !isNoSuchUpload(err) {
+		return err
+	}
+	s3Repo.forgetUpload(ctx, uploadID)
+	return nil
+}
+
+func (s3Repo *S3Repository) forgetUpload(ctx context.Context, uploadID string) {
+	if s3Repo.uploads != nil {
+		s3Repo.uploads.DeleteUpload(ctx, uploadID)
+	}
+}
+
+// SweepUploads aborts the multipart uploads not continued since before: those
+// recorded in the upload store, and those initiated before in buckets that are
+// not recorded as continued since. It returns how many it aborted.
+func (s3Repo *S3Repository) SweepUploads(ctx context.Context, before time.Time, buckets []string) (int, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "SweepUploads")
+	defer span.End()
+
+	aborted := 0
+	if s3Repo.uploads != nil {
+		uploads, err := s3Repo.uploads.StaleUploads(ctx, before)
+		if err != nil {
+			return 0, err
+		}
+		for _, upload := range uploads {
+			if err := s3Repo.abortUpload(ctx, upload.Bucket, upload.Key, upload.ID); err != nil {
+				return aborted, err
+			}
+			aborted++
+		}
+	}
+
+	for _, bucket := range buckets {
+		input := &s3.ListMultipartUploadsInput{Bucket: aws.String(bucket)}
+		for {
+			out, err := s3Repo.sess.ListMultipartUploads(ctx, input)
+			if err != nil {
+				return aborted, err
+			}
+			for _, upload := range out.Uploads {
+				key, uploadID := aws.ToString(upload.Key), aws.ToString(upload.UploadId)
+				if upload.Initiated == nil || !upload.Initiated.Before(before) || s3Repo.continuedSince(ctx, bucket, key, uploadID, before) {
+					continue
+				}
+				if err := s3Repo.abortUpload(ctx, bucket, key, uploadID); err != nil {
+					return aborted, err
+				}
+				aborted++
+			}
+			if !out.IsTruncated {
+				break
+			}
+			input.KeyMarker, input.UploadIdMarker = out.NextKeyMarker, out.NextUploadIdMarker
+		}
+	}
+
+	span.SetAttributes(attribute.Int("aborted", aborted))
+	return aborted, nil
+}
+
+// continuedSince reports whether the upload is recorded with a part since before,
+// which is the case for large objects taking long to resume.
+func (s3Repo *S3Repository) continuedSince(ctx context.Context, bucket, key, uploadID string, before time.Time) bool {
+	if s3Repo.uploads == nil {
+		return false
+	}
+	upload, _, err := s3Repo.uploads.FindUpload(ctx, bucket, key)
+	// keep the upload when unsure
+	if err != nil {
+		return true
+	}
+	return upload != nil && upload.ID == uploadID && !upload.UpdatedAt.Before(before)
+}
+
+// fingerprint hashes what an upload is started with besides its parts.
+func (s3Repo *S3Repository) fingerprint(input *s3.PutObjectInput) string {
+	h := sha256.New()
+	names := make([]string, 0, len(input.Metadata))
+	for name := range input.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "metadata %q=%q\n", name, input.Metadata[name])
+	}
+	fmt.Fprintf(h, "content type %q\n", aws.ToString(input.ContentType))
+	fmt.Fprintf(h, "sse %q %q %q\n", input.ServerSideEncryption, aws.ToString(input.SSEKMSKeyId), aws.ToString(input.SSECustomerKeyMD5))
+	fmt.Fprintf(h, "storage class %q\ntags %q\nchecksum %q\n", input.StorageClass, aws.ToString(input.Tagging), input.ChecksumAlgorithm)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checksumSHA256 returns the base64 x-amz-checksum-sha256 of a hex SHA-256.
+func checksumSHA256(hash string) *string {
+	sum, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil
+	}
+	return aws.String(base64.StdEncoding.EncodeToString(sum))
+}
+
+// isNoSuchUpload reports whether S3 no longer knows an upload, e.g. one the
+// sweeper aborted.
+func isNoSuchUpload(err error) bool {
+	var apiErr interface{ ErrorCode() string }
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload"
+}
@@ -1,28 +1,46 @@
 package s3repo
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"go.opentelemetry.io/otel"
+
+	"audio_compression/config"
+	"audio_compression/entity"
 )
 
 const traceName = "S3-Repo"
 
 type S3Repository struct {
 	sess *s3.Client
+	// customerKey is the SSE-C key, nil when none is configured
+	customerKey []byte
+	partSize    int64
+	concurrency int
+	download    config.S3Download
+	// uploads records multipart uploads to resume them, nil when they start over
+	uploads entity.UploadStore
 }
 
 func boolPointer(b bool) *bool {
 	return &b
 }
 
-func NewS3Repository() (*S3Repository, error) {
+func NewS3Repository(s3cfg config.S3) (*S3Repository, error) {
 	// sdkConfig, err := config.LoadDefaultConfig(context.TODO())
 	// if err != nil {
 	// 	fmt.Println("Couldn't load default configuration. Have you set up your AWS account?")
@@ -30,70 +48,282 @@ func NewS3Repository() (*S3Repository, error) {
 	// 	return nil, err
 	// }
 
-	const defaultRegion = "us-east-1"
-	hostAddress := "http://localhost:9000"
-
 	resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...any) (aws.Endpoint, error) {
 		return aws.Endpoint{
 			PartitionID:       "aws",
-			SigningRegion:     defaultRegion,
-			URL:               hostAddress,
+			SigningRegion:     s3cfg.Region,
+			URL:               s3cfg.Endpoint,
 			HostnameImmutable: true,
 		}, nil
 	})
 
 	cfg := aws.Config{
-		Region:                      defaultRegion,
+		Region:                      s3cfg.Region,
 		EndpointResolverWithOptions: resolver,
-		Credentials:                 credentials.NewStaticCredentialsProvider("minioadmin", "minioadmin", ""),
+		Credentials:                 credentials.NewStaticCredentialsProvider(s3cfg.AccessKey, s3cfg.SecretKey, ""),
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
-	return &S3Repository{s3Client}, nil
+	repo := &S3Repository{
+		sess:        s3.NewFromConfig(cfg),
+		partSize:    s3cfg.Multipart.PartSize,
+		concurrency: s3cfg.Multipart.Concurrency,
+		download:    s3cfg.Download,
+	}
+	if repo.partSize < minPartSize {
+		repo.partSize = minPartSize
+	}
+	if repo.concurrency < 1 {
+		repo.concurrency = 1
+	}
+	if repo.download.PartSize < 1 {
+		repo.download.PartSize = minPartSize
+	}
+	if repo.download.Concurrency < 1 {
+		repo.download.Concurrency = 1
+	}
+	if s3cfg.SSECustomerKeyFile != "" {
+		b, err := os.ReadFile(s3cfg.SSECustomerKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("SSE-C key must be 32 base64 encoded bytes")
+		}
+		repo.customerKey = key
+	}
+	return repo, nil
 }
 
+// DownloadObject copies the object to w, see OpenObject.
 func (s3Repo *S3Repository) DownloadObject(ctx context.Context, bucket string, key string, w io.Writer) error {
 	ctx, span := otel.Tracer(traceName).Start(ctx, "DownloadObject")
 	defer span.End()
 
-	downloader := manager.NewDownloader(s3Repo.sess)
+	r, _, err := s3Repo.OpenObject(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-	var buffer []byte
-	bw := manager.NewWriteAtBuffer(buffer)
+	_, err = io.Copy(w, r)
+	return err
+}
 
-	numBytes, err := downloader.Download(context.TODO(), bw, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+func (s3Repo *S3Repository) UploadObject(ctx context.Context, bucket string, key string, r io.Reader, opts entity.UploadOptions) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "UploadObject")
+	defer span.End()
+
+	input, err := s3Repo.putInput(bucket, key, opts)
 	if err != nil {
 		return err
 	}
 
-	if numBytes < 1 {
-		return errors.New("zero bytes written to memory")
+	// objects up to one part are put in one request
+	first := make([]byte, s3Repo.partSize)
+	n, err := io.ReadFull(r, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		input.Body = bytes.NewReader(first[:n])
+		_, err = s3Repo.sess.PutObject(ctx, input)
+		return err
 	}
-
-	if _, err := w.Write(bw.Bytes()); err != nil {
+	if err != nil {
 		return err
 	}
+	return s3Repo.uploadMultipart(ctx, input, first, r)
+}
 
-	return nil
+// putInput returns the request storing an object as opts says, without its body.
+func (s3Repo *S3Repository) putInput(bucket, key string, opts entity.UploadOptions) (*s3.PutObjectInput, error) {
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Metadata: opts.Metadata,
+		// kept for every part as well, so GETs of parts are validated
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+
+	switch opts.Storage.SSE {
+	case "":
+	case entity.SSEC:
+		if s3Repo.customerKey == nil {
+			return nil, errors.New("SSE-C requested but no customer key is configured")
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = s3Repo.sseC()
+	default:
+		input.ServerSideEncryption = types.ServerSideEncryption(opts.Storage.SSE)
+		if opts.Storage.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(opts.Storage.KMSKeyID)
+		}
+	}
+	if opts.Storage.StorageClass != "" {
+		input.StorageClass = types.StorageClass(opts.Storage.StorageClass)
+	}
+	if len(opts.Storage.Tags) > 0 {
+		input.Tagging = aws.String(encodeTags(opts.Storage.Tags))
+	}
+	return input, nil
 }
 
-func (s3Repo *S3Repository) UploadObject(ctx context.Context, bucket string, key string, r io.Reader) error {
-	ctx, span := otel.Tracer(traceName).Start(ctx, "UploadObject")
+func (s3Repo *S3Repository) StatObject(ctx context.Context, bucket string, key string) (*entity.ObjectInfo, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "StatObject")
 	defer span.End()
 
-	uploader := manager.NewUploader(s3Repo.sess)
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	out, err := s3Repo.sess.HeadObject(ctx, input)
+	if s3Repo.retryWithCustomerKey(err) {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = s3Repo.sseC()
+		out, err = s3Repo.sess.HeadObject(ctx, input)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := uploader.Upload(context.TODO(), &s3.PutObjectInput{
+	info := &entity.ObjectInfo{
+		Key:          key,
+		ETag:         strings.Trim(aws.ToString(out.ETag), `"`),
+		Size:         out.ContentLength,
+		Metadata:     out.Metadata,
+		ContentType:  aws.ToString(out.ContentType),
+		StorageClass: string(out.StorageClass),
+		SSE:          string(out.ServerSideEncryption),
+		KMSKeyID:     aws.ToString(out.SSEKMSKeyId),
+		// x-amz-restore reads ongoing-request="false" once the copy is available
+		Restored: strings.Contains(aws.ToString(out.Restore), `ongoing-request="false"`),
+	}
+	if out.SSECustomerAlgorithm != nil {
+		info.SSE = entity.SSEC
+	}
+	if out.LastModified != nil {
+		info.LastModified = *out.LastModified
+	}
+	return info, nil
+}
+
+func (s3Repo *S3Repository) ListObjects(ctx context.Context, bucket, prefix string, fn func(object *entity.ObjectInfo) error) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "ListObjects")
+	defer span.End()
+
+	paginator := s3.NewListObjectsV2Paginator(s3Repo.sess, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			info := &entity.ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				ETag:         strings.Trim(aws.ToString(object.ETag), `"`),
+				Size:         object.Size,
+				StorageClass: string(object.StorageClass),
+			}
+			if object.LastModified != nil {
+				info.LastModified = *object.LastModified
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s3Repo *S3Repository) DeleteObject(ctx context.Context, bucket, key string) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "DeleteObject")
+	defer span.End()
+
+	_, err := s3Repo.sess.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-		Body:   r,
 	})
+	return err
+}
+
+// ReplaceMetadata copies the object onto itself, in parts for objects over the
+// 5 GB CopyObject takes. Tags are copied along. Objects in an archive storage
+// class have to be restored first.
+func (s3Repo *S3Repository) ReplaceMetadata(ctx context.Context, bucket, key, etag string, metadata map[string]string) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "ReplaceMetadata")
+	defer span.End()
+
+	info, err := s3Repo.StatObject(ctx, bucket, key)
 	if err != nil {
 		return err
 	}
+	if info.NeedsRestore() {
+		return entity.ErrArchiveInColdStorage
+	}
 
-	return nil
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(url.PathEscape(bucket) + "/" + escapeKey(key)),
+		CopySourceIfMatch: aws.String(`"` + etag + `"`),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          metadata,
+	}
+	// a copy takes the bucket defaults unless told otherwise
+	if info.ContentType != "" {
+		input.ContentType = aws.String(info.ContentType)
+	}
+	if info.StorageClass != "" {
+		input.StorageClass = types.StorageClass(info.StorageClass)
+	}
+	switch info.SSE {
+	case "":
+	case entity.SSEC:
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = s3Repo.sseC()
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = s3Repo.sseC()
+	default:
+		input.ServerSideEncryption = types.ServerSideEncryption(info.SSE)
+		if info.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(info.KMSKeyID)
+		}
+	}
+
+	if info.Size > maxCopySize {
+		return s3Repo.copyMultipart(ctx, input, info.Size)
+	}
+	_, err = s3Repo.sess.CopyObject(ctx, input)
+	return err
+}
+
+// retryWithCustomerKey reports whether a read failed because the object was
+// written with SSE-C, which S3 answers with 400 Bad Request.
+func (s3Repo *S3Repository) retryWithCustomerKey(err error) bool {
+	var responseError *awshttp.ResponseError
+	return s3Repo.customerKey != nil && errors.As(err, &responseError) && responseError.HTTPStatusCode() == http.StatusBadRequest
+}
+
+// sseC returns the algorithm, key and key MD5 of the SSE-C headers.
+func (s3Repo *S3Repository) sseC() (*string, *string, *string) {
+	sum := md5.Sum(s3Repo.customerKey)
+	return aws.String("AES256"), aws.String(base64.StdEncoding.EncodeToString(s3Repo.customerKey)), aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// encodeTags formats tags as the query string x-amz-tagging takes.
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+// escapeKey escapes the segments of key, keeping its slashes.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
 }
@@ -7,7 +7,7 @@ import (
 )
 
 type NewRequest struct {
-	Requestid string `json: "requestid"`
+	Requestid string `json:"requestid"`
 	TraceID   string
 	SpanID    string
 }
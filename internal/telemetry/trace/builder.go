@@ -53,9 +53,7 @@ func (b *traceProviderBuilder) Build() (*trace.TracerProvider, CloseFunc, error)
 	return tracerProvider, func(ctx context.Context) error {
 		cxt, cancel := context.WithTimeout(ctx, 5*time.Second)
 		defer cancel()
-		if err := b.exporter.Shutdown(cxt); err != nil {
-			return err
-		}
-		return err
+		// flushes the spans still batched, then shuts the exporter down
+		return tracerProvider.Shutdown(cxt)
 	}, nil
 }
@@ -44,15 +44,22 @@ func (s *Worker) Run(ctx context.Context, cfg *config.Config) error {
 
 	compUsecase := compression.NewCompressionUsecase(cfg, db, l)
 
-	amqpWoker, err := rmq.NewAMQPWorker(cfg, l, compUsecase)
+	amqpWorker, err := rmq.NewAMQPWorker(cfg, l, compUsecase)
 	if err != nil {
 		l.Fatal(err)
 	}
 
-	if err := amqpWoker.StartConsumer(); err != nil {
-		l.Error(err)
+	if err := amqpWorker.StartConsumer(); err != nil {
+		l.Fatal(err)
 	}
 
+	sweepCtx, stopSweep := context.WithCancel(ctx)
+	sweepDone := make(chan struct{})
+	go func() {
+		defer close(sweepDone)
+		compUsecase.SweepUploads(sweepCtx)
+	}()
+
 	l.Info("compression worker started")
 
 	// Waiting signal
@@ -62,23 +69,21 @@ func (s *Worker) Run(ctx context.Context, cfg *config.Config) error {
 	select {
 	case s := <-interrupt:
 		l.Info("app - Run - signal: " + s.String())
-		// case err := <-amqpWoker.Notify():
-		// 	l.Error(fmt.Errorf("app - Run - httpServer.Notify: %w", err))
+	case err := <-amqpWorker.Notify():
+		l.Error(fmt.Errorf("app - Run - amqpWorker.Notify: %v", err))
 	}
 
-	log.Printf("server stopped")
+	log.Printf("worker stopping")
 
-	ctxShutDown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer func() {
-		cancel()
-	}()
+	// Shutdown, draining the jobs in flight before anything they use is closed
+	ctxShutDown, cancel := context.WithTimeout(context.Background(), cfg.Worker.ShutdownTimeout)
+	defer cancel()
 
-	// Shutdown
-	if err := amqpWoker.CloseChan(); err != nil {
-		l.Error(fmt.Errorf("app - Run - compressionConsumer.Shutdown: %w", err))
+	if err := amqpWorker.Shutdown(ctxShutDown); err != nil {
+		l.Error(fmt.Errorf("app - Run - amqpWorker.Shutdown: %w", err))
 	}
-
-	log.Printf("server exited properly")
+	stopSweep()
+	<-sweepDone
 
 	sql, err := db.DB()
 	if err != nil {
@@ -89,23 +94,17 @@ func (s *Worker) Run(ctx context.Context, cfg *config.Config) error {
 		log.Fatal().Msgf("unable close db connection")
 	}
 
-	// for _, closeFn := range s.metricProviderCloseFn {
-	// 	go func() {
-	// 		err = closeFn(ctxShutDown)
-	// 		if err != nil {
-	// 			log.Error().Err(err).Msgf("Unable to close metric provider")
-	// 		}
-	// 	}()
-	// }
+	// Metrics are scraped from the process, so only traces need flushing
+	ctxFlush, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
 	for _, closeFn := range s.traceProviderCloseFn {
-		go func() {
-			err = closeFn(ctxShutDown)
-			if err != nil {
-				log.Error().Err(err).Msgf("Unable to close trace provider")
-			}
-		}()
+		if err = closeFn(ctxFlush); err != nil {
+			log.Error().Err(err).Msgf("Unable to close trace provider")
+		}
 	}
 
+	log.Printf("worker exited properly")
+
 	return err
 }
 
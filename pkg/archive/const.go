@@ -1,3 +1,6 @@
 package archive
 
 const traceName = "archiver"
+
+// ManifestName is the member name of the manifest embedded at the head of compressed archives.
+const ManifestName = ".manifest.json"
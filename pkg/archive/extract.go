@@ -0,0 +1,187 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"audio_compression/entity"
+)
+
+// Limits bound what Extract reads into memory. Zero values are unlimited.
+type Limits struct {
+	MaxTotalBytes  int64
+	MaxMembers     int
+	MaxMemberBytes int64
+	// MaxRatio bounds the extracted bytes per byte of the archive, which catches
+	// gzip bombs as well as sparse tar members
+	MaxRatio float64
+}
+
+// ratioSlack keeps small archives of highly compressible members under MaxRatio.
+const ratioSlack = 1 << 20
+
+// Violation names the check an archive failed.
+type Violation string
+
+const (
+	ViolationTotalSize   Violation = "total_size"
+	ViolationMemberCount Violation = "member_count"
+	ViolationMemberSize  Violation = "member_size"
+	ViolationRatio       Violation = "ratio"
+	ViolationUnsafePath  Violation = "unsafe_path"
+	ViolationDuplicate   Violation = "duplicate_member"
+	ViolationEntryType   Violation = "entry_type"
+)
+
+// ExtractError is returned by Extract for archives it refuses. It matches
+// entity.ErrUnsafeArchive.
+type ExtractError struct {
+	Violation Violation
+	Member    string
+	Detail    string
+}
+
+func (e *ExtractError) Error() string {
+	if e.Member == "" {
+		return fmt.Sprintf("unsafe archive: %s: %s", e.Violation, e.Detail)
+	}
+	return fmt.Sprintf("unsafe archive: %s: member %q: %s", e.Violation, e.Member, e.Detail)
+}
+
+func (e *ExtractError) Is(target error) bool {
+	return target == entity.ErrUnsafeArchive
+}
+
+// countingReader counts the bytes of the archive read so far.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// extractTar reads the regular members of tr into memory. Directories are skipped,
+// any other entry type is refused since it cannot be restored as a file. archive
+// counts the bytes of the archive as stored, for the ratio check.
+func extractTar(ctx context.Context, tr *tar.Reader, archive *countingReader, limits Limits) ([]entity.FileObject, error) {
+	var extractedFiles []entity.FileObject
+	var total int64
+	seen := make(map[string]bool)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeDir:
+			continue
+		default:
+			return nil, &ExtractError{Violation: ViolationEntryType, Member: hdr.Name, Detail: fmt.Sprintf("type %q is not a regular file", hdr.Typeflag)}
+		}
+
+		name, ok := CleanName(hdr.Name)
+		if !ok {
+			return nil, &ExtractError{Violation: ViolationUnsafePath, Member: hdr.Name, Detail: "path leaves the archive"}
+		}
+		if seen[name] {
+			return nil, &ExtractError{Violation: ViolationDuplicate, Member: name, Detail: "name appears more than once"}
+		}
+		seen[name] = true
+
+		if limits.MaxMembers > 0 && len(seen) > limits.MaxMembers {
+			return nil, &ExtractError{Violation: ViolationMemberCount, Detail: fmt.Sprintf("more than %d members", limits.MaxMembers)}
+		}
+		if limits.MaxMemberBytes > 0 && hdr.Size > limits.MaxMemberBytes {
+			return nil, &ExtractError{Violation: ViolationMemberSize, Member: name, Detail: fmt.Sprintf("%d bytes is over the limit of %d", hdr.Size, limits.MaxMemberBytes)}
+		}
+		if limits.MaxTotalBytes > 0 && total+hdr.Size > limits.MaxTotalBytes {
+			return nil, &ExtractError{Violation: ViolationTotalSize, Member: name, Detail: fmt.Sprintf("members add up to more than %d bytes", limits.MaxTotalBytes)}
+		}
+
+		// the header size is checked before reading, the ratio while reading
+		fileBody, err := readMember(tr, hdr.Size, total, archive, limits.MaxRatio)
+		if err != nil {
+			if e, ok := err.(*ExtractError); ok {
+				e.Member = name
+			}
+			return nil, err
+		}
+		total += hdr.Size
+
+		extractedFiles = append(extractedFiles, entity.FileObject{Name: name, Body: fileBody})
+	}
+	return extractedFiles, nil
+}
+
+// readMember reads a member of size bytes in chunks, checking after each one that
+// the bytes extracted stay within maxRatio of the archive bytes read. The buffer
+// grows with the bytes read, not with the size the header claims.
+func readMember(r io.Reader, size, extracted int64, archive *countingReader, maxRatio float64) ([]byte, error) {
+	const chunk = 1 << 20
+
+	var body bytes.Buffer
+	member := io.LimitReader(r, size)
+	for read := int64(0); read < size; {
+		n := size - read
+		if n > chunk {
+			n = chunk
+		}
+		if _, err := io.CopyN(&body, member, n); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		read += n
+
+		if maxRatio > 0 && archive != nil {
+			out := extracted + read
+			if out > ratioSlack && float64(out) > maxRatio*float64(archive.n) {
+				return nil, &ExtractError{Violation: ViolationRatio, Detail: fmt.Sprintf("expands more than %g times", maxRatio)}
+			}
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// CleanName normalises a member name to a slash separated relative path. It reports
+// false for names that are absolute, climb out of the archive or hold characters
+// other systems treat as separators.
+func CleanName(name string) (string, bool) {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || path.IsAbs(name) {
+		return "", false
+	}
+	if len(name) >= 2 && name[1] == ':' {
+		// a Windows drive letter
+		return "", false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return "", false
+	}
+	return cleaned, true
+}
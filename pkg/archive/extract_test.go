@@ -0,0 +1,172 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+
+	"audio_compression/entity"
+)
+
+// member is a tar entry of a test archive.
+type member struct {
+	name     string
+	typeflag byte
+	body     []byte
+}
+
+func regular(name string, size int) member {
+	return member{name: name, typeflag: tar.TypeReg, body: bytes.Repeat([]byte{'a'}, size)}
+}
+
+func buildTar(t *testing.T, members ...member) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Typeflag: m.typeflag, Mode: 0600, Size: int64(len(m.body))}
+		switch m.typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = "target.wav"
+		}
+		if m.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write(m.body); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(b)
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// violationOf returns the violation of an ExtractError and checks it matches
+// entity.ErrUnsafeArchive.
+func violationOf(t *testing.T, err error) Violation {
+	t.Helper()
+	var e *ExtractError
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v, want an ExtractError", err)
+	}
+	if !errors.Is(err, entity.ErrUnsafeArchive) {
+		t.Errorf("%v does not match entity.ErrUnsafeArchive", err)
+	}
+	return e.Violation
+}
+
+func TestExtractRefusesUnsafeArchives(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []member
+		limits  Limits
+		want    Violation
+	}{
+		{"parent dir", []member{regular("../a.wav", 1)}, Limits{}, ViolationUnsafePath},
+		{"parent dir inside", []member{regular("a/../../a.wav", 1)}, Limits{}, ViolationUnsafePath},
+		{"parent dir resolving inside", []member{regular("a/../a.wav", 1)}, Limits{}, ViolationUnsafePath},
+		{"absolute", []member{regular("/etc/passwd", 1)}, Limits{}, ViolationUnsafePath},
+		{"drive letter", []member{regular("C:/a.wav", 1)}, Limits{}, ViolationUnsafePath},
+		{"drive relative", []member{regular("c:a.wav", 1)}, Limits{}, ViolationUnsafePath},
+		{"backslash", []member{regular(`a\..\..\a.wav`, 1)}, Limits{}, ViolationUnsafePath},
+		{"dot", []member{regular(".", 1)}, Limits{}, ViolationUnsafePath},
+		{"duplicate", []member{regular("a.wav", 1), regular("a.wav", 1)}, Limits{}, ViolationDuplicate},
+		{"duplicate once cleaned", []member{regular("a.wav", 1), regular("./a.wav", 1)}, Limits{}, ViolationDuplicate},
+		{"symlink", []member{{name: "a.wav", typeflag: tar.TypeSymlink}}, Limits{}, ViolationEntryType},
+		{"hard link", []member{{name: "a.wav", typeflag: tar.TypeLink}}, Limits{}, ViolationEntryType},
+		{"char device", []member{{name: "a.wav", typeflag: tar.TypeChar}}, Limits{}, ViolationEntryType},
+		{"block device", []member{{name: "a.wav", typeflag: tar.TypeBlock}}, Limits{}, ViolationEntryType},
+		{"fifo", []member{{name: "a.wav", typeflag: tar.TypeFifo}}, Limits{}, ViolationEntryType},
+		{"member count", []member{regular("a.wav", 1), regular("b.wav", 1), regular("c.wav", 1)}, Limits{MaxMembers: 2}, ViolationMemberCount},
+		{"member size", []member{regular("a.wav", 101)}, Limits{MaxMemberBytes: 100}, ViolationMemberSize},
+		{"total size", []member{regular("a.wav", 100), regular("b.wav", 100)}, Limits{MaxTotalBytes: 150}, ViolationTotalSize},
+		{"ratio", []member{regular("a.wav", 4<<20)}, Limits{MaxRatio: 10}, ViolationRatio},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := gzipped(t, buildTar(t, tt.members...))
+			_, err := NewTarGzArchiever(tt.limits).Extract(context.Background(), bytes.NewReader(archive))
+			if got := violationOf(t, err); got != tt.want {
+				t.Errorf("got violation %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractWithinLimits(t *testing.T) {
+	limits := Limits{MaxMembers: 2, MaxMemberBytes: 100, MaxTotalBytes: 200, MaxRatio: 10}
+	archive := buildTar(t,
+		member{name: "dir/", typeflag: tar.TypeDir},
+		regular("./dir/a.wav", 100),
+		regular("b.wav", 100),
+	)
+
+	for name, archiver := range map[string]Archiver{"tar": NewTarArchiever(limits), "tar gz": NewTarGzArchiever(limits)} {
+		t.Run(name, func(t *testing.T) {
+			body := archive
+			if name == "tar gz" {
+				body = gzipped(t, archive)
+			}
+			files, err := archiver.Extract(context.Background(), bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 2 || files[0].Name != "dir/a.wav" || files[1].Name != "b.wav" {
+				t.Fatalf("got %+v", files)
+			}
+			for _, file := range files {
+				if len(file.Body) != 100 {
+					t.Errorf("%s has %d bytes, want 100", file.Name, len(file.Body))
+				}
+			}
+		})
+	}
+}
+
+// TestExtractTruncatedMember checks a header claiming a large member does not
+// allocate its size before the bytes arrive.
+func TestExtractTruncatedMember(t *testing.T) {
+	const claimed = 1 << 30
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "a.wav", Typeflag: tar.TypeReg, Mode: 0600, Size: claimed}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(make([]byte, 1000))
+	tw.Flush()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := NewTarArchiever(Limits{MaxMemberBytes: 2 * claimed}).Extract(context.Background(), &buf)
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > claimed/16 {
+		t.Errorf("allocated %d bytes for a member of 1000 bytes", allocated)
+	}
+}
@@ -9,4 +9,5 @@ import (
 type Archiver interface {
 	Compress(ctx context.Context, fileObjects []entity.FileObject, buf io.Writer) error
 	Extract(ctx context.Context, r io.Reader) ([]entity.FileObject, error)
+	List(ctx context.Context, r io.Reader) (*entity.Manifest, error)
 }
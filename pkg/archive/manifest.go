@@ -0,0 +1,54 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	"audio_compression/entity"
+)
+
+// listTar reads the embedded manifest when it is the first member, otherwise it
+// walks the tar headers without reading member bodies.
+func listTar(tr *tar.Reader) (*entity.Manifest, error) {
+	manifest := &entity.Manifest{Source: entity.ManifestSourceHeaders}
+	first := true
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if first && hdr.Name == ManifestName {
+			var embedded entity.Manifest
+			if err := json.NewDecoder(tr).Decode(&embedded); err != nil {
+				return nil, err
+			}
+			embedded.Source = entity.ManifestSourceEmbedded
+			return &embedded, nil
+		}
+		first = false
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		manifest.Entries = append(manifest.Entries, entity.ManifestEntry{
+			Name:           hdr.Name,
+			StoredName:     hdr.Name,
+			CompressedSize: hdr.Size,
+			Format:         FormatFromName(hdr.Name),
+		})
+	}
+	return manifest, nil
+}
+
+// FormatFromName returns the lower-cased file extension without the dot.
+func FormatFromName(name string) string {
+	return strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+}
@@ -11,10 +11,12 @@ import (
 )
 
 type TarArchiever struct {
+	limits Limits
 }
 
-func NewTarArchiever() Archiver {
-	return &TarArchiever{}
+// NewTarArchiever -. limits apply to Extract.
+func NewTarArchiever(limits Limits) Archiver {
+	return &TarArchiever{limits: limits}
 }
 
 func (gz *TarArchiever) Compress(ctx context.Context, fileObjects []entity.FileObject, buf io.Writer) error {
@@ -25,6 +27,9 @@ func (gz *TarArchiever) Compress(ctx context.Context, fileObjects []entity.FileO
 	defer tw.Close()
 
 	for _, fileObject := range fileObjects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		hdr := &tar.Header{
 			Name: fileObject.Name,
 			Mode: int64(0600),
@@ -44,26 +49,13 @@ func (gz *TarArchiever) Extract(ctx context.Context, buf io.Reader) ([]entity.Fi
 	ctx, span := otel.Tracer(traceName).Start(ctx, "extract - tar")
 	defer span.End()
 
-	var extractedFiles []entity.FileObject
-	tr := tar.NewReader(buf)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		fileHeader := hdr
-
-		fileBody, err := io.ReadAll(tr)
-		if err != nil {
-			return nil, err
-		}
+	archive := &countingReader{r: buf}
+	return extractTar(ctx, tar.NewReader(archive), archive, gz.limits)
+}
 
-		extractedFiles = append(extractedFiles, entity.FileObject{Name: fileHeader.Name, Body: fileBody})
+func (gz *TarArchiever) List(ctx context.Context, buf io.Reader) (*entity.Manifest, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "list - tar")
+	defer span.End()
 
-	}
-	return extractedFiles, nil
+	return listTar(tar.NewReader(buf))
 }
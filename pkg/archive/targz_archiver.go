@@ -4,31 +4,91 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
+	"os/exec"
 
 	"audio_compression/entity"
 
 	"go.opentelemetry.io/otel"
 )
 
+// TarGzArchiever writes tar.gz archives, or tar.zst ones with the zstd codec, and
+// reads both.
 type TarGzArchiever struct {
+	limits Limits
+	level  int
+	// zstdLevel compresses with zstd instead of gzip when set
+	zstdLevel int
 }
 
-func NewTarGzArchiever() Archiver {
-	return &TarGzArchiever{}
+// NewTarGzArchiever -. limits apply to Extract.
+func NewTarGzArchiever(limits Limits) Archiver {
+	return &TarGzArchiever{limits: limits, level: gzip.DefaultCompression}
+}
+
+// CheckCodec reports whether archives of codec can be written and read here. zstd
+// needs the zstd binary.
+func CheckCodec(codec string) error {
+	if err := entity.ValidateCodec(codec, 0); err != nil {
+		return err
+	}
+	if codec != entity.CodecZstd {
+		return nil
+	}
+	if _, err := exec.LookPath(zstdBinary); err != nil {
+		return fmt.Errorf("zstd archives need the zstd binary: %w", err)
+	}
+	return nil
+}
+
+// WithCodec returns a copy of a that compresses with codec at level, its default
+// when zero. gzip levels are 1 to 9, zstd levels 1 to 19. Other archivers return a
+// as it is, unknown codecs and levels keep gzip at its default.
+func WithCodec(a Archiver, codec string, level int) Archiver {
+	gz, ok := a.(*TarGzArchiever)
+	if !ok || entity.ValidateCodec(codec, level) != nil {
+		return a
+	}
+	leveled := *gz
+	switch {
+	case codec == entity.CodecZstd && level == 0:
+		leveled.zstdLevel = defaultZstdLevel
+	case codec == entity.CodecZstd:
+		leveled.zstdLevel = level
+	case level > 0:
+		leveled.level = level
+	}
+	return &leveled
 }
 
 func (gz *TarGzArchiever) Compress(ctx context.Context, fileObjects []entity.FileObject, buf io.Writer) error {
 	ctx, span := otel.Tracer(traceName).Start(ctx, "compress - tar gz")
 	defer span.End()
 
-	gw := gzip.NewWriter(buf)
+	if gz.zstdLevel > 0 {
+		return compressZstd(ctx, gz.zstdLevel, buf, func(w io.Writer) error {
+			return writeTar(ctx, fileObjects, w)
+		})
+	}
+
+	gw, err := gzip.NewWriterLevel(buf, gz.level)
+	if err != nil {
+		return err
+	}
 	defer gw.Close()
 
-	tw := tar.NewWriter(gw)
+	return writeTar(ctx, fileObjects, gw)
+}
+
+func writeTar(ctx context.Context, fileObjects []entity.FileObject, w io.Writer) error {
+	tw := tar.NewWriter(w)
 	defer tw.Close()
 
 	for _, fileObject := range fileObjects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		hdr := &tar.Header{
 			Name: fileObject.Name,
 			Mode: int64(0600),
@@ -41,39 +101,41 @@ func (gz *TarGzArchiever) Compress(ctx context.Context, fileObjects []entity.Fil
 			return err
 		}
 	}
-	return nil
+	return tw.Close()
 }
 
 func (gz *TarGzArchiever) Extract(ctx context.Context, buf io.Reader) ([]entity.FileObject, error) {
 	ctx, span := otel.Tracer(traceName).Start(ctx, "extract - tar gz")
 	defer span.End()
 
-	var extractedFiles []entity.FileObject
-
-	gr, err := gzip.NewReader(buf)
+	archive := &countingReader{r: buf}
+	r, err := decompress(ctx, archive)
 	if err != nil {
 		return nil, err
 	}
+	defer r.Close()
 
-	tr := tar.NewReader(gr)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		fileHeader := hdr
-
-		fileBody, err := io.ReadAll(tr)
-		if err != nil {
-			return nil, err
-		}
+	files, err := extractTar(ctx, tar.NewReader(r), archive, gz.limits)
+	if err != nil {
+		return nil, err
+	}
+	// the end of the stream is where a corrupted one fails its checksum, the tar
+	// padding is all that should be left
+	if _, err := io.Copy(io.Discard, io.LimitReader(r, ratioSlack)); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
 
-		extractedFiles = append(extractedFiles, entity.FileObject{Name: fileHeader.Name, Body: fileBody})
+func (gz *TarGzArchiever) List(ctx context.Context, buf io.Reader) (*entity.Manifest, error) {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "list - tar gz")
+	defer span.End()
 
+	r, err := decompress(ctx, buf)
+	if err != nil {
+		return nil, err
 	}
-	return extractedFiles, nil
+	defer r.Close()
+
+	return listTar(tar.NewReader(r))
 }
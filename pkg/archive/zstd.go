@@ -0,0 +1,102 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// zstdBinary compresses and decompresses zstd archives, there is no zstd package
+// among the dependencies. CheckCodec tells whether it is installed.
+const zstdBinary = "zstd"
+
+// defaultZstdLevel is what the zstd binary compresses at without a level.
+const defaultZstdLevel = 3
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var errZstdClosed = errors.New("zstd: reader closed")
+
+// compressZstd writes the output of write to w compressed by the zstd binary.
+func compressZstd(ctx context.Context, level int, w io.Writer, write func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, zstdBinary, "-q", "-c", "-"+strconv.Itoa(level))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pr, w, &stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("zstd: %w", err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+
+	err := cmd.Wait()
+	// unblocks write when zstd exited before reading everything
+	pr.CloseWithError(errZstdClosed)
+	if writeErr := <-written; writeErr != nil && writeErr != errZstdClosed {
+		return writeErr
+	}
+	return zstdError(err, &stderr)
+}
+
+// zstdReader reads the output of the zstd binary decompressing r.
+type zstdReader struct {
+	*io.PipeReader
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stderr bytes.Buffer
+}
+
+func newZstdReader(ctx context.Context, r io.Reader) (*zstdReader, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	z := &zstdReader{PipeReader: pr, cancel: cancel}
+	z.cmd = exec.CommandContext(ctx, zstdBinary, "-q", "-d", "-c")
+	z.cmd.Stdin, z.cmd.Stdout, z.cmd.Stderr = r, pw, &z.stderr
+	if err := z.cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	go func() {
+		err := z.cmd.Wait()
+		pw.CloseWithError(zstdError(err, &z.stderr))
+	}()
+	return z, nil
+}
+
+// Close stops zstd unless it is done already.
+func (z *zstdReader) Close() error {
+	z.cancel()
+	return z.PipeReader.Close()
+}
+
+func zstdError(err error, stderr *bytes.Buffer) error {
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("zstd: %w: %s", err, msg)
+	}
+	return fmt.Errorf("zstd: %w", err)
+}
+
+// decompress returns the tar stream of a gzip or zstd compressed archive, told
+// apart by the magic bytes at its start.
+func decompress(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		return newZstdReader(ctx, br)
+	}
+	return gzip.NewReader(br)
+}
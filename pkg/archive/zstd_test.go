@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"testing"
+
+	"audio_compression/entity"
+)
+
+func TestZstdRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath(zstdBinary); err != nil {
+		t.Skip("zstd not found")
+	}
+	ctx := context.Background()
+	files := []entity.FileObject{
+		{Name: ManifestName, Body: []byte(`{"entries":[]}`)},
+		{Name: "a.flac", Body: bytes.Repeat([]byte("flac"), 100000)},
+		{Name: "b.txt", Body: []byte("notes")},
+	}
+
+	archiver := NewTarGzArchiever(Limits{MaxRatio: 10000})
+	var compressed bytes.Buffer
+	if err := WithCodec(archiver, entity.CodecZstd, 19).Compress(ctx, files, &compressed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(compressed.Bytes(), zstdMagic) {
+		t.Fatalf("archive starts with %x, want the zstd magic", compressed.Bytes()[:4])
+	}
+
+	extracted, err := archiver.Extract(ctx, bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extracted) != len(files) {
+		t.Fatalf("got %d members, want %d", len(extracted), len(files))
+	}
+	for i, file := range files {
+		if extracted[i].Name != file.Name || !bytes.Equal(extracted[i].Body, file.Body) {
+			t.Errorf("member %d is %s of %d bytes, want %s of %d", i, extracted[i].Name, len(extracted[i].Body), file.Name, len(file.Body))
+		}
+	}
+
+	if _, err := archiver.List(ctx, bytes.NewReader(compressed.Bytes())); err != nil {
+		t.Errorf("list: %v", err)
+	}
+
+	// a damaged frame fails its checksum even when the tar stream looks complete
+	damaged := append([]byte(nil), compressed.Bytes()...)
+	damaged[len(damaged)-1] ^= 0xff
+	if _, err := archiver.Extract(ctx, bytes.NewReader(damaged)); err == nil {
+		t.Error("extracted a damaged archive")
+	}
+	if _, err := archiver.Extract(ctx, bytes.NewReader(compressed.Bytes()[:compressed.Len()/2])); err == nil {
+		t.Error("extracted a truncated archive")
+	}
+}
+
+func TestWithCodecKeepsGzip(t *testing.T) {
+	tests := []struct {
+		codec string
+		level int
+	}{
+		{"", 0},
+		{entity.CodecGzip, 9},
+		// out of range levels keep the gzip default
+		{entity.CodecGzip, 10},
+		{entity.CodecZstd, 20},
+	}
+	files := []entity.FileObject{{Name: "a.txt", Body: []byte("a")}}
+	for _, tt := range tests {
+		var compressed bytes.Buffer
+		if err := WithCodec(NewTarGzArchiever(Limits{}), tt.codec, tt.level).Compress(context.Background(), files, &compressed); err != nil {
+			t.Fatal(err)
+		}
+		if b := compressed.Bytes(); len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+			t.Errorf("%s level %d: archive starts with %x, want the gzip magic", tt.codec, tt.level, b)
+		}
+	}
+}
+
+func TestCheckCodec(t *testing.T) {
+	if err := CheckCodec(entity.CodecGzip); err != nil {
+		t.Error(err)
+	}
+	if err := CheckCodec("lz4"); err == nil {
+		t.Error("accepted an unknown codec")
+	}
+	_, lookErr := exec.LookPath(zstdBinary)
+	if err := CheckCodec(entity.CodecZstd); (err == nil) != (lookErr == nil) {
+		t.Errorf("zstd: got %v, binary lookup %v", err, lookErr)
+	}
+}
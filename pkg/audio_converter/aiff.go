@@ -0,0 +1,113 @@
+package audio_converter
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrInvalidAiff = errors.New("invalid aiff header")
+
+type AiffHeader struct {
+	// Compression is the AIFF-C compression type, "NONE" for plain AIFF
+	Compression   string
+	Channels      uint16
+	SampleFrames  uint32
+	BitsPerSample uint16
+	SampleRate    float64
+	DataOffset    int
+	DataSize      uint32
+	Tags          map[string]string
+}
+
+// Duration returns the length of the sound data in seconds.
+func (h *AiffHeader) Duration() float64 {
+	if h.SampleRate == 0 {
+		return 0
+	}
+	return float64(h.SampleFrames) / h.SampleRate
+}
+
+// ParseAiffHeader walks the chunks of a FORM/AIFF or FORM/AIFC body.
+func ParseAiffHeader(b []byte) (*AiffHeader, error) {
+	if len(b) < 12 || string(b[0:4]) != "FORM" || (string(b[8:12]) != "AIFF" && string(b[8:12]) != "AIFC") {
+		return nil, ErrInvalidAiff
+	}
+
+	hdr := AiffHeader{Compression: "NONE"}
+	var hasComm, hasData bool
+	pos := 12
+	for pos+8 <= len(b) {
+		id := string(b[pos : pos+4])
+		size := int(binary.BigEndian.Uint32(b[pos+4 : pos+8]))
+		body := pos + 8
+		if size > len(b)-body {
+			size = len(b) - body
+		}
+
+		switch id {
+		case "COMM":
+			if size < 18 {
+				return nil, ErrInvalidAiff
+			}
+			hdr.Channels = binary.BigEndian.Uint16(b[body:])
+			hdr.SampleFrames = binary.BigEndian.Uint32(b[body+2:])
+			hdr.BitsPerSample = binary.BigEndian.Uint16(b[body+6:])
+			hdr.SampleRate = parseExtended(b[body+8 : body+18])
+			if string(b[8:12]) == "AIFC" && size >= 22 {
+				hdr.Compression = string(b[body+18 : body+22])
+			}
+			hasComm = true
+		case "SSND":
+			if size < 8 {
+				return nil, ErrInvalidAiff
+			}
+			offset := int(binary.BigEndian.Uint32(b[body:]))
+			if offset > size-8 {
+				return nil, ErrInvalidAiff
+			}
+			hdr.DataOffset = body + 8 + offset
+			hdr.DataSize = uint32(size - 8 - offset)
+			hasData = true
+		case "NAME", "AUTH", "(c) ", "ANNO":
+			if hdr.Tags == nil {
+				hdr.Tags = make(map[string]string)
+			}
+			hdr.Tags[id] = string(b[body : body+size])
+		}
+
+		pos = body + size + size&1
+	}
+
+	if !hasComm || !hasData {
+		return nil, ErrInvalidAiff
+	}
+
+	return &hdr, nil
+}
+
+// parseExtended decodes an 80 bit IEEE 754 extended precision number.
+func parseExtended(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7fff)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+	v := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// putExtended encodes a positive v as an 80 bit extended precision number into b.
+func putExtended(b []byte, v float64) {
+	for i := range b[:10] {
+		b[i] = 0
+	}
+	if v > 0 {
+		frac, exp := math.Frexp(v)
+		binary.BigEndian.PutUint16(b[0:], uint16(exp-1+16383))
+		binary.BigEndian.PutUint64(b[2:], uint64(math.Ldexp(frac, 64)))
+	}
+}
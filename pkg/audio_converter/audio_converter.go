@@ -1,36 +1,128 @@
 package audio_converter
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os/exec"
+	"strings"
 
 	ffmpeg "github.com/u2takey/ffmpeg-go"
+
+	"audio_compression/pkg/audio_converter/flac"
 )
 
-type AudioConverter struct {
+// FFmpegConverter shells out to the ffmpeg binary.
+type FFmpegConverter struct {
+	limits Limits
+}
+
+func NewFFmpegConverter(limits Limits) *FFmpegConverter {
+	return &FFmpegConverter{limits: limits}
 }
 
-func NewAudioConverter() *AudioConverter {
-	return &AudioConverter{}
+func (ac *FFmpegConverter) ConvertWavToFlac(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer) error {
+	return ac.Convert(ctx, inputAudio, ouputAudio, Format{Container: "wav"}, Format{Container: "flac"})
 }
 
-func (ac *AudioConverter) ConvertWavToFlac(inputAudio io.Reader, ouputAudio io.Writer) error {
-	err := ffmpeg.Input("pipe:", ffmpeg.KwArgs{"f": "wav"}).Output("pipe:", ffmpeg.KwArgs{"f": "flac"}).WithInput(inputAudio).WithOutput(ouputAudio).
-		OverWriteOutput().Run()
+func (ac *FFmpegConverter) ConvertFlacToWav(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer) error {
+	body, err := io.ReadAll(inputAudio)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 
-	return nil
+	// ffmpeg writes pcm_s16le by default, keep the stream sample width instead
+	to := Format{Container: "wav"}
+	if info, err := flac.ReadStreamInfo(body); err == nil {
+		to.Codec = pcmCodecName(int(info.BitsPerSample))
+	}
+
+	return ac.Convert(ctx, bytes.NewReader(body), ouputAudio, Format{Container: "flac"}, to)
 }
 
-func (ac *AudioConverter) ConvertFlacToWav(inputAudio io.Reader, ouputAudio io.Writer) error {
-	err := ffmpeg.Input("pipe:", ffmpeg.KwArgs{"f": "flac"}).Output("pipe:", ffmpeg.KwArgs{"f": "wav"}).WithInput(inputAudio).WithOutput(ouputAudio).
-		OverWriteOutput().Run()
+func (ac *FFmpegConverter) Convert(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer, from, to Format) error {
+	inputArgs := ffmpeg.KwArgs{"f": from.Container}
+	// raw PCM carries no header to read the stream parameters from
+	if from.Codec != "" && RawContainer(from.Codec) == from.Container {
+		inputArgs["ar"] = from.SampleRate
+		inputArgs["ac"] = from.Channels
+	}
+
+	outputArgs := ffmpeg.KwArgs{"f": to.Container}
+	if to.Codec != "" {
+		outputArgs["acodec"] = to.Codec
+	}
+	if to.Bitrate != "" {
+		outputArgs["b:a"] = to.Bitrate
+	}
+	if to.SampleRate > 0 {
+		outputArgs["ar"] = to.SampleRate
+	}
+	if to.Channels > 0 {
+		outputArgs["ac"] = to.Channels
+	}
+
+	// the process is killed once ctx is done or the output grows past the limit
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	output := newLimitWriter(ouputAudio, ac.limits.MaxOutputBytes, cancel)
+
+	var stderr bytes.Buffer
+	stream := ffmpeg.Input("pipe:", inputArgs).Output("pipe:", outputArgs)
+	stream.Context = runCtx
+	cmd := stream.WithInput(inputAudio).WithOutput(output, &stderr).OverWriteOutput().Compile()
+	if args := ac.limits.wrapCommand(cmd.Args); len(args) != len(cmd.Args) {
+		wrapped := exec.CommandContext(runCtx, args[0], args[1:]...)
+		wrapped.Stdin, wrapped.Stdout, wrapped.Stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+		cmd = wrapped
+	}
+
+	if err := cmd.Start(); err != nil {
+		if ctx.Err() != nil {
+			return classify(ctx, err, false)
+		}
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+	if err := ac.limits.joinCgroup(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+
+	err := cmd.Wait()
+	if output.hit {
+		return classify(ctx, fmt.Errorf("ffmpeg: %w", errOutputLimit), false)
+	}
 	if err != nil {
-		return err
+		// ffmpeg exits with an error status for inputs it cannot read, a signal means
+		// it crashed or hit a resource limit
+		var exitErr *exec.ExitError
+		crashed := errors.As(err, &exitErr) && !exitErr.Exited()
+		return classify(ctx, ffmpegError(err, &stderr), crashed)
 	}
 
 	return nil
 }
+
+func pcmCodecName(bitsPerSample int) string {
+	switch {
+	case bitsPerSample <= 8:
+		return "pcm_u8"
+	case bitsPerSample <= 16:
+		return "pcm_s16le"
+	case bitsPerSample <= 24:
+		return "pcm_s24le"
+	}
+	return "pcm_s32le"
+}
+
+// ffmpegError keeps the last line ffmpeg printed, which usually names the failure.
+func ffmpegError(err error, stderr *bytes.Buffer) error {
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return fmt.Errorf("ffmpeg: %w: %s", err, last)
+	}
+	return fmt.Errorf("ffmpeg: %w", err)
+}
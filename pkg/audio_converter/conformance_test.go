@@ -0,0 +1,185 @@
+package audio_converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// wavFixture describes a PCM WAV file of generated samples.
+type wavFixture struct {
+	bits     int
+	channels int
+	frames   int
+	// extra adds a LIST/INFO chunk before the samples and a cue chunk after them
+	extra bool
+}
+
+func (f wavFixture) String() string {
+	name := fmt.Sprintf("%dbit-%dch", f.bits, f.channels)
+	if f.extra {
+		name += "-chunks"
+	}
+	return name
+}
+
+// build returns the WAV file of the fixture and its samples scaled to 32 bits.
+func (f wavFixture) build() ([]byte, []int32) {
+	rng := rand.New(rand.NewSource(int64(f.bits*10 + f.channels)))
+	width := f.bits / 8
+	data := make([]byte, 0, f.frames*f.channels*width)
+	samples := make([]int32, 0, f.frames*f.channels)
+	for i := 0; i < f.frames; i++ {
+		for ch := 0; ch < f.channels; ch++ {
+			// a tone with noise, clipped, so the encoder sees full scale samples too
+			v := 1.1*math.Sin(float64(i)*0.03*float64(ch+1)) + 0.05*rng.NormFloat64()
+			v = math.Max(-1, math.Min(1, v))
+			max := float64(int64(1)<<(f.bits-1) - 1)
+			s := int32(math.Round(v * max))
+
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], uint32(s))
+			if f.bits == 8 {
+				// 8 bit WAV samples are unsigned
+				b[0] = byte(s + 128)
+			}
+			data = append(data, b[:width]...)
+			samples = append(samples, s<<(32-f.bits))
+		}
+	}
+
+	var body bytes.Buffer
+	chunk := func(id string, b []byte) {
+		body.WriteString(id)
+		binary.Write(&body, binary.LittleEndian, uint32(len(b)))
+		body.Write(b)
+		if len(b)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+	fmtChunk := canonicalWavHeader(f.channels, 48000, f.bits, len(data))[20:36]
+
+	body.WriteString("RIFF\x00\x00\x00\x00WAVE")
+	chunk("fmt ", fmtChunk)
+	if f.extra {
+		chunk("LIST", []byte("INFOINAM\x0b\x00\x00\x00conformance\x00"))
+	}
+	chunk("data", data)
+	if f.extra {
+		chunk("cue ", []byte{0, 0, 0, 0})
+	}
+	b := body.Bytes()
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+	return b, samples
+}
+
+// pcmSamples returns the samples of a WAV file scaled to 32 bits, which compares
+// samples widened by a converter with the source.
+func pcmSamples(t *testing.T, body []byte) []int32 {
+	t.Helper()
+	hdr, err := ParseWavHeader(body)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	data := body[hdr.DataOffset : hdr.DataOffset+int(hdr.DataSize)]
+
+	width := int(hdr.BitsPerSample) / 8
+	samples := make([]int32, 0, len(data)/width)
+	for i := 0; i+width <= len(data); i += width {
+		var b [4]byte
+		copy(b[4-width:], data[i:i+width])
+		s := int32(binary.LittleEndian.Uint32(b[:]))
+		if width == 1 {
+			s = int32(int8(data[i]-128)) << 24
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func equalSamples(t *testing.T, want, got []int32) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("sample %d is %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func roundTrip(t *testing.T, encoder, decoder AudioConverter, wav []byte) ([]byte, []byte) {
+	t.Helper()
+	ctx := context.Background()
+
+	var encoded, decoded bytes.Buffer
+	if err := encoder.ConvertWavToFlac(ctx, bytes.NewReader(wav), &encoded); err != nil {
+		t.Fatalf("wav to flac: %v", err)
+	}
+	if err := decoder.ConvertFlacToWav(ctx, bytes.NewReader(encoded.Bytes()), &decoded); err != nil {
+		t.Fatalf("flac to wav: %v", err)
+	}
+	return encoded.Bytes(), decoded.Bytes()
+}
+
+// TestConverterConformance round-trips WAV files through FLAC with each converter,
+// and across them, and expects the samples back bit for bit.
+func TestConverterConformance(t *testing.T) {
+	var fixtures []wavFixture
+	for _, bits := range []int{8, 16, 24} {
+		for _, channels := range []int{1, 2} {
+			for _, extra := range []bool{false, true} {
+				// an odd frame count leaves a short last FLAC block and, for
+				// 8 bit mono, a padded data chunk
+				fixtures = append(fixtures, wavFixture{bits: bits, channels: channels, frames: 10007, extra: extra})
+			}
+		}
+	}
+	_, lookErr := exec.LookPath("ffmpeg")
+
+	native := NewNativeConverter(Limits{})
+	ffmpeg := NewFFmpegConverter(Limits{})
+
+	for _, fixture := range fixtures {
+		wav, want := fixture.build()
+
+		t.Run(fixture.String()+"/native", func(t *testing.T) {
+			_, restored := roundTrip(t, native, native, wav)
+			equalSamples(t, want, pcmSamples(t, restored))
+			// the container chunks are kept as well
+			if !bytes.Equal(wav, restored) {
+				t.Errorf("restored %d bytes differ from the %d source bytes", len(restored), len(wav))
+			}
+		})
+
+		t.Run(fixture.String()+"/ffmpeg", func(t *testing.T) {
+			if lookErr != nil {
+				t.Skip("ffmpeg not found")
+			}
+			_, restored := roundTrip(t, ffmpeg, ffmpeg, wav)
+			equalSamples(t, want, pcmSamples(t, restored))
+		})
+
+		t.Run(fixture.String()+"/native-to-ffmpeg", func(t *testing.T) {
+			if lookErr != nil {
+				t.Skip("ffmpeg not found")
+			}
+			_, restored := roundTrip(t, native, ffmpeg, wav)
+			equalSamples(t, want, pcmSamples(t, restored))
+		})
+
+		t.Run(fixture.String()+"/ffmpeg-to-native", func(t *testing.T) {
+			if lookErr != nil {
+				t.Skip("ffmpeg not found")
+			}
+			_, restored := roundTrip(t, ffmpeg, native, wav)
+			equalSamples(t, want, pcmSamples(t, restored))
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package audio_converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrorKind tells why a conversion failed.
+type ErrorKind string
+
+const (
+	// ErrorTimeout is a conversion that ran past its deadline
+	ErrorTimeout ErrorKind = "timeout"
+	// ErrorBadInput is an input the converter rejected
+	ErrorBadInput ErrorKind = "bad_input"
+	// ErrorCrash is a converter that died, e.g. killed by a signal or a resource limit
+	ErrorCrash ErrorKind = "crash"
+	// ErrorOutputLimit is a conversion that wrote more than Limits.MaxOutputBytes
+	ErrorOutputLimit ErrorKind = "output_limit"
+)
+
+var errOutputLimit = errors.New("output limit exceeded")
+
+// ConvertError is returned for failed conversions, except for ErrUnsupportedFormat
+// and cancellations, which are returned as they are.
+type ConvertError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *ConvertError) Error() string {
+	return fmt.Sprintf("convert: %s: %v", e.Kind, e.Err)
+}
+
+func (e *ConvertError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKindOf returns the kind of a ConvertError in the chain of err, or an empty
+// kind when there is none.
+func ErrorKindOf(err error) ErrorKind {
+	var convertErr *ConvertError
+	if errors.As(err, &convertErr) {
+		return convertErr.Kind
+	}
+	return ""
+}
+
+// classify wraps err of a conversion run under ctx. crashed reports a converter
+// that did not exit on its own.
+func classify(ctx context.Context, err error, crashed bool) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errOutputLimit):
+		return &ConvertError{Kind: ErrorOutputLimit, Err: err}
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &ConvertError{Kind: ErrorTimeout, Err: err}
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case errors.Is(err, ErrUnsupportedFormat):
+		return err
+	case crashed:
+		return &ConvertError{Kind: ErrorCrash, Err: err}
+	}
+	return &ConvertError{Kind: ErrorBadInput, Err: err}
+}
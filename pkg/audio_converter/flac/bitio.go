@@ -0,0 +1,144 @@
+package flac
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+var errUnexpectedEOF = fmt.Errorf("%w: unexpected end of stream", ErrCorrupted)
+
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// writeBits appends the n low bits of v, n must not exceed 32.
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	if n == 0 {
+		return
+	}
+	w.acc = w.acc<<n | v&(1<<n-1)
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.nbits -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.nbits))
+	}
+	w.acc &= 1<<w.nbits - 1
+}
+
+func (w *bitWriter) writeSigned(v int64, n uint) {
+	w.writeBits(uint64(v), n)
+}
+
+// writeUnary appends q zero bits followed by a one bit.
+func (w *bitWriter) writeUnary(q uint64) {
+	for q >= 32 {
+		w.writeBits(0, 32)
+		q -= 32
+	}
+	w.writeBits(1, uint(q)+1)
+}
+
+// align pads with zero bits up to the next byte boundary.
+func (w *bitWriter) align() {
+	if w.nbits > 0 {
+		w.writeBits(0, 8-w.nbits)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// bitReader keeps the next unread bits left aligned in cache.
+type bitReader struct {
+	data  []byte
+	pos   int
+	cache uint64
+	cbits uint
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) fill() {
+	for r.cbits <= 56 && r.pos < len(r.data) {
+		r.cache |= uint64(r.data[r.pos]) << (56 - r.cbits)
+		r.cbits += 8
+		r.pos++
+	}
+}
+
+// offset returns the number of whole bytes consumed so far.
+func (r *bitReader) offset() int {
+	return r.pos - int(r.cbits/8)
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if n > 64 {
+		return 0, ErrCorrupted
+	}
+	if n > 32 {
+		hi, err := r.readBits(n - 32)
+		if err != nil {
+			return 0, err
+		}
+		lo, err := r.readBits(32)
+		if err != nil {
+			return 0, err
+		}
+		return hi<<32 | lo, nil
+	}
+	if r.cbits < n {
+		r.fill()
+		if r.cbits < n {
+			return 0, errUnexpectedEOF
+		}
+	}
+	v := r.cache >> (64 - n)
+	r.cache <<= n
+	r.cbits -= n
+	return v, nil
+}
+
+func (r *bitReader) readSigned(n uint) (int64, error) {
+	v, err := r.readBits(n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	shift := 64 - n
+	return int64(v<<shift) >> shift, nil
+}
+
+// readUnary counts zero bits up to and including the terminating one bit.
+func (r *bitReader) readUnary() (uint64, error) {
+	var q uint64
+	for {
+		if r.cbits == 0 {
+			r.fill()
+			if r.cbits == 0 {
+				return 0, errUnexpectedEOF
+			}
+		}
+		lz := uint(bits.LeadingZeros64(r.cache))
+		if lz < r.cbits {
+			r.cache <<= lz + 1
+			r.cbits -= lz + 1
+			return q + uint64(lz), nil
+		}
+		q += uint64(r.cbits)
+		r.cache = 0
+		r.cbits = 0
+	}
+}
+
+func (r *bitReader) align() {
+	drop := r.cbits % 8
+	r.cache <<= drop
+	r.cbits -= drop
+}
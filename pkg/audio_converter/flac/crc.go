@@ -0,0 +1,52 @@
+package flac
+
+var (
+	crc8Table  = makeCRC8Table(0x07)
+	crc16Table = makeCRC16Table(0x8005)
+)
+
+func makeCRC8Table(poly uint8) (table [256]uint8) {
+	for i := range table {
+		crc := uint8(i)
+		for j := 0; j < 8; j++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func makeCRC16Table(poly uint16) (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func crc8(b []byte) uint8 {
+	var crc uint8
+	for _, v := range b {
+		crc = crc8Table[crc^v]
+	}
+	return crc
+}
+
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, v := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^v]
+	}
+	return crc
+}
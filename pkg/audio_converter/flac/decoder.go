@@ -0,0 +1,475 @@
+package flac
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"io"
+)
+
+var ErrChecksumMismatch = errors.New("flac: checksum mismatch")
+
+type Decoder struct {
+	Info         *StreamInfo
+	Applications []Application
+
+	data    []byte
+	samples [][]int32
+}
+
+// NewDecoder reads a whole FLAC stream and parses its metadata blocks.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info, apps, pos, err := readMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	if info.Channels > 8 || info.BitsPerSample < 4 || info.BitsPerSample > 32 {
+		return nil, ErrUnsupportedFormat
+	}
+
+	return &Decoder{Info: info, Applications: apps, data: data[pos:]}, nil
+}
+
+// ContainerBytes is the width of a sample written by WritePCM.
+func (d *Decoder) ContainerBytes() int {
+	return (int(d.Info.BitsPerSample) + 7) / 8
+}
+
+// WritePCM decodes every frame and writes interleaved little-endian PCM. Samples are
+// left justified in whole bytes and eight bit samples are unsigned as in WAV files.
+// The STREAMINFO MD5, when set, is checked once the last frame is decoded. Decoding
+// stops between frames once ctx is done.
+func (d *Decoder) WritePCM(ctx context.Context, w io.Writer) (int64, error) {
+	channels := int(d.Info.Channels)
+	d.samples = make([][]int32, channels)
+
+	width := d.ContainerBytes()
+	shift := uint(width*8) - uint(d.Info.BitsPerSample)
+	digest := md5.New()
+
+	var written int64
+	var out, signed []byte
+	r := newBitReader(d.data)
+	for r.offset() < len(d.data) {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := d.decodeFrame(r)
+		if err != nil {
+			return written, err
+		}
+
+		out = out[:0]
+		signed = signed[:0]
+		for i := 0; i < n; i++ {
+			for ch := 0; ch < channels; ch++ {
+				v := d.samples[ch][i]
+				signed = appendSample(signed, v, width)
+				v <<= shift
+				if width == 1 {
+					v += 128
+				}
+				out = appendSample(out, v, width)
+			}
+		}
+		digest.Write(signed)
+
+		m, err := w.Write(out)
+		written += int64(m)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	var zero [16]byte
+	if d.Info.MD5 != zero && !bytes.Equal(digest.Sum(nil), d.Info.MD5[:]) {
+		return written, ErrChecksumMismatch
+	}
+
+	return written, nil
+}
+
+func appendSample(b []byte, v int32, width int) []byte {
+	for i := 0; i < width; i++ {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+func (d *Decoder) decodeFrame(r *bitReader) (int, error) {
+	start := r.offset()
+
+	sync, err := r.readBits(14)
+	if err != nil {
+		return 0, err
+	}
+	if sync != 0x3FFE {
+		return 0, ErrCorrupted
+	}
+	// Reserved bit and blocking strategy
+	if _, err := r.readBits(2); err != nil {
+		return 0, err
+	}
+	codes, err := r.readBits(16)
+	if err != nil {
+		return 0, err
+	}
+	blockCode := codes >> 12
+	rateCode := codes >> 8 & 0xf
+	assignment := int(codes >> 4 & 0xf)
+	sizeCode := codes >> 1 & 0x7
+
+	if err := skipUTF8(r); err != nil {
+		return 0, err
+	}
+
+	var n int
+	switch {
+	case blockCode == 0:
+		return 0, ErrCorrupted
+	case blockCode == 1:
+		n = 192
+	case blockCode <= 5:
+		n = 576 << (blockCode - 2)
+	case blockCode == 6:
+		v, err := r.readBits(8)
+		if err != nil {
+			return 0, err
+		}
+		n = int(v) + 1
+	case blockCode == 7:
+		v, err := r.readBits(16)
+		if err != nil {
+			return 0, err
+		}
+		n = int(v) + 1
+	default:
+		n = 256 << (blockCode - 8)
+	}
+
+	switch rateCode {
+	case 12:
+		_, err = r.readBits(8)
+	case 13, 14:
+		_, err = r.readBits(16)
+	case 15:
+		err = ErrCorrupted
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	headerEnd := r.offset()
+	crc, err := r.readBits(8)
+	if err != nil {
+		return 0, err
+	}
+	if uint8(crc) != crc8(d.data[start:headerEnd]) {
+		return 0, ErrChecksumMismatch
+	}
+
+	var bps uint
+	switch sizeCode {
+	case 0:
+		bps = uint(d.Info.BitsPerSample)
+	case 1:
+		bps = 8
+	case 2:
+		bps = 12
+	case 4:
+		bps = 16
+	case 5:
+		bps = 20
+	case 6:
+		bps = 24
+	case 7:
+		bps = 32
+	default:
+		return 0, ErrCorrupted
+	}
+
+	channels := assignment + 1
+	if assignment >= channelLeftSide {
+		if assignment > channelMidSide {
+			return 0, ErrCorrupted
+		}
+		channels = 2
+	}
+	if channels != len(d.samples) {
+		return 0, ErrCorrupted
+	}
+
+	for ch := 0; ch < channels; ch++ {
+		if cap(d.samples[ch]) < n {
+			d.samples[ch] = make([]int32, n)
+		}
+		d.samples[ch] = d.samples[ch][:n]
+
+		width := bps
+		if (assignment == channelLeftSide && ch == 1) || (assignment == channelSideRight && ch == 0) || (assignment == channelMidSide && ch == 1) {
+			width++
+		}
+		if err := decodeSubframe(r, d.samples[ch], width); err != nil {
+			return 0, err
+		}
+	}
+
+	r.align()
+	frameEnd := r.offset()
+	crc, err = r.readBits(16)
+	if err != nil {
+		return 0, err
+	}
+	if uint16(crc) != crc16(d.data[start:frameEnd]) {
+		return 0, ErrChecksumMismatch
+	}
+
+	if channels == 2 {
+		decorrelate(assignment, d.samples[0], d.samples[1])
+	}
+
+	return n, nil
+}
+
+func skipUTF8(r *bitReader) error {
+	lead, err := r.readBits(8)
+	if err != nil {
+		return err
+	}
+	extra := 0
+	for mask := uint64(0x80); lead&mask != 0 && mask > 1; mask >>= 1 {
+		extra++
+	}
+	if extra == 1 || extra > 7 {
+		return ErrCorrupted
+	}
+	if extra > 0 {
+		extra--
+	}
+	_, err = r.readBits(uint(8 * extra))
+	return err
+}
+
+func decorrelate(assignment int, a, b []int32) {
+	switch assignment {
+	case channelLeftSide:
+		for i := range a {
+			b[i] = a[i] - b[i]
+		}
+	case channelSideRight:
+		for i := range a {
+			a[i] += b[i]
+		}
+	case channelMidSide:
+		for i := range a {
+			mid := a[i]<<1 | b[i]&1
+			side := b[i]
+			a[i] = (mid + side) >> 1
+			b[i] = (mid - side) >> 1
+		}
+	}
+}
+
+func decodeSubframe(r *bitReader, s []int32, bps uint) error {
+	header, err := r.readBits(8)
+	if err != nil {
+		return err
+	}
+	kind := int(header >> 1 & 0x3f)
+
+	var wasted uint
+	if header&1 != 0 {
+		k, err := r.readUnary()
+		if err != nil {
+			return err
+		}
+		if k+1 >= uint64(bps) {
+			return ErrCorrupted
+		}
+		wasted = uint(k) + 1
+		bps -= wasted
+	}
+
+	switch {
+	case kind == subframeConstant:
+		v, err := r.readSigned(bps)
+		if err != nil {
+			return err
+		}
+		for i := range s {
+			s[i] = int32(v)
+		}
+	case kind == subframeVerbatim:
+		for i := range s {
+			v, err := r.readSigned(bps)
+			if err != nil {
+				return err
+			}
+			s[i] = int32(v)
+		}
+	case kind >= subframeFixed && kind <= subframeFixed+maxFixedOrder:
+		order := kind - subframeFixed
+		if err := readWarmup(r, s, order, bps); err != nil {
+			return err
+		}
+		if err := readResidual(r, s, order); err != nil {
+			return err
+		}
+		restoreFixed(s, order)
+	case kind >= 32:
+		order := kind - 31
+		if err := readWarmup(r, s, order, bps); err != nil {
+			return err
+		}
+		precision, err := r.readBits(4)
+		if err != nil {
+			return err
+		}
+		if precision == 15 {
+			return ErrCorrupted
+		}
+		shift, err := r.readSigned(5)
+		if err != nil {
+			return err
+		}
+		if shift < 0 {
+			return ErrCorrupted
+		}
+		coeffs := make([]int64, order)
+		for i := range coeffs {
+			if coeffs[i], err = r.readSigned(uint(precision) + 1); err != nil {
+				return err
+			}
+		}
+		if err := readResidual(r, s, order); err != nil {
+			return err
+		}
+		restoreLPC(s, coeffs, uint(shift))
+	default:
+		return ErrCorrupted
+	}
+
+	if wasted > 0 {
+		for i := range s {
+			s[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+func readWarmup(r *bitReader, s []int32, order int, bps uint) error {
+	if order > len(s) {
+		return ErrCorrupted
+	}
+	for i := 0; i < order; i++ {
+		v, err := r.readSigned(bps)
+		if err != nil {
+			return err
+		}
+		s[i] = int32(v)
+	}
+	return nil
+}
+
+// readResidual stores the residual of samples[order:] in place.
+func readResidual(r *bitReader, s []int32, order int) error {
+	method, err := r.readBits(2)
+	if err != nil {
+		return err
+	}
+	if method > 1 {
+		return ErrCorrupted
+	}
+	paramBits := uint(4 + method)
+	escape := uint64(1)<<paramBits - 1
+
+	partitionOrder, err := r.readBits(4)
+	if err != nil {
+		return err
+	}
+	n := len(s)
+	size := n >> partitionOrder
+	if size<<partitionOrder != n || size < order {
+		return ErrCorrupted
+	}
+
+	idx := order
+	for p := 0; p < 1<<partitionOrder; p++ {
+		count := size
+		if p == 0 {
+			count -= order
+		}
+		if idx+count > len(s) {
+			return ErrCorrupted
+		}
+		k, err := r.readBits(paramBits)
+		if err != nil {
+			return err
+		}
+
+		if k == escape {
+			width, err := r.readBits(5)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < count; i++ {
+				v, err := r.readSigned(uint(width))
+				if err != nil {
+					return err
+				}
+				s[idx] = int32(v)
+				idx++
+			}
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			q, err := r.readUnary()
+			if err != nil {
+				return err
+			}
+			lo, err := r.readBits(uint(k))
+			if err != nil {
+				return err
+			}
+			u := q<<k | lo
+			s[idx] = int32(u>>1) ^ -int32(u&1)
+			idx++
+		}
+	}
+	return nil
+}
+
+func restoreFixed(s []int32, order int) {
+	for i := order; i < len(s); i++ {
+		var p int64
+		switch order {
+		case 1:
+			p = int64(s[i-1])
+		case 2:
+			p = 2*int64(s[i-1]) - int64(s[i-2])
+		case 3:
+			p = 3*int64(s[i-1]) - 3*int64(s[i-2]) + int64(s[i-3])
+		case 4:
+			p = 4*int64(s[i-1]) - 6*int64(s[i-2]) + 4*int64(s[i-3]) - int64(s[i-4])
+		}
+		s[i] = int32(int64(s[i]) + p)
+	}
+}
+
+func restoreLPC(s []int32, coeffs []int64, shift uint) {
+	order := len(coeffs)
+	for i := order; i < len(s); i++ {
+		var sum int64
+		for j, c := range coeffs {
+			sum += c * int64(s[i-1-j])
+		}
+		s[i] += int32(sum >> shift)
+	}
+}
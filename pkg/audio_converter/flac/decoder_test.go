@@ -0,0 +1,124 @@
+package flac
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// testStream encodes a few frames of stereo 16 bit noise on a tone.
+func testStream(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	pcm := make([]byte, 3*defaultBlockSize*4+100)
+	for i := 0; i+2 <= len(pcm); i += 2 {
+		v := int16(8000*(i/2%200-100)/100 + rng.Intn(64))
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(v))
+	}
+
+	var stream bytes.Buffer
+	apps := []Application{{ID: "riff", Data: []byte("RIFF\x00\x00\x00\x00WAVE")}}
+	if err := Encode(context.Background(), &stream, 48000, 2, 16, pcm, apps); err != nil {
+		t.Fatal(err)
+	}
+	return stream.Bytes(), pcm
+}
+
+func decode(stream []byte) ([]byte, error) {
+	d, err := NewDecoder(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	var pcm bytes.Buffer
+	_, err = d.WritePCM(context.Background(), &pcm)
+	return pcm.Bytes(), err
+}
+
+// frameOffsets returns the offset of every frame in stream and of its end.
+func frameOffsets(t *testing.T, stream []byte) []int {
+	t.Helper()
+	d, err := NewDecoder(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.samples = make([][]int32, d.Info.Channels)
+
+	first := len(stream) - len(d.data)
+	r := newBitReader(d.data)
+	var offsets []int
+	for r.offset() < len(d.data) {
+		offsets = append(offsets, first+r.offset())
+		if _, err := d.decodeFrame(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append(offsets, len(stream))
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	stream, _ := testStream(t)
+	offsets := frameOffsets(t, stream)
+
+	// every cut through the metadata and the first frame, then a sample of the others
+	for cut := 0; cut < len(stream); cut++ {
+		if cut > offsets[1] && cut%13 != 0 {
+			continue
+		}
+		_, err := decode(stream[:cut])
+		switch {
+		case cut < offsets[0]:
+			if !errors.Is(err, ErrInvalidStream) {
+				t.Fatalf("cut at %d in the metadata: got %v, want %v", cut, err, ErrInvalidStream)
+			}
+		case err == nil:
+			t.Fatalf("cut at %d decoded", cut)
+		case !errors.Is(err, ErrCorrupted) && !errors.Is(err, ErrChecksumMismatch):
+			t.Fatalf("cut at %d: got %v", cut, err)
+		}
+	}
+}
+
+// TestDecodeCorruptedFrames damages frame bodies and fixes up the frame CRC, so the
+// damage reaches the subframe decoder instead of failing the checksum.
+func TestDecodeCorruptedFrames(t *testing.T) {
+	stream, pcm := testStream(t)
+	offsets := frameOffsets(t, stream)
+	rng := rand.New(rand.NewSource(2))
+
+	// frame headers are shorter than this
+	const headerBytes = 16
+
+	for i := 0; i < 3000; i++ {
+		frame := rng.Intn(len(offsets) - 1)
+		start, end := offsets[frame], offsets[frame+1]
+		body := end - 2 - (start + headerBytes)
+
+		damaged := append([]byte(nil), stream...)
+		at := start + headerBytes + rng.Intn(body)
+		if i%2 == 0 {
+			damaged[at] ^= 1 << rng.Intn(8)
+		} else {
+			// a run of garbage drives sizes, orders and parameters out of range
+			n := 1 + rng.Intn(16)
+			if at+n > end-2 {
+				n = end - 2 - at
+			}
+			rng.Read(damaged[at : at+n])
+		}
+		binary.BigEndian.PutUint16(damaged[end-2:], crc16(damaged[start:end-2]))
+
+		got, err := decode(damaged)
+		switch {
+		case err == nil:
+			// only the padding before the frame CRC changed
+			if !bytes.Equal(got, pcm) {
+				t.Fatalf("damage at %d decoded to other samples", at)
+			}
+		case !errors.Is(err, ErrCorrupted) && !errors.Is(err, ErrChecksumMismatch):
+			t.Fatalf("damage at %d: got %v", at, err)
+		}
+	}
+}
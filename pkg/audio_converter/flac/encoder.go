@@ -0,0 +1,458 @@
+package flac
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+const (
+	defaultBlockSize  = 4096
+	maxFixedOrder     = 4
+	maxPartitionOrder = 8
+	maxRiceParam      = 30
+	maxRiceParam4Bit  = 14
+
+	subframeConstant = 0
+	subframeVerbatim = 1
+	subframeFixed    = 8
+
+	channelLeftSide  = 8
+	channelSideRight = 9
+	channelMidSide   = 10
+)
+
+type subframePlan struct {
+	kind           int
+	order          int
+	partitionOrder int
+	params         []uint
+	cost           uint64
+}
+
+type encoder struct {
+	channels  int
+	bps       uint
+	blockSize int
+	samples   [][]int32
+	side      []int32
+	mid       []int32
+	residual  []int32
+}
+
+// Encode writes interleaved little-endian PCM as a FLAC stream. Eight bit samples
+// are unsigned as stored in WAV files. Encoding stops between frames once ctx is done.
+func Encode(ctx context.Context, w io.Writer, sampleRate uint32, channels, bitsPerSample uint8, pcm []byte, apps []Application) error {
+	if channels < 1 || channels > 8 || sampleRate == 0 || sampleRate >= 1<<20 {
+		return ErrUnsupportedFormat
+	}
+	if bitsPerSample != 8 && bitsPerSample != 16 && bitsPerSample != 24 {
+		return ErrUnsupportedFormat
+	}
+	for _, app := range apps {
+		if len(app.ID) != 4 || len(app.Data)+4 > maxBlockLength {
+			return ErrInvalidStream
+		}
+	}
+
+	bytesPerSample := int(bitsPerSample) / 8
+	frameBytes := int(channels) * bytesPerSample
+	if len(pcm)%frameBytes != 0 {
+		return ErrUnsupportedFormat
+	}
+	total := len(pcm) / frameBytes
+
+	e := &encoder{channels: int(channels), bps: uint(bitsPerSample), blockSize: defaultBlockSize}
+	e.samples = make([][]int32, channels)
+	for ch := range e.samples {
+		e.samples[ch] = make([]int32, e.blockSize)
+	}
+	e.side = make([]int32, e.blockSize)
+	e.mid = make([]int32, e.blockSize)
+	e.residual = make([]int32, e.blockSize)
+
+	info := StreamInfo{
+		BlockSizeMin:  uint16(e.blockSize),
+		BlockSizeMax:  uint16(e.blockSize),
+		SampleRate:    sampleRate,
+		Channels:      channels,
+		BitsPerSample: bitsPerSample,
+		TotalSamples:  uint64(total),
+	}
+
+	digest := md5.New()
+	var frames bytes.Buffer
+	var frameNumber uint64
+	for start := 0; start < total; start += e.blockSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := total - start
+		if n > e.blockSize {
+			n = e.blockSize
+		}
+		block := pcm[start*frameBytes : (start+n)*frameBytes]
+		e.load(block, n, digest)
+
+		frame := e.encodeFrame(frameNumber, n)
+		size := uint32(len(frame))
+		if info.FrameSizeMin == 0 || size < info.FrameSizeMin {
+			info.FrameSizeMin = size
+		}
+		if size > info.FrameSizeMax {
+			info.FrameSizeMax = size
+		}
+		frames.Write(frame)
+		frameNumber++
+	}
+	copy(info.MD5[:], digest.Sum(nil))
+
+	header := append([]byte{}, signature...)
+	header = appendBlockHeader(header, blockTypeStreamInfo, streamInfoSize, len(apps) == 0)
+	header = append(header, info.marshal()...)
+	for i, app := range apps {
+		header = appendBlockHeader(header, blockTypeApplication, len(app.Data)+4, i == len(apps)-1)
+		header = append(header, app.ID...)
+		header = append(header, app.Data...)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := frames.WriteTo(w)
+	return err
+}
+
+// load deinterleaves a block into the per channel sample buffers and hashes the
+// signed samples for the STREAMINFO MD5.
+func (e *encoder) load(block []byte, n int, digest hash.Hash) {
+	switch e.bps {
+	case 8:
+		signed := make([]byte, len(block))
+		for i := 0; i < n; i++ {
+			for ch := 0; ch < e.channels; ch++ {
+				v := int32(block[i*e.channels+ch]) - 128
+				e.samples[ch][i] = v
+				signed[i*e.channels+ch] = byte(int8(v))
+			}
+		}
+		digest.Write(signed)
+	case 16:
+		for i := 0; i < n; i++ {
+			for ch := 0; ch < e.channels; ch++ {
+				off := (i*e.channels + ch) * 2
+				e.samples[ch][i] = int32(int16(binary.LittleEndian.Uint16(block[off:])))
+			}
+		}
+		digest.Write(block)
+	case 24:
+		for i := 0; i < n; i++ {
+			for ch := 0; ch < e.channels; ch++ {
+				off := (i*e.channels + ch) * 3
+				v := int32(block[off]) | int32(block[off+1])<<8 | int32(block[off+2])<<16
+				e.samples[ch][i] = v << 8 >> 8
+			}
+		}
+		digest.Write(block)
+	}
+}
+
+func (e *encoder) encodeFrame(frameNumber uint64, n int) []byte {
+	assignment := e.channels - 1
+	plans := make([]subframePlan, e.channels)
+	inputs := make([][]int32, e.channels)
+	widths := make([]uint, e.channels)
+	for ch := 0; ch < e.channels; ch++ {
+		inputs[ch] = e.samples[ch][:n]
+		widths[ch] = e.bps
+		plans[ch] = e.plan(inputs[ch], e.bps)
+	}
+
+	// Pick the cheapest stereo decorrelation
+	if e.channels == 2 {
+		left, right := inputs[0], inputs[1]
+		side, mid := e.side[:n], e.mid[:n]
+		for i := 0; i < n; i++ {
+			side[i] = left[i] - right[i]
+			mid[i] = (left[i] + right[i]) >> 1
+		}
+		sidePlan := e.plan(side, e.bps+1)
+		midPlan := e.plan(mid, e.bps)
+
+		best := plans[0].cost + plans[1].cost
+		if cost := plans[0].cost + sidePlan.cost; cost < best {
+			best, assignment = cost, channelLeftSide
+		}
+		if cost := sidePlan.cost + plans[1].cost; cost < best {
+			best, assignment = cost, channelSideRight
+		}
+		if cost := midPlan.cost + sidePlan.cost; cost < best {
+			assignment = channelMidSide
+		}
+
+		switch assignment {
+		case channelLeftSide:
+			inputs[1], widths[1], plans[1] = side, e.bps+1, sidePlan
+		case channelSideRight:
+			inputs[0], widths[0], plans[0] = side, e.bps+1, sidePlan
+		case channelMidSide:
+			inputs[0], widths[0], plans[0] = mid, e.bps, midPlan
+			inputs[1], widths[1], plans[1] = side, e.bps+1, sidePlan
+		}
+	}
+
+	w := &bitWriter{}
+	w.writeBits(0x3FFE, 14)
+	w.writeBits(0, 1)
+	w.writeBits(0, 1)
+
+	switch {
+	case n == e.blockSize:
+		w.writeBits(blockSizeCode(n), 4)
+	case n <= 256:
+		w.writeBits(6, 4)
+	default:
+		w.writeBits(7, 4)
+	}
+	// Sample rate is taken from STREAMINFO
+	w.writeBits(0, 4)
+	w.writeBits(uint64(assignment), 4)
+	w.writeBits(sampleSizeCode(e.bps), 3)
+	w.writeBits(0, 1)
+	writeUTF8(w, frameNumber)
+	if n != e.blockSize {
+		if n <= 256 {
+			w.writeBits(uint64(n-1), 8)
+		} else {
+			w.writeBits(uint64(n-1), 16)
+		}
+	}
+	w.writeBits(uint64(crc8(w.bytes())), 8)
+
+	for ch := 0; ch < e.channels; ch++ {
+		e.writeSubframe(w, inputs[ch], widths[ch], plans[ch])
+	}
+
+	w.align()
+	crc := crc16(w.bytes())
+	w.writeBits(uint64(crc), 16)
+	return w.bytes()
+}
+
+// plan estimates the cost of every subframe type and keeps the cheapest.
+func (e *encoder) plan(samples []int32, bps uint) subframePlan {
+	n := len(samples)
+
+	constant := true
+	for _, v := range samples[1:] {
+		if v != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		return subframePlan{kind: subframeConstant, cost: 8 + uint64(bps)}
+	}
+
+	best := subframePlan{kind: subframeVerbatim, cost: 8 + uint64(n)*uint64(bps)}
+	for order := 0; order <= maxFixedOrder && order < n; order++ {
+		residual := fixedResidual(samples, order, e.residual)
+		partitionOrder, params, riceCost := planRice(residual, n, order)
+		cost := 8 + uint64(order)*uint64(bps) + riceCost
+		if cost < best.cost {
+			best = subframePlan{kind: subframeFixed, order: order, partitionOrder: partitionOrder, params: params, cost: cost}
+		}
+	}
+	return best
+}
+
+func (e *encoder) writeSubframe(w *bitWriter, samples []int32, bps uint, plan subframePlan) {
+	switch plan.kind {
+	case subframeConstant:
+		w.writeBits(subframeConstant<<1, 8)
+		w.writeSigned(int64(samples[0]), bps)
+	case subframeVerbatim:
+		w.writeBits(subframeVerbatim<<1, 8)
+		for _, v := range samples {
+			w.writeSigned(int64(v), bps)
+		}
+	case subframeFixed:
+		w.writeBits(uint64(subframeFixed+plan.order)<<1, 8)
+		for _, v := range samples[:plan.order] {
+			w.writeSigned(int64(v), bps)
+		}
+		residual := fixedResidual(samples, plan.order, e.residual)
+		writeRice(w, residual, len(samples), plan)
+	}
+}
+
+// fixedResidual returns the prediction error of the fixed polynomial predictor of
+// the given order for samples[order:].
+func fixedResidual(s []int32, order int, buf []int32) []int32 {
+	out := buf[:len(s)-order]
+	for i := order; i < len(s); i++ {
+		var r int64
+		switch order {
+		case 0:
+			r = int64(s[i])
+		case 1:
+			r = int64(s[i]) - int64(s[i-1])
+		case 2:
+			r = int64(s[i]) - 2*int64(s[i-1]) + int64(s[i-2])
+		case 3:
+			r = int64(s[i]) - 3*int64(s[i-1]) + 3*int64(s[i-2]) - int64(s[i-3])
+		case 4:
+			r = int64(s[i]) - 4*int64(s[i-1]) + 6*int64(s[i-2]) - 4*int64(s[i-3]) + int64(s[i-4])
+		}
+		out[i-order] = int32(r)
+	}
+	return out
+}
+
+func fold(r int32) uint64 {
+	return uint64(uint32(r<<1) ^ uint32(r>>31))
+}
+
+// planRice chooses the partition order and per partition Rice parameters with the
+// lowest estimated size.
+func planRice(residual []int32, n, order int) (int, []uint, uint64) {
+	maxOrder := 0
+	for p := maxPartitionOrder; p > 0; p-- {
+		if n%(1<<p) == 0 && n>>p > order {
+			maxOrder = p
+			break
+		}
+	}
+
+	parts := 1 << maxOrder
+	size := n >> maxOrder
+	sums := make([]uint64, parts)
+	counts := make([]uint64, parts)
+	for i, r := range residual {
+		p := (i + order) / size
+		sums[p] += fold(r)
+		counts[p]++
+	}
+
+	bestOrder, bestCost := 0, ^uint64(0)
+	var bestParams []uint
+	for p := maxOrder; p >= 0; p-- {
+		params := make([]uint, len(sums))
+		var cost uint64 = 2 + 4
+		paramBits := uint64(4)
+		for i := range sums {
+			k, c := bestRiceParam(sums[i], counts[i])
+			params[i] = k
+			cost += c
+			if k > maxRiceParam4Bit {
+				paramBits = 5
+			}
+		}
+		cost += paramBits * uint64(len(sums))
+		if cost < bestCost {
+			bestOrder, bestCost, bestParams = p, cost, params
+		}
+
+		// Merge neighbouring partitions for the next lower order
+		if p > 0 {
+			half := len(sums) / 2
+			for i := 0; i < half; i++ {
+				sums[i] = sums[2*i] + sums[2*i+1]
+				counts[i] = counts[2*i] + counts[2*i+1]
+			}
+			sums, counts = sums[:half], counts[:half]
+		}
+	}
+	return bestOrder, bestParams, bestCost
+}
+
+func bestRiceParam(sum, count uint64) (uint, uint64) {
+	bestK, bestCost := uint(0), count+sum
+	for k := uint(1); k <= maxRiceParam; k++ {
+		cost := count*(uint64(k)+1) + sum>>k
+		if cost < bestCost {
+			bestK, bestCost = k, cost
+		}
+	}
+	return bestK, bestCost
+}
+
+func writeRice(w *bitWriter, residual []int32, n int, plan subframePlan) {
+	paramBits := uint(4)
+	for _, k := range plan.params {
+		if k > maxRiceParam4Bit {
+			paramBits = 5
+		}
+	}
+	w.writeBits(uint64(paramBits-4), 2)
+	w.writeBits(uint64(plan.partitionOrder), 4)
+
+	size := n >> plan.partitionOrder
+	idx := 0
+	for p, k := range plan.params {
+		count := size
+		if p == 0 {
+			count -= plan.order
+		}
+		w.writeBits(uint64(k), paramBits)
+		for _, r := range residual[idx : idx+count] {
+			u := fold(r)
+			w.writeUnary(u >> k)
+			w.writeBits(u, k)
+		}
+		idx += count
+	}
+}
+
+func blockSizeCode(n int) uint64 {
+	switch n {
+	case 192:
+		return 1
+	case 576, 1152, 2304, 4608:
+		return uint64(2 + log2(n/576))
+	case 256, 512, 1024, 2048, 4096, 8192, 16384, 32768:
+		return uint64(8 + log2(n/256))
+	}
+	return 7
+}
+
+func log2(n int) int {
+	l := 0
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return l
+}
+
+func sampleSizeCode(bps uint) uint64 {
+	switch bps {
+	case 8:
+		return 1
+	case 16:
+		return 4
+	case 24:
+		return 6
+	}
+	return 0
+}
+
+// writeUTF8 writes a frame number using the extended UTF-8 coding of the frame header.
+func writeUTF8(w *bitWriter, v uint64) {
+	if v < 0x80 {
+		w.writeBits(v, 8)
+		return
+	}
+	extra := 1
+	for v >= 1<<(5*extra+6) && extra < 6 {
+		extra++
+	}
+	lead := uint64(0xff00>>(extra+1)) & 0xff
+	w.writeBits(lead|v>>(6*extra), 8)
+	for i := extra - 1; i >= 0; i-- {
+		w.writeBits(0x80|(v>>(6*i))&0x3f, 8)
+	}
+}
@@ -0,0 +1,142 @@
+// Package flac implements a FLAC encoder and decoder for integer PCM audio.
+package flac
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrInvalidStream     = errors.New("flac: invalid stream")
+	ErrUnsupportedFormat = errors.New("flac: unsupported sample format")
+	// ErrCorrupted is returned for frames that are truncated or hold values out of
+	// range, such as sizes and orders that do not fit the block
+	ErrCorrupted = errors.New("flac: corrupted frame")
+)
+
+const (
+	blockTypeStreamInfo  = 0
+	blockTypeApplication = 2
+
+	streamInfoSize = 34
+	maxBlockLength = 1<<24 - 1
+)
+
+var signature = []byte("fLaC")
+
+type StreamInfo struct {
+	BlockSizeMin  uint16
+	BlockSizeMax  uint16
+	FrameSizeMin  uint32
+	FrameSizeMax  uint32
+	SampleRate    uint32
+	Channels      uint8
+	BitsPerSample uint8
+	TotalSamples  uint64
+	MD5           [16]byte
+}
+
+// Application is an APPLICATION metadata block identified by a registered 4 byte ID.
+type Application struct {
+	ID   string
+	Data []byte
+}
+
+func (si *StreamInfo) marshal() []byte {
+	w := &bitWriter{}
+	w.writeBits(uint64(si.BlockSizeMin), 16)
+	w.writeBits(uint64(si.BlockSizeMax), 16)
+	w.writeBits(uint64(si.FrameSizeMin), 24)
+	w.writeBits(uint64(si.FrameSizeMax), 24)
+	w.writeBits(uint64(si.SampleRate), 20)
+	w.writeBits(uint64(si.Channels-1), 3)
+	w.writeBits(uint64(si.BitsPerSample-1), 5)
+	w.writeBits(si.TotalSamples>>32, 4)
+	w.writeBits(si.TotalSamples, 32)
+	return append(w.bytes(), si.MD5[:]...)
+}
+
+func unmarshalStreamInfo(b []byte) (*StreamInfo, error) {
+	if len(b) < streamInfoSize {
+		return nil, ErrInvalidStream
+	}
+	r := newBitReader(b)
+	var si StreamInfo
+	v, _ := r.readBits(16)
+	si.BlockSizeMin = uint16(v)
+	v, _ = r.readBits(16)
+	si.BlockSizeMax = uint16(v)
+	v, _ = r.readBits(24)
+	si.FrameSizeMin = uint32(v)
+	v, _ = r.readBits(24)
+	si.FrameSizeMax = uint32(v)
+	v, _ = r.readBits(20)
+	si.SampleRate = uint32(v)
+	v, _ = r.readBits(3)
+	si.Channels = uint8(v) + 1
+	v, _ = r.readBits(5)
+	si.BitsPerSample = uint8(v) + 1
+	si.TotalSamples, _ = r.readBits(36)
+	copy(si.MD5[:], b[18:34])
+	return &si, nil
+}
+
+func appendBlockHeader(b []byte, blockType byte, length int, last bool) []byte {
+	if last {
+		blockType |= 0x80
+	}
+	return append(b, blockType, byte(length>>16), byte(length>>8), byte(length))
+}
+
+// readMetadata parses the signature and metadata blocks and returns the offset of the first frame.
+func readMetadata(data []byte) (*StreamInfo, []Application, int, error) {
+	if len(data) < len(signature) || string(data[:len(signature)]) != string(signature) {
+		return nil, nil, 0, ErrInvalidStream
+	}
+
+	var info *StreamInfo
+	var apps []Application
+	pos := len(signature)
+	for {
+		if pos+4 > len(data) {
+			return nil, nil, 0, ErrInvalidStream
+		}
+		last := data[pos]&0x80 != 0
+		blockType := data[pos] & 0x7f
+		length := int(binary.BigEndian.Uint32(data[pos:pos+4]) & maxBlockLength)
+		body := pos + 4
+		if body+length > len(data) {
+			return nil, nil, 0, ErrInvalidStream
+		}
+
+		switch blockType {
+		case blockTypeStreamInfo:
+			si, err := unmarshalStreamInfo(data[body : body+length])
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			info = si
+		case blockTypeApplication:
+			if length >= 4 {
+				apps = append(apps, Application{ID: string(data[body : body+4]), Data: data[body+4 : body+length]})
+			}
+		}
+
+		pos = body + length
+		if last {
+			break
+		}
+	}
+
+	if info == nil {
+		return nil, nil, 0, ErrInvalidStream
+	}
+
+	return info, apps, pos, nil
+}
+
+// ReadStreamInfo returns the STREAMINFO block of a FLAC stream.
+func ReadStreamInfo(data []byte) (*StreamInfo, error) {
+	info, _, _, err := readMetadata(data)
+	return info, err
+}
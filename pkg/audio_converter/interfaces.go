@@ -0,0 +1,32 @@
+package audio_converter
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const (
+	ConverterFFmpeg = "ffmpeg"
+	ConverterNative = "native"
+)
+
+// AudioConverter conversions stop once ctx is done, killing the ffmpeg process
+// if there is one. Failures other than ErrUnsupportedFormat and cancellations are
+// returned as a *ConvertError.
+type AudioConverter interface {
+	ConvertWavToFlac(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer) error
+	ConvertFlacToWav(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer) error
+	Convert(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer, from, to Format) error
+}
+
+// NewAudioConverter returns the converter implementation selected by kind.
+func NewAudioConverter(kind string, limits Limits) (AudioConverter, error) {
+	switch kind {
+	case ConverterFFmpeg, "":
+		return NewFFmpegConverter(limits), nil
+	case ConverterNative:
+		return NewNativeConverter(limits), nil
+	}
+	return nil, fmt.Errorf("unknown audio converter %q", kind)
+}
@@ -0,0 +1,83 @@
+package audio_converter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Limits bound the resources of a conversion. Zero values are unlimited.
+type Limits struct {
+	// MaxOutputBytes stops a conversion that writes more than that
+	MaxOutputBytes int64
+	// CPUSeconds and MaxMemoryBytes are set on the ffmpeg process with prlimit(1)
+	CPUSeconds     int
+	MaxMemoryBytes int64
+	// Cgroup is a cgroup v2 directory ffmpeg processes are moved into once started,
+	// so cpu.max and memory.max set on it apply to them
+	Cgroup string
+}
+
+// wrapCommand prefixes the ffmpeg command line with prlimit when a rlimit is set.
+func (l Limits) wrapCommand(args []string) []string {
+	var prefix []string
+	if l.CPUSeconds > 0 {
+		prefix = append(prefix, "--cpu="+strconv.Itoa(l.CPUSeconds))
+	}
+	if l.MaxMemoryBytes > 0 {
+		prefix = append(prefix, "--as="+strconv.FormatInt(l.MaxMemoryBytes, 10))
+	}
+	if len(prefix) == 0 {
+		return args
+	}
+	return append(append(append([]string{"prlimit"}, prefix...), "--"), args...)
+}
+
+// joinCgroup moves the process pid into the configured cgroup.
+func (l Limits) joinCgroup(pid int) error {
+	if l.Cgroup == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(l.Cgroup, "cgroup.procs"), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("cgroup: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strconv.Itoa(pid)); err != nil {
+		return fmt.Errorf("cgroup: %w", err)
+	}
+	return nil
+}
+
+// limitWriter fails writes past max bytes and calls exceeded once when it does.
+type limitWriter struct {
+	w        io.Writer
+	max      int64
+	written  int64
+	exceeded func()
+
+	once sync.Once
+	hit  bool
+}
+
+func newLimitWriter(w io.Writer, max int64, exceeded func()) *limitWriter {
+	return &limitWriter{w: w, max: max, exceeded: exceeded}
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.max > 0 && lw.written+int64(len(p)) > lw.max {
+		lw.once.Do(func() {
+			lw.hit = true
+			if lw.exceeded != nil {
+				lw.exceeded()
+			}
+		})
+		return 0, fmt.Errorf("%w: more than %d bytes", errOutputLimit, lw.max)
+	}
+	n, err := lw.w.Write(p)
+	lw.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,62 @@
+package audio_converter
+
+var (
+	mp3Bitrates = [2][16]int{
+		// MPEG-1 Layer III
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		// MPEG-2 and 2.5 Layer III
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	}
+	mp3SampleRates = [4][4]int{
+		{11025, 12000, 8000, 0},  // MPEG-2.5
+		{0, 0, 0, 0},             // reserved
+		{22050, 24000, 16000, 0}, // MPEG-2
+		{44100, 48000, 32000, 0}, // MPEG-1
+	}
+)
+
+// probeMP3 reads the first Layer III frame header, after an optional ID3v2 tag.
+// The duration assumes a constant bitrate.
+func probeMP3(b []byte) (*AudioInfo, bool) {
+	pos := 0
+	if len(b) >= 10 && string(b[0:3]) == "ID3" {
+		size := int(b[6]&0x7f)<<21 | int(b[7]&0x7f)<<14 | int(b[8]&0x7f)<<7 | int(b[9]&0x7f)
+		pos = 10 + size
+	}
+	if pos+4 > len(b) || b[pos] != 0xff || b[pos+1]&0xe0 != 0xe0 {
+		return nil, false
+	}
+
+	version := int(b[pos+1] >> 3 & 0x3)
+	layer := b[pos+1] >> 1 & 0x3
+	bitrateIndex := b[pos+2] >> 4
+	rateIndex := b[pos+2] >> 2 & 0x3
+	mode := b[pos+3] >> 6
+
+	// Layer III only
+	if version == 1 || layer != 1 {
+		return nil, false
+	}
+	table := 1
+	if version == 3 {
+		table = 0
+	}
+	bitrate := mp3Bitrates[table][bitrateIndex] * 1000
+	sampleRate := mp3SampleRates[version][rateIndex]
+	if bitrate == 0 || sampleRate == 0 {
+		return nil, false
+	}
+
+	channels := 2
+	if mode == 3 {
+		channels = 1
+	}
+
+	return &AudioInfo{
+		Format:     "mp3",
+		Codec:      "mp3",
+		SampleRate: sampleRate,
+		Channels:   channels,
+		Duration:   float64(len(b)-pos) * 8 / float64(bitrate),
+	}, true
+}
@@ -0,0 +1,317 @@
+package audio_converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"audio_compression/pkg/audio_converter/flac"
+)
+
+// maxForeignChunk keeps a chunk within the 24 bit metadata block length.
+const maxForeignChunk = 1<<24 - 5
+
+// foreignLayout describes how the container chunks around the samples are kept in
+// APPLICATION blocks, following flac --keep-foreign-metadata.
+type foreignLayout struct {
+	id     string
+	magic  string
+	marker string
+	order  binary.ByteOrder
+}
+
+var (
+	riffLayout = foreignLayout{id: "riff", magic: "RIFF", marker: "data", order: binary.LittleEndian}
+	aiffLayout = foreignLayout{id: "aiff", magic: "FORM", marker: "SSND", order: binary.BigEndian}
+)
+
+// NativeConverter converts integer PCM WAV, AIFF and raw PCM to FLAC and back
+// without an external binary. The container chunks around the audio data are kept
+// in APPLICATION blocks so the original file is restored byte for byte.
+type NativeConverter struct {
+	limits Limits
+}
+
+// NewNativeConverter -. Only the output limit applies, the conversion runs in the
+// worker process.
+func NewNativeConverter(limits Limits) *NativeConverter {
+	return &NativeConverter{limits: limits}
+}
+
+func (ac *NativeConverter) ConvertWavToFlac(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer) error {
+	return ac.Convert(ctx, inputAudio, ouputAudio, Format{Container: "wav"}, Format{Container: "flac"})
+}
+
+func (ac *NativeConverter) ConvertFlacToWav(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer) error {
+	return ac.Convert(ctx, inputAudio, ouputAudio, Format{Container: "flac"}, Format{Container: "wav"})
+}
+
+// Convert supports FLAC as either the source or the target. Resampling, remixing
+// and lossy codecs are left to the ffmpeg converter.
+func (ac *NativeConverter) Convert(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer, from, to Format) (err error) {
+	// the decoder checks its input and returns flac.ErrCorrupted, this is the last
+	// resort that keeps a bug from taking the worker down
+	defer func() {
+		if r := recover(); r != nil {
+			err = &ConvertError{Kind: ErrorCrash, Err: fmt.Errorf("native: %v", r)}
+		}
+	}()
+
+	err = convertNative(ctx, inputAudio, newLimitWriter(ouputAudio, ac.limits.MaxOutputBytes, nil), from, to)
+	return classify(ctx, err, false)
+}
+
+func convertNative(ctx context.Context, inputAudio io.Reader, ouputAudio io.Writer, from, to Format) error {
+	switch {
+	case to.Container == "flac" && from.Container != "flac":
+		body, err := io.ReadAll(inputAudio)
+		if err != nil {
+			return err
+		}
+		return encodeFlac(ctx, ouputAudio, body, from)
+	case from.Container == "flac" && to.Container != "flac":
+		return decodeFlac(ctx, inputAudio, ouputAudio, to)
+	}
+	return ErrUnsupportedFormat
+}
+
+func encodeFlac(ctx context.Context, w io.Writer, body []byte, from Format) error {
+	var (
+		sampleRate, channels, bitsPerSample int
+		data                                []byte
+		apps                                []flac.Application
+	)
+
+	switch from.Container {
+	case "wav":
+		hdr, err := ParseWavHeader(body)
+		if err != nil {
+			return err
+		}
+		if hdr.AudioFormat != wavFormatPCM || hdr.BitsPerSample%8 != 0 || hdr.BlockAlign != hdr.Channels*hdr.BitsPerSample/8 {
+			return ErrUnsupportedFormat
+		}
+		sampleRate, channels, bitsPerSample = int(hdr.SampleRate), int(hdr.Channels), int(hdr.BitsPerSample)
+		data = body[hdr.DataOffset : hdr.DataOffset+int(hdr.DataSize)]
+		apps = foreignChunks(body, riffLayout, hdr.DataOffset, int(hdr.DataSize))
+	case "aiff":
+		hdr, err := ParseAiffHeader(body)
+		if err != nil {
+			return err
+		}
+		codec := aiffCodecName(hdr)
+		if !isIntegerCodec(codec) || hdr.BitsPerSample%8 != 0 || hdr.SampleRate != float64(int(hdr.SampleRate)) {
+			return ErrUnsupportedFormat
+		}
+		sampleRate, channels, bitsPerSample = int(hdr.SampleRate), int(hdr.Channels), int(hdr.BitsPerSample)
+		data = convertPCMLayout(body[hdr.DataOffset:hdr.DataOffset+int(hdr.DataSize)], codec)
+		apps = foreignChunks(body, aiffLayout, hdr.DataOffset, int(hdr.DataSize))
+	default:
+		if RawContainer(from.Codec) != from.Container || !isIntegerCodec(from.Codec) {
+			return ErrUnsupportedFormat
+		}
+		sampleRate, channels, bitsPerSample = from.SampleRate, from.Channels, pcmBitDepth(from.Codec)
+		data = convertPCMLayout(body, from.Codec)
+	}
+
+	err := flac.Encode(ctx, w, uint32(sampleRate), uint8(channels), uint8(bitsPerSample), data, apps)
+	if errors.Is(err, flac.ErrUnsupportedFormat) {
+		return ErrUnsupportedFormat
+	}
+	return err
+}
+
+func decodeFlac(ctx context.Context, r io.Reader, w io.Writer, to Format) error {
+	dec, err := flac.NewDecoder(r)
+	if err != nil {
+		return err
+	}
+	if to.SampleRate != 0 && to.SampleRate != int(dec.Info.SampleRate) || to.Channels != 0 && to.Channels != int(dec.Info.Channels) {
+		return ErrUnsupportedFormat
+	}
+
+	var pcm bytes.Buffer
+	if _, err := dec.WritePCM(ctx, &pcm); err != nil {
+		return err
+	}
+
+	channels, sampleRate, bitsPerSample := int(dec.Info.Channels), int(dec.Info.SampleRate), dec.ContainerBytes()*8
+
+	var header, data, trailer []byte
+	switch to.Container {
+	case "wav":
+		data = pcm.Bytes()
+		var ok bool
+		if header, trailer, ok = restoreForeignChunks(dec.Applications, riffLayout, len(data)); !ok {
+			header, trailer = canonicalWavHeader(channels, sampleRate, bitsPerSample, len(data)), padding(len(data))
+		}
+	case "aiff":
+		codec := to.Codec
+		if codec == "" {
+			codec = aiffCodecName(&AiffHeader{Compression: "NONE", BitsPerSample: uint16(bitsPerSample)})
+		}
+		if pcmBitDepth(codec) != bitsPerSample {
+			return ErrUnsupportedFormat
+		}
+		data = convertPCMLayout(pcm.Bytes(), codec)
+		var ok bool
+		if header, trailer, ok = restoreForeignChunks(dec.Applications, aiffLayout, len(data)); !ok {
+			header, trailer = canonicalAiffHeader(channels, sampleRate, bitsPerSample, len(data)), padding(len(data))
+		}
+	default:
+		if RawContainer(to.Codec) != to.Container || !isIntegerCodec(to.Codec) || pcmBitDepth(to.Codec) != bitsPerSample {
+			return ErrUnsupportedFormat
+		}
+		data = convertPCMLayout(pcm.Bytes(), to.Codec)
+	}
+
+	for _, b := range [][]byte{header, data, trailer} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertPCMLayout converts between the little-endian layout with unsigned eight bit
+// samples the flac package uses and the layout of codec. The conversion is its own
+// inverse.
+func convertPCMLayout(data []byte, codec string) []byte {
+	switch codec {
+	case "pcm_s8":
+		out := make([]byte, len(data))
+		for i, b := range data {
+			out[i] = b ^ 0x80
+		}
+		return out
+	case "pcm_s16be", "pcm_s24be":
+		size := pcmBitDepth(codec) / 8
+		out := make([]byte, len(data))
+		for i := 0; i+size <= len(data); i += size {
+			for j := 0; j < size; j++ {
+				out[i+j] = data[i+size-1-j]
+			}
+		}
+		return out
+	}
+	return data
+}
+
+func isIntegerCodec(codec string) bool {
+	return (&AudioInfo{Codec: codec}).IsIntegerPCM()
+}
+
+// foreignChunks splits everything but the audio samples into one block per chunk.
+// The chunk holding the samples is kept up to where the samples start.
+func foreignChunks(body []byte, layout foreignLayout, dataOffset, dataSize int) []flac.Application {
+	apps := []flac.Application{{ID: layout.id, Data: body[:12]}}
+
+	pos := 12
+	for {
+		if pos+8 > dataOffset {
+			return nil
+		}
+		if string(body[pos:pos+4]) == layout.marker {
+			apps = append(apps, flac.Application{ID: layout.id, Data: body[pos:dataOffset]})
+			break
+		}
+		size := int(layout.order.Uint32(body[pos+4:]))
+		next := pos + 8 + size + size&1
+		if next > dataOffset {
+			return nil
+		}
+		apps = append(apps, flac.Application{ID: layout.id, Data: body[pos:next]})
+		pos = next
+	}
+
+	if trailer := body[dataOffset+dataSize:]; len(trailer) > 0 {
+		apps = append(apps, flac.Application{ID: layout.id, Data: trailer})
+	}
+
+	for _, app := range apps {
+		if len(app.Data) > maxForeignChunk {
+			return nil
+		}
+	}
+	return apps
+}
+
+// restoreForeignChunks returns the container bytes around the audio data when the
+// stream carries them and they describe dataSize bytes of samples.
+func restoreForeignChunks(apps []flac.Application, layout foreignLayout, dataSize int) ([]byte, []byte, bool) {
+	var header, trailer, marker []byte
+	for _, app := range apps {
+		if app.ID != layout.id {
+			continue
+		}
+		if marker != nil {
+			trailer = append(trailer, app.Data...)
+			continue
+		}
+		header = append(header, app.Data...)
+		if len(header) > 12 && len(app.Data) >= 8 && string(app.Data[:4]) == layout.marker {
+			marker = app.Data
+		}
+	}
+	if marker == nil || len(header) < 20 || string(header[:4]) != layout.magic {
+		return nil, nil, false
+	}
+
+	declared := int(layout.order.Uint32(marker[4:8])) - (len(marker) - 8)
+	if declared != dataSize && !(declared > dataSize && len(trailer) == 0) {
+		return nil, nil, false
+	}
+	return header, trailer, true
+}
+
+func padding(dataSize int) []byte {
+	if dataSize%2 == 1 {
+		return []byte{0}
+	}
+	return nil
+}
+
+func canonicalWavHeader(channels, sampleRate, bitsPerSample, dataSize int) []byte {
+	blockAlign := channels * bitsPerSample / 8
+	riffSize := 36 + dataSize + dataSize%2
+
+	b := make([]byte, 44)
+	copy(b[0:], "RIFF")
+	binary.LittleEndian.PutUint32(b[4:], uint32(riffSize))
+	copy(b[8:], "WAVE")
+	copy(b[12:], "fmt ")
+	binary.LittleEndian.PutUint32(b[16:], 16)
+	binary.LittleEndian.PutUint16(b[20:], wavFormatPCM)
+	binary.LittleEndian.PutUint16(b[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(b[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(b[28:], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(b[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(b[34:], uint16(bitsPerSample))
+	copy(b[36:], "data")
+	binary.LittleEndian.PutUint32(b[40:], uint32(dataSize))
+	return b
+}
+
+func canonicalAiffHeader(channels, sampleRate, bitsPerSample, dataSize int) []byte {
+	frames := 0
+	if frameSize := channels * bitsPerSample / 8; frameSize > 0 {
+		frames = dataSize / frameSize
+	}
+	formSize := 4 + 8 + 18 + 16 + dataSize + dataSize%2
+
+	b := make([]byte, 54)
+	copy(b[0:], "FORM")
+	binary.BigEndian.PutUint32(b[4:], uint32(formSize))
+	copy(b[8:], "AIFFCOMM")
+	binary.BigEndian.PutUint32(b[16:], 18)
+	binary.BigEndian.PutUint16(b[20:], uint16(channels))
+	binary.BigEndian.PutUint32(b[22:], uint32(frames))
+	binary.BigEndian.PutUint16(b[26:], uint16(bitsPerSample))
+	putExtended(b[28:], float64(sampleRate))
+	copy(b[38:], "SSND")
+	binary.BigEndian.PutUint32(b[42:], uint32(8+dataSize))
+	return b
+}
@@ -0,0 +1,104 @@
+package audio_converter
+
+import (
+	"fmt"
+
+	"audio_compression/entity"
+)
+
+// Conversion targets.
+const (
+	TargetFlac = "flac"
+	TargetOpus = "opus"
+	TargetCopy = "copy"
+)
+
+// Format describes one side of a conversion using ffmpeg names.
+type Format struct {
+	// Container is the muxer, e.g. wav, aiff, flac, ogg or s16le for raw PCM
+	Container  string
+	Codec      string
+	SampleRate int
+	Channels   int
+	Bitrate    string
+}
+
+// DefaultPolicies store integer PCM losslessly and copy everything else.
+var DefaultPolicies = []entity.ConversionPolicy{
+	{Source: SourceWav, Target: TargetFlac},
+	{Source: SourceAiff, Target: TargetFlac},
+	{Source: SourceRaw, Target: TargetFlac},
+}
+
+type PolicyEngine struct {
+	policies []entity.ConversionPolicy
+}
+
+func NewPolicyEngine(policies []entity.ConversionPolicy) (*PolicyEngine, error) {
+	if len(policies) == 0 {
+		policies = DefaultPolicies
+	}
+
+	for _, policy := range policies {
+		switch policy.Source {
+		case SourceWav, SourceWavFloat, SourceTelephony, SourceAiff, SourceRaw, SourceMP3, SourceOther:
+		default:
+			return nil, fmt.Errorf("unknown policy source %q", policy.Source)
+		}
+		switch policy.Target {
+		case TargetFlac:
+			if !isIntegerSource(policy.Source) {
+				return nil, fmt.Errorf("policy source %q cannot be stored as flac", policy.Source)
+			}
+		case TargetOpus:
+			if policy.Bitrate == "" {
+				return nil, fmt.Errorf("opus policy for %q needs a bitrate", policy.Source)
+			}
+		case TargetCopy:
+		default:
+			return nil, fmt.Errorf("unknown policy target %q", policy.Target)
+		}
+	}
+
+	return &PolicyEngine{policies}, nil
+}
+
+// Select returns the policy of the source class for the tier. A policy naming the
+// tier wins over one without a tier, which matches every tier, whatever their order.
+// Sources without a policy are copied.
+func (pe *PolicyEngine) Select(source, tier string) entity.ConversionPolicy {
+	var generic *entity.ConversionPolicy
+	for i, policy := range pe.policies {
+		switch {
+		case policy.Source != source:
+		case policy.Tier != "" && policy.Tier == tier:
+			return policy
+		case policy.Tier == "" && generic == nil:
+			generic = &pe.policies[i]
+		}
+	}
+	if generic != nil {
+		return *generic
+	}
+	return entity.ConversionPolicy{Source: source, Target: TargetCopy}
+}
+
+// TargetFormat returns the format and file extension a policy stores audio as.
+func TargetFormat(policy entity.ConversionPolicy) (Format, string) {
+	switch policy.Target {
+	case TargetFlac:
+		return Format{Container: "flac"}, ".flac"
+	case TargetOpus:
+		return Format{Container: "ogg", Codec: "libopus", Bitrate: policy.Bitrate}, ".opus"
+	}
+	return Format{}, ""
+}
+
+// IsExact reports whether audio stored under the policy restores to the original samples.
+func IsExact(policy entity.ConversionPolicy) bool {
+	return policy.Target == TargetCopy || policy.Target == TargetFlac && isIntegerSource(policy.Source)
+}
+
+func isIntegerSource(source string) bool {
+	return source == SourceWav || source == SourceAiff || source == SourceRaw
+}
@@ -0,0 +1,32 @@
+package audio_converter
+
+import (
+	"testing"
+
+	"audio_compression/entity"
+)
+
+func TestPolicySelectPrefersTier(t *testing.T) {
+	engine, err := NewPolicyEngine([]entity.ConversionPolicy{
+		{Source: SourceWav, Target: TargetFlac},
+		{Source: SourceWav, Tier: "cold", Target: TargetOpus, Bitrate: "64k"},
+		{Source: SourceWav, Tier: "cold", Target: TargetCopy},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source, tier, target string
+	}{
+		{SourceWav, "cold", TargetOpus},
+		{SourceWav, "hot", TargetFlac},
+		{SourceWav, "", TargetFlac},
+		{SourceAiff, "cold", TargetCopy},
+	}
+	for _, tt := range tests {
+		if got := engine.Select(tt.source, tt.tier); got.Target != tt.target {
+			t.Errorf("Select(%q, %q) = %q, want %q", tt.source, tt.tier, got.Target, tt.target)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package audio_converter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+
+// Source classes policies are selected by.
+const (
+	SourceWav       = "wav"
+	SourceWavFloat  = "wav_float"
+	SourceTelephony = "wav_telephony"
+	SourceAiff      = "aiff"
+	SourceRaw       = "raw"
+	SourceMP3       = "mp3"
+	SourceOther     = "other"
+)
+
+type AudioInfo struct {
+	Format     string
+	Codec      string
+	SampleRate int
+	Channels   int
+	BitDepth   int
+	Duration   float64
+	Tags       map[string]string
+}
+
+// IsIntegerPCM reports whether the samples can be stored losslessly as FLAC.
+func (i *AudioInfo) IsIntegerPCM() bool {
+	switch i.Codec {
+	case "pcm_u8", "pcm_s8", "pcm_s16le", "pcm_s16be", "pcm_s24le", "pcm_s24be":
+		return true
+	}
+	return false
+}
+
+// Class returns the source class of the audio for policy selection.
+func (i *AudioInfo) Class() string {
+	switch i.Format {
+	case "wav":
+		switch {
+		case i.IsIntegerPCM():
+			return SourceWav
+		case i.Codec == "pcm_alaw" || i.Codec == "pcm_mulaw":
+			return SourceTelephony
+		case strings.HasPrefix(i.Codec, "pcm_f"):
+			return SourceWavFloat
+		}
+	case "aiff":
+		if i.IsIntegerPCM() {
+			return SourceAiff
+		}
+	case "raw":
+		return SourceRaw
+	case "mp3":
+		return SourceMP3
+	}
+	return SourceOther
+}
+
+// SourceFormat describes the probed audio as a conversion format.
+func (i *AudioInfo) SourceFormat() Format {
+	container := i.Format
+	if container == "raw" {
+		container = RawContainer(i.Codec)
+	}
+	return Format{Container: container, Codec: i.Codec, SampleRate: i.SampleRate, Channels: i.Channels}
+}
+
+// Probe reads the stream parameters of an audio body without decoding it.
+func Probe(body []byte) (*AudioInfo, error) {
+	if hdr, err := ParseWavHeader(body); err == nil {
+		return &AudioInfo{
+			Format:     "wav",
+			Codec:      wavCodecName(hdr),
+			SampleRate: int(hdr.SampleRate),
+			Channels:   int(hdr.Channels),
+			BitDepth:   int(hdr.BitsPerSample),
+			Duration:   hdr.Duration(),
+			Tags:       hdr.Tags,
+		}, nil
+	}
+
+	if hdr, err := ParseAiffHeader(body); err == nil {
+		return &AudioInfo{
+			Format:     "aiff",
+			Codec:      aiffCodecName(hdr),
+			SampleRate: int(hdr.SampleRate),
+			Channels:   int(hdr.Channels),
+			BitDepth:   int(hdr.BitsPerSample),
+			Duration:   hdr.Duration(),
+			Tags:       hdr.Tags,
+		}, nil
+	}
+
+	if info, ok := probeMP3(body); ok {
+		return info, nil
+	}
+
+	return nil, ErrUnsupportedFormat
+}
+
+// ProbeRaw describes a headerless PCM body with the given stream parameters.
+func ProbeRaw(body []byte, codec string, sampleRate, channels int) (*AudioInfo, error) {
+	bitDepth := pcmBitDepth(codec)
+	if bitDepth == 0 || sampleRate <= 0 || channels <= 0 {
+		return nil, ErrUnsupportedFormat
+	}
+
+	frameSize := channels * bitDepth / 8
+	return &AudioInfo{
+		Format:     "raw",
+		Codec:      codec,
+		SampleRate: sampleRate,
+		Channels:   channels,
+		BitDepth:   bitDepth,
+		Duration:   float64(len(body)/frameSize) / float64(sampleRate),
+	}, nil
+}
+
+// RawContainer returns the ffmpeg raw muxer name of a PCM codec, e.g. s16le.
+func RawContainer(codec string) string {
+	return strings.TrimPrefix(codec, "pcm_")
+}
+
+func pcmBitDepth(codec string) int {
+	switch codec {
+	case "pcm_u8", "pcm_s8", "pcm_alaw", "pcm_mulaw":
+		return 8
+	case "pcm_s16le", "pcm_s16be":
+		return 16
+	case "pcm_s24le", "pcm_s24be":
+		return 24
+	}
+	return 0
+}
+
+// wavCodecName follows the ffmpeg codec naming.
+func wavCodecName(hdr *WavHeader) string {
+	switch hdr.AudioFormat {
+	case wavFormatPCM:
+		if hdr.BitsPerSample <= 8 {
+			return "pcm_u8"
+		}
+		return fmt.Sprintf("pcm_s%dle", hdr.BitsPerSample)
+	case wavFormatFloat:
+		return fmt.Sprintf("pcm_f%dle", hdr.BitsPerSample)
+	case wavFormatALaw:
+		return "pcm_alaw"
+	case wavFormatMuLaw:
+		return "pcm_mulaw"
+	case wavFormatMP3:
+		return "mp3"
+	default:
+		return fmt.Sprintf("wav_0x%04x", hdr.AudioFormat)
+	}
+}
+
+func aiffCodecName(hdr *AiffHeader) string {
+	switch hdr.Compression {
+	case "NONE", "twos":
+		if hdr.BitsPerSample <= 8 {
+			return "pcm_s8"
+		}
+		return fmt.Sprintf("pcm_s%dbe", hdr.BitsPerSample)
+	case "sowt":
+		return fmt.Sprintf("pcm_s%dle", hdr.BitsPerSample)
+	case "ulaw", "ULAW":
+		return "pcm_mulaw"
+	case "alaw", "ALAW":
+		return "pcm_alaw"
+	case "fl32", "FL32":
+		return "pcm_f32be"
+	}
+	return "aifc_" + strings.TrimSpace(hdr.Compression)
+}
+
+// PCMData returns the sample bytes of a probed WAV, AIFF or raw PCM body.
+func PCMData(body []byte, info *AudioInfo) ([]byte, error) {
+	switch info.Format {
+	case "wav":
+		hdr, err := ParseWavHeader(body)
+		if err != nil {
+			return nil, err
+		}
+		return body[hdr.DataOffset : hdr.DataOffset+int(hdr.DataSize)], nil
+	case "aiff":
+		hdr, err := ParseAiffHeader(body)
+		if err != nil {
+			return nil, err
+		}
+		return body[hdr.DataOffset : hdr.DataOffset+int(hdr.DataSize)], nil
+	case "raw":
+		return body, nil
+	}
+	return nil, ErrUnsupportedFormat
+}
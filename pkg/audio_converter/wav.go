@@ -0,0 +1,113 @@
+package audio_converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidWav = errors.New("invalid wav header")
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatALaw       = 0x0006
+	wavFormatMuLaw      = 0x0007
+	wavFormatMP3        = 0x0055
+	wavFormatExtensible = 0xFFFE
+)
+
+type WavHeader struct {
+	AudioFormat   uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	DataOffset    int
+	DataSize      uint32
+	Tags          map[string]string
+}
+
+// Duration returns the length of the data chunk in seconds.
+func (h *WavHeader) Duration() float64 {
+	if h.ByteRate == 0 {
+		return 0
+	}
+	return float64(h.DataSize) / float64(h.ByteRate)
+}
+
+// ParseWavHeader walks the chunks of a RIFF/WAVE body, reading the fmt chunk,
+// the position of the data chunk and any LIST/INFO tags.
+func ParseWavHeader(b []byte) (*WavHeader, error) {
+	if len(b) < 12 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		return nil, ErrInvalidWav
+	}
+
+	var hdr WavHeader
+	var hasFmt, hasData bool
+	pos := 12
+	for pos+8 <= len(b) {
+		id := string(b[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(b[pos+4 : pos+8]))
+		body := pos + 8
+		// Streaming writers leave the size of the last chunk unset
+		if size > len(b)-body {
+			size = len(b) - body
+		}
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, ErrInvalidWav
+			}
+			hdr.AudioFormat = binary.LittleEndian.Uint16(b[body:])
+			hdr.Channels = binary.LittleEndian.Uint16(b[body+2:])
+			hdr.SampleRate = binary.LittleEndian.Uint32(b[body+4:])
+			hdr.ByteRate = binary.LittleEndian.Uint32(b[body+8:])
+			hdr.BlockAlign = binary.LittleEndian.Uint16(b[body+12:])
+			hdr.BitsPerSample = binary.LittleEndian.Uint16(b[body+14:])
+			// WAVE_FORMAT_EXTENSIBLE carries the real format in the sub-format GUID
+			if hdr.AudioFormat == wavFormatExtensible && size >= 26 {
+				hdr.AudioFormat = binary.LittleEndian.Uint16(b[body+24:])
+			}
+			hasFmt = true
+		case "data":
+			hdr.DataOffset = body
+			hdr.DataSize = uint32(size)
+			hasData = true
+		case "LIST":
+			if size >= 4 && string(b[body:body+4]) == "INFO" {
+				hdr.Tags = parseInfoList(b[body+4 : body+size])
+			}
+		}
+
+		// Chunks are word aligned
+		pos = body + size + size&1
+	}
+
+	if !hasFmt || !hasData {
+		return nil, ErrInvalidWav
+	}
+
+	return &hdr, nil
+}
+
+func parseInfoList(b []byte) map[string]string {
+	tags := make(map[string]string)
+	pos := 0
+	for pos+8 <= len(b) {
+		id := string(b[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(b[pos+4 : pos+8]))
+		body := pos + 8
+		if size > len(b)-body {
+			break
+		}
+		value := bytes.TrimRight(b[body:body+size], "\x00")
+		if len(value) > 0 {
+			tags[id] = string(value)
+		}
+		pos = body + size + size&1
+	}
+	return tags
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"audio_compression/config"
+)
+
+// APIKeyHeader carries a static API key.
+const APIKeyHeader = "X-API-Key"
+
+type apiKey struct {
+	name   string
+	tenant string
+	hash   []byte
+}
+
+// APIKeys authenticates static API keys by their SHA-256, so the configuration
+// never holds the keys themselves.
+type APIKeys struct {
+	keys []apiKey
+}
+
+// NewAPIKeys -.
+func NewAPIKeys(keys []config.APIKey) (*APIKeys, error) {
+	a := &APIKeys{}
+	for _, k := range keys {
+		hash, err := hex.DecodeString(strings.TrimSpace(k.SHA256))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("auth: api key %q: sha256 must be 64 hex characters", k.Name)
+		}
+		if k.Tenant == "" {
+			return nil, fmt.Errorf("auth: api key %q has no tenant", k.Name)
+		}
+		a.keys = append(a.keys, apiKey{name: k.Name, tenant: k.Tenant, hash: hash})
+	}
+	return a, nil
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, errNoCredentials
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(sum[:], k.hash) == 1 {
+			return &Principal{Tenant: k.tenant, Subject: k.name, Method: MethodAPIKey}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown api key", ErrUnauthenticated)
+}
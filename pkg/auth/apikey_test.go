@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"audio_compression/config"
+)
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestNewAPIKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		key  config.APIKey
+		ok   bool
+	}{
+		{"valid", config.APIKey{Name: "ci", Tenant: "acme", SHA256: keyHash("k")}, true},
+		{"upper case hash", config.APIKey{Name: "ci", Tenant: "acme", SHA256: strings.ToUpper(keyHash("k"))}, true},
+		{"padded hash", config.APIKey{Name: "ci", Tenant: "acme", SHA256: " " + keyHash("k") + "\n"}, true},
+		{"key instead of hash", config.APIKey{Name: "ci", Tenant: "acme", SHA256: "k"}, false},
+		{"short hash", config.APIKey{Name: "ci", Tenant: "acme", SHA256: keyHash("k")[:62]}, false},
+		{"long hash", config.APIKey{Name: "ci", Tenant: "acme", SHA256: keyHash("k") + "00"}, false},
+		{"no tenant", config.APIKey{Name: "ci", SHA256: keyHash("k")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAPIKeys([]config.APIKey{tt.key})
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAPIKeysAuthenticate(t *testing.T) {
+	keys, err := NewAPIKeys([]config.APIKey{
+		{Name: "ci", Tenant: "acme", SHA256: keyHash("ci-key")},
+		{Name: "ops", Tenant: "globex", SHA256: keyHash("ops-key")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		tenant  string
+		subject string
+		err     error
+	}{
+		{"first key", "ci-key", "acme", "ci", nil},
+		{"second key", "ops-key", "globex", "ops", nil},
+		{"no key", "", "", "", errNoCredentials},
+		{"hash mismatch", "ci-key2", "", "", ErrUnauthenticated},
+		{"prefix of a key", "ci-ke", "", "", ErrUnauthenticated},
+		{"hash as key", keyHash("ci-key"), "", "", ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.key != "" {
+				r.Header.Set(APIKeyHeader, tt.key)
+			}
+			p, err := keys.Authenticate(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && (p.Tenant != tt.tenant || p.Subject != tt.subject || p.Method != MethodAPIKey) {
+				t.Errorf("got %+v", p)
+			}
+		})
+	}
+}
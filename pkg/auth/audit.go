@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes one API request.
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Action     Action    `json:"action,omitempty"`
+	Bucket     string    `json:"bucket,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	Status     int       `json:"status"`
+	Duration   float64   `json:"duration_seconds"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLog writes one JSON line per record.
+type AuditLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewAuditLog appends to the file at path, or writes to stdout when path is empty.
+func NewAuditLog(path string) (*AuditLog, error) {
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &AuditLog{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (a *AuditLog) Record(r AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enc.Encode(r)
+}
+
+// Close closes the audit file.
+func (a *AuditLog) Close() error {
+	if c, ok := a.w.(io.Closer); ok && a.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package auth authenticates API requests with static API keys or JWTs and
+// authorizes tenants on buckets and key prefixes.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"audio_compression/config"
+)
+
+var (
+	// ErrUnauthenticated is returned when a request carries no valid credentials.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	errNoCredentials   = errors.New("no credentials")
+)
+
+// Method names how a principal was authenticated.
+const (
+	MethodAnonymous = "anonymous"
+	MethodAPIKey    = "api_key"
+	MethodJWT       = "jwt"
+)
+
+// Principal is the caller of a request.
+type Principal struct {
+	Tenant  string `json:"tenant"`
+	Subject string `json:"subject"`
+	Method  string `json:"method"`
+}
+
+// Authenticator turns the credentials of a request into a principal.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Auth authenticates requests with the configured authenticators and authorizes
+// their principals with the tenant policy.
+type Auth struct {
+	authenticators []Authenticator
+	policy         *Policy
+	disabled       bool
+}
+
+// New builds the authenticators configured in cfg.
+func New(cfg config.Auth) (*Auth, error) {
+	a := &Auth{disabled: cfg.Disabled}
+	if cfg.Disabled {
+		return a, nil
+	}
+
+	if len(cfg.APIKeys) > 0 {
+		keys, err := NewAPIKeys(cfg.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		a.authenticators = append(a.authenticators, keys)
+	}
+
+	if cfg.JWT.HS256Secret != "" || cfg.JWT.JWKSFile != "" {
+		jwt, err := NewJWT(cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.authenticators = append(a.authenticators, jwt)
+	}
+
+	if len(a.authenticators) == 0 {
+		return nil, errors.New("auth: no api keys or jwt keys configured")
+	}
+
+	policy, err := NewPolicy(cfg.Tenants)
+	if err != nil {
+		return nil, err
+	}
+	a.policy = policy
+
+	return a, nil
+}
+
+// Disabled reports whether every request is let through.
+func (a *Auth) Disabled() bool {
+	return a.disabled
+}
+
+// Authenticate returns the principal of the first authenticator the request
+// carries credentials for.
+func (a *Auth) Authenticate(r *http.Request) (*Principal, error) {
+	if a.disabled {
+		return &Principal{Method: MethodAnonymous}, nil
+	}
+
+	for _, authenticator := range a.authenticators {
+		p, err := authenticator.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrUnauthenticated
+}
+
+// Allowed reports whether the principal may perform action on the key of bucket.
+func (a *Auth) Allowed(p *Principal, action Action, bucket, key string) bool {
+	if a.disabled {
+		return true
+	}
+	return a.policy.Allowed(p.Tenant, action, bucket, key)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
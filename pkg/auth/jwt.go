@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"audio_compression/config"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *json.Number    `json:"exp"`
+	NotBefore *json.Number    `json:"nbf"`
+}
+
+// JWT authenticates bearer tokens. HS256 tokens are checked with the shared
+// secret and RS256 tokens with the key of their kid in the JWKS file, which is
+// read again when a token names a kid it does not know yet.
+type JWT struct {
+	cfg    config.JWT
+	secret []byte
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	jwksMtime time.Time
+}
+
+// NewJWT -.
+func NewJWT(cfg config.JWT) (*JWT, error) {
+	j := &JWT{cfg: cfg, secret: []byte(cfg.HS256Secret)}
+	if cfg.JWKSFile != "" {
+		if err := j.loadJWKS(); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errNoCredentials
+	}
+
+	claims, registered, err := j.verify(token, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	tenant, _ := claims[j.cfg.TenantClaim].(string)
+	if tenant == "" {
+		return nil, fmt.Errorf("%w: token has no %s claim", ErrUnauthenticated, j.cfg.TenantClaim)
+	}
+
+	return &Principal{Tenant: tenant, Subject: registered.Subject, Method: MethodJWT}, nil
+}
+
+// verify checks the signature and the registered claims of token and returns its claims.
+func (j *JWT) verify(token string, now time.Time) (map[string]interface{}, *jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// The algorithm only selects among the configured keys, so an RS256 key can
+	// never be used as an HS256 secret
+	switch header.Alg {
+	case "HS256":
+		if len(j.secret) == 0 {
+			return nil, nil, errors.New("HS256 is not accepted")
+		}
+		mac := hmac.New(sha256.New, j.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, nil, errors.New("invalid signature")
+		}
+	case "RS256":
+		key, err := j.key(header.Kid)
+		if err != nil {
+			return nil, nil, err
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, nil, fmt.Errorf("algorithm %q is not accepted", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, nil, fmt.Errorf("claims: %w", err)
+	}
+	var registered jwtClaims
+	if err := decodeSegment(parts[1], &registered); err != nil {
+		return nil, nil, errors.New("invalid registered claims")
+	}
+
+	if registered.ExpiresAt == nil {
+		return nil, nil, errors.New("token has no exp claim")
+	}
+	exp, err := registered.ExpiresAt.Int64()
+	if err != nil {
+		return nil, nil, errors.New("invalid exp claim")
+	}
+	if now.Add(-j.cfg.Leeway).Unix() >= exp {
+		return nil, nil, errors.New("token expired")
+	}
+	if registered.NotBefore != nil {
+		nbf, err := registered.NotBefore.Int64()
+		if err != nil {
+			return nil, nil, errors.New("invalid nbf claim")
+		}
+		if now.Add(j.cfg.Leeway).Unix() < nbf {
+			return nil, nil, errors.New("token not valid yet")
+		}
+	}
+	if j.cfg.Issuer != "" && registered.Issuer != j.cfg.Issuer {
+		return nil, nil, errors.New("unexpected issuer")
+	}
+	if j.cfg.Audience != "" && !hasAudience(registered.Audience, j.cfg.Audience) {
+		return nil, nil, errors.New("unexpected audience")
+	}
+
+	return claims, &registered, nil
+}
+
+// key returns the RS256 key of kid, reloading the JWKS file when it changed.
+func (j *JWT) key(kid string) (*rsa.PublicKey, error) {
+	if j.cfg.JWKSFile == "" {
+		return nil, errors.New("RS256 is not accepted")
+	}
+
+	j.mu.Lock()
+	key, ok := j.keys[kid]
+	j.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	if err := j.loadJWKS(); err != nil {
+		return nil, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// loadJWKS reads the RSA signing keys of the JWKS file unless it is unchanged.
+func (j *JWT) loadJWKS() error {
+	st, err := os.Stat(j.cfg.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("auth: jwks: %w", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.keys != nil && st.ModTime().Equal(j.jwksMtime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(j.cfg.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("auth: jwks: %w", err)
+	}
+	var set jwks
+	if err := json.Unmarshal(b, &set); err != nil {
+		return fmt.Errorf("auth: jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("auth: jwks: key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return fmt.Errorf("auth: jwks: key %q: invalid exponent", k.Kid)
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+		if key.N.BitLen() < 2048 {
+			return fmt.Errorf("auth: jwks: key %q is shorter than 2048 bits", k.Kid)
+		}
+		keys[k.Kid] = key
+	}
+
+	j.keys = keys
+	j.jwksMtime = st.ModTime()
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// hasAudience accepts aud as a single string or a list of them.
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"audio_compression/config"
+)
+
+const testSecret = "secret"
+
+var testNow = time.Unix(1700000000, 0)
+
+func segment(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signToken builds a token of header and claims signed by sign.
+func signToken(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	signed := segment(t, header) + "." + segment(t, claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func unsigned([]byte) []byte { return nil }
+
+func rsaKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeJWKS writes a JWKS file of the public keys by kid and returns its path.
+func writeJWKS(t *testing.T, path string, keys map[string]*rsa.PrivateKey) string {
+	t.Helper()
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	b, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "jwks.json")
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func claims(overrides map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"sub":    "user",
+		"tenant": "acme",
+		"exp":    testNow.Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(c, k)
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+func newTestJWT(t *testing.T, cfg config.JWT) *JWT {
+	t.Helper()
+	if cfg.TenantClaim == "" {
+		cfg.TenantClaim = "tenant"
+	}
+	j, err := NewJWT(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJWTVerifyAlgorithms(t *testing.T) {
+	key := rsaKey(t, 2048)
+	jwksFile := writeJWKS(t, "", map[string]*rsa.PrivateKey{"k1": key})
+
+	hsOnly := config.JWT{HS256Secret: testSecret}
+	rsOnly := config.JWT{JWKSFile: jwksFile}
+	both := config.JWT{HS256Secret: testSecret, JWKSFile: jwksFile}
+
+	// the public key serialised as an HMAC secret, the classic key confusion
+	publicSecret := string(key.PublicKey.N.Bytes())
+
+	tests := []struct {
+		name   string
+		cfg    config.JWT
+		header map[string]interface{}
+		sign   func([]byte) []byte
+		ok     bool
+	}{
+		{"hs256", hsOnly, map[string]interface{}{"alg": "HS256"}, hs256(testSecret), true},
+		{"hs256 wrong secret", hsOnly, map[string]interface{}{"alg": "HS256"}, hs256("other"), false},
+		{"rs256", rsOnly, map[string]interface{}{"alg": "RS256", "kid": "k1"}, rs256(t, key), true},
+		{"rs256 and hs256 configured", both, map[string]interface{}{"alg": "RS256", "kid": "k1"}, rs256(t, key), true},
+		{"rs256 wrong key", rsOnly, map[string]interface{}{"alg": "RS256", "kid": "k1"}, rs256(t, rsaKey(t, 2048)), false},
+		{"none", both, map[string]interface{}{"alg": "none"}, unsigned, false},
+		{"none upper case", both, map[string]interface{}{"alg": "NONE"}, unsigned, false},
+		{"none signed", both, map[string]interface{}{"alg": "none"}, hs256(testSecret), false},
+		{"no alg", both, map[string]interface{}{}, hs256(testSecret), false},
+		{"hs512", both, map[string]interface{}{"alg": "HS512"}, hs256(testSecret), false},
+		{"rs512", both, map[string]interface{}{"alg": "RS512", "kid": "k1"}, rs256(t, key), false},
+		{"hs256 lower case", both, map[string]interface{}{"alg": "hs256"}, hs256(testSecret), false},
+		{"rs256 against hs only", hsOnly, map[string]interface{}{"alg": "RS256", "kid": "k1"}, rs256(t, key), false},
+		{"hs256 against rs only", rsOnly, map[string]interface{}{"alg": "HS256"}, hs256(""), false},
+		{"hs256 signed with the public key", rsOnly, map[string]interface{}{"alg": "HS256", "kid": "k1"}, hs256(publicSecret), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := newTestJWT(t, tt.cfg)
+			_, _, err := j.verify(signToken(t, tt.header, claims(nil), tt.sign), testNow)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestJWTVerifyMalformed(t *testing.T) {
+	j := newTestJWT(t, config.JWT{HS256Secret: testSecret})
+	valid := signToken(t, map[string]interface{}{"alg": "HS256"}, claims(nil), hs256(testSecret))
+	parts := strings.Split(valid, ".")
+	tampered := segment(t, claims(map[string]interface{}{"tenant": "other"}))
+	notJSON := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte("x"))
+	notJSON += "." + base64.RawURLEncoding.EncodeToString(hs256(testSecret)([]byte(notJSON)))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"two segments", parts[0] + "." + parts[1]},
+		{"four segments", valid + "."},
+		{"header not base64", "!." + parts[1] + "." + parts[2]},
+		{"signature not base64", parts[0] + "." + parts[1] + ".!"},
+		{"padded signature", valid + "="},
+		{"tampered claims", parts[0] + "." + tampered + "." + parts[2]},
+		{"claims not json", notJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := j.verify(tt.token, testNow); err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+}
+
+func TestJWTVerifyClaims(t *testing.T) {
+	leeway := 30 * time.Second
+	now := testNow.Unix()
+
+	tests := []struct {
+		name   string
+		cfg    config.JWT
+		claims map[string]interface{}
+		ok     bool
+	}{
+		{"no exp", config.JWT{}, map[string]interface{}{"exp": nil}, false},
+		{"exp not a number", config.JWT{}, map[string]interface{}{"exp": "soon"}, false},
+		{"expired", config.JWT{}, map[string]interface{}{"exp": now}, false},
+		{"expired within leeway", config.JWT{Leeway: leeway}, map[string]interface{}{"exp": now - 29}, true},
+		{"expired at leeway", config.JWT{Leeway: leeway}, map[string]interface{}{"exp": now - 30}, false},
+		{"nbf passed", config.JWT{}, map[string]interface{}{"nbf": now}, true},
+		{"nbf ahead", config.JWT{}, map[string]interface{}{"nbf": now + 1}, false},
+		{"nbf ahead within leeway", config.JWT{Leeway: leeway}, map[string]interface{}{"nbf": now + 30}, true},
+		{"nbf ahead beyond leeway", config.JWT{Leeway: leeway}, map[string]interface{}{"nbf": now + 31}, false},
+		{"nbf not a number", config.JWT{}, map[string]interface{}{"nbf": "now"}, false},
+		{"issuer", config.JWT{Issuer: "idp"}, map[string]interface{}{"iss": "idp"}, true},
+		{"wrong issuer", config.JWT{Issuer: "idp"}, map[string]interface{}{"iss": "other"}, false},
+		{"no issuer", config.JWT{Issuer: "idp"}, nil, false},
+		{"audience string", config.JWT{Audience: "api"}, map[string]interface{}{"aud": "api"}, true},
+		{"wrong audience string", config.JWT{Audience: "api"}, map[string]interface{}{"aud": "other"}, false},
+		{"audience list", config.JWT{Audience: "api"}, map[string]interface{}{"aud": []string{"other", "api"}}, true},
+		{"wrong audience list", config.JWT{Audience: "api"}, map[string]interface{}{"aud": []string{"other"}}, false},
+		{"empty audience list", config.JWT{Audience: "api"}, map[string]interface{}{"aud": []string{}}, false},
+		{"audience not a string", config.JWT{Audience: "api"}, map[string]interface{}{"aud": 1}, false},
+		{"no audience", config.JWT{Audience: "api"}, nil, false},
+		{"audience not required", config.JWT{}, map[string]interface{}{"aud": "other"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.HS256Secret = testSecret
+			j := newTestJWT(t, tt.cfg)
+			token := signToken(t, map[string]interface{}{"alg": "HS256"}, claims(tt.claims), hs256(testSecret))
+			_, _, err := j.verify(token, testNow)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestJWTReloadsJWKS(t *testing.T) {
+	first, second := rsaKey(t, 2048), rsaKey(t, 2048)
+	jwksFile := writeJWKS(t, "", map[string]*rsa.PrivateKey{"k1": first})
+	j := newTestJWT(t, config.JWT{JWKSFile: jwksFile})
+
+	secondToken := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims(nil), rs256(t, second))
+	if _, _, err := j.verify(secondToken, testNow); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("unknown kid: got %v", err)
+	}
+
+	// rotated: k2 is added, the mtime moved on so the unknown kid reloads the file
+	writeJWKS(t, jwksFile, map[string]*rsa.PrivateKey{"k1": first, "k2": second})
+	mtime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(jwksFile, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := j.verify(secondToken, testNow); err != nil {
+		t.Fatalf("after the rotation: %v", err)
+	}
+
+	// a kid signed with another kid's key is still rejected
+	forged := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims(nil), rs256(t, second))
+	if _, _, err := j.verify(forged, testNow); err == nil {
+		t.Error("token of k2 was accepted as k1")
+	}
+	if _, _, err := j.verify(signToken(t, map[string]interface{}{"alg": "RS256", "kid": "k3"}, claims(nil), rs256(t, second)), testNow); err == nil {
+		t.Error("unknown kid was accepted after the reload")
+	}
+
+	// removed keys stop verifying once the file changes again
+	writeJWKS(t, jwksFile, map[string]*rsa.PrivateKey{"k1": first})
+	mtime = mtime.Add(time.Minute)
+	if err := os.Chtimes(jwksFile, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.loadJWKS(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := j.verify(secondToken, testNow); err == nil {
+		t.Error("removed key was accepted")
+	}
+}
+
+func TestJWTLoadJWKS(t *testing.T) {
+	rsaJWK := func(key *rsa.PrivateKey, fields map[string]string) map[string]string {
+		jwk := map[string]string{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   "AQAB",
+		}
+		for k, v := range fields {
+			jwk[k] = v
+		}
+		return jwk
+	}
+	key := rsaKey(t, 2048)
+
+	tests := []struct {
+		name string
+		jwk  map[string]string
+		// loaded reports whether k1 is usable, ok whether the file was accepted
+		ok, loaded bool
+	}{
+		{"rsa key", rsaJWK(key, nil), true, true},
+		{"signing key", rsaJWK(key, map[string]string{"use": "sig", "alg": "RS256"}), true, true},
+		{"encryption key", rsaJWK(key, map[string]string{"use": "enc"}), true, false},
+		{"other algorithm", rsaJWK(key, map[string]string{"alg": "RS512"}), true, false},
+		{"ec key", map[string]string{"kty": "EC", "kid": "k1", "crv": "P-256"}, true, false},
+		{"short key", rsaJWK(rsaKey(t, 1024), nil), false, false},
+		{"modulus not base64", rsaJWK(key, map[string]string{"n": "!"}), false, false},
+		{"empty exponent", rsaJWK(key, map[string]string{"e": ""}), false, false},
+		{"long exponent", rsaJWK(key, map[string]string{"e": base64.RawURLEncoding.EncodeToString([]byte{1, 0, 0, 0, 1})}), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{tt.jwk}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "jwks.json")
+			if err := os.WriteFile(path, b, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			j, err := NewJWT(config.JWT{JWKSFile: path})
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			_, loaded := j.keys["k1"]
+			if loaded != tt.loaded {
+				t.Errorf("k1 loaded %v, want %v", loaded, tt.loaded)
+			}
+		})
+	}
+
+	if _, err := NewJWT(config.JWT{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("missing jwks file was accepted")
+	}
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	j := newTestJWT(t, config.JWT{HS256Secret: testSecret})
+	header := map[string]interface{}{"alg": "HS256"}
+	// Authenticate checks against the clock rather than testNow
+	live := func(overrides map[string]interface{}) map[string]interface{} {
+		c := claims(overrides)
+		c["exp"] = time.Now().Add(time.Hour).Unix()
+		return c
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		tenant        string
+		err           error
+	}{
+		{"bearer", "Bearer " + signToken(t, header, live(nil), hs256(testSecret)), "acme", nil},
+		{"lower case scheme", "bearer " + signToken(t, header, live(nil), hs256(testSecret)), "acme", nil},
+		{"no header", "", "", errNoCredentials},
+		{"basic", "Basic dXNlcjpwYXNz", "", errNoCredentials},
+		{"invalid token", "Bearer " + signToken(t, header, live(nil), hs256("other")), "", ErrUnauthenticated},
+		{"no tenant", "Bearer " + signToken(t, header, live(map[string]interface{}{"tenant": nil}), hs256(testSecret)), "", ErrUnauthenticated},
+		{"tenant not a string", "Bearer " + signToken(t, header, live(map[string]interface{}{"tenant": 1}), hs256(testSecret)), "", ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			p, err := j.Authenticate(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && (p.Tenant != tt.tenant || p.Subject != "user" || p.Method != MethodJWT) {
+				t.Errorf("got %+v", p)
+			}
+		})
+	}
+}
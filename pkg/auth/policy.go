@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"audio_compression/config"
+)
+
+// Action is what a tenant does with an object.
+type Action string
+
+const (
+	// ActionCompress plans compressions and uploads archives.
+	ActionCompress Action = "compress"
+	// ActionRead decompresses archives, lists their entries and searches recordings.
+	ActionRead Action = "read"
+)
+
+type rule struct {
+	bucket   string
+	prefixes []string
+	actions  map[Action]bool
+}
+
+// Policy maps tenants to the buckets and key prefixes they may use. Anything not
+// granted by a rule is denied.
+type Policy struct {
+	tenants map[string][]rule
+}
+
+// NewPolicy -.
+func NewPolicy(tenants []config.Tenant) (*Policy, error) {
+	p := &Policy{tenants: make(map[string][]rule)}
+	for _, t := range tenants {
+		if t.Name == "" {
+			return nil, fmt.Errorf("auth: tenant without name")
+		}
+		for _, r := range t.Rules {
+			if r.Bucket == "" {
+				return nil, fmt.Errorf("auth: tenant %q: rule without bucket", t.Name)
+			}
+			actions := make(map[Action]bool)
+			for _, a := range r.Actions {
+				switch Action(a) {
+				case ActionCompress, ActionRead:
+					actions[Action(a)] = true
+				default:
+					return nil, fmt.Errorf("auth: tenant %q: unknown action %q", t.Name, a)
+				}
+			}
+			prefixes := make([]string, 0, len(r.Prefixes))
+			for _, prefix := range r.Prefixes {
+				prefixes = append(prefixes, strings.TrimPrefix(prefix, "/"))
+			}
+			p.tenants[t.Name] = append(p.tenants[t.Name], rule{bucket: r.Bucket, prefixes: prefixes, actions: actions})
+		}
+	}
+	return p, nil
+}
+
+// Allowed reports whether tenant may perform action on the key of bucket. An empty
+// key stands for every key of the bucket, as in an unfiltered search.
+func (p *Policy) Allowed(tenant string, action Action, bucket, key string) bool {
+	key = strings.TrimPrefix(key, "/")
+	if !safeKey(key) {
+		return false
+	}
+
+	for _, r := range p.tenants[tenant] {
+		if !r.actions[action] || (r.bucket != "*" && r.bucket != bucket) {
+			continue
+		}
+		if len(r.prefixes) == 0 {
+			return true
+		}
+		for _, prefix := range r.prefixes {
+			if key != "" && strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// safeKey rejects dot segments, which some stores resolve and which would otherwise
+// escape a prefix.
+func safeKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"testing"
+
+	"audio_compression/config"
+)
+
+func TestNewPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		tenant config.Tenant
+		ok     bool
+	}{
+		{"valid", config.Tenant{Name: "acme", Rules: []config.TenantRule{{Bucket: "calls", Actions: []string{"read", "compress"}}}}, true},
+		{"no name", config.Tenant{Rules: []config.TenantRule{{Bucket: "calls", Actions: []string{"read"}}}}, false},
+		{"no bucket", config.Tenant{Name: "acme", Rules: []config.TenantRule{{Actions: []string{"read"}}}}, false},
+		{"unknown action", config.Tenant{Name: "acme", Rules: []config.TenantRule{{Bucket: "calls", Actions: []string{"delete"}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicy([]config.Tenant{tt.tenant})
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	p, err := NewPolicy([]config.Tenant{
+		{Name: "acme", Rules: []config.TenantRule{
+			{Bucket: "calls", Prefixes: []string{"/acme/", "shared/"}, Actions: []string{"read", "compress"}},
+			{Bucket: "archive", Actions: []string{"read"}},
+		}},
+		{Name: "admin", Rules: []config.TenantRule{
+			{Bucket: "*", Actions: []string{"read", "compress"}},
+		}},
+		{Name: "auditor", Rules: []config.TenantRule{
+			{Bucket: "*", Prefixes: []string{"audit/"}, Actions: []string{"read"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tenant string
+		action Action
+		bucket string
+		key    string
+		ok     bool
+	}{
+		{"within prefix", "acme", ActionRead, "calls", "acme/a.tar", true},
+		{"within second prefix", "acme", ActionCompress, "calls", "shared/a.tar", true},
+		{"leading slash", "acme", ActionRead, "calls", "/acme/a.tar", true},
+		{"outside prefix", "acme", ActionRead, "calls", "globex/a.tar", false},
+		{"prefix without its slash", "acme", ActionRead, "calls", "acme", false},
+		{"dot dot escapes prefix", "acme", ActionRead, "calls", "acme/../globex/a.tar", false},
+		{"dot dot at the end", "acme", ActionRead, "calls", "acme/..", false},
+		{"dot segment", "acme", ActionRead, "calls", "acme/./a.tar", false},
+		{"dot dot after leading slash", "acme", ActionRead, "calls", "/../acme/a.tar", false},
+		{"dots within a name", "acme", ActionRead, "calls", "acme/..a.tar", true},
+		{"action not granted", "acme", ActionCompress, "archive", "a.tar", false},
+		{"bucket without prefixes", "acme", ActionRead, "archive", "any/a.tar", true},
+		{"dot dot in a bucket without prefixes", "acme", ActionRead, "archive", "../a.tar", false},
+		{"other bucket", "acme", ActionRead, "other", "acme/a.tar", false},
+		{"unknown tenant", "globex", ActionRead, "calls", "acme/a.tar", false},
+		{"no tenant", "", ActionRead, "calls", "acme/a.tar", false},
+		{"wildcard bucket", "admin", ActionCompress, "other", "a.tar", true},
+
+		// an empty key or bucket stands for all of them, as in an unfiltered search
+		{"search whole bucket within prefixes", "acme", ActionRead, "calls", "", false},
+		{"search whole bucket", "acme", ActionRead, "archive", "", true},
+		{"search every bucket", "acme", ActionRead, "", "", false},
+		{"search every bucket within prefix", "acme", ActionRead, "", "acme/", false},
+		{"search every bucket with wildcard", "admin", ActionRead, "", "", true},
+		{"search every bucket with wildcard prefix", "auditor", ActionRead, "", "audit/2024/", true},
+		{"search every bucket outside wildcard prefix", "auditor", ActionRead, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Allowed(tt.tenant, tt.action, tt.bucket, tt.key); got != tt.ok {
+				t.Errorf("got %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package envelope
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Object metadata describing an encrypted object. The data key is stored wrapped
+// by the master key named by MetaKeyID.
+const (
+	MetaAlgorithm  = "envelope-alg"
+	MetaKeyID      = "envelope-key-id"
+	MetaWrappedKey = "envelope-wrapped-key"
+
+	Algorithm = "AES256-GCM-STREAM"
+)
+
+// keyringFile is the JSON layout of a keyring file, e.g.
+//
+//	{"primary": "2026-10", "keys": {"2026-10": "<base64 of 32 bytes>"}}
+type keyringFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// ErrNoKeyring is returned for encrypted objects read without a keyring.
+var ErrNoKeyring = errors.New("envelope: object is encrypted but no keyring is configured")
+
+// Keyring holds the master keys. New data keys are wrapped by the primary key,
+// the others are kept to unwrap data keys until every object is rewrapped.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// LoadKeyring reads the keyring file at path.
+func LoadKeyring(path string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: keyring: %w", err)
+	}
+	var f keyringFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("envelope: keyring: %w", err)
+	}
+
+	k := &Keyring{primary: f.Primary, keys: make(map[string][]byte)}
+	for id, encoded := range f.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("envelope: keyring: key %q is not 32 base64 encoded bytes", id)
+		}
+		k.keys[id] = key
+	}
+	if _, ok := k.keys[k.primary]; !ok {
+		return nil, fmt.Errorf("envelope: keyring: primary key %q is missing", k.primary)
+	}
+	return k, nil
+}
+
+// Primary returns the ID of the key new data keys are wrapped with.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// NewDataKey returns a random data key and the metadata to store with the object
+// it encrypts.
+func (k *Keyring) NewDataKey() ([]byte, map[string]string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := k.wrap(k.primary, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, map[string]string{
+		MetaAlgorithm:  Algorithm,
+		MetaKeyID:      k.primary,
+		MetaWrappedKey: wrapped,
+	}, nil
+}
+
+// ContentDataKey returns a data key derived by the primary key from the name and
+// the digest of the content it encrypts, and the metadata to store with the object.
+// The same content under the same name gets the same key and metadata, which makes
+// its encryption by NewContentWriter repeatable, other content an unrelated key.
+func (k *Keyring) ContentDataKey(name string, digest []byte) ([]byte, map[string]string, error) {
+	mac := hmac.New(sha256.New, k.keys[k.primary])
+	mac.Write([]byte("data-key\x00" + name + "\x00"))
+	mac.Write(digest)
+	dataKey := mac.Sum(nil)
+
+	// a nonce of its own for every data key, so wrapping it again repeats as well
+	mac = hmac.New(sha256.New, k.keys[k.primary])
+	mac.Write([]byte("wrap-nonce\x00"))
+	mac.Write(dataKey)
+	wrapped, err := k.wrapWithNonce(k.primary, dataKey, mac.Sum(nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, map[string]string{
+		MetaAlgorithm:  Algorithm,
+		MetaKeyID:      k.primary,
+		MetaWrappedKey: wrapped,
+	}, nil
+}
+
+// DataKey unwraps the data key of an object from its metadata.
+func (k *Keyring) DataKey(metadata map[string]string) ([]byte, error) {
+	if alg := lookup(metadata, MetaAlgorithm); alg != Algorithm {
+		return nil, fmt.Errorf("envelope: unknown algorithm %q", alg)
+	}
+	id := lookup(metadata, MetaKeyID)
+	master, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("envelope: unknown master key %q", id)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(lookup(metadata, MetaWrappedKey))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrCorrupted
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(Algorithm+"\x00"+id))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return dataKey, nil
+}
+
+// Rewrap returns the metadata with the data key wrapped by the primary key, and
+// false when it already is.
+func (k *Keyring) Rewrap(metadata map[string]string) (map[string]string, bool, error) {
+	if lookup(metadata, MetaKeyID) == k.primary {
+		return metadata, false, nil
+	}
+	dataKey, err := k.DataKey(metadata)
+	if err != nil {
+		return nil, false, err
+	}
+	wrapped, err := k.wrap(k.primary, dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rewrapped := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		switch strings.ToLower(name) {
+		case MetaKeyID, MetaWrappedKey:
+		default:
+			rewrapped[name] = value
+		}
+	}
+	rewrapped[MetaKeyID] = k.primary
+	rewrapped[MetaWrappedKey] = wrapped
+	return rewrapped, true, nil
+}
+
+// wrap seals dataKey with the master key id, bound to the key ID.
+func (k *Keyring) wrap(id string, dataKey []byte) (string, error) {
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return k.wrapWithNonce(id, dataKey, nonce)
+}
+
+// wrapWithNonce seals dataKey under the nonce, of which the GCM nonce size is used.
+func (k *Keyring) wrapWithNonce(id string, dataKey, nonce []byte) (string, error) {
+	aead, err := newGCM(k.keys[id])
+	if err != nil {
+		return "", err
+	}
+	nonce = nonce[:aead.NonceSize()]
+	sealed := aead.Seal(append([]byte(nil), nonce...), nonce, dataKey, []byte(Algorithm+"\x00"+id))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Encrypted reports whether the metadata describes an encrypted object.
+func Encrypted(metadata map[string]string) bool {
+	return lookup(metadata, MetaKeyID) != ""
+}
+
+// lookup ignores the case of metadata names, which S3 implementations differ on.
+func lookup(metadata map[string]string, name string) string {
+	if v, ok := metadata[name]; ok {
+		return v
+	}
+	for k, v := range metadata {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
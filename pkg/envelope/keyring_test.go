@@ -0,0 +1,166 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeyring writes a keyring file of the keys, which are named after their
+// first byte.
+func writeKeyring(t *testing.T, primary string, keys ...[]byte) string {
+	t.Helper()
+	f := keyringFile{Primary: primary, Keys: map[string]string{}}
+	for _, key := range keys {
+		f.Keys[string(rune('a'+key[0]%26))] = base64.StdEncoding.EncodeToString(key)
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func masterKey(id byte) []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = id
+	}
+	return key
+}
+
+func TestKeyringRewrap(t *testing.T) {
+	oldMaster, newMaster := masterKey(0), masterKey(1)
+
+	before, err := LoadKeyring(writeKeyring(t, "a", oldMaster))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, metadata, err := before.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata["Content-Type"] = "application/gzip"
+
+	// rotated: b is the primary key, a is kept to unwrap
+	after, err := LoadKeyring(writeKeyring(t, "b", oldMaster, newMaster))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, changed, err := after.Rewrap(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || rewrapped[MetaKeyID] != "b" || rewrapped["Content-Type"] != "application/gzip" {
+		t.Fatalf("rewrapped metadata %v", rewrapped)
+	}
+
+	// only the new master key is needed from now on
+	retired, err := LoadKeyring(writeKeyring(t, "b", newMaster))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := retired.DataKey(rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(dataKey) {
+		t.Error("rewrapped data key differs")
+	}
+	if _, err := retired.DataKey(metadata); err == nil {
+		t.Error("unwrapped a data key of a retired master key")
+	}
+
+	// rewrapping twice changes nothing
+	if _, changed, err := after.Rewrap(rewrapped); err != nil || changed {
+		t.Errorf("second rewrap changed %t, %v", changed, err)
+	}
+}
+
+func TestKeyringDataKeyTampered(t *testing.T) {
+	k, err := LoadKeyring(writeKeyring(t, "a", masterKey(0), masterKey(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, metadata, err := k.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the wrapped key is bound to the ID of its master key
+	moved := map[string]string{MetaAlgorithm: Algorithm, MetaKeyID: "b", MetaWrappedKey: metadata[MetaWrappedKey]}
+	if _, err := k.DataKey(moved); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("key moved to another master key: got %v, want ErrCorrupted", err)
+	}
+
+	wrapped, _ := base64.StdEncoding.DecodeString(metadata[MetaWrappedKey])
+	wrapped[len(wrapped)-1] ^= 1
+	flipped := map[string]string{MetaAlgorithm: Algorithm, MetaKeyID: "a", MetaWrappedKey: base64.StdEncoding.EncodeToString(wrapped)}
+	if _, err := k.DataKey(flipped); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("flipped wrapped key: got %v, want ErrCorrupted", err)
+	}
+}
+
+func TestKeyringContentDataKey(t *testing.T) {
+	k, err := LoadKeyring(writeKeyring(t, "a", masterKey(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("archive"), ChunkSize/3)
+	digest := sha256.Sum256(plain)
+
+	encryptContent := func(name string, digest []byte) (map[string]string, []byte) {
+		dataKey, metadata, err := k.ContentDataKey(name, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sealed bytes.Buffer
+		w, err := NewContentWriter(&sealed, dataKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(plain)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return metadata, sealed.Bytes()
+	}
+
+	// a retry writes the same bytes
+	metadata, sealed := encryptContent("bucket/a.tar.gz", digest[:])
+	retryMetadata, retrySealed := encryptContent("bucket/a.tar.gz", digest[:])
+	if metadata[MetaWrappedKey] != retryMetadata[MetaWrappedKey] || !bytes.Equal(sealed, retrySealed) {
+		t.Error("encrypting the same content again differs")
+	}
+
+	dataKey, err := k.DataKey(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decrypt(dataKey, sealed)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypted %d bytes, %v", len(got), err)
+	}
+
+	// other content or another object never shares the key
+	other := sha256.Sum256([]byte("other"))
+	for name, d := range map[string][]byte{"bucket/a.tar.gz": other[:], "bucket/b.tar.gz": digest[:]} {
+		otherMetadata, _ := encryptContent(name, d)
+		otherKey, err := k.DataKey(otherMetadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(otherKey, dataKey) {
+			t.Errorf("%s shares the data key", name)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Package envelope encrypts objects with AES-256-GCM under a per-object data key,
+// which is stored wrapped by a master key of a Keyring.
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	magic   = "TENV"
+	version = 1
+
+	// ChunkSize is the plaintext sealed at a time
+	ChunkSize = 64 << 10
+
+	noncePrefixSize = 7
+	headerSize      = len(magic) + 1 + 4 + noncePrefixSize
+	maxChunks       = 1<<32 - 1
+)
+
+// ErrCorrupted is returned for ciphertext that was modified, truncated or sealed
+// with another data key.
+var ErrCorrupted = errors.New("envelope: corrupted ciphertext")
+
+// The stream is a header followed by chunks of ChunkSize plaintext bytes, each
+// sealed on its own. The nonce of a chunk is the random prefix of the header, the
+// chunk counter and a flag marking the last chunk, so chunks cannot be reordered,
+// dropped or cut off at the end. The header is authenticated with every chunk.
+func newHeader(chunkSize int, noncePrefix []byte) ([]byte, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = version
+	binary.BigEndian.PutUint32(header[len(magic)+1:], uint32(chunkSize))
+	if noncePrefix != nil {
+		copy(header[len(magic)+5:], noncePrefix)
+	} else if _, err := io.ReadFull(rand.Reader, header[len(magic)+5:]); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func chunkNonce(header []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, header[len(magic)+5:])
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("envelope: key is %d bytes, AES-256 needs 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Writer encrypts what is written to it. Close seals the last chunk and must be
+// called, it does not close the underlying writer.
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint32
+	err     error
+}
+
+// NewWriter encrypts to w with the data key.
+func NewWriter(w io.Writer, dataKey []byte) (*Writer, error) {
+	return newWriter(w, dataKey, nil)
+}
+
+// NewContentWriter encrypts to w with a data key of ContentDataKey, deriving the
+// nonce prefix from the key, so encrypting the same content again gives the same
+// ciphertext. The key must not encrypt other content.
+func NewContentWriter(w io.Writer, dataKey []byte) (*Writer, error) {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte("nonce-prefix"))
+	return newWriter(w, dataKey, mac.Sum(nil)[:noncePrefixSize])
+}
+
+func newWriter(w io.Writer, dataKey, noncePrefix []byte) (*Writer, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header, err := newHeader(ChunkSize, noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, header: header, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (e *Writer) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data follows, the last one is
+		// sealed by Close
+		if len(e.buf) == ChunkSize {
+			if e.err = e.seal(false); e.err != nil {
+				return written, e.err
+			}
+		}
+		n := copy(e.buf[len(e.buf):ChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk.
+func (e *Writer) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.seal(true)
+	if e.err == nil {
+		e.err = errors.New("envelope: writer is closed")
+		return nil
+	}
+	return e.err
+}
+
+func (e *Writer) seal(last bool) error {
+	if e.counter == maxChunks {
+		return errors.New("envelope: too many chunks")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.header, e.counter, last), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Reader decrypts a stream written by Writer.
+type Reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	sealed  []byte
+	plain   []byte
+	counter uint32
+	done    bool
+	err     error
+}
+
+// NewReader decrypts r with the data key.
+func NewReader(r io.Reader, dataKey []byte) (*Reader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(r, ChunkSize+aead.Overhead()+1)
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrCorrupted
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) || header[len(magic)] != version {
+		return nil, ErrCorrupted
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(magic)+1:]))
+	if chunkSize < 1 || chunkSize > 16<<20 {
+		return nil, ErrCorrupted
+	}
+
+	return &Reader{r: br, aead: aead, header: header, sealed: make([]byte, chunkSize+aead.Overhead())}, nil
+}
+
+func (d *Reader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk. A chunk shorter than a full one, or one that
+// ends the stream, has to be sealed as the last one.
+func (d *Reader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch err {
+	case nil:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return ErrCorrupted
+	default:
+		return err
+	}
+
+	if d.counter == maxChunks {
+		return ErrCorrupted
+	}
+	plain, err := d.aead.Open(d.sealed[:0:0], chunkNonce(d.header, d.counter, last), d.sealed[:n], d.header)
+	if err != nil {
+		return ErrCorrupted
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
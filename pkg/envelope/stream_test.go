@@ -0,0 +1,167 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealedChunk is the size of a full chunk in the stream.
+const sealedChunk = ChunkSize + 16
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, key, plain []byte, writeSize int) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := NewWriter(&sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := plain; len(p) > 0; {
+		n := writeSize
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func decrypt(key, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+	tests := []struct {
+		name   string
+		size   int
+		chunks int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"chunk minus one", ChunkSize - 1, 1},
+		{"chunk", ChunkSize, 1},
+		{"chunk plus one", ChunkSize + 1, 2},
+		{"three chunks minus one", 3*ChunkSize - 1, 3},
+		{"three chunks", 3 * ChunkSize, 3},
+		{"three chunks plus one", 3*ChunkSize + 1, 4},
+	}
+	for _, tt := range tests {
+		plain := make([]byte, tt.size)
+		rand.Read(plain)
+
+		// whole, in pieces not aligned to chunks and byte by byte around a boundary
+		for _, writeSize := range []int{tt.size + 1, 1000, 1} {
+			if writeSize == 1 && tt.size > 2*ChunkSize {
+				continue
+			}
+			sealed := encrypt(t, key, plain, writeSize)
+			if want := headerSize + tt.size + 16*tt.chunks; len(sealed) != want {
+				t.Errorf("%s: sealed %d bytes, want %d", tt.name, len(sealed), want)
+			}
+			got, err := decrypt(key, sealed)
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("%s: decrypted %d bytes differ from the %d written", tt.name, len(got), len(plain))
+			}
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*ChunkSize+100)
+	rand.Read(plain)
+	sealed := encrypt(t, key, plain, len(plain))
+
+	chunk := func(i int) []byte {
+		start := headerSize + i*sealedChunk
+		end := start + sealedChunk
+		if end > len(sealed) {
+			end = len(sealed)
+		}
+		return sealed[start:end]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	flip := func(at int) []byte {
+		b := append([]byte(nil), sealed...)
+		b[at] ^= 1
+		return b
+	}
+	header := sealed[:headerSize]
+
+	tests := []struct {
+		name   string
+		key    []byte
+		sealed []byte
+	}{
+		{"truncated at a chunk boundary", key, sealed[:headerSize+2*sealedChunk]},
+		{"truncated after the header", key, header},
+		{"truncated in a chunk", key, sealed[:len(sealed)-10]},
+		{"truncated header", key, sealed[:headerSize-1]},
+		{"dropped chunk", key, join(header, chunk(0), chunk(2), chunk(3))},
+		{"reordered chunks", key, join(header, chunk(1), chunk(0), chunk(2), chunk(3))},
+		{"last chunk moved", key, join(header, chunk(0), chunk(1), chunk(3))},
+		{"trailing data", key, join(sealed, []byte{0})},
+		{"flipped magic", key, flip(0)},
+		{"flipped version", key, flip(len(magic))},
+		{"flipped chunk size", key, flip(len(magic) + 4)},
+		{"flipped nonce prefix", key, flip(headerSize - 1)},
+		{"flipped ciphertext", key, flip(headerSize + sealedChunk + 5)},
+		{"flipped tag", key, flip(len(sealed) - 1)},
+		{"wrong data key", testKey(t), sealed},
+	}
+	for _, tt := range tests {
+		if _, err := decrypt(tt.key, tt.sealed); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: got %v, want ErrCorrupted", tt.name, err)
+		}
+	}
+}
+
+func TestStreamWriterClosed(t *testing.T) {
+	w, err := NewWriter(io.Discard, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("late")); err == nil {
+		t.Error("write after close succeeded")
+	}
+}
+
+func TestStreamKeySize(t *testing.T) {
+	if _, err := NewWriter(io.Discard, make([]byte, 16)); err == nil {
+		t.Error("writer accepted a 16 byte key")
+	}
+	if _, err := NewReader(bytes.NewReader(nil), make([]byte, 16)); err == nil {
+		t.Error("reader accepted a 16 byte key")
+	}
+}